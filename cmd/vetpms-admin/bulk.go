@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/os-foundry/vetpms/internal/platform/auth"
+	"github.com/os-foundry/vetpms/internal/platform/bulk"
+	"github.com/os-foundry/vetpms/internal/platform/query"
+	"github.com/os-foundry/vetpms/internal/platform/web"
+	"github.com/os-foundry/vetpms/internal/product"
+	"github.com/os-foundry/vetpms/internal/user"
+	"github.com/pkg/errors"
+)
+
+// entity describes how records of one kind are imported and exported. New
+// kinds of records are supported by adding them to entities.
+type entity struct {
+	// record returns a pointer to an empty record to import into.
+	record func() interface{}
+
+	// create stores an imported record.
+	create func(ctx context.Context, rec interface{}, now time.Time) error
+
+	// list returns a page of the records to export.
+	list func(ctx context.Context, opts query.Options) ([]interface{}, query.Page, error)
+}
+
+// newSale is an imported sale together with the product it belongs to.
+type newSale struct {
+	ProductID string `json:"product_id" validate:"required"`
+	product.NewSale
+}
+
+// entities returns the kinds of records that can be imported and exported.
+// Imported products are owned by the given user.
+func entities(ust user.Storage, pst product.Storage, owner auth.Claims) map[string]entity {
+	return map[string]entity{
+		"users": {
+			record: func() interface{} { return &user.NewUser{} },
+			create: func(ctx context.Context, rec interface{}, now time.Time) error {
+				_, err := ust.Create(ctx, *rec.(*user.NewUser), now)
+				return err
+			},
+			list: func(ctx context.Context, opts query.Options) ([]interface{}, query.Page, error) {
+				us, page, err := ust.List(ctx, opts)
+				recs := make([]interface{}, len(us))
+				for i := range us {
+					recs[i] = &us[i]
+				}
+				return recs, page, err
+			},
+		},
+		"products": {
+			record: func() interface{} { return &product.NewProduct{} },
+			create: func(ctx context.Context, rec interface{}, now time.Time) error {
+				_, err := pst.Create(ctx, owner, *rec.(*product.NewProduct), now)
+				return err
+			},
+			list: func(ctx context.Context, opts query.Options) ([]interface{}, query.Page, error) {
+				ps, page, err := pst.List(ctx, opts)
+				recs := make([]interface{}, len(ps))
+				for i := range ps {
+					recs[i] = &ps[i]
+				}
+				return recs, page, err
+			},
+		},
+		"sales": {
+			record: func() interface{} { return &newSale{} },
+			create: func(ctx context.Context, rec interface{}, now time.Time) error {
+				s := rec.(*newSale)
+				_, err := pst.AddSale(ctx, s.NewSale, s.ProductID, now)
+				return err
+			},
+			list: func(ctx context.Context, opts query.Options) ([]interface{}, query.Page, error) {
+				ss, page, err := pst.ListSales(ctx, opts)
+				recs := make([]interface{}, len(ss))
+				for i := range ss {
+					recs[i] = &ss[i]
+				}
+				return recs, page, err
+			},
+		},
+	}
+}
+
+// entityNames returns the names of the entities for usage messages.
+func entityNames(ents map[string]entity) string {
+	var names []string
+	for name := range ents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// bulkFlags registers the flags shared by import and export and returns a
+// function resolving the entity, file, format and mapping after parsing.
+func bulkFlags(fs *flag.FlagSet) func(ents map[string]entity) (entity, string, string, bulk.Mapping, error) {
+	format := fs.String("format", "", "csv or jsonl, derived from the file extension by default")
+	mapping := fs.String("map", "", "comma separated column=field pairs naming the columns of the file")
+
+	return func(ents map[string]entity) (entity, string, string, bulk.Mapping, error) {
+		e, ok := ents[fs.Arg(0)]
+		if !ok {
+			return entity{}, "", "", nil, fmt.Errorf("%s command must be called with one of: %s", fs.Name(), entityNames(ents))
+		}
+
+		file := fs.Arg(1)
+		f := *format
+		if f == "" {
+			f = bulk.FormatOf(file)
+		}
+		if f != bulk.CSV && f != bulk.JSONL {
+			return entity{}, "", "", nil, bulk.ErrFormat
+		}
+
+		m, err := bulk.ParseMapping(*mapping)
+		if err != nil {
+			return entity{}, "", "", nil, err
+		}
+
+		return e, file, f, m, nil
+	}
+}
+
+// importRecords reads records from a file and stores them. Every record is
+// validated like a request body of the API. Records that fail are reported
+// by line and skipped. With --dry-run the records are only validated.
+func importRecords(ust user.Storage, pst product.Storage, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	resolve := bulkFlags(fs)
+	dryRun := fs.Bool("dry-run", false, "validate the records without storing them")
+	owner := fs.String("owner", "00000000-0000-0000-0000-000000000000", "ID of the user owning imported products")
+	if err := fs.Parse(args); err != nil {
+		return errors.Wrap(err, "parsing import arguments")
+	}
+
+	ents := entities(ust, pst, auth.NewClaims(*owner, []string{auth.RoleAdmin}, time.Now(), time.Hour))
+	e, file, format, m, err := resolve(ents)
+	if err != nil {
+		return err
+	}
+	if file == "" {
+		return errors.New("import command must be called with a file to import")
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return errors.Wrap(err, "opening import file")
+	}
+	defer f.Close()
+
+	r, err := bulk.NewReader(f, format, m)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	var total, failed int
+	for {
+		rec := e.record()
+		err := r.Read(rec)
+		if err == io.EOF {
+			break
+		}
+		total++
+
+		if rerr, ok := err.(*bulk.RowError); ok {
+			failed++
+			fmt.Println(rerr)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		// Report the validation errors of every field of the record.
+		line := r.Line()
+		if err := web.Validate(rec); err != nil {
+			failed++
+			if werr, ok := err.(*web.Error); ok {
+				for _, fe := range werr.Fields {
+					fmt.Printf("line %d: %s: %s\n", line, fe.Field, fe.Error)
+				}
+				continue
+			}
+			fmt.Printf("line %d: %s\n", line, err)
+			continue
+		}
+
+		if *dryRun {
+			continue
+		}
+
+		if err := e.create(ctx, rec, time.Now()); err != nil {
+			failed++
+			fmt.Printf("line %d: %s\n", line, err)
+		}
+	}
+
+	verb := "Imported"
+	if *dryRun {
+		verb = "Validated"
+	}
+	fmt.Printf("%s %d of %d %s\n", verb, total-failed, total, fs.Arg(0))
+
+	if failed > 0 {
+		return fmt.Errorf("%d records failed", failed)
+	}
+	return nil
+}
+
+// exportRecords writes all live records of an entity to a file, or to the
+// standard output if no file is given.
+func exportRecords(ust user.Storage, pst product.Storage, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	resolve := bulkFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return errors.Wrap(err, "parsing export arguments")
+	}
+
+	e, file, format, m, err := resolve(entities(ust, pst, auth.Claims{}))
+	if err != nil {
+		return err
+	}
+
+	out := os.Stdout
+	if file != "" {
+		if out, err = os.Create(file); err != nil {
+			return errors.Wrap(err, "creating export file")
+		}
+		defer out.Close()
+	}
+
+	w, err := bulk.NewWriter(out, format, m)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	opts := query.Options{Limit: query.MaxLimit}
+
+	var total int
+	for {
+		recs, page, err := e.list(ctx, opts)
+		if err != nil {
+			return err
+		}
+		for _, rec := range recs {
+			if err := w.Write(rec); err != nil {
+				return err
+			}
+		}
+		total += len(recs)
+
+		if page.NextCursor == "" {
+			break
+		}
+		opts.Cursor = page.NextCursor
+	}
+
+	if err := w.Flush(); err != nil {
+		return errors.Wrap(err, "writing export file")
+	}
+
+	if file != "" {
+		if err := out.Close(); err != nil {
+			return errors.Wrap(err, "closing export file")
+		}
+		fmt.Printf("Exported %d %s to %s\n", total, fs.Arg(0), file)
+	}
+
+	return nil
+}
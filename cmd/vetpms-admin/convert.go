@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/os-foundry/vetpms/internal/backup"
+	"github.com/os-foundry/vetpms/internal/schema"
+	"github.com/pkg/errors"
+)
+
+// convertState is the progress of a conversion saved between runs.
+type convertState struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	backup.Progress
+}
+
+// convert copies all data from the --from database to the --to database and
+// verifies the copy. Progress is saved to the --state file after every page,
+// running the same command again resumes an interrupted conversion.
+func convert(cfg dbConfig, args []string) error {
+	fs := flag.NewFlagSet("convert", flag.ContinueOnError)
+	from := fs.String("from", "", "type of the database to convert from, bolt or postgres")
+	to := fs.String("to", "", "type of the database to convert to, bolt or postgres")
+	path := fs.String("state", "vetpms-convert.json", "file the progress is saved to")
+	if err := fs.Parse(args); err != nil {
+		return errors.Wrap(err, "parsing convert arguments")
+	}
+	if *from == "" || *to == "" || *from == *to {
+		return errors.New("convert command must be called with different --from and --to database types")
+	}
+
+	state := convertState{From: *from, To: *to}
+	switch b, err := ioutil.ReadFile(*path); {
+	case os.IsNotExist(err):
+	case err != nil:
+		return errors.Wrap(err, "reading state")
+	default:
+		if err := json.Unmarshal(b, &state); err != nil {
+			return errors.Wrap(err, "decoding state")
+		}
+		if state.From != *from || state.To != *to {
+			return fmt.Errorf("%s belongs to a conversion from %s to %s", *path, state.From, state.To)
+		}
+		fmt.Printf("Resuming conversion at %s\n", state.Entity)
+	}
+
+	src, err := open(cfg, *from)
+	if err != nil {
+		return err
+	}
+	defer src.close()
+
+	dst, err := open(cfg, *to)
+	if err != nil {
+		return err
+	}
+	defer dst.close()
+
+	if err := schema.Migrate(dst.db); err != nil {
+		return errors.Wrap(err, "migrating target")
+	}
+
+	save := func(p backup.Progress) error {
+		state.Progress = p
+		b, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+
+		// Replace the state at once, so it is never half written.
+		tmp := *path + ".tmp"
+		if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+			return err
+		}
+		return os.Rename(tmp, *path)
+	}
+
+	ctx := context.Background()
+
+	p, err := backup.Convert(ctx, src.stores, dst.stores, state.Progress, save)
+	if err != nil {
+		return errors.Wrap(err, "converting, run the command again to resume")
+	}
+
+	files, err := backup.Verify(ctx, src.stores, dst.stores)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		fmt.Printf("Converted %d %s, %d verified with checksum %s\n", p.Copied[f.Entity], f.Entity, f.Count, f.SHA256)
+	}
+
+	if err := os.Remove(*path); err != nil {
+		return errors.Wrap(err, "removing state")
+	}
+	return nil
+}
@@ -7,15 +7,29 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/pem"
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
 	"time"
 
+	"github.com/os-foundry/vetpms/internal/audit"
+	auditBolt "github.com/os-foundry/vetpms/internal/audit/bolt"
+	auditPq "github.com/os-foundry/vetpms/internal/audit/postgres"
+	"github.com/os-foundry/vetpms/internal/backup"
 	"github.com/os-foundry/vetpms/internal/platform/auth"
 	"github.com/os-foundry/vetpms/internal/platform/conf"
 	"github.com/os-foundry/vetpms/internal/platform/database"
+	"github.com/os-foundry/vetpms/internal/platform/query"
+	"github.com/os-foundry/vetpms/internal/product"
+	productBolt "github.com/os-foundry/vetpms/internal/product/bolt"
+	productPq "github.com/os-foundry/vetpms/internal/product/postgres"
 	"github.com/os-foundry/vetpms/internal/schema"
 	"github.com/os-foundry/vetpms/internal/user"
 	userBolt "github.com/os-foundry/vetpms/internal/user/bolt"
@@ -37,18 +51,9 @@ func run() error {
 	// Configuration
 
 	var cfg struct {
-		DB struct {
-			Type       string `conf:"default:postgres"` // Can be postgres or bolt
-			User       string `conf:"default:postgres"`
-			Password   string `conf:"default:postgres,noprint"`
-			Host       string `conf:"default:localhost"`
-			Name       string `conf:"default:postgres"`
-			DisableTLS bool   `conf:"default:false"`
-
-			// Only required for bolt
-			File        string        `conf:"default:/opt/vetpms/data/vetpms.db"`
-			Permissions os.FileMode   `conf:"default:0660"`
-			Timeout     time.Duration `conf:"default:1s"`
+		DB    dbConfig
+		Audit struct {
+			Clinic string `conf:"default:main"`
 		}
 		Args conf.Args
 	}
@@ -65,78 +70,242 @@ func run() error {
 		return errors.Wrap(err, "error: parsing config")
 	}
 
+	// Converting opens both databases itself.
+	if cfg.Args.Num(0) == "convert" {
+		return convert(cfg.DB, cfg.Args[1:])
+	}
+
+	b, err := open(cfg.DB, cfg.DB.Type)
+	if err != nil {
+		return err
+	}
+	defer b.close()
+
+	// Changes made from the command line are recorded as changes by the system.
+	// Backups read and write the records as they are, without auditing.
+	trail := audit.Trail{Storage: b.stores.Audit, Clinic: cfg.Audit.Clinic, UnitOfWork: b.uow}
 	var (
-		ust      user.Storage
-		activeDB interface{}
+		ust user.Storage    = user.Audited{Storage: b.stores.Users, Trail: trail}
+		pst product.Storage = product.Audited{Storage: b.stores.Products, Trail: trail}
 	)
 
-	switch cfg.DB.Type {
+	switch cfg.Args.Num(0) {
+	case "migrate":
+		err = migrate(b.db, cfg.Args.Num(1))
+	case "index":
+		err = index(b.db, cfg.Args.Num(1))
+	case "seed":
+		err = seed(b.db)
+	case "useradd":
+		err = useradd(ust, cfg.Args.Num(1), cfg.Args.Num(2))
+	case "apikey":
+		err = apikey(ust, cfg.Args[1:])
+	case "keygen":
+		err = keygen(cfg.Args.Num(1))
+	case "keyrotate":
+		err = keyrotate(cfg.Args[1:])
+	case "purge":
+		err = purge(ust, pst, cfg.Args[1:])
+	case "import":
+		err = importRecords(ust, pst, cfg.Args[1:])
+	case "export":
+		err = exportRecords(ust, pst, cfg.Args[1:])
+	case "backup":
+		err = backupRecords(b.stores, cfg.Args.Num(1))
+	case "restore":
+		err = restoreRecords(b.stores, cfg.Args.Num(1))
+	default:
+		err = errors.New("Must specify a command")
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// dbConfig configures the connection to the database.
+type dbConfig struct {
+	Type       string `conf:"default:postgres"` // Can be postgres or bolt
+	User       string `conf:"default:postgres"`
+	Password   string `conf:"default:postgres,noprint"`
+	Host       string `conf:"default:localhost"`
+	Name       string `conf:"default:postgres"`
+	DisableTLS bool   `conf:"default:false"`
+
+	// Only required for bolt
+	File        string        `conf:"default:/opt/vetpms/data/vetpms.db"`
+	Permissions os.FileMode   `conf:"default:0660"`
+	Timeout     time.Duration `conf:"default:1s"`
+}
+
+// backend is an open database and its storages.
+type backend struct {
+	db     interface{}
+	stores backup.Stores
+	uow    database.UnitOfWork
+	close  func() error
+}
+
+// open connects to the database of type tp, which can be postgres or bolt.
+func open(cfg dbConfig, tp string) (backend, error) {
+	switch tp {
 	case "postgres":
 		dbConfig := database.Config{
-			User:       cfg.DB.User,
-			Password:   cfg.DB.Password,
-			Host:       cfg.DB.Host,
-			Name:       cfg.DB.Name,
-			DisableTLS: cfg.DB.DisableTLS,
+			User:       cfg.User,
+			Password:   cfg.Password,
+			Host:       cfg.Host,
+			Name:       cfg.Name,
+			DisableTLS: cfg.DisableTLS,
 		}
 
 		db, err := database.Open(dbConfig)
 		if err != nil {
-			return errors.Wrap(err, "connecting to postgres")
+			return backend{}, errors.Wrap(err, "connecting to postgres")
 		}
 
-		ust = userPq.Postgres{db}
-		activeDB = db
-
-		defer db.Close()
+		return backend{
+			db: db,
+			stores: backup.Stores{
+				Users:    userPq.Postgres{db},
+				Products: productPq.Postgres{db},
+				Audit:    auditPq.Postgres{db},
+				Snapshot: database.PqSnapshot(db),
+			},
+			uow:   database.PqUnitOfWork(db),
+			close: db.Close,
+		}, nil
 
 	case "bolt":
-		if err := database.CheckAndPrepareBolt(cfg.DB.File, cfg.DB.Permissions); err != nil {
-			return errors.Wrap(err, "preparing bolt filepath")
+		if err := database.CheckAndPrepareBolt(cfg.File, cfg.Permissions); err != nil {
+			return backend{}, errors.Wrap(err, "preparing bolt filepath")
 		}
 
-		db, err := bolt.Open(cfg.DB.File, cfg.DB.Permissions, &bolt.Options{Timeout: cfg.DB.Timeout})
+		db, err := bolt.Open(cfg.File, cfg.Permissions, &bolt.Options{Timeout: cfg.Timeout})
+		if err == bolt.ErrTimeout {
+			return backend{}, errors.Wrap(err, "connecting to bolt: the database is locked, stop vetpms-api or download a backup from its /v1/backup endpoint")
+		}
 		if err != nil {
-			return errors.Wrap(err, "connecting to bolt")
+			return backend{}, errors.Wrap(err, "connecting to bolt")
 		}
 
-		ust = userBolt.Bolt{db}
-		activeDB = db
+		return backend{
+			db: db,
+			stores: backup.Stores{
+				Users:    userBolt.Bolt{db},
+				Products: productBolt.Bolt{db},
+				Audit:    auditBolt.Bolt{db},
+				Snapshot: database.BoltSnapshot(db),
+			},
+			uow:   database.BoltUnitOfWork(db),
+			close: db.Close,
+		}, nil
+	}
 
-		defer db.Close()
+	return backend{}, fmt.Errorf("database type should be bolt or postgres")
+}
 
+// migrate applies the pending migrations, or lists the migrations and
+// whether they were applied when called as migrate status.
+func migrate(db interface{}, cmd string) error {
+	switch cmd {
+	case "":
+	case "status":
+		return migrateStatus(db)
 	default:
-		return fmt.Errorf("database type should be bolt or postgres")
+		return fmt.Errorf("unknown migrate command %q", cmd)
 	}
 
-	var err error
-	switch cfg.Args.Num(0) {
-	case "migrate":
-		err = migrate(activeDB)
-	case "seed":
-		err = seed(activeDB)
-	case "useradd":
-		err = useradd(ust, cfg.Args.Num(1), cfg.Args.Num(2))
-	case "keygen":
-		err = keygen(cfg.Args.Num(1))
-	default:
-		err = errors.New("Must specify a command")
+	if err := schema.Migrate(db); err != nil {
+		return err
 	}
 
+	fmt.Println("Migrations complete")
+	return nil
+}
+
+func migrateStatus(db interface{}) error {
+	status, err := schema.Status(db)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tSTATUS\tAPPLIED\tDESCRIPTION")
+	for _, s := range status {
+		applied := "-"
+		if !s.AppliedAt.IsZero() {
+			applied = s.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%v\t%s\t%s\t%s\n", s.Version, s.Status, applied, s.Description)
+	}
+	return w.Flush()
 }
 
-func migrate(db interface{}) error {
-	if err := schema.Migrate(db); err != nil {
-		return err
+// index verifies the secondary indexes and sales totals of a Bolt database,
+// or rebuilds them from the records when called as index rebuild.
+func index(dbi interface{}, cmd string) error {
+	db, ok := dbi.(*bolt.DB)
+	if !ok {
+		return errors.New("index command is only supported for bolt, postgres maintains its own indexes")
 	}
 
-	fmt.Println("Migrations complete")
-	return nil
+	switch cmd {
+	case "verify":
+		var failed int
+		report := func(r database.IndexReport) {
+			status := "ok"
+			if !r.OK() {
+				status = "damaged"
+				failed++
+			}
+			fmt.Printf("%s: %s, %d entries, %d missing, %d stale\n", r.Index, status, r.Entries, r.Missing, r.Stale)
+		}
+
+		if err := db.View(func(tx *bolt.Tx) error {
+			for _, ix := range schema.BoltIndexes {
+				r, err := ix.Verify(tx)
+				if err != nil {
+					return errors.Wrapf(err, "verifying %s", ix.Name)
+				}
+				report(r)
+			}
+
+			r, err := productBolt.VerifyTotals(tx)
+			if err != nil {
+				return errors.Wrap(err, "verifying sales totals")
+			}
+			report(r)
+			return nil
+		}); err != nil {
+			return err
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d indexes are damaged, run index rebuild to repair them", failed)
+		}
+		return nil
+
+	case "rebuild":
+		return db.Update(func(tx *bolt.Tx) error {
+			for _, ix := range schema.BoltIndexes {
+				n, err := ix.Rebuild(tx)
+				if err != nil {
+					return errors.Wrapf(err, "rebuilding %s", ix.Name)
+				}
+				fmt.Printf("%s: rebuilt with %d entries\n", ix.Name, n)
+			}
+
+			n, err := productBolt.RebuildTotals(tx)
+			if err != nil {
+				return errors.Wrap(err, "rebuilding sales totals")
+			}
+			fmt.Printf("sales_totals: rebuilt with %d entries\n", n)
+			return nil
+		})
+	}
+
+	return fmt.Errorf("index command must be called as index verify or index rebuild")
 }
 
 func seed(db interface{}) error {
@@ -184,6 +353,185 @@ func useradd(st user.Storage, email, password string) error {
 	return nil
 }
 
+// apikey manages the API keys of service accounts. The only subcommand is
+// create, which creates a key for the service account with the email address
+// and prints it. The service account is created first if nobody has the
+// address.
+func apikey(st user.Storage, args []string) error {
+	if len(args) == 0 || args[0] != "create" {
+		return errors.New("apikey command must be called with the create subcommand")
+	}
+
+	fs := flag.NewFlagSet("apikey create", flag.ContinueOnError)
+	name := fs.String("name", "", "what the key is used for, e.g. Lab analyzer")
+	scopes := fs.String("scopes", "", "comma separated scopes of the key, e.g. products:read,products:write")
+	expires := fs.Duration("expires", 0, "how long the key is valid, 0 never expires")
+	admin := fs.Bool("admin", false, "give a new service account the admin role")
+	if err := fs.Parse(args[1:]); err != nil {
+		return errors.Wrap(err, "parsing apikey arguments")
+	}
+	email := fs.Arg(0)
+	if email == "" || *name == "" || *scopes == "" {
+		return errors.New("apikey create must be called with --name, --scopes and the email of the service account")
+	}
+
+	ctx := context.Background()
+	now := time.Now()
+
+	n := user.NewAPIKey{
+		Name:   *name,
+		Scopes: strings.Split(*scopes, ","),
+	}
+	if *expires > 0 {
+		exp := now.Add(*expires)
+		n.ExpiresAt = &exp
+	}
+	for _, sc := range n.Scopes {
+		if !auth.ValidScope(sc) {
+			return errors.Errorf("unknown scope %q, scopes are %s", sc, strings.Join(auth.Scopes, ","))
+		}
+	}
+
+	u, err := serviceAccount(ctx, st, email, *admin, now)
+	if err != nil {
+		return err
+	}
+	n.UserID = u.ID
+
+	k, key, err := st.CreateAPIKey(ctx, n, now)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("API key %s created for %s, it is only shown once:\n%s\n", k.ID, email, key)
+	return nil
+}
+
+// serviceAccount returns the service account with the email address, creating
+// it if nobody has the address. Keys aren't created for people, who sign in
+// with their password.
+func serviceAccount(ctx context.Context, st user.Storage, email string, admin bool, now time.Time) (*user.User, error) {
+	opts := query.Options{Filters: []query.Filter{{Field: "email", Value: email}}}
+	users, _, err := st.List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(users) > 0 {
+		if !users[0].ServiceAccount() {
+			return nil, errors.Errorf("%s is not a service account", email)
+		}
+		return &users[0], nil
+	}
+
+	// Nobody knows the password, service accounts can't sign in with it
+	// anyway.
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, errors.Wrap(err, "generating password")
+	}
+	pw := base64.RawURLEncoding.EncodeToString(b)
+
+	nu := user.NewUser{
+		Name:            email,
+		Email:           email,
+		Roles:           []string{auth.RoleService, auth.RoleUser},
+		Password:        pw,
+		PasswordConfirm: pw,
+	}
+	if admin {
+		nu.Roles = append(nu.Roles, auth.RoleAdmin)
+	}
+
+	u, err := st.Create(ctx, nu, now)
+	if err != nil {
+		return nil, errors.Wrapf(err, "creating service account %s", email)
+	}
+
+	fmt.Println("Service account created with id:", u.ID)
+	return u, nil
+}
+
+// purge permanently removes the users and products that were deleted longer
+// ago than the --older-than duration.
+func purge(ust user.Storage, pst product.Storage, args []string) error {
+	fs := flag.NewFlagSet("purge", flag.ContinueOnError)
+	olderThan := fs.Duration("older-than", 0, "remove records deleted longer ago than this, e.g. 720h")
+	if err := fs.Parse(args); err != nil {
+		return errors.Wrap(err, "parsing purge arguments")
+	}
+	if *olderThan <= 0 {
+		return errors.New("purge command must be called with a positive --older-than duration")
+	}
+
+	ctx := context.Background()
+	before := time.Now().Add(-*olderThan)
+
+	nu, err := ust.Purge(ctx, before)
+	if err != nil {
+		return err
+	}
+
+	np, err := pst.Purge(ctx, before)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Purged %d users and %d products deleted before %s\n", nu, np, before.Format(time.RFC3339))
+	return nil
+}
+
+// backupRecords writes a backup archive of all data to path.
+func backupRecords(st backup.Stores, path string) error {
+	if path == "" {
+		return errors.New("backup command must be called with the path of the archive")
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return errors.Wrap(err, "creating archive")
+	}
+	defer f.Close()
+
+	m, err := backup.Write(context.Background(), f, st, time.Now())
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "closing archive")
+	}
+
+	for _, file := range m.Files {
+		fmt.Printf("Backed up %d %s\n", file.Count, file.Entity)
+	}
+	return nil
+}
+
+// restoreRecords restores all data of the backup archive at path.
+func restoreRecords(st backup.Stores, path string) error {
+	if path == "" {
+		return errors.New("restore command must be called with the path of the archive")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "opening archive")
+	}
+	defer f.Close()
+
+	m, err := backup.Restore(context.Background(), f, st)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range m.Files {
+		fmt.Printf("Restored %d %s\n", file.Count, file.Entity)
+	}
+	fmt.Printf("Backup created %s\n", m.Created.Format(time.RFC3339))
+	return nil
+}
+
 // keygen creates an x509 private key for signing auth tokens.
 func keygen(path string) error {
 	if path == "" {
@@ -195,7 +543,7 @@ func keygen(path string) error {
 		return errors.Wrap(err, "generating keys")
 	}
 
-	file, err := os.Create(path)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return errors.Wrap(err, "creating private file")
 	}
@@ -216,3 +564,56 @@ func keygen(path string) error {
 
 	return nil
 }
+
+// keyrotate adds a new signing key to a key directory. The key is named by
+// the current time, which makes it the active key of the directory. The keys
+// it replaces still verify the tokens they signed until they are removed.
+func keyrotate(args []string) error {
+	fs := flag.NewFlagSet("keyrotate", flag.ContinueOnError)
+	keep := fs.Int("keep", 0, "remove the oldest keys beyond this number, 0 keeps all keys")
+	if err := fs.Parse(args); err != nil {
+		return errors.Wrap(err, "parsing keyrotate arguments")
+	}
+	dir := fs.Arg(0)
+	if dir == "" {
+		return errors.New("keyrotate missing argument for key directory")
+	}
+	// The previous key verifies the tokens it signed until they expire.
+	if *keep < 0 || *keep == 1 {
+		return errors.New("keyrotate --keep must be 0 or keep the previous key as well")
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrap(err, "creating key directory")
+	}
+
+	kid := time.Now().UTC().Format("20060102T150405Z")
+	path := filepath.Join(dir, kid+".pem")
+	if _, err := os.Stat(path); err == nil {
+		return errors.Errorf("key %s already exists", kid)
+	}
+	if err := keygen(path); err != nil {
+		return err
+	}
+	fmt.Printf("Added key %s\n", kid)
+
+	if *keep == 0 {
+		return nil
+	}
+
+	// Key names sort in the order the keys were created.
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return errors.Wrap(err, "listing keys")
+	}
+	sort.Strings(files)
+	for len(files) > *keep {
+		if err := os.Remove(files[0]); err != nil {
+			return errors.Wrap(err, "removing key")
+		}
+		fmt.Printf("Removed key %s\n", strings.TrimSuffix(filepath.Base(files[0]), ".pem"))
+		files = files[1:]
+	}
+
+	return nil
+}
@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/os-foundry/vetpms/internal/platform/auth"
+	"github.com/os-foundry/vetpms/internal/platform/web"
+	"github.com/os-foundry/vetpms/internal/user"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// APIKey represents the API key method handler set.
+type APIKey struct {
+	st user.Storage
+}
+
+// createdKey is the response to creating an API key. It is the only time the
+// key is shown.
+type createdKey struct {
+	*user.APIKey
+	Key string `json:"key"`
+}
+
+// List returns a page of the API keys, in the order they were created unless
+// sorted otherwise. Filter on user_id for the keys of a user.
+func (a *APIKey) List(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.APIKey.List")
+	defer span.End()
+
+	opts, err := web.DecodeQuerySort(r, user.APIKeyQueryFields, "date_created")
+	if err != nil {
+		return err
+	}
+
+	keys, page, err := a.st.ListAPIKeys(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	return web.RespondPage(ctx, w, r, keys, page)
+}
+
+// Retrieve returns the API key identified by an ID in the request URL.
+func (a *APIKey) Retrieve(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.APIKey.Retrieve")
+	defer span.End()
+
+	k, err := a.st.RetrieveAPIKey(ctx, params["id"])
+	if err != nil {
+		switch err {
+		case user.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case user.ErrAPIKeyNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "ID: %s", params["id"])
+		}
+	}
+
+	return web.Respond(ctx, w, k, http.StatusOK)
+}
+
+// Create decodes the body of a request to create an API key for a user. The
+// response holds the key, which is never shown again. An API key can only
+// create keys with scopes it has itself.
+func (a *APIKey) Create(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.APIKey.Create")
+	defer span.End()
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return web.NewShutdownError("claims missing from context")
+	}
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	var n user.NewAPIKey
+	if err := web.Decode(r, &n); err != nil {
+		return errors.Wrap(err, "decoding new api key")
+	}
+
+	for _, s := range n.Scopes {
+		if !claims.HasScope(s) {
+			return web.NewRequestError(user.ErrForbidden, http.StatusForbidden)
+		}
+	}
+
+	k, key, err := a.st.CreateAPIKey(ctx, n, v.Now)
+	if err != nil {
+		switch err {
+		case user.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case user.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "creating api key for user %s", n.UserID)
+		}
+	}
+
+	return web.Respond(ctx, w, createdKey{APIKey: k, Key: key}, http.StatusCreated)
+}
+
+// Delete removes the API key identified by an ID in the request URL, which
+// can't be used from then on.
+func (a *APIKey) Delete(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.APIKey.Delete")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	if err := a.st.DeleteAPIKey(ctx, params["id"], v.Now); err != nil {
+		switch err {
+		case user.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case user.ErrAPIKeyNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "ID: %s", params["id"])
+		}
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
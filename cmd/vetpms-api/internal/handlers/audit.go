@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/os-foundry/vetpms/internal/audit"
+	"github.com/os-foundry/vetpms/internal/platform/web"
+	"go.opencensus.io/trace"
+)
+
+// Audit represents the audit trail API method handler set.
+type Audit struct {
+	st audit.Storage
+}
+
+// List gets a page of the audit trail. Without an explicit sort the most
+// recent entries are returned first.
+func (a *Audit) List(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Audit.List")
+	defer span.End()
+
+	opts, err := web.DecodeQuerySort(r, audit.QueryFields, "-id")
+	if err != nil {
+		return err
+	}
+
+	entries, page, err := a.st.List(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	return web.RespondPage(ctx, w, r, entries, page)
+}
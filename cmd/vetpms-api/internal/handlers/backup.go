@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/os-foundry/vetpms/internal/backup"
+	"github.com/os-foundry/vetpms/internal/platform/web"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// Backup represents the backup API method handler set.
+type Backup struct {
+	st backup.Stores
+}
+
+// Download sends a backup archive of all data. It allows backing up a Bolt
+// database while the service holds its lock.
+func (b *Backup) Download(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Backup.Download")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	// The archive is written to a file first so a failing backup is reported
+	// as an error instead of a truncated download.
+	f, err := ioutil.TempFile("", "vetpms-backup")
+	if err != nil {
+		return errors.Wrap(err, "creating temporary file")
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	m, err := backup.Write(ctx, f, b.st, v.Now)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return errors.Wrap(err, "reading temporary file")
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrap(err, "reading temporary file")
+	}
+
+	name := fmt.Sprintf("vetpms-%s.tar.gz", m.Created.Format("20060102T150405Z"))
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	w.Header().Set("Content-Length", fmt.Sprint(info.Size()))
+
+	v.StatusCode = http.StatusOK
+	w.WriteHeader(http.StatusOK)
+
+	// The response has started, errors can only be logged from here on.
+	if _, err := io.Copy(w, f); err != nil {
+		return errors.Wrap(err, "sending backup")
+	}
+
+	return nil
+}
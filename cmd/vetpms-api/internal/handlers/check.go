@@ -3,39 +3,121 @@ package handlers
 import (
 	"context"
 	"net/http"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/os-foundry/vetpms/internal/platform/database"
 	"github.com/os-foundry/vetpms/internal/platform/web"
 	"go.opencensus.io/trace"
 )
 
+// checkTimeout bounds how long checking a single component may take.
+const checkTimeout = 2 * time.Second
+
+// Health describes the build of the service and the components its
+// readiness depends on besides the storages, like the disk or the tracing
+// exporter.
+type Health struct {
+	Build  string
+	Start  time.Time
+	Checks map[string]database.StatusChecker
+}
+
 // Check provides support for orchestration health checks.
 type Check struct {
-	checks []database.StatusChecker
+	build      string
+	start      time.Time
+	components []component
+}
+
+// component is a named dependency of the service.
+type component struct {
+	name    string
+	checker database.StatusChecker
+}
+
+// componentStatus is the result of checking a component.
+type componentStatus struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// health is the response of the health checks.
+type health struct {
+	Status     string            `json:"status"`
+	Build      string            `json:"build"`
+	Uptime     string            `json:"uptime"`
+	Components []componentStatus `json:"components,omitempty"`
+}
 
-	// ADD OTHER STATE LIKE THE LOGGER IF NEEDED.
+// newCheck constructs the health checks of the service. The components are
+// checked in the order of their names.
+func newCheck(h Health, checks map[string]database.StatusChecker) *Check {
+	c := Check{build: h.Build, start: h.Start}
+	for _, m := range []map[string]database.StatusChecker{checks, h.Checks} {
+		for name, checker := range m {
+			c.components = append(c.components, component{name: name, checker: checker})
+		}
+	}
+	sort.Slice(c.components, func(i, j int) bool { return c.components[i].name < c.components[j].name })
+	return &c
+}
+
+// Live reports that the service is running. It doesn't check any components,
+// so an orchestrator doesn't restart the service when a dependency is down.
+func (c *Check) Live(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Check.Live")
+	defer span.End()
+
+	return web.Respond(ctx, w, c.health("ok", nil), http.StatusOK)
 }
 
-// Health validates the service is healthy and ready to accept requests.
-func (c *Check) Health(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
-	ctx, span := trace.StartSpan(ctx, "handlers.Check.Health")
+// Ready validates the service is healthy and ready to accept requests. Every
+// component is checked, and the service is only ready when all of them are.
+func (c *Check) Ready(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Check.Ready")
 	defer span.End()
 
-	var health struct {
-		Status string `json:"status"`
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	// Check the components at the same time, so a slow one doesn't delay
+	// the others.
+	statuses := make([]componentStatus, len(c.components))
+	var wg sync.WaitGroup
+	for i, comp := range c.components {
+		wg.Add(1)
+		go func(i int, comp component) {
+			defer wg.Done()
+			statuses[i] = componentStatus{Name: comp.name, Status: "ok"}
+			if err := comp.checker.StatusCheck(ctx); err != nil {
+				statuses[i].Status = "failed"
+				statuses[i].Error = err.Error()
+			}
+		}(i, comp)
 	}
+	wg.Wait()
 
-	// Perform the checks
-	for _, check := range c.checks {
-		if err := check.StatusCheck(ctx); err != nil {
-			// If the database is not ready we will tell the client and use a 500
-			// status. Do not respond by just returning an error because further up in
-			// the call stack will interpret that as an unhandled error.
-			health.Status = "db not ready"
-			return web.Respond(ctx, w, health, http.StatusInternalServerError)
+	// If a component is not ready we will tell the client and use a 503
+	// status. Do not respond by just returning an error because further up in
+	// the call stack will interpret that as an unhandled error.
+	for _, s := range statuses {
+		if s.Status != "ok" {
+			return web.Respond(ctx, w, c.health("not ready", statuses), http.StatusServiceUnavailable)
 		}
 	}
 
-	health.Status = "ok"
-	return web.Respond(ctx, w, health, http.StatusOK)
+	return web.Respond(ctx, w, c.health("ok", statuses), http.StatusOK)
+}
+
+// health returns the response with the given status and component results.
+func (c *Check) health(status string, components []componentStatus) health {
+	return health{
+		Status:     status,
+		Build:      c.build,
+		Uptime:     time.Since(c.start).Round(time.Second).String(),
+		Components: components,
+	}
 }
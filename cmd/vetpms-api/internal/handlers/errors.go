@@ -0,0 +1,22 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/os-foundry/vetpms/internal/platform/web"
+	"go.opencensus.io/trace"
+)
+
+// Errors documents the errors of the API.
+type Errors struct{}
+
+// Codes responds with every code of the errors sent to clients, with a
+// description and the message in every language, so clients can react to
+// errors and translate them.
+func (e *Errors) Codes(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Errors.Codes")
+	defer span.End()
+
+	return web.Respond(ctx, w, web.ErrorCodes(), http.StatusOK)
+}
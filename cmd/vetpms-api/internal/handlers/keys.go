@@ -0,0 +1,24 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/os-foundry/vetpms/internal/platform/auth"
+	"github.com/os-foundry/vetpms/internal/platform/web"
+	"go.opencensus.io/trace"
+)
+
+// Keys publishes the keys verifying the tokens of the service.
+type Keys struct {
+	keys *auth.KeyStore
+}
+
+// JWKS responds with the public keys as a JSON Web Key Set, so other services
+// can verify our tokens.
+func (k *Keys) JWKS(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Keys.JWKS")
+	defer span.End()
+
+	return web.Respond(ctx, w, k.keys.JWKS(), http.StatusOK)
+}
@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/os-foundry/vetpms/internal/platform/auth"
+	"github.com/os-foundry/vetpms/internal/platform/web"
+	"github.com/os-foundry/vetpms/internal/user"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// Lockout configures how failed sign ins lock further attempts with the same
+// email address and from the same IP address. The zero value never locks.
+type Lockout struct {
+	Account user.LockoutPolicy
+	IP      user.LockoutPolicy
+}
+
+// attempt is a key sign ins are counted by and the policy locking it.
+type attempt struct {
+	key    string
+	policy user.LockoutPolicy
+}
+
+// attempts returns the keys a sign in with the email address is counted by.
+func (l Lockout) attempts(r *http.Request, email string) []attempt {
+	return []attempt{
+		{key: user.EmailAttempts(email), policy: l.Account},
+		{key: user.IPAttempts(web.RemoteIP(r)), policy: l.IP},
+	}
+}
+
+// checkLocked returns ErrAuthenticationFailure when one of the keys is
+// locked, without checking the password. The response tells when to try
+// again, which doesn't reveal whether the email is known since unknown
+// addresses are locked the same way.
+func (u *User) checkLocked(ctx context.Context, w http.ResponseWriter, now time.Time, attempts []attempt) error {
+	for _, a := range attempts {
+		if a.policy.Threshold == 0 {
+			continue
+		}
+		la, err := u.st.LoginAttempts(ctx, a.key)
+		if err != nil {
+			return errors.Wrap(err, "checking lockout")
+		}
+		if la.Locked(now) {
+			retry := math.Ceil(la.LockedUntil.Sub(now).Seconds())
+			w.Header().Set("Retry-After", fmt.Sprint(retry))
+			return web.NewRequestError(user.ErrAuthenticationFailure, http.StatusUnauthorized)
+		}
+	}
+	return nil
+}
+
+// failLogin counts a failed sign in for the keys.
+func (u *User) failLogin(ctx context.Context, now time.Time, attempts []attempt) error {
+	for _, a := range attempts {
+		if a.policy.Threshold == 0 {
+			continue
+		}
+		if _, err := u.st.FailLogin(ctx, a.key, a.policy, now); err != nil {
+			return errors.Wrap(err, "counting failed login")
+		}
+	}
+	return nil
+}
+
+// Unlock forgets the failed sign ins with the email address of the user
+// identified by an ID in the request URL, so they can sign in again at once.
+func (u *User) Unlock(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.Unlock")
+	defer span.End()
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
+	usr, err := u.st.Retrieve(ctx, claims, params["id"])
+	if err != nil {
+		switch err {
+		case user.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case user.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "ID: %s", params["id"])
+		}
+	}
+
+	if err := u.st.ResetLoginAttempts(ctx, user.EmailAttempts(usr.Email)); err != nil {
+		return errors.Wrapf(err, "ID: %s", usr.ID)
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
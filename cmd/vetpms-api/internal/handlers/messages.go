@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"github.com/os-foundry/vetpms/internal/platform/oidc"
+	"github.com/os-foundry/vetpms/internal/platform/web"
+)
+
+// The errors sent to clients have stable codes and are translated to the
+// languages of the API.
+func init() {
+	web.RegisterError(errBasicAuth, "auth.basic_auth_required", "Signing in requires the email and password in Basic auth.", web.Translations{
+		"nl": "e-mailadres en wachtwoord moeten via Basic auth worden meegestuurd",
+		"bg": "трябва да подадете имейл и парола чрез Basic auth",
+	})
+	web.RegisterError(errMFAUnavailable, "mfa.unavailable", "Two-factor authentication isn't configured on the service.", web.Translations{
+		"nl": "tweestapsverificatie is niet ingesteld",
+		"bg": "двуфакторното удостоверяване не е настроено",
+	})
+	web.RegisterError(errMFARequired, "mfa.required", "The role of the user requires two-factor authentication. Enroll before signing in.", web.Translations{
+		"nl": "tweestapsverificatie is verplicht voor uw rol",
+		"bg": "двуфакторното удостоверяване е задължително за вашата роля",
+	})
+	web.RegisterError(errSSOState, "sso.state_invalid", "The single sign-on expired or was started in another browser.", web.Translations{
+		"nl": "aanmelding is verlopen of elders gestart, probeer het opnieuw",
+		"bg": "влизането е изтекло или е започнато другаде, опитайте отново",
+	})
+	web.RegisterError(errSSONoRole, "sso.no_role", "The groups of the account at the identity provider map to no role.", web.Translations{
+		"nl": "uw account bij de identiteitsprovider heeft geen rol in deze dienst",
+		"bg": "профилът ви при доставчика на самоличност няма роля в тази услуга",
+	})
+	web.RegisterError(errSSOEmail, "sso.email_unverified", "The identity provider didn't share a verified email address.", web.Translations{
+		"nl": "identiteitsprovider heeft geen geverifieerd e-mailadres gedeeld",
+		"bg": "доставчикът на самоличност не сподели потвърден имейл адрес",
+	})
+	web.RegisterError(oidc.ErrRejected, "sso.rejected", "The identity provider rejected the sign in.", web.Translations{
+		"nl": "identiteitsprovider heeft de aanmelding geweigerd",
+		"bg": "доставчикът на самоличност отхвърли влизането",
+	})
+	web.RegisterError(oidc.ErrInvalidToken, "sso.invalid_token", "The ID token of the identity provider is invalid.", web.Translations{
+		"nl": "ID-token is ongeldig",
+		"bg": "ID токенът е невалиден",
+	})
+}
@@ -0,0 +1,429 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/os-foundry/vetpms/internal/platform/auth"
+	"github.com/os-foundry/vetpms/internal/platform/seal"
+	"github.com/os-foundry/vetpms/internal/platform/totp"
+	"github.com/os-foundry/vetpms/internal/platform/web"
+	"github.com/os-foundry/vetpms/internal/user"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// errMFAUnavailable is returned when a second factor is enrolled or used
+// while no key to seal secrets with is configured.
+var errMFAUnavailable = errors.New("two-factor authentication is not configured")
+
+// errMFARequired is returned when a user whose roles require a second factor
+// tries to disable theirs.
+var errMFARequired = errors.New("two-factor authentication is required for your role")
+
+// MFA configures two-factor authentication. Secrets are sealed with Box, and
+// without one users can't enroll a second factor. Users with one of Roles
+// must use a second factor, they enroll with the MFA challenge of the next
+// time they sign in.
+type MFA struct {
+	Box    *seal.Box
+	Issuer string
+	Roles  []string
+}
+
+// required reports whether the user with the claims must use a second
+// factor.
+func (m MFA) required(claims auth.Claims) bool {
+	return len(m.Roles) > 0 && claims.HasRole(m.Roles...)
+}
+
+// mfaChallenge is the response of authenticating with a password when a
+// code is needed as well. Enroll is set when the user has to enroll a second
+// factor with the challenge first.
+type mfaChallenge struct {
+	MFAToken string `json:"mfa_token"`
+	Enroll   bool   `json:"enroll,omitempty"`
+}
+
+// mfaEnrollment is what a user needs to add their account to an
+// authenticator app. The URI is usually shown as a QR code.
+type mfaEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// mfaCode is a request holding a code of the app or a recovery code.
+type mfaCode struct {
+	Code string `json:"code" validate:"required"`
+}
+
+// challenge responds with an MFA challenge for the user. Users who must use a
+// second factor but don't have one yet have to enroll one with the challenge.
+// Signing in doesn't change their second factor, so a password alone can't
+// replace one that is being enrolled.
+func (u *User) challenge(ctx context.Context, w http.ResponseWriter, usr *user.User, now time.Time) error {
+	if u.mfa.Box == nil {
+		return web.NewRequestError(errMFAUnavailable, http.StatusNotImplemented)
+	}
+
+	resp := mfaChallenge{Enroll: !usr.MFA.Enabled}
+
+	var err error
+	if resp.MFAToken, err = u.st.CreateMFAChallenge(ctx, usr.ID, now); err != nil {
+		return errors.Wrap(err, "creating mfa challenge")
+	}
+
+	return web.Respond(ctx, w, resp, http.StatusOK)
+}
+
+// enrollment returns what the user with the email address needs to add the
+// secret to their authenticator app.
+func (u *User) enrollment(email string, secret []byte) mfaEnrollment {
+	return mfaEnrollment{
+		Secret: totp.Encode(secret),
+		URI:    totp.URI(u.mfa.Issuer, email, secret),
+	}
+}
+
+// EnrollMFAChallenge starts enrolling a second factor for a user who has to
+// enroll one while signing in. The MFA challenge authenticates the request.
+// It responds with the secret to add to an authenticator app, which is kept
+// with the challenge until VerifyMFA confirms a code of it. Enrolling again
+// with the same challenge responds with the same secret.
+func (u *User) EnrollMFAChallenge(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.EnrollMFAChallenge")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	if u.mfa.Box == nil {
+		return web.NewRequestError(errMFAUnavailable, http.StatusNotImplemented)
+	}
+
+	var req struct {
+		MFAToken string `json:"mfa_token" validate:"required"`
+	}
+	if err := web.Decode(r, &req); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	m, _, err := user.NewMFA(u.mfa.Box)
+	if err != nil {
+		return err
+	}
+
+	c, err := u.st.EnrollMFAChallenge(ctx, v.Now, req.MFAToken, m.Secret)
+	if err != nil {
+		switch err {
+		case user.ErrMFAChallengeInvalid:
+			return web.NewRequestError(err, http.StatusUnauthorized)
+		default:
+			return errors.Wrap(err, "enrolling with mfa challenge")
+		}
+	}
+
+	// The challenge proves the password was right, so the user is read as if
+	// they were authenticated.
+	claims := auth.NewClaims(c.UserID, nil, v.Now, time.Minute)
+	ctx = context.WithValue(ctx, auth.Key, claims)
+
+	usr, err := u.st.Retrieve(ctx, claims, c.UserID)
+	if err != nil {
+		switch err {
+		case user.ErrNotFound:
+			return web.NewRequestError(user.ErrAuthenticationFailure, http.StatusUnauthorized)
+		default:
+			return errors.Wrapf(err, "ID: %s", c.UserID)
+		}
+	}
+	if usr.MFA.Enabled {
+		return web.NewRequestError(user.ErrMFAEnabled, http.StatusConflict)
+	}
+
+	secret, err := u.mfa.Box.Open(c.Secret)
+	if err != nil {
+		return errors.Wrap(err, "opening secret")
+	}
+
+	return web.Respond(ctx, w, u.enrollment(usr.Email, secret), http.StatusOK)
+}
+
+// VerifyMFA exchanges an MFA challenge and a code for the tokens of a new
+// session. A challenge can only be used once, a wrong code means signing in
+// again. Users who enrolled with the challenge enable their second factor
+// with the code and receive their recovery codes.
+func (u *User) VerifyMFA(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.VerifyMFA")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	if u.mfa.Box == nil {
+		return web.NewRequestError(errMFAUnavailable, http.StatusNotImplemented)
+	}
+
+	var req struct {
+		MFAToken string `json:"mfa_token" validate:"required"`
+		Code     string `json:"code" validate:"required"`
+	}
+	if err := web.Decode(r, &req); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	c, err := u.st.UseMFAChallenge(ctx, v.Now, req.MFAToken)
+	if err != nil {
+		switch err {
+		case user.ErrMFAChallengeInvalid:
+			return web.NewRequestError(err, http.StatusUnauthorized)
+		default:
+			return errors.Wrap(err, "using mfa challenge")
+		}
+	}
+
+	// The challenge proves the password was right, so the user is read, and
+	// the change recorded in the audit trail, as if they were authenticated.
+	id := c.UserID
+	claims := auth.NewClaims(id, nil, v.Now, time.Minute)
+	ctx = context.WithValue(ctx, auth.Key, claims)
+
+	usr, err := u.st.Retrieve(ctx, claims, id)
+	if err != nil {
+		switch err {
+		case user.ErrNotFound:
+			return web.NewRequestError(user.ErrAuthenticationFailure, http.StatusUnauthorized)
+		default:
+			return errors.Wrapf(err, "ID: %s", id)
+		}
+	}
+
+	m := usr.MFA
+	var codes []string
+	if m.Enabled {
+		err = m.Verify(u.mfa.Box, req.Code, v.Now)
+	} else {
+		m = user.MFA{Secret: c.Secret}
+		codes, err = m.Enable(u.mfa.Box, req.Code, v.Now)
+	}
+	if err != nil {
+		switch err {
+		case user.ErrMFACodeInvalid:
+
+			// Wrong codes count as failed sign ins, so codes can't be
+			// guessed by anyone who knows the password.
+			if err := u.failLogin(ctx, v.Now, u.lockout.attempts(r, usr.Email)); err != nil {
+				return err
+			}
+			return web.NewRequestError(err, http.StatusUnauthorized)
+		default:
+			return errors.Wrap(err, "verifying code")
+		}
+	}
+
+	if err := u.st.SetMFA(ctx, id, m, v.Now); err != nil {
+		return errors.Wrapf(err, "ID: %s", id)
+	}
+	if err := u.st.ResetLoginAttempts(ctx, user.EmailAttempts(usr.Email)); err != nil {
+		return err
+	}
+
+	tkn, err := u.startSession(ctx, auth.NewClaims(usr.ID, usr.Roles, v.Now, user.AccessTokenTTL), device(r, r.Header.Get(deviceHeader)), v.Now)
+	if err != nil {
+		return err
+	}
+	tkn.RecoveryCodes = codes
+
+	return web.Respond(ctx, w, tkn, http.StatusOK)
+}
+
+// EnrollMFA starts enrolling a second factor for the authenticated user. It
+// responds with the secret to add to an authenticator app. The second factor
+// is enabled with EnableMFA.
+func (u *User) EnrollMFA(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.EnrollMFA")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
+	if u.mfa.Box == nil {
+		return web.NewRequestError(errMFAUnavailable, http.StatusNotImplemented)
+	}
+
+	usr, err := u.st.Retrieve(ctx, claims, claims.Subject)
+	if err != nil {
+		switch err {
+		case user.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "ID: %s", claims.Subject)
+		}
+	}
+	if usr.MFA.Enabled {
+		return web.NewRequestError(user.ErrMFAEnabled, http.StatusConflict)
+	}
+
+	m, secret, err := user.NewMFA(u.mfa.Box)
+	if err != nil {
+		return err
+	}
+	if err := u.st.SetMFA(ctx, usr.ID, m, v.Now); err != nil {
+		return errors.Wrapf(err, "ID: %s", usr.ID)
+	}
+
+	return web.Respond(ctx, w, u.enrollment(usr.Email, secret), http.StatusOK)
+}
+
+// EnableMFA enables the second factor the authenticated user enrolled with a
+// code of it. It responds with the recovery codes of the user.
+func (u *User) EnableMFA(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.EnableMFA")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
+	if u.mfa.Box == nil {
+		return web.NewRequestError(errMFAUnavailable, http.StatusNotImplemented)
+	}
+
+	var req mfaCode
+	if err := web.Decode(r, &req); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	usr, err := u.st.Retrieve(ctx, claims, claims.Subject)
+	if err != nil {
+		switch err {
+		case user.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "ID: %s", claims.Subject)
+		}
+	}
+
+	m := usr.MFA
+	codes, err := m.Enable(u.mfa.Box, req.Code, v.Now)
+	if err != nil {
+		switch err {
+		case user.ErrMFAEnabled:
+			return web.NewRequestError(err, http.StatusConflict)
+		case user.ErrMFACodeInvalid:
+			return web.NewRequestError(err, http.StatusForbidden)
+		default:
+			return errors.Wrap(err, "enabling mfa")
+		}
+	}
+
+	if err := u.st.SetMFA(ctx, usr.ID, m, v.Now); err != nil {
+		return errors.Wrapf(err, "ID: %s", usr.ID)
+	}
+
+	resp := struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{codes}
+
+	return web.Respond(ctx, w, resp, http.StatusOK)
+}
+
+// DisableMFA removes the second factor of the authenticated user. It requires
+// a code of it, and is forbidden when the roles of the user require one.
+func (u *User) DisableMFA(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.DisableMFA")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
+	if u.mfa.required(claims) {
+		return web.NewRequestError(errMFARequired, http.StatusForbidden)
+	}
+	if u.mfa.Box == nil {
+		return web.NewRequestError(errMFAUnavailable, http.StatusNotImplemented)
+	}
+
+	var req mfaCode
+	if err := web.Decode(r, &req); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	usr, err := u.st.Retrieve(ctx, claims, claims.Subject)
+	if err != nil {
+		switch err {
+		case user.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "ID: %s", claims.Subject)
+		}
+	}
+
+	m := usr.MFA
+	if err := m.Verify(u.mfa.Box, req.Code, v.Now); err != nil {
+		switch err {
+		case user.ErrMFACodeInvalid:
+			return web.NewRequestError(err, http.StatusForbidden)
+		default:
+			return errors.Wrap(err, "verifying code")
+		}
+	}
+
+	if err := u.st.SetMFA(ctx, usr.ID, user.MFA{}, v.Now); err != nil {
+		return errors.Wrapf(err, "ID: %s", usr.ID)
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// ResetMFA removes the second factor of the user identified by an ID in the
+// request URL, for example when they lost their phone and recovery codes.
+// If their roles require a second factor they enroll a new one the next time
+// they sign in.
+func (u *User) ResetMFA(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.ResetMFA")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	if err := u.st.SetMFA(ctx, params["id"], user.MFA{}, v.Now); err != nil {
+		switch err {
+		case user.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case user.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "ID: %s", params["id"])
+		}
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
@@ -19,17 +19,31 @@ type Product struct {
 	// ADD OTHER STATE LIKE THE LOGGER IF NEEDED.
 }
 
-// List gets all existing products in the system.
+// List gets a page of the existing products in the system. Only admins can
+// list the deleted products.
 func (p *Product) List(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
 	ctx, span := trace.StartSpan(ctx, "handlers.Product.List")
 	defer span.End()
 
-	products, err := p.st.List(ctx)
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return web.NewShutdownError("claims missing from context")
+	}
+
+	opts, err := web.DecodeQuery(r, product.QueryFields)
+	if err != nil {
+		return err
+	}
+	if opts.Deleted && !claims.HasRole(auth.RoleAdmin) {
+		return web.NewRequestError(product.ErrForbidden, http.StatusForbidden)
+	}
+
+	products, page, err := p.st.List(ctx, opts)
 	if err != nil {
 		return err
 	}
 
-	return web.Respond(ctx, w, products, http.StatusOK)
+	return web.RespondPage(ctx, w, r, products, page)
 }
 
 // Retrieve returns the specified product from the system.
@@ -82,7 +96,8 @@ func (p *Product) Create(ctx context.Context, w http.ResponseWriter, r *http.Req
 }
 
 // Update decodes the body of a request to update an existing product. The ID
-// of the product is part of the request URL.
+// of the product is part of the request URL. If the request has an If-Match
+// header the product is only updated if it still has that entity tag.
 func (p *Product) Update(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
 	ctx, span := trace.StartSpan(ctx, "handlers.Product.Update")
 	defer span.End()
@@ -101,6 +116,7 @@ func (p *Product) Update(ctx context.Context, w http.ResponseWriter, r *http.Req
 	if err := web.Decode(r, &up); err != nil {
 		return errors.Wrap(err, "")
 	}
+	up.ETags = web.IfMatch(r)
 
 	if err := p.st.Update(ctx, claims, params["id"], up, v.Now); err != nil {
 		switch err {
@@ -110,6 +126,8 @@ func (p *Product) Update(ctx context.Context, w http.ResponseWriter, r *http.Req
 			return web.NewRequestError(err, http.StatusNotFound)
 		case product.ErrForbidden:
 			return web.NewRequestError(err, http.StatusForbidden)
+		case product.ErrModified:
+			return web.NewRequestError(err, http.StatusPreconditionFailed)
 		default:
 			return errors.Wrapf(err, "updating product %q: %+v", params["id"], up)
 		}
@@ -118,12 +136,23 @@ func (p *Product) Update(ctx context.Context, w http.ResponseWriter, r *http.Req
 	return web.Respond(ctx, w, nil, http.StatusNoContent)
 }
 
-// Delete removes a single product identified by an ID in the request URL.
+// Delete marks a single product identified by an ID in the request URL as
+// deleted.
 func (p *Product) Delete(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
 	ctx, span := trace.StartSpan(ctx, "handlers.Product.Delete")
 	defer span.End()
 
-	if err := p.st.Delete(ctx, params["id"]); err != nil {
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	if err := p.st.Delete(ctx, claims, params["id"], v.Now); err != nil {
 		switch err {
 		case product.ErrInvalidID:
 			return web.NewRequestError(err, http.StatusBadRequest)
@@ -134,3 +163,28 @@ func (p *Product) Delete(ctx context.Context, w http.ResponseWriter, r *http.Req
 
 	return web.Respond(ctx, w, nil, http.StatusNoContent)
 }
+
+// Restore undoes the deletion of a single product identified by an ID in the
+// request URL.
+func (p *Product) Restore(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Product.Restore")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	if err := p.st.Restore(ctx, params["id"], v.Now); err != nil {
+		switch err {
+		case product.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case product.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "Id: %s", params["id"])
+		}
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
@@ -5,51 +5,163 @@ import (
 	"net/http"
 	"os"
 
+	"github.com/os-foundry/vetpms/internal/audit"
+	"github.com/os-foundry/vetpms/internal/backup"
 	"github.com/os-foundry/vetpms/internal/mid"
 	"github.com/os-foundry/vetpms/internal/platform/auth" // Import is removed in final PR
 	"github.com/os-foundry/vetpms/internal/platform/database"
+	"github.com/os-foundry/vetpms/internal/platform/mail"
+	"github.com/os-foundry/vetpms/internal/platform/ratelimit"
 	"github.com/os-foundry/vetpms/internal/platform/web"
 	"github.com/os-foundry/vetpms/internal/product"
 	"github.com/os-foundry/vetpms/internal/user"
 )
 
-// API constructs an http.Handler with all application routes defined.
-func API(shutdown chan os.Signal, log *log.Logger, u user.Storage, p product.Storage, authenticator *auth.Authenticator) http.Handler {
+// RateLimits configures the quotas of the routes. Auth limits the routes to
+// sign in and reset passwords per IP address, and API the authenticated
+// routes per user. The zero value doesn't limit any route.
+type RateLimits struct {
+	Limiter ratelimit.Limiter
+	Auth    ratelimit.Quota
+	API     ratelimit.Quota
+}
+
+// Config holds the dependencies of the routes. The zero values of Mailer,
+// MFA, Lockout, RateLimits, CORS and SSO disable the features they configure.
+type Config struct {
+	Health        Health
+	Users         user.Storage
+	Products      product.Storage
+	Audit         audit.Storage
+	Snapshot      backup.Snapshot
+	Authenticator *auth.Authenticator
+	Keys          *auth.KeyStore
+	Mailer        mail.Mailer
+	MFA           MFA
+	Lockout       Lockout
+	RateLimits    RateLimits
+	CORS          web.CORS
+	SSO           SSO
+}
 
+// API constructs an http.Handler with all application routes defined.
+func API(shutdown chan os.Signal, log *log.Logger, cfg Config) http.Handler {
 	// Construct the web.App which holds all routes as well as common Middleware.
-	app := web.NewApp(shutdown, log, mid.Logger(log), mid.Errors(log), mid.Metrics(), mid.Panics(log))
+	// Browsers may call every route from the origins CORS allows.
+	app := web.NewApp(shutdown, log, cfg.CORS, mid.Logger(log), mid.Errors(log), mid.Metrics(), mid.Panics(log))
 
-	// Register health check endpoint. This route is not authenticated.
-	check := Check{
-		checks: []database.StatusChecker{u},
-	}
-	app.Handle("GET", "/v1/health", check.Health)
+	// Register health check endpoints. These routes are not authenticated.
+	check := newCheck(cfg.Health, map[string]database.StatusChecker{"users": cfg.Users, "products": cfg.Products})
+	app.Handle("GET", "/v1/health", check.Ready)
+	app.Handle("GET", "/v1/health/live", check.Live)
+	app.Handle("GET", "/v1/health/ready", check.Ready)
+
+	// Tokens of revoked sessions are rejected. Requests authenticated with an
+	// API key are limited to the scopes of the key.
+	authenticate := mid.Authenticate(cfg.Authenticator, cfg.Users, cfg.Users)
+
+	// Authenticated routes share a quota per user, the routes to sign in
+	// share a quota per IP address.
+	limit := mid.RateLimit(cfg.RateLimits.Limiter, "api", cfg.RateLimits.API)
+	authLimit := mid.RateLimit(cfg.RateLimits.Limiter, "auth", cfg.RateLimits.Auth)
 
 	// Register user management and authentication endpoints.
 	uh := User{
-		st:            u,
-		authenticator: authenticator,
+		st:            cfg.Users,
+		authenticator: cfg.Authenticator,
+		mailer:        cfg.Mailer,
+		mfa:           cfg.MFA,
+		lockout:       cfg.Lockout,
+		sso:           cfg.SSO,
 	}
 
-	app.Handle("GET", "/v1/users", uh.List, mid.Authenticate(authenticator), mid.HasRole(auth.RoleAdmin))
-	app.Handle("POST", "/v1/users", uh.Create, mid.Authenticate(authenticator), mid.HasRole(auth.RoleAdmin))
-	app.Handle("GET", "/v1/user", uh.Retrieve, mid.Authenticate(authenticator))
-	app.Handle("GET", "/v1/users/:id", uh.Retrieve, mid.Authenticate(authenticator))
-	app.Handle("PUT", "/v1/users/:id", uh.Update, mid.Authenticate(authenticator), mid.HasRole(auth.RoleAdmin))
-	app.Handle("DELETE", "/v1/users/:id", uh.Delete, mid.Authenticate(authenticator), mid.HasRole(auth.RoleAdmin))
+	app.Handle("GET", "/v1/users", uh.List, authenticate, limit, mid.HasScope(auth.ScopeUsersRead), mid.HasRole(auth.RoleAdmin))
+	app.Handle("POST", "/v1/users", uh.Create, authenticate, limit, mid.HasScope(auth.ScopeUsersWrite), mid.HasRole(auth.RoleAdmin))
+	app.Handle("GET", "/v1/user", uh.Retrieve, authenticate, limit, mid.HasScope(auth.ScopeUsersRead))
+	app.Handle("PUT", "/v1/user/password", uh.ChangePassword, authenticate, limit, mid.HasScope(auth.ScopeUsersWrite))
+	app.Handle("POST", "/v1/user/mfa", uh.EnrollMFA, authenticate, limit, mid.HasScope(auth.ScopeUsersWrite))
+	app.Handle("PUT", "/v1/user/mfa", uh.EnableMFA, authenticate, limit, mid.HasScope(auth.ScopeUsersWrite))
+	app.Handle("DELETE", "/v1/user/mfa", uh.DisableMFA, authenticate, limit, mid.HasScope(auth.ScopeUsersWrite))
+	app.Handle("GET", "/v1/users/:id", uh.Retrieve, authenticate, limit, mid.HasScope(auth.ScopeUsersRead))
+	app.Handle("PUT", "/v1/users/:id", uh.Update, authenticate, limit, mid.HasScope(auth.ScopeUsersWrite), mid.HasRole(auth.RoleAdmin))
+	app.Handle("DELETE", "/v1/users/:id", uh.Delete, authenticate, limit, mid.HasScope(auth.ScopeUsersWrite), mid.HasRole(auth.RoleAdmin))
+	app.Handle("POST", "/v1/users/:id/restore", uh.Restore, authenticate, limit, mid.HasScope(auth.ScopeUsersWrite), mid.HasRole(auth.RoleAdmin))
+	app.Handle("DELETE", "/v1/users/:id/sessions", uh.RevokeSessions, authenticate, limit, mid.HasScope(auth.ScopeUsersWrite), mid.HasRole(auth.RoleAdmin))
+	app.Handle("DELETE", "/v1/users/:id/mfa", uh.ResetMFA, authenticate, limit, mid.HasScope(auth.ScopeUsersWrite), mid.HasRole(auth.RoleAdmin))
+	app.Handle("DELETE", "/v1/users/:id/lockout", uh.Unlock, authenticate, limit, mid.HasScope(auth.ScopeUsersWrite), mid.HasRole(auth.RoleAdmin))
+
+	// These routes are not authenticated
+	app.Handle("GET", "/v1/users/token", uh.Token, authLimit)
+	app.Handle("POST", "/v1/users/token/refresh", uh.Refresh, authLimit)
+	app.Handle("POST", "/v1/users/token/mfa", uh.VerifyMFA, authLimit)
+	app.Handle("POST", "/v1/users/token/mfa/enroll", uh.EnrollMFAChallenge, authLimit)
 
-	// This route is not authenticated
-	app.Handle("GET", "/v1/users/token", uh.Token)
+	// Passwords are reset with tokens sent by mail, so the routes need a
+	// mailer. These routes are not authenticated either.
+	if cfg.Mailer != nil {
+		app.Handle("POST", "/v1/users/password/reset", uh.RequestReset, authLimit)
+		app.Handle("PUT", "/v1/users/password/reset", uh.ResetPassword, authLimit)
+	}
+
+	// Staff sign in with the identity provider of their practice group when
+	// one is configured. These routes are not authenticated either.
+	if cfg.SSO.Provider != nil {
+		app.Handle("GET", "/v1/users/sso/login", uh.SSOLogin, authLimit)
+		app.Handle("GET", "/v1/users/sso/callback", uh.SSOCallback, authLimit)
+	}
+
+	// Register session endpoints. Users see and end the sessions of their
+	// devices, admins those of everyone.
+	sh := Session{
+		st: cfg.Users,
+	}
+	app.Handle("GET", "/v1/user/sessions", sh.ListOwn, authenticate, limit, mid.HasScope(auth.ScopeUsersRead))
+	app.Handle("DELETE", "/v1/user/sessions/:id", sh.RevokeOwn, authenticate, limit, mid.HasScope(auth.ScopeUsersWrite))
+	app.Handle("GET", "/v1/sessions", sh.List, authenticate, limit, mid.HasScope(auth.ScopeUsersRead), mid.HasRole(auth.RoleAdmin))
+	app.Handle("DELETE", "/v1/sessions/:id", sh.Revoke, authenticate, limit, mid.HasScope(auth.ScopeUsersWrite), mid.HasRole(auth.RoleAdmin))
+
+	// Register API key management endpoints.
+	akh := APIKey{
+		st: cfg.Users,
+	}
+	app.Handle("GET", "/v1/apikeys", akh.List, authenticate, limit, mid.HasScope(auth.ScopeAPIKeys), mid.HasRole(auth.RoleAdmin))
+	app.Handle("POST", "/v1/apikeys", akh.Create, authenticate, limit, mid.HasScope(auth.ScopeAPIKeys), mid.HasRole(auth.RoleAdmin))
+	app.Handle("GET", "/v1/apikeys/:id", akh.Retrieve, authenticate, limit, mid.HasScope(auth.ScopeAPIKeys), mid.HasRole(auth.RoleAdmin))
+	app.Handle("DELETE", "/v1/apikeys/:id", akh.Delete, authenticate, limit, mid.HasScope(auth.ScopeAPIKeys), mid.HasRole(auth.RoleAdmin))
+
+	// Publish the keys verifying our tokens. This route is not authenticated.
+	kh := Keys{
+		keys: cfg.Keys,
+	}
+	app.Handle("GET", "/v1/.well-known/jwks.json", kh.JWKS)
+
+	// Document the codes of the errors. This route is not authenticated.
+	eh := Errors{}
+	app.Handle("GET", "/v1/errors", eh.Codes)
 
 	// Register product and sale endpoints.
 	ph := Product{
-		st: p,
+		st: cfg.Products,
+	}
+	app.Handle("GET", "/v1/products", ph.List, authenticate, limit, mid.HasScope(auth.ScopeProductsRead))
+	app.Handle("POST", "/v1/products", ph.Create, authenticate, limit, mid.HasScope(auth.ScopeProductsWrite))
+	app.Handle("GET", "/v1/products/:id", ph.Retrieve, authenticate, limit, mid.HasScope(auth.ScopeProductsRead))
+	app.Handle("PUT", "/v1/products/:id", ph.Update, authenticate, limit, mid.HasScope(auth.ScopeProductsWrite))
+	app.Handle("DELETE", "/v1/products/:id", ph.Delete, authenticate, limit, mid.HasScope(auth.ScopeProductsWrite))
+	app.Handle("POST", "/v1/products/:id/restore", ph.Restore, authenticate, limit, mid.HasScope(auth.ScopeProductsWrite), mid.HasRole(auth.RoleAdmin))
+
+	// Register audit trail endpoints. The trail is read only.
+	ah := Audit{
+		st: cfg.Audit,
+	}
+	app.Handle("GET", "/v1/audit", ah.List, authenticate, limit, mid.HasScope(auth.ScopeAuditRead), mid.HasRole(auth.RoleAdmin))
+
+	// Register the backup endpoint. Snapshot makes the backup consistent
+	// while other requests keep writing.
+	bh := Backup{
+		st: backup.Stores{Users: cfg.Users, Products: cfg.Products, Audit: cfg.Audit, Snapshot: cfg.Snapshot},
 	}
-	app.Handle("GET", "/v1/products", ph.List, mid.Authenticate(authenticator))
-	app.Handle("POST", "/v1/products", ph.Create, mid.Authenticate(authenticator))
-	app.Handle("GET", "/v1/products/:id", ph.Retrieve, mid.Authenticate(authenticator))
-	app.Handle("PUT", "/v1/products/:id", ph.Update, mid.Authenticate(authenticator))
-	app.Handle("DELETE", "/v1/products/:id", ph.Delete, mid.Authenticate(authenticator))
+	app.Handle("GET", "/v1/backup", bh.Download, authenticate, limit, mid.HasScope(auth.ScopeBackupRead), mid.HasRole(auth.RoleAdmin))
 
 	return app
 }
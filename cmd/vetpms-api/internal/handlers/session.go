@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/os-foundry/vetpms/internal/platform/auth"
+	"github.com/os-foundry/vetpms/internal/platform/query"
+	"github.com/os-foundry/vetpms/internal/platform/web"
+	"github.com/os-foundry/vetpms/internal/user"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// Session represents the session method handler set. Users manage the
+// devices they are signed in on, admins the sessions of everyone.
+type Session struct {
+	st user.Storage
+}
+
+// session is a session in a response. Current marks the session the request
+// was sent with.
+type session struct {
+	user.RefreshToken
+	Current bool `json:"current"`
+}
+
+// ListOwn returns a page of the active sessions of the authenticated user.
+func (s *Session) ListOwn(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Session.ListOwn")
+	defer span.End()
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
+	return s.list(ctx, w, r, claims, claims.Subject)
+}
+
+// RevokeOwn ends the session identified by an ID in the request URL, which
+// must be one of the authenticated user. Its access tokens stop working
+// immediately.
+func (s *Session) RevokeOwn(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Session.RevokeOwn")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
+	// Sessions of other users are reported as missing, so their IDs can't
+	// be probed.
+	t, err := s.st.RetrieveSession(ctx, params["id"], v.Now)
+	if err == nil && t.UserID != claims.Subject {
+		err = user.ErrSessionNotFound
+	}
+	if err != nil {
+		return sessionError(err, params["id"])
+	}
+
+	return s.revoke(ctx, w, params["id"], v.Now)
+}
+
+// List returns a page of the active sessions of all users. Filter on user_id
+// for those of a user.
+func (s *Session) List(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Session.List")
+	defer span.End()
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
+	return s.list(ctx, w, r, claims, "")
+}
+
+// Revoke ends the session identified by an ID in the request URL. Its access
+// tokens stop working immediately.
+func (s *Session) Revoke(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Session.Revoke")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	return s.revoke(ctx, w, params["id"], v.Now)
+}
+
+// list responds with a page of the active sessions of the user, or of all
+// users if the user ID is empty. Without an explicit sort sessions are listed
+// in the order they were started.
+func (s *Session) list(ctx context.Context, w http.ResponseWriter, r *http.Request, claims auth.Claims, userID string) error {
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	opts, err := web.DecodeQuerySort(r, user.SessionQueryFields, "date_created")
+	if err != nil {
+		return err
+	}
+
+	// Users only see their own sessions, whatever they filter on.
+	if userID != "" {
+		filters := []query.Filter{{Field: "user_id", Value: userID}}
+		for _, f := range opts.Filters {
+			if f.Field != "user_id" {
+				filters = append(filters, f)
+			}
+		}
+		opts.Filters = filters
+	}
+
+	stored, page, err := s.st.ListSessions(ctx, opts, v.Now)
+	if err != nil {
+		return err
+	}
+
+	sessions := make([]session, len(stored))
+	for i, t := range stored {
+		sessions[i] = session{RefreshToken: t, Current: t.ID == claims.SessionID}
+	}
+
+	return web.RespondPage(ctx, w, r, sessions, page)
+}
+
+// revoke ends the session with the ID.
+func (s *Session) revoke(ctx context.Context, w http.ResponseWriter, id string, now time.Time) error {
+	if err := s.st.RevokeSession(ctx, id, now); err != nil {
+		return sessionError(err, id)
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// sessionError maps the errors of looking up the session with the ID to
+// responses.
+func sessionError(err error, id string) error {
+	switch err {
+	case user.ErrInvalidID:
+		return web.NewRequestError(err, http.StatusBadRequest)
+	case user.ErrSessionNotFound:
+		return web.NewRequestError(err, http.StatusNotFound)
+	default:
+		return errors.Wrapf(err, "ID: %s", id)
+	}
+}
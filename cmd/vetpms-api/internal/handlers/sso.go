@@ -0,0 +1,292 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/os-foundry/vetpms/internal/platform/auth"
+	"github.com/os-foundry/vetpms/internal/platform/oidc"
+	"github.com/os-foundry/vetpms/internal/platform/query"
+	"github.com/os-foundry/vetpms/internal/platform/web"
+	"github.com/os-foundry/vetpms/internal/user"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// errSSOState is returned when a user comes back from the identity provider
+// without having started the sign in in the same browser.
+var errSSOState = errors.New("sign in expired or was started elsewhere, try again")
+
+// errSSONoRole is returned when the claims of a user don't map to any role.
+var errSSONoRole = errors.New("your account at the identity provider has no role in this service")
+
+// errSSOEmail is returned when an account at the identity provider can't be
+// linked to a user by its email address.
+var errSSOEmail = errors.New("identity provider didn't share a verified email address")
+
+// ssoCookie holds the state and nonce of a sign in, and the name of the
+// device, while the user is at the identity provider, for at most ssoTTL.
+const (
+	ssoCookie = "vetpms_sso"
+	ssoTTL    = 10 * time.Minute
+)
+
+// SSO configures signing in with an OpenID Connect provider. Roles maps the
+// values of RoleClaim to the roles of users, who can't sign in without one.
+// Without a provider single sign-on is disabled.
+type SSO struct {
+	Provider  *oidc.Provider
+	RoleClaim string
+	Roles     oidc.RoleMap
+}
+
+// SSOLogin handles a request to sign in with the identity provider. It sends
+// the user to the provider, which sends them back to SSOCallback. Browsers
+// can't set headers when following links, so the device is named in the
+// device query parameter instead.
+func (u *User) SSOLogin(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.SSOLogin")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	state, err := randomToken()
+	if err != nil {
+		return err
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		return err
+	}
+
+	url, err := u.sso.Provider.AuthCodeURL(ctx, state, nonce)
+	if err != nil {
+		return errors.Wrap(err, "starting sign in")
+	}
+
+	// The cookie binds the sign in to the browser it was started in.
+	name := base64.RawURLEncoding.EncodeToString([]byte(device(r, r.URL.Query().Get("device")).Name))
+	u.sso.setCookie(w, state+"."+nonce+"."+name, int(ssoTTL.Seconds()))
+
+	v.StatusCode = http.StatusFound
+	http.Redirect(w, r, url, http.StatusFound)
+	return nil
+}
+
+// SSOCallback handles the user coming back from the identity provider. The
+// first time an account signs in it is linked to the user with its verified
+// email address, or a new user is created for it. The roles of the user are
+// set from the claims of the account every time. It responds with a JWT and
+// a refresh token starting a new session.
+func (u *User) SSOCallback(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.SSOCallback")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	// The state and nonce can only be used once.
+	c, err := r.Cookie(ssoCookie)
+	u.sso.setCookie(w, "", -1)
+
+	q := r.URL.Query()
+	if q.Get("error") != "" {
+		return web.NewRequestError(oidc.ErrRejected, http.StatusUnauthorized)
+	}
+	if err != nil {
+		return web.NewRequestError(errSSOState, http.StatusUnauthorized)
+	}
+	parts := strings.SplitN(c.Value, ".", 3)
+	if len(parts) != 3 || subtle.ConstantTimeCompare([]byte(parts[0]), []byte(q.Get("state"))) != 1 {
+		return web.NewRequestError(errSSOState, http.StatusUnauthorized)
+	}
+
+	id, err := u.sso.Provider.Exchange(ctx, q.Get("code"), parts[1], v.Now)
+	if err != nil {
+		switch errors.Cause(err) {
+		case oidc.ErrRejected, oidc.ErrInvalidToken:
+			return web.NewRequestError(errors.Cause(err), http.StatusUnauthorized)
+		default:
+			return errors.Wrap(err, "signing in")
+		}
+	}
+
+	roles := u.sso.Roles.Roles(id.Strings(u.sso.RoleClaim))
+	if len(roles) == 0 {
+		return web.NewRequestError(errSSONoRole, http.StatusForbidden)
+	}
+
+	claims, err := u.ssoClaims(ctx, id, roles, v.Now)
+	if err != nil {
+		return err
+	}
+
+	name, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return web.NewRequestError(errSSOState, http.StatusUnauthorized)
+	}
+
+	tkn, err := u.startSession(ctx, claims, device(r, string(name)), v.Now)
+	if err != nil {
+		return err
+	}
+
+	return web.Respond(ctx, w, tkn, http.StatusOK)
+}
+
+// ssoClaims returns the claims of the user linked to the account at the
+// identity provider, linking a user first if there is none. The user gets
+// the roles.
+func (u *User) ssoClaims(ctx context.Context, id oidc.Identity, roles []string, now time.Time) (auth.Claims, error) {
+	var userID string
+	i, err := u.st.RetrieveIdentity(ctx, id.Issuer, id.Subject)
+	switch err {
+	case nil:
+		userID = i.UserID
+	case user.ErrIdentityNotFound:
+		if userID, err = u.linkSSO(ctx, id, roles, now); err != nil {
+			return auth.Claims{}, err
+		}
+	default:
+		return auth.Claims{}, errors.Wrap(err, "finding linked user")
+	}
+
+	// The user acts on their own behalf from here on.
+	claims := auth.NewClaims(userID, roles, now, user.AccessTokenTTL)
+
+	usr, err := u.st.Retrieve(ctx, claims, userID)
+	if err != nil {
+		switch err {
+		case user.ErrNotFound:
+
+			// Deleted users stay linked, so they can't sign in until they
+			// are restored.
+			return auth.Claims{}, web.NewRequestError(user.ErrAuthenticationFailure, http.StatusUnauthorized)
+		default:
+			return auth.Claims{}, errors.Wrapf(err, "ID: %s", userID)
+		}
+	}
+	if usr.ServiceAccount() {
+		return auth.Claims{}, web.NewRequestError(user.ErrAuthenticationFailure, http.StatusUnauthorized)
+	}
+
+	if !sameRoles(usr.Roles, roles) {
+		if err := u.st.Update(ctx, claims, userID, user.UpdateUser{Roles: roles}, now); err != nil {
+			return auth.Claims{}, errors.Wrapf(err, "updating roles of %s", userID)
+		}
+	}
+
+	return claims, nil
+}
+
+// linkSSO links an account at the identity provider to the user with its
+// email address, or to a new user if nobody has it. It returns the ID of the
+// user.
+func (u *User) linkSSO(ctx context.Context, id oidc.Identity, roles []string, now time.Time) (string, error) {
+	if id.Email == "" {
+		return "", web.NewRequestError(errSSOEmail, http.StatusForbidden)
+	}
+
+	opts := query.Options{Filters: []query.Filter{{Field: "email", Value: id.Email}}}
+	users, _, err := u.st.List(ctx, opts)
+	if err != nil {
+		return "", errors.Wrap(err, "finding user by email")
+	}
+
+	var userID string
+	if len(users) > 0 {
+
+		// Otherwise anyone adding the address to an account at the provider
+		// would take over the user.
+		if !id.EmailVerified {
+			return "", web.NewRequestError(errSSOEmail, http.StatusForbidden)
+		}
+
+		// Service accounts only sign in with API keys.
+		if users[0].ServiceAccount() {
+			return "", web.NewRequestError(user.ErrAuthenticationFailure, http.StatusUnauthorized)
+		}
+		userID = users[0].ID
+	} else {
+
+		// New users sign in with the provider, nobody knows their password
+		// until they reset it.
+		pw, err := randomToken()
+		if err != nil {
+			return "", err
+		}
+		nu := user.NewUser{
+			Name:            id.Name,
+			Email:           id.Email,
+			Roles:           roles,
+			Password:        pw,
+			PasswordConfirm: pw,
+		}
+		if nu.Name == "" {
+			nu.Name = id.Email
+		}
+
+		usr, err := u.st.Create(ctx, nu, now)
+		if err != nil {
+			return "", errors.Wrapf(err, "creating user for %s", id.Email)
+		}
+		userID = usr.ID
+	}
+
+	if err := u.st.LinkIdentity(ctx, id.Issuer, id.Subject, userID, now); err != nil {
+		return "", errors.Wrapf(err, "linking user %s", userID)
+	}
+
+	return userID, nil
+}
+
+// setCookie sets the cookie holding the state of a sign in. A negative
+// maxAge removes it.
+func (s SSO) setCookie(w http.ResponseWriter, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     ssoCookie,
+		Value:    value,
+		Path:     "/v1/users/sso",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(s.Provider.RedirectURL(), "https:"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// sameRoles reports whether both lists hold the same roles.
+func sameRoles(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// randomToken returns a random token for the state or nonce of a sign in.
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "generating token")
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
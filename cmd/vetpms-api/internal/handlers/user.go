@@ -2,9 +2,12 @@ package handlers
 
 import (
 	"context"
+	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/os-foundry/vetpms/internal/platform/auth"
+	"github.com/os-foundry/vetpms/internal/platform/mail"
 	"github.com/os-foundry/vetpms/internal/platform/web"
 	"github.com/os-foundry/vetpms/internal/user"
 	"github.com/pkg/errors"
@@ -16,21 +19,30 @@ type User struct {
 	// db            *sqlx.DB
 	st            user.Storage
 	authenticator *auth.Authenticator
+	mailer        mail.Mailer
+	mfa           MFA
+	lockout       Lockout
+	sso           SSO
 
 	// ADD OTHER STATE LIKE THE LOGGER AND CONFIG HERE.
 }
 
-// List returns all the existing users in the system.
+// List returns a page of the existing users in the system.
 func (u *User) List(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
 	ctx, span := trace.StartSpan(ctx, "handlers.User.List")
 	defer span.End()
 
-	usrs, err := u.st.List(ctx)
+	opts, err := web.DecodeQuery(r, user.QueryFields)
 	if err != nil {
 		return err
 	}
 
-	return web.Respond(ctx, w, usrs, http.StatusOK)
+	usrs, page, err := u.st.List(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	return web.RespondPage(ctx, w, r, usrs, page)
 }
 
 // Retrieve returns the specified user from the system.
@@ -83,13 +95,17 @@ func (u *User) Create(ctx context.Context, w http.ResponseWriter, r *http.Reques
 
 	usr, err := u.st.Create(ctx, nu, v.Now)
 	if err != nil {
+		if err == user.ErrEmailInUse {
+			return web.NewRequestError(err, http.StatusConflict)
+		}
 		return errors.Wrapf(err, "User: %+v", &usr)
 	}
 
 	return web.Respond(ctx, w, usr, http.StatusCreated)
 }
 
-// Update updates the specified user in the system.
+// Update updates the specified user in the system. If the request has an
+// If-Match header the user is only updated if it still has that entity tag.
 func (u *User) Update(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
 	ctx, span := trace.StartSpan(ctx, "handlers.User.Update")
 	defer span.End()
@@ -108,6 +124,7 @@ func (u *User) Update(ctx context.Context, w http.ResponseWriter, r *http.Reques
 	if err := web.Decode(r, &upd); err != nil {
 		return errors.Wrap(err, "")
 	}
+	upd.ETags = web.IfMatch(r)
 
 	err := u.st.Update(ctx, claims, params["id"], upd, v.Now)
 	if err != nil {
@@ -118,6 +135,10 @@ func (u *User) Update(ctx context.Context, w http.ResponseWriter, r *http.Reques
 			return web.NewRequestError(err, http.StatusNotFound)
 		case user.ErrForbidden:
 			return web.NewRequestError(err, http.StatusForbidden)
+		case user.ErrModified:
+			return web.NewRequestError(err, http.StatusPreconditionFailed)
+		case user.ErrEmailInUse:
+			return web.NewRequestError(err, http.StatusConflict)
 		default:
 			return errors.Wrapf(err, "ID: %s  User: %+v", params["id"], &upd)
 		}
@@ -126,12 +147,22 @@ func (u *User) Update(ctx context.Context, w http.ResponseWriter, r *http.Reques
 	return web.Respond(ctx, w, nil, http.StatusNoContent)
 }
 
-// Delete removes the specified user from the system.
+// Delete marks the user identified by an ID in the request URL as deleted.
 func (u *User) Delete(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
 	ctx, span := trace.StartSpan(ctx, "handlers.User.Delete")
 	defer span.End()
 
-	err := u.st.Delete(ctx, params["id"])
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
+	err := u.st.Delete(ctx, claims, params["id"], v.Now)
 	if err != nil {
 		switch err {
 		case user.ErrInvalidID:
@@ -148,8 +179,71 @@ func (u *User) Delete(ctx context.Context, w http.ResponseWriter, r *http.Reques
 	return web.Respond(ctx, w, nil, http.StatusNoContent)
 }
 
+// Restore undoes the deletion of the user identified by an ID in the request
+// URL.
+func (u *User) Restore(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.Restore")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	if err := u.st.Restore(ctx, params["id"], v.Now); err != nil {
+		switch err {
+		case user.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case user.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case user.ErrEmailInUse:
+			return web.NewRequestError(err, http.StatusConflict)
+		default:
+			return errors.Wrapf(err, "Id: %s", params["id"])
+		}
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// RevokeSessions revokes the refresh tokens of the user identified by an ID in
+// the request URL. Their access tokens stop working immediately.
+func (u *User) RevokeSessions(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.RevokeSessions")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	if err := u.st.RevokeRefreshTokens(ctx, params["id"], v.Now); err != nil {
+		switch err {
+		case user.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		default:
+			return errors.Wrapf(err, "Id: %s", params["id"])
+		}
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// errBasicAuth is returned when a user signs in without Basic auth.
+var errBasicAuth = errors.New("must provide email and password in Basic auth")
+
+// tokens is the response of a successful authentication. Recovery codes are
+// included when the user enabled a second factor while signing in.
+type tokens struct {
+	Token         string   `json:"token"`
+	RefreshToken  string   `json:"refresh_token"`
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+}
+
 // Token handles a request to authenticate a user. It expects a request using
-// Basic Auth with a user's email and password. It responds with a JWT.
+// Basic Auth with a user's email and password. It responds with a JWT and a
+// refresh token starting a new session, or with an MFA challenge when the
+// user has to enter a code of their second factor as well.
 func (u *User) Token(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
 	ctx, span := trace.StartSpan(ctx, "handlers.User.Token")
 	defer span.End()
@@ -161,23 +255,107 @@ func (u *User) Token(ctx context.Context, w http.ResponseWriter, r *http.Request
 
 	email, pass, ok := r.BasicAuth()
 	if !ok {
-		err := errors.New("must provide email and password in Basic auth")
-		return web.NewRequestError(err, http.StatusUnauthorized)
+		return web.NewRequestError(errBasicAuth, http.StatusUnauthorized)
+	}
+
+	attempts := u.lockout.attempts(r, email)
+	if err := u.checkLocked(ctx, w, v.Now, attempts); err != nil {
+		return err
 	}
 
 	claims, err := u.st.Authenticate(ctx, v.Now, email, pass)
 	if err != nil {
 		switch err {
 		case user.ErrAuthenticationFailure:
+			if err := u.failLogin(ctx, v.Now, attempts); err != nil {
+				return err
+			}
 			return web.NewRequestError(err, http.StatusUnauthorized)
 		default:
 			return errors.Wrap(err, "authenticating")
 		}
 	}
 
-	var tkn struct {
-		Token string `json:"token"`
+	usr, err := u.st.Retrieve(ctx, claims, claims.Subject)
+	if err != nil {
+		return errors.Wrapf(err, "ID: %s", claims.Subject)
+	}
+	if usr.MFA.Enabled || u.mfa.required(claims) {
+		return u.challenge(ctx, w, usr, v.Now)
+	}
+
+	if err := u.st.ResetLoginAttempts(ctx, user.EmailAttempts(email)); err != nil {
+		return err
+	}
+
+	tkn, err := u.startSession(ctx, claims, device(r, r.Header.Get(deviceHeader)), v.Now)
+	if err != nil {
+		return err
+	}
+
+	return web.Respond(ctx, w, tkn, http.StatusOK)
+}
+
+// deviceHeader is the header clients name the device they sign in on with.
+const deviceHeader = "X-Device-Name"
+
+// device describes the device a request to sign in was sent from, with the
+// name the client gave it.
+func device(r *http.Request, name string) user.Device {
+	return user.NewDevice(name, web.RemoteIP(r), r.UserAgent())
+}
+
+// startSession issues the tokens of a new session on the device with the
+// claims.
+func (u *User) startSession(ctx context.Context, claims auth.Claims, d user.Device, now time.Time) (tokens, error) {
+	rt, refresh, err := user.NewRefreshToken(claims.Subject, d, now)
+	if err != nil {
+		return tokens{}, err
+	}
+	if err := u.st.CreateRefreshToken(ctx, rt); err != nil {
+		return tokens{}, errors.Wrap(err, "starting session")
 	}
+	claims.SessionID = rt.ID
+
+	tkn := tokens{RefreshToken: refresh}
+	tkn.Token, err = u.authenticator.GenerateToken(claims)
+	if err != nil {
+		return tokens{}, errors.Wrap(err, "generating token")
+	}
+
+	return tkn, nil
+}
+
+// Refresh handles a request to exchange a refresh token for a new JWT. The
+// refresh token can only be used once, the response holds the one replacing
+// it.
+func (u *User) Refresh(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.Refresh")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	var req struct {
+		RefreshToken string `json:"refresh_token" validate:"required"`
+	}
+	if err := web.Decode(r, &req); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	claims, refresh, err := u.st.Refresh(ctx, v.Now, req.RefreshToken)
+	if err != nil {
+		switch err {
+		case user.ErrAuthenticationFailure:
+			return web.NewRequestError(err, http.StatusUnauthorized)
+		default:
+			return errors.Wrap(err, "refreshing")
+		}
+	}
+
+	tkn := tokens{RefreshToken: refresh}
 	tkn.Token, err = u.authenticator.GenerateToken(claims)
 	if err != nil {
 		return errors.Wrap(err, "generating token")
@@ -185,3 +363,148 @@ func (u *User) Token(ctx context.Context, w http.ResponseWriter, r *http.Request
 
 	return web.Respond(ctx, w, tkn, http.StatusOK)
 }
+
+// ChangePassword changes the password of the authenticated user. It requires
+// their current password and ends all of their sessions, so they log in again
+// with the new password.
+func (u *User) ChangePassword(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.ChangePassword")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
+	var cp user.ChangePassword
+	if err := web.Decode(r, &cp); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	usr, err := u.st.Retrieve(ctx, claims, claims.Subject)
+	if err != nil {
+		switch err {
+		case user.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "ID: %s", claims.Subject)
+		}
+	}
+
+	if err := usr.CheckPassword(cp.CurrentPassword); err != nil {
+		return web.NewRequestError(err, http.StatusForbidden)
+	}
+
+	if err := u.setPassword(ctx, claims, cp.Password, []string{usr.ETag()}, v.Now); err != nil {
+		return err
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// RequestReset sends a password reset token to the user with the email
+// address in the request. It responds the same whether there is such a user
+// or not, so it doesn't reveal which addresses are known.
+func (u *User) RequestReset(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.RequestReset")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	var req user.RequestReset
+	if err := web.Decode(r, &req); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	usr, tkn, err := u.st.CreateResetToken(ctx, req.Email, v.Now)
+	if err != nil {
+		switch err {
+		case user.ErrNotFound:
+			return web.Respond(ctx, w, nil, http.StatusNoContent)
+		default:
+			return errors.Wrap(err, "creating reset token")
+		}
+	}
+
+	m := mail.Message{
+		To:      usr.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hello %s,\n\n"+
+			"Someone asked to reset the password of your account. Use this token "+
+			"within %v to choose a new password:\n\n%s\n\n"+
+			"If you didn't ask for this you can ignore this email.\n", usr.Name, user.ResetTokenTTL, tkn),
+	}
+	if err := u.mailer.Send(ctx, m); err != nil {
+		return errors.Wrap(err, "sending reset token")
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// ResetPassword sets a new password with a reset token. The token can only be
+// used once, and all sessions of the user are ended.
+func (u *User) ResetPassword(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.ResetPassword")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	var rp user.ResetPassword
+	if err := web.Decode(r, &rp); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	id, err := u.st.UseResetToken(ctx, v.Now, rp.Token)
+	if err != nil {
+		switch err {
+		case user.ErrResetTokenInvalid:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		default:
+			return errors.Wrap(err, "using reset token")
+		}
+	}
+
+	// The token proves who the user is, so the change is made, and recorded
+	// in the audit trail, as if they were authenticated.
+	claims := auth.NewClaims(id, nil, v.Now, time.Minute)
+	ctx = context.WithValue(ctx, auth.Key, claims)
+
+	if err := u.setPassword(ctx, claims, rp.Password, nil, v.Now); err != nil {
+		return err
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// setPassword replaces the password of the user the claims are for and ends
+// all of their sessions. If etags is not nil the user must have one of them.
+func (u *User) setPassword(ctx context.Context, claims auth.Claims, password string, etags []string, now time.Time) error {
+	upd := user.UpdateUser{Password: &password, ETags: etags}
+	if err := u.st.Update(ctx, claims, claims.Subject, upd, now); err != nil {
+		switch err {
+		case user.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case user.ErrModified:
+			return web.NewRequestError(err, http.StatusPreconditionFailed)
+		default:
+			return errors.Wrapf(err, "ID: %s", claims.Subject)
+		}
+	}
+
+	if err := u.st.RevokeRefreshTokens(ctx, claims.Subject, now); err != nil {
+		return errors.Wrapf(err, "ID: %s", claims.Subject)
+	}
+
+	return nil
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"crypto/rsa"
 	"expvar" // Register the expvar handlers
 	"fmt"
 	"io/ioutil"
@@ -11,6 +10,7 @@ import (
 	_ "net/http/pprof" // Register the pprof handlers
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"syscall"
 	"time"
@@ -20,10 +20,20 @@ import (
 	openzipkin "github.com/openzipkin/zipkin-go"
 	zipkinHTTP "github.com/openzipkin/zipkin-go/reporter/http"
 	"github.com/os-foundry/vetpms/cmd/vetpms-api/internal/handlers"
+	"github.com/os-foundry/vetpms/internal/audit"
+	auditBolt "github.com/os-foundry/vetpms/internal/audit/bolt"
+	auditPq "github.com/os-foundry/vetpms/internal/audit/postgres"
+	"github.com/os-foundry/vetpms/internal/backup"
 	"github.com/os-foundry/vetpms/internal/platform/auth"
 	"github.com/os-foundry/vetpms/internal/platform/conf"
 	"github.com/os-foundry/vetpms/internal/platform/database"
+	"github.com/os-foundry/vetpms/internal/platform/health"
 	"github.com/os-foundry/vetpms/internal/platform/logtracer"
+	"github.com/os-foundry/vetpms/internal/platform/mail"
+	"github.com/os-foundry/vetpms/internal/platform/oidc"
+	"github.com/os-foundry/vetpms/internal/platform/ratelimit"
+	"github.com/os-foundry/vetpms/internal/platform/seal"
+	"github.com/os-foundry/vetpms/internal/platform/web"
 	"github.com/os-foundry/vetpms/internal/product"
 	productBolt "github.com/os-foundry/vetpms/internal/product/bolt"
 	productPq "github.com/os-foundry/vetpms/internal/product/postgres"
@@ -88,16 +98,85 @@ func run() error {
 			File        string        `conf:"default:/opt/vetpms/data/vetpms.db"`
 			Permissions os.FileMode   `conf:"default:0660"`
 			Timeout     time.Duration `conf:"default:1s"`
+			MinFree     uint64        `conf:"default:104857600"` // Free bytes required on the disk of File
 		}
 		Auth struct {
 			KeyID          string `conf:"default:1"`
 			PrivateKeyFile string `conf:"default:/app/private.pem"`
+			KeyDir         string // Replaces KeyID and PrivateKeyFile when set
 			Algorithm      string `conf:"default:RS256"`
+
+			// Requirements of new passwords. The denylist is a file with one
+			// password per line.
+			PasswordMinLength int `conf:"default:8"`
+			PasswordDenylist  string
+
+			// Two-factor authentication is available when a key to seal the
+			// secrets with is set, a base64 encoded 32 byte key. Users with
+			// one of MFARoles must use it.
+			MFAKey    string `conf:"noprint"`
+			MFAIssuer string `conf:"default:VetPMS"`
+			MFARoles  []string
+
+			// Failed sign ins lock the email address after LockoutThreshold
+			// and the IP address after LockoutIPThreshold failures, for
+			// LockoutDelay doubling with every further failure.
+			LockoutThreshold   int           `conf:"default:5"`
+			LockoutIPThreshold int           `conf:"default:20"`
+			LockoutDelay       time.Duration `conf:"default:1m"`
+			LockoutMaxDelay    time.Duration `conf:"default:1h"`
+		}
+		OIDC struct {
+			// Staff sign in with the OpenID Connect provider of Issuer when
+			// it is set. The client must be registered with the provider,
+			// with RedirectURL pointing at /v1/users/sso/callback.
+			Issuer       string
+			ClientID     string
+			ClientSecret string `conf:"noprint"`
+			RedirectURL  string
+			Scopes       []string // openid, email and profile when empty
+
+			// RoleMap maps values of RoleClaim to roles as value=role, * maps
+			// every account. Accounts without a role can't sign in.
+			RoleClaim string `conf:"default:groups"`
+			RoleMap   []string
+		}
+		CORS struct {
+			// Origins browser clients may call the API from, * allows any
+			// but can't be combined with credentials.
+			// Empty methods allow those of each route, empty headers the
+			// ones the API reads.
+			AllowedOrigins   []string
+			AllowedMethods   []string
+			AllowedHeaders   []string
+			AllowCredentials bool          `conf:"default:false"`
+			MaxAge           time.Duration `conf:"default:10m"`
+		}
+		RateLimit struct {
+			// Memory limits each instance on its own, postgres shares the
+			// quotas between all instances using the database.
+			Backend string `conf:"default:memory"`
+
+			// Quotas of the form limit/duration, 0 doesn't limit. Auth
+			// limits signing in per IP address, API the authenticated
+			// routes per user.
+			Auth string `conf:"default:20/1m"`
+			API  string `conf:"default:600/1m"`
+		}
+		Mail struct {
+			Addr     string // Password resets are disabled when empty
+			From     string `conf:"default:vetpms@localhost"`
+			User     string
+			Password string `conf:"noprint"`
+		}
+		Audit struct {
+			Clinic string `conf:"default:main"`
 		}
 		Zipkin struct {
 			Enabled       bool    `conf:"default:false"`
 			LocalEndpoint string  `conf:"default:0.0.0.0:3000"`
 			ReporterURI   string  `conf:"default:http://zipkin:9411/api/v2/spans"`
+			HealthURI     string  `conf:"default:http://zipkin:9411/health"`
 			ServiceName   string  `conf:"default:vetpms-api"`
 			Probability   float64 `conf:"default:0.05"`
 		}
@@ -118,6 +197,9 @@ func run() error {
 	// =========================================================================
 	// App Starting
 
+	// Remember when the service started to report its uptime.
+	start := time.Now()
+
 	// Print the build version for our logs. Also expose it under /debug/vars.
 	expvar.NewString("build").Set(build)
 	log.Printf("main : Started : Application initializing : version %q", build)
@@ -134,22 +216,114 @@ func run() error {
 
 	log.Println("main : Started : Initializing authentication support")
 
-	keyContents, err := ioutil.ReadFile(cfg.Auth.PrivateKeyFile)
-	if err != nil {
-		return errors.Wrap(err, "reading auth private key")
-	}
+	// A key directory holds the active key and the keys it replaced, which
+	// still verify the tokens they signed.
+	var keys *auth.KeyStore
+	if cfg.Auth.KeyDir != "" {
+		var err error
+		if keys, err = auth.LoadKeyDir(cfg.Auth.KeyDir); err != nil {
+			return errors.Wrap(err, "loading auth keys")
+		}
+	} else {
+		keyContents, err := ioutil.ReadFile(cfg.Auth.PrivateKeyFile)
+		if err != nil {
+			return errors.Wrap(err, "reading auth private key")
+		}
 
-	privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(keyContents)
-	if err != nil {
-		return errors.Wrap(err, "parsing auth private key")
+		privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(keyContents)
+		if err != nil {
+			return errors.Wrap(err, "parsing auth private key")
+		}
+		keys = auth.NewKeyStore(cfg.Auth.KeyID, privateKey)
 	}
 
-	f := auth.NewSimpleKeyLookupFunc(cfg.Auth.KeyID, privateKey.Public().(*rsa.PublicKey))
-	authenticator, err := auth.NewAuthenticator(privateKey, cfg.Auth.KeyID, cfg.Auth.Algorithm, f)
+	kid, privateKey := keys.Active()
+	log.Printf("main : Started : Signing tokens with key %q", kid)
+	authenticator, err := auth.NewAuthenticator(privateKey, kid, cfg.Auth.Algorithm, keys.PublicKey)
 	if err != nil {
 		return errors.Wrap(err, "constructing authenticator")
 	}
 
+	policy := user.PasswordPolicy{MinLength: cfg.Auth.PasswordMinLength}
+	if cfg.Auth.PasswordDenylist != "" {
+		if policy.Denylist, err = user.LoadDenylist(cfg.Auth.PasswordDenylist); err != nil {
+			return err
+		}
+	}
+	user.SetPasswordPolicy(policy)
+
+	mfa := handlers.MFA{Issuer: cfg.Auth.MFAIssuer, Roles: cfg.Auth.MFARoles}
+	if cfg.Auth.MFAKey != "" {
+		key, err := seal.ParseKey(cfg.Auth.MFAKey)
+		if err != nil {
+			return errors.Wrap(err, "parsing mfa key")
+		}
+		if mfa.Box, err = seal.NewBox(key); err != nil {
+			return errors.Wrap(err, "parsing mfa key")
+		}
+	} else if len(mfa.Roles) > 0 {
+		return errors.New("requiring two-factor authentication needs an mfa key")
+	}
+
+	lockout := handlers.Lockout{
+		Account: user.LockoutPolicy{Threshold: cfg.Auth.LockoutThreshold, Delay: cfg.Auth.LockoutDelay, MaxDelay: cfg.Auth.LockoutMaxDelay},
+		IP:      user.LockoutPolicy{Threshold: cfg.Auth.LockoutIPThreshold, Delay: cfg.Auth.LockoutDelay, MaxDelay: cfg.Auth.LockoutMaxDelay},
+	}
+
+	var limits handlers.RateLimits
+	if limits.Auth, err = ratelimit.ParseQuota(cfg.RateLimit.Auth); err != nil {
+		return errors.Wrap(err, "parsing auth rate limit")
+	}
+	if limits.API, err = ratelimit.ParseQuota(cfg.RateLimit.API); err != nil {
+		return errors.Wrap(err, "parsing api rate limit")
+	}
+	switch strings.ToLower(cfg.RateLimit.Backend) {
+	case "memory":
+		limits.Limiter = ratelimit.NewMemory()
+	case "postgres":
+		if strings.ToLower(cfg.DB.Type) != "postgres" {
+			return errors.New("sharing rate limits needs a postgres database")
+		}
+	default:
+		return errors.Errorf("unknown rate limit backend %q", cfg.RateLimit.Backend)
+	}
+
+	var sso handlers.SSO
+	if cfg.OIDC.Issuer != "" {
+		sso.Provider, err = oidc.NewProvider(oidc.Config{
+			Issuer:       cfg.OIDC.Issuer,
+			ClientID:     cfg.OIDC.ClientID,
+			ClientSecret: cfg.OIDC.ClientSecret,
+			RedirectURL:  cfg.OIDC.RedirectURL,
+			Scopes:       cfg.OIDC.Scopes,
+		})
+		if err != nil {
+			return errors.Wrap(err, "configuring oidc")
+		}
+		if sso.Roles, err = oidc.ParseRoleMap(cfg.OIDC.RoleMap); err != nil {
+			return errors.Wrap(err, "parsing oidc role map")
+		}
+		for _, roles := range sso.Roles {
+			for _, r := range roles {
+				if r != auth.RoleAdmin && r != auth.RoleUser {
+					return errors.Errorf("oidc role map has unknown role %q", r)
+				}
+			}
+		}
+		sso.RoleClaim = cfg.OIDC.RoleClaim
+	}
+
+	cors := web.CORS{
+		AllowedOrigins:   cfg.CORS.AllowedOrigins,
+		AllowedMethods:   cfg.CORS.AllowedMethods,
+		AllowedHeaders:   cfg.CORS.AllowedHeaders,
+		AllowCredentials: cfg.CORS.AllowCredentials,
+		MaxAge:           cfg.CORS.MaxAge,
+	}
+	if err := cors.Validate(); err != nil {
+		return err
+	}
+
 	// =========================================================================
 	// Start Database and initialize storages
 
@@ -158,6 +332,17 @@ func run() error {
 	var (
 		ust user.Storage
 		pst product.Storage
+		ast audit.Storage
+
+		// snapshot keeps backups consistent while requests write.
+		snapshot backup.Snapshot
+
+		// uow makes changes that span storages atomic.
+		uow database.UnitOfWork
+
+		// checks are the dependencies readiness depends on besides the
+		// storages.
+		checks = map[string]database.StatusChecker{}
 	)
 	switch strings.ToLower(cfg.DB.Type) {
 
@@ -175,6 +360,12 @@ func run() error {
 
 		ust = userPq.Postgres{db}
 		pst = productPq.Postgres{db}
+		ast = auditPq.Postgres{db}
+		snapshot = database.PqSnapshot(db)
+		uow = database.PqUnitOfWork(db)
+		if limits.Limiter == nil {
+			limits.Limiter = ratelimit.NewPostgres(db)
+		}
 
 		defer func() {
 			log.Printf("main : Database Stopping : %s", cfg.DB.Host)
@@ -193,6 +384,10 @@ func run() error {
 
 		ust = userBolt.Bolt{db}
 		pst = productBolt.Bolt{db}
+		ast = auditBolt.Bolt{db}
+		snapshot = database.BoltSnapshot(db)
+		uow = database.BoltUnitOfWork(db)
+		checks["disk"] = health.DiskSpace{Path: filepath.Dir(cfg.DB.File), MinFree: cfg.DB.MinFree}
 
 		defer func() {
 			log.Printf("main : Database Stopping : %s", cfg.DB.Host)
@@ -200,6 +395,12 @@ func run() error {
 		}()
 	}
 
+	// Record every mutation of users and products in the audit trail, in the
+	// same transaction as the mutation.
+	trail := audit.Trail{Storage: ast, Clinic: cfg.Audit.Clinic, UnitOfWork: uow}
+	ust = user.Audited{Storage: ust, Trail: trail}
+	pst = product.Audited{Storage: pst, Trail: trail}
+
 	// =========================================================================
 	// Start Tracing Support
 
@@ -214,6 +415,7 @@ func run() error {
 		ze := zipkin.NewExporter(reporter, localEndpoint)
 
 		trace.RegisterExporter(ze)
+		checks["tracing"] = health.Endpoint{URL: cfg.Zipkin.HealthURI, Client: &http.Client{Timeout: time.Second}}
 		trace.ApplyConfig(trace.Config{
 			DefaultSampler: trace.ProbabilitySampler(cfg.Zipkin.Probability),
 		})
@@ -254,9 +456,33 @@ func run() error {
 	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
 
+	h := handlers.Health{Build: build, Start: start, Checks: checks}
+
+	// Reset tokens are only ever mailed, so resets need a mail server.
+	var mailer mail.Mailer
+	if cfg.Mail.Addr != "" {
+		mailer = mail.SMTP{Addr: cfg.Mail.Addr, From: cfg.Mail.From, User: cfg.Mail.User, Password: cfg.Mail.Password}
+	} else {
+		log.Println("main : No mail server configured : Password resets disabled")
+	}
+
 	api := http.Server{
-		Addr:         cfg.Web.APIHost,
-		Handler:      handlers.API(shutdown, log, ust, pst, authenticator),
+		Addr: cfg.Web.APIHost,
+		Handler: handlers.API(shutdown, log, handlers.Config{
+			Health:        h,
+			Users:         ust,
+			Products:      pst,
+			Audit:         ast,
+			Snapshot:      snapshot,
+			Authenticator: authenticator,
+			Keys:          keys,
+			Mailer:        mailer,
+			MFA:           mfa,
+			Lockout:       lockout,
+			RateLimits:    limits,
+			CORS:          cors,
+			SSO:           sso,
+		}),
 		ReadTimeout:  cfg.Web.ReadTimeout,
 		WriteTimeout: cfg.Web.WriteTimeout,
 	}
@@ -0,0 +1,66 @@
+package tests
+
+import (
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/os-foundry/vetpms/cmd/vetpms-api/internal/handlers"
+	"github.com/os-foundry/vetpms/internal/audit"
+	auditBolt "github.com/os-foundry/vetpms/internal/audit/bolt"
+	auditPq "github.com/os-foundry/vetpms/internal/audit/postgres"
+	"github.com/os-foundry/vetpms/internal/platform/database"
+	"github.com/os-foundry/vetpms/internal/platform/mail"
+	"github.com/os-foundry/vetpms/internal/product"
+	productBolt "github.com/os-foundry/vetpms/internal/product/bolt"
+	productPq "github.com/os-foundry/vetpms/internal/product/postgres"
+	"github.com/os-foundry/vetpms/internal/tests"
+	"github.com/os-foundry/vetpms/internal/user"
+	userBolt "github.com/os-foundry/vetpms/internal/user/bolt"
+	userPq "github.com/os-foundry/vetpms/internal/user/postgres"
+)
+
+// apiConfig returns the dependencies of the API on the storages of the test
+// case, postgres or bolt. Mail is logged and the optional features are
+// disabled, tests set the ones they cover.
+func apiConfig(t *testing.T, test *tests.Test, tc string) handlers.Config {
+	t.Helper()
+
+	cfg := handlers.Config{
+		Authenticator: test.Authenticator,
+		Keys:          test.Keys,
+		Mailer:        mail.Log{test.Log},
+	}
+
+	switch tc {
+	case "postgres":
+		cfg.Users = userPq.Postgres{test.Pq}
+		cfg.Products = productPq.Postgres{test.Pq}
+		cfg.Audit = auditPq.Postgres{test.Pq}
+		cfg.Snapshot = database.PqSnapshot(test.Pq)
+	case "bolt":
+		cfg.Users = userBolt.Bolt{test.Bolt}
+		cfg.Products = productBolt.Bolt{test.Bolt}
+		cfg.Audit = auditBolt.Bolt{test.Bolt}
+		cfg.Snapshot = database.BoltSnapshot(test.Bolt)
+	default:
+		t.Fatalf("test case should be bolt or postgres")
+	}
+
+	return cfg
+}
+
+// audited records the changes to users and products of the config in its
+// audit trail.
+func audited(cfg handlers.Config) handlers.Config {
+	trail := audit.Trail{Storage: cfg.Audit}
+	cfg.Users = user.Audited{Storage: cfg.Users, Trail: trail}
+	cfg.Products = product.Audited{Storage: cfg.Products, Trail: trail}
+	return cfg
+}
+
+// newAPI constructs the routes of the API with the config.
+func newAPI(test *tests.Test, cfg handlers.Config) http.Handler {
+	shutdown := make(chan os.Signal, 1)
+	return handlers.API(shutdown, test.Log, cfg)
+}
@@ -0,0 +1,119 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/os-foundry/vetpms/internal/platform/auth"
+	"github.com/os-foundry/vetpms/internal/tests"
+	"github.com/os-foundry/vetpms/internal/user"
+)
+
+// TestAPIKeys validates integrations can call the API with a key limited to
+// its scopes until the key is deleted.
+func TestAPIKeys(t *testing.T) {
+	tt := []string{"postgres", "bolt"}
+	for _, tc := range tt {
+		test := tests.NewIntegration(t, tc)
+		defer test.Teardown()
+
+		handler := newAPI(test, apiConfig(t, test, tc))
+
+		ut := UserTests{
+			app:        handler,
+			userToken:  test.Token("user@example.com", "gophers"),
+			adminToken: test.Token("admin@example.com", "gophers"),
+		}
+
+		// withKey serves a request authenticated by the header set by auth.
+		withKey := func(method, url string, auth func(r *http.Request)) *httptest.ResponseRecorder {
+			r := httptest.NewRequest(method, url, nil)
+			auth(r)
+			w := httptest.NewRecorder()
+			ut.app.ServeHTTP(w, r)
+			return w
+		}
+
+		t.Log("Given the need to let integrations call the API.")
+		{
+			var created struct {
+				ID  string `json:"id"`
+				Key string `json:"key"`
+			}
+
+			t.Log("\tTest 0:\tWhen an admin creates a key.")
+			{
+				n := user.NewAPIKey{
+					UserID: tests.UserID,
+					Name:   "Stock sync",
+					Scopes: []string{auth.ScopeProductsRead},
+				}
+				w := ut.serve(t, "POST", "/v1/apikeys", ut.adminToken, n)
+				if w.Code != http.StatusCreated {
+					t.Fatalf("\t%s\tShould receive a status code of 201 for the response : %v %s", tests.Failed, w.Code, w.Body)
+				}
+				if err := json.NewDecoder(w.Body).Decode(&created); err != nil || created.Key == "" {
+					t.Fatalf("\t%s\tShould receive the key : %v", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould receive the key.", tests.Success)
+
+				if w := ut.serve(t, "POST", "/v1/apikeys", ut.userToken, n); w.Code != http.StatusForbidden {
+					t.Fatalf("\t%s\tShould not let users create keys : %v", tests.Failed, w.Code)
+				}
+				t.Logf("\t%s\tShould not let users create keys.", tests.Success)
+
+				w = ut.serve(t, "GET", "/v1/apikeys?limit=1&user_id="+tests.UserID, ut.adminToken, nil)
+				var keys []user.APIKey
+				if w.Code != http.StatusOK {
+					t.Fatalf("\t%s\tShould receive a status code of 200 for the list : %v %s", tests.Failed, w.Code, w.Body)
+				}
+				if err := json.NewDecoder(w.Body).Decode(&keys); err != nil || len(keys) != 1 || keys[0].ID != created.ID {
+					t.Fatalf("\t%s\tShould list the key : %+v %v", tests.Failed, keys, err)
+				}
+				if cursor := w.Header().Get("X-Next-Cursor"); cursor != "" {
+					t.Fatalf("\t%s\tShould not get a next page : %q", tests.Failed, cursor)
+				}
+				t.Logf("\t%s\tShould list the key.", tests.Success)
+			}
+
+			t.Log("\tTest 1:\tWhen an integration uses the key.")
+			{
+				headers := map[string]func(r *http.Request){
+					"X-API-Key":     func(r *http.Request) { r.Header.Set("X-API-Key", created.Key) },
+					"Authorization": func(r *http.Request) { r.Header.Set("Authorization", "ApiKey "+created.Key) },
+				}
+				for name, h := range headers {
+					if w := withKey("GET", "/v1/products", h); w.Code != http.StatusOK {
+						t.Fatalf("\t%s\tShould read products with the %s header : %v %s", tests.Failed, name, w.Code, w.Body)
+					}
+					t.Logf("\t%s\tShould read products with the %s header.", tests.Success, name)
+				}
+
+				w := withKey("POST", "/v1/products", func(r *http.Request) { r.Header.Set("X-API-Key", created.Key) })
+				if w.Code != http.StatusForbidden {
+					t.Fatalf("\t%s\tShould not write products without the scope : %v", tests.Failed, w.Code)
+				}
+				t.Logf("\t%s\tShould not write products without the scope.", tests.Success)
+
+				if w := withKey("GET", "/v1/users", func(r *http.Request) { r.Header.Set("X-API-Key", "vpk_nope") }); w.Code != http.StatusUnauthorized {
+					t.Fatalf("\t%s\tShould refuse an unknown key : %v", tests.Failed, w.Code)
+				}
+				t.Logf("\t%s\tShould refuse an unknown key.", tests.Success)
+			}
+
+			t.Log("\tTest 2:\tWhen an admin deletes the key.")
+			{
+				if w := ut.serve(t, "DELETE", "/v1/apikeys/"+created.ID, ut.adminToken, nil); w.Code != http.StatusNoContent {
+					t.Fatalf("\t%s\tShould receive a status code of 204 for the response : %v", tests.Failed, w.Code)
+				}
+				w := withKey("GET", "/v1/products", func(r *http.Request) { r.Header.Set("X-API-Key", created.Key) })
+				if w.Code != http.StatusUnauthorized {
+					t.Fatalf("\t%s\tShould refuse the key : %v", tests.Failed, w.Code)
+				}
+				t.Logf("\t%s\tShould refuse the key.", tests.Success)
+			}
+		}
+	}
+}
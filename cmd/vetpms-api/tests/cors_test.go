@@ -0,0 +1,140 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/os-foundry/vetpms/internal/platform/web"
+	"github.com/os-foundry/vetpms/internal/tests"
+)
+
+// TestCORS validates browsers may call the API from the allowed origins.
+func TestCORS(t *testing.T) {
+	cors := web.CORS{
+		AllowedOrigins:   []string{"https://desk.example.com"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	}
+
+	tt := []string{"postgres", "bolt"}
+	for _, tc := range tt {
+		test := tests.NewIntegration(t, tc)
+		defer test.Teardown()
+
+		cfg := apiConfig(t, test, tc)
+		cfg.CORS = cors
+		handler := newAPI(test, cfg)
+
+		// preflight returns the response to a preflight request.
+		preflight := func(origin, method, headers string) *httptest.ResponseRecorder {
+			r := httptest.NewRequest("OPTIONS", "/v1/users/"+tests.UserID, nil)
+			r.Header.Set("Origin", origin)
+			r.Header.Set("Access-Control-Request-Method", method)
+			r.Header.Set("Access-Control-Request-Headers", headers)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			return w
+		}
+
+		t.Log("Given the need to call the API from browsers.")
+		{
+			t.Log("\tTest 0:\tWhen a browser asks to call a route from an allowed origin.")
+			{
+				w := preflight("https://desk.example.com", "PUT", "Authorization, Content-Type")
+				if w.Code != http.StatusNoContent {
+					t.Fatalf("\t%s\tShould receive a status code of 204 for the response : %v", tests.Failed, w.Code)
+				}
+				t.Logf("\t%s\tShould receive a status code of 204 for the response.", tests.Success)
+
+				want := map[string]string{
+					"Access-Control-Allow-Origin":      "https://desk.example.com",
+					"Access-Control-Allow-Methods":     "DELETE, GET, PUT",
+					"Access-Control-Allow-Headers":     "Authorization, Content-Type",
+					"Access-Control-Allow-Credentials": "true",
+					"Access-Control-Max-Age":           "600",
+				}
+				for k, v := range want {
+					if got := w.Header().Get(k); got != v {
+						t.Fatalf("\t%s\tShould allow the call : %s is %q, want %q", tests.Failed, k, got, v)
+					}
+				}
+				t.Logf("\t%s\tShould allow the call.", tests.Success)
+			}
+
+			t.Log("\tTest 1:\tWhen a browser asks for what isn't allowed.")
+			{
+				tt := []struct {
+					name                    string
+					origin, method, headers string
+				}{
+					{"an origin", "https://evil.example.com", "GET", ""},
+					{"a method", "https://desk.example.com", "POST", ""},
+					{"a header", "https://desk.example.com", "GET", "X-Secret"},
+				}
+				for _, tc := range tt {
+					w := preflight(tc.origin, tc.method, tc.headers)
+					if w.Header().Get("Access-Control-Allow-Methods") != "" {
+						t.Fatalf("\t%s\tShould not allow %s.", tests.Failed, tc.name)
+					}
+					t.Logf("\t%s\tShould not allow %s.", tests.Success, tc.name)
+				}
+			}
+
+			t.Log("\tTest 2:\tWhen a browser calls a route from an allowed origin.")
+			{
+				r := httptest.NewRequest("GET", "/v1/user", nil)
+				r.Header.Set("Origin", "https://desk.example.com")
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, r)
+
+				if w.Code != http.StatusUnauthorized {
+					t.Fatalf("\t%s\tShould receive a status code of 401 for the response : %v", tests.Failed, w.Code)
+				}
+				if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://desk.example.com" {
+					t.Fatalf("\t%s\tShould let the browser read errors : %q", tests.Failed, got)
+				}
+				t.Logf("\t%s\tShould let the browser read errors.", tests.Success)
+			}
+
+			t.Log("\tTest 3:\tWhen a client asks for the methods of a route.")
+			{
+				r := httptest.NewRequest("OPTIONS", "/v1/products", nil)
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, r)
+
+				if w.Code != http.StatusNoContent || w.Header().Get("Allow") != "GET, POST, OPTIONS" {
+					t.Fatalf("\t%s\tShould list the methods : %v %q", tests.Failed, w.Code, w.Header().Get("Allow"))
+				}
+				t.Logf("\t%s\tShould list the methods.", tests.Success)
+			}
+
+			t.Log("\tTest 4:\tWhen any origin is allowed with credentials.")
+			{
+				wildcard := cors
+				wildcard.AllowedOrigins = []string{"*", "https://desk.example.com"}
+				if err := wildcard.Validate(); err != web.ErrCORSWildcardCredentials {
+					t.Fatalf("\t%s\tShould refuse the configuration : %v", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould refuse the configuration.", tests.Success)
+
+				cfg := apiConfig(t, test, tc)
+				cfg.CORS = wildcard
+				handler := newAPI(test, cfg)
+
+				for origin, want := range map[string]string{"https://evil.example.com": "", "https://desk.example.com": "https://desk.example.com"} {
+					r := httptest.NewRequest("GET", "/v1/health/live", nil)
+					r.Header.Set("Origin", origin)
+					w := httptest.NewRecorder()
+					handler.ServeHTTP(w, r)
+
+					if got := w.Header().Get("Access-Control-Allow-Origin"); got != want {
+						t.Fatalf("\t%s\tShould only allow the listed origins : %s got %q", tests.Failed, origin, got)
+					}
+				}
+				t.Logf("\t%s\tShould only allow the listed origins.", tests.Success)
+			}
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/os-foundry/vetpms/internal/platform/web"
+	"github.com/os-foundry/vetpms/internal/tests"
+)
+
+// TestErrorCodes validates errors are sent with stable codes and every code
+// is documented.
+func TestErrorCodes(t *testing.T) {
+	tt := []string{"postgres", "bolt"}
+	for _, tc := range tt {
+		test := tests.NewIntegration(t, tc)
+		defer test.Teardown()
+
+		handler := newAPI(test, apiConfig(t, test, tc))
+
+		ut := UserTests{
+			app:        handler,
+			userToken:  test.Token("user@example.com", "gophers"),
+			adminToken: test.Token("admin@example.com", "gophers"),
+		}
+
+		var documented map[string]web.ErrorCode
+
+		t.Log("Given the need to react to errors programmatically.")
+		{
+			t.Log("\tTest 0:\tWhen listing the codes of the errors.")
+			{
+				w := ut.serve(t, "GET", "/v1/errors", "", nil)
+				if w.Code != http.StatusOK {
+					t.Fatalf("\t%s\tShould receive a status code of 200 for the response : %v", tests.Failed, w.Code)
+				}
+				t.Logf("\t%s\tShould receive a status code of 200 for the response.", tests.Success)
+
+				var list []web.ErrorCode
+				if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+					t.Fatalf("\t%s\tShould be able to unmarshal the codes : %v", tests.Failed, err)
+				}
+				documented = make(map[string]web.ErrorCode)
+				for _, ec := range list {
+					if ec.Description == "" {
+						t.Fatalf("\t%s\tShould describe every code : %q", tests.Failed, ec.Code)
+					}
+					documented[ec.Code] = ec
+				}
+				t.Logf("\t%s\tShould describe every code.", tests.Success)
+
+				ec := documented["user.not_found"]
+				if ec.Messages["en"] != "User not found" || ec.Messages["nl"] != "Gebruiker niet gevonden" || ec.Messages["bg"] == "" {
+					t.Fatalf("\t%s\tShould list the messages of a code in every language : %+v", tests.Failed, ec)
+				}
+				t.Logf("\t%s\tShould list the messages of a code in every language.", tests.Success)
+			}
+
+			t.Log("\tTest 1:\tWhen requests fail.")
+			{
+				cases := []struct {
+					name   string
+					method string
+					url    string
+					token  string
+					body   interface{}
+					status int
+					code   string
+				}{
+					{"of a domain", "GET", "/v1/users/a224a8d6-3f9e-4b11-9900-e81a25d80702", ut.adminToken, nil, http.StatusNotFound, "user.not_found"},
+					{"of the middleware", "GET", "/v1/users", ut.userToken, nil, http.StatusForbidden, "auth.forbidden"},
+					{"of validation", "POST", "/v1/products", ut.userToken, map[string]string{}, http.StatusBadRequest, "validation.failed"},
+					{"without a code of their own", "GET", "/v1/user", "invalid", nil, http.StatusUnauthorized, "request.unauthorized"},
+				}
+				for _, c := range cases {
+					w := ut.serve(t, c.method, c.url, c.token, c.body)
+					if w.Code != c.status {
+						t.Fatalf("\t%s\tShould receive a status code of %d for errors %s : %v", tests.Failed, c.status, c.name, w.Code)
+					}
+
+					var got web.ErrorResponse
+					if err := json.NewDecoder(w.Body).Decode(&got); err != nil || got.Code != c.code {
+						t.Fatalf("\t%s\tShould send the code of errors %s : %q, %v", tests.Failed, c.name, got.Code, err)
+					}
+					if _, ok := documented[got.Code]; !ok {
+						t.Fatalf("\t%s\tShould document the code of errors %s : %q", tests.Failed, c.name, got.Code)
+					}
+					t.Logf("\t%s\tShould send the documented code of errors %s.", tests.Success, c.name)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/os-foundry/vetpms/cmd/vetpms-api/internal/handlers"
+	"github.com/os-foundry/vetpms/internal/platform/database"
+	"github.com/os-foundry/vetpms/internal/tests"
+)
+
+// checkerFunc adapts a function to a database.StatusChecker.
+type checkerFunc func(ctx context.Context) error
+
+func (f checkerFunc) StatusCheck(ctx context.Context) error { return f(ctx) }
+
+// TestHealth validates the liveness and readiness checks.
+func TestHealth(t *testing.T) {
+	tt := []string{"postgres", "bolt"}
+	for _, tc := range tt {
+		test := tests.NewIntegration(t, tc)
+		defer test.Teardown()
+
+		// api constructs the handler with an additional component.
+		api := func(name string, c database.StatusChecker) http.Handler {
+			h := handlers.Health{
+				Build:  "test",
+				Start:  time.Now(),
+				Checks: map[string]database.StatusChecker{name: c},
+			}
+			cfg := apiConfig(t, test, tc)
+			cfg.Health = h
+			return newAPI(test, cfg)
+		}
+
+		ok := api("disk", checkerFunc(func(ctx context.Context) error { return nil }))
+		failing := api("tracing", checkerFunc(func(ctx context.Context) error { return errors.New("unreachable") }))
+
+		t.Log("Given the need to report the health of the service.")
+		{
+			var resp struct {
+				Status     string `json:"status"`
+				Build      string `json:"build"`
+				Components []struct {
+					Name   string `json:"name"`
+					Status string `json:"status"`
+					Error  string `json:"error"`
+				} `json:"components"`
+			}
+
+			get := func(app http.Handler, url string, status int) {
+				t.Helper()
+				r := httptest.NewRequest("GET", url, nil)
+				w := httptest.NewRecorder()
+				app.ServeHTTP(w, r)
+
+				if w.Code != status {
+					t.Fatalf("\t%s\tShould receive a status code of %d for the response : %v", tests.Failed, status, w.Code)
+				}
+				t.Logf("\t%s\tShould receive a status code of %d for the response.", tests.Success, status)
+
+				resp.Components = nil
+				if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+					t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+				}
+			}
+
+			t.Log("\tTest 0:\tWhen checking whether the service is alive.")
+			{
+				get(failing, "/v1/health/live", http.StatusOK)
+				if resp.Status != "ok" || resp.Build != "test" || len(resp.Components) != 0 {
+					t.Fatalf("\t%s\tShould report the build without checking components : %+v.", tests.Failed, resp)
+				}
+				t.Logf("\t%s\tShould report the build without checking components.", tests.Success)
+			}
+
+			t.Log("\tTest 1:\tWhen all components are ready.")
+			{
+				get(ok, "/v1/health/ready", http.StatusOK)
+				if len(resp.Components) != 3 || resp.Components[0].Name != "disk" || resp.Components[1].Name != "products" || resp.Components[2].Name != "users" {
+					t.Fatalf("\t%s\tShould report every component : %+v.", tests.Failed, resp.Components)
+				}
+				for _, c := range resp.Components {
+					if c.Status != "ok" {
+						t.Fatalf("\t%s\tShould report every component : %+v.", tests.Failed, resp.Components)
+					}
+				}
+				t.Logf("\t%s\tShould report every component.", tests.Success)
+			}
+
+			t.Log("\tTest 2:\tWhen a component is not ready.")
+			{
+				get(failing, "/v1/health/ready", http.StatusServiceUnavailable)
+				if resp.Status != "not ready" || resp.Components[0].Name != "products" || resp.Components[1].Status != "failed" || resp.Components[1].Error != "unreachable" {
+					t.Fatalf("\t%s\tShould report the failed component : %+v.", tests.Failed, resp)
+				}
+				t.Logf("\t%s\tShould report the failed component.", tests.Success)
+			}
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/os-foundry/vetpms/cmd/vetpms-api/internal/handlers"
+	"github.com/os-foundry/vetpms/internal/tests"
+	"github.com/os-foundry/vetpms/internal/user"
+)
+
+// TestLockout validates failed sign ins lock the account until an admin
+// unlocks it.
+func TestLockout(t *testing.T) {
+	lockout := handlers.Lockout{
+		Account: user.LockoutPolicy{Threshold: 3, Delay: time.Hour, MaxDelay: time.Hour},
+		IP:      user.LockoutPolicy{Threshold: 100, Delay: time.Hour, MaxDelay: time.Hour},
+	}
+
+	tt := []string{"postgres", "bolt"}
+	for _, tc := range tt {
+		test := tests.NewIntegration(t, tc)
+		defer test.Teardown()
+
+		cfg := apiConfig(t, test, tc)
+		cfg.Lockout = lockout
+		handler := newAPI(test, cfg)
+
+		ut := UserTests{
+			app:        handler,
+			adminToken: test.Token("admin@example.com", "gophers"),
+		}
+
+		// signIn returns the response of signing in.
+		signIn := func(email, password string) *httptest.ResponseRecorder {
+			r := httptest.NewRequest("GET", "/v1/users/token", nil)
+			r.SetBasicAuth(email, password)
+			w := httptest.NewRecorder()
+			ut.app.ServeHTTP(w, r)
+			return w
+		}
+
+		t.Log("Given the need to stop passwords from being guessed.")
+		{
+			t.Log("\tTest 0:\tWhen the password of a user is guessed.")
+			{
+				for i := 0; i < 3; i++ {
+					signIn("user@example.com", "guess")
+				}
+				w := signIn("user@example.com", "gophers")
+				if w.Code != http.StatusUnauthorized || w.Header().Get("Retry-After") != "3600" {
+					t.Fatalf("\t%s\tShould lock the account : %v %q", tests.Failed, w.Code, w.Header().Get("Retry-After"))
+				}
+				t.Logf("\t%s\tShould lock the account.", tests.Success)
+			}
+
+			t.Log("\tTest 1:\tWhen the password of an unknown email is guessed.")
+			{
+				for i := 0; i < 3; i++ {
+					signIn("unknown@example.com", "guess")
+				}
+				w := signIn("unknown@example.com", "gophers")
+				if w.Code != http.StatusUnauthorized || w.Header().Get("Retry-After") != "3600" {
+					t.Fatalf("\t%s\tShould respond the same as for a known email : %v %q", tests.Failed, w.Code, w.Header().Get("Retry-After"))
+				}
+				t.Logf("\t%s\tShould respond the same as for a known email.", tests.Success)
+			}
+
+			t.Log("\tTest 2:\tWhen an admin unlocks the user.")
+			{
+				if w := ut.serve(t, "DELETE", "/v1/users/"+tests.UserID+"/lockout", ut.adminToken, nil); w.Code != http.StatusNoContent {
+					t.Fatalf("\t%s\tShould receive a status code of 204 for the response : %v", tests.Failed, w.Code)
+				}
+				t.Logf("\t%s\tShould receive a status code of 204 for the response.", tests.Success)
+
+				if w := signIn("user@example.com", "gophers"); w.Code != http.StatusOK {
+					t.Fatalf("\t%s\tShould be able to sign in : %v", tests.Failed, w.Code)
+				}
+				t.Logf("\t%s\tShould be able to sign in.", tests.Success)
+			}
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package tests
+
+import (
+	"encoding/base32"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/os-foundry/vetpms/cmd/vetpms-api/internal/handlers"
+	"github.com/os-foundry/vetpms/internal/platform/auth"
+	"github.com/os-foundry/vetpms/internal/platform/seal"
+	"github.com/os-foundry/vetpms/internal/platform/totp"
+	"github.com/os-foundry/vetpms/internal/tests"
+	"github.com/os-foundry/vetpms/internal/user"
+)
+
+// TestMFA validates signing in with a second factor. Admins are required to
+// use one.
+func TestMFA(t *testing.T) {
+	box, err := seal.NewBox(make([]byte, seal.KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mfa := handlers.MFA{Box: box, Issuer: "VetPMS", Roles: []string{auth.RoleAdmin}}
+
+	tt := []string{"postgres", "bolt"}
+	for _, tc := range tt {
+		test := tests.NewIntegration(t, tc)
+		defer test.Teardown()
+
+		cfg := audited(apiConfig(t, test, tc))
+		cfg.MFA = mfa
+		handler := newAPI(test, cfg)
+
+		ut := UserTests{
+			app:        handler,
+			adminToken: test.Token("admin@example.com", "gophers"),
+		}
+
+		t.Run("optionalMFA", ut.optionalMFA)
+		t.Run("requiredMFA", ut.requiredMFA)
+	}
+}
+
+// mfaResponse is the response of signing in, with either tokens or an MFA
+// challenge.
+type mfaResponse struct {
+	Token         string   `json:"token"`
+	RecoveryCodes []string `json:"recovery_codes"`
+	MFAToken      string   `json:"mfa_token"`
+	Enroll        bool     `json:"enroll"`
+}
+
+// signIn authenticates with a password.
+func (ut *UserTests) signIn(t *testing.T, email, password string) mfaResponse {
+	t.Helper()
+	r := httptest.NewRequest("GET", "/v1/users/token", nil)
+	r.SetBasicAuth(email, password)
+	w := httptest.NewRecorder()
+	ut.app.ServeHTTP(w, r)
+
+	var resp mfaResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("\t%s\tShould be able to sign in : %v", tests.Failed, err)
+	}
+	return resp
+}
+
+// verify answers an MFA challenge with a code.
+func (ut *UserTests) verify(t *testing.T, challenge, code string) (*httptest.ResponseRecorder, mfaResponse) {
+	t.Helper()
+	w := ut.serve(t, "POST", "/v1/users/token/mfa", "", map[string]string{"mfa_token": challenge, "code": code})
+
+	var resp mfaResponse
+	if w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+		}
+	}
+	return w, resp
+}
+
+// enroll enrolls a second factor with an MFA challenge and returns its
+// secret.
+func (ut *UserTests) enroll(t *testing.T, challenge string) string {
+	t.Helper()
+	w := ut.serve(t, "POST", "/v1/users/token/mfa/enroll", "", map[string]string{"mfa_token": challenge})
+	if w.Code != http.StatusOK {
+		t.Fatalf("\t%s\tShould receive a status code of 200 for the enrollment : %v %s", tests.Failed, w.Code, w.Body)
+	}
+
+	var enroll struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&enroll); err != nil || enroll.Secret == "" || enroll.URI == "" {
+		t.Fatalf("\t%s\tShould receive a secret : %v", tests.Failed, err)
+	}
+	return enroll.Secret
+}
+
+// code returns the code of the base32 encoded secret for a period.
+func code(t *testing.T, secret string, step int64) string {
+	t.Helper()
+	b, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatalf("\t%s\tShould be able to decode the secret : %v", tests.Failed, err)
+	}
+	return totp.Code(b, step)
+}
+
+// optionalMFA validates users can enable and disable a second factor.
+func (ut *UserTests) optionalMFA(t *testing.T) {
+	step := totp.Step(time.Now())
+
+	t.Log("Given the need for users to protect their account with a second factor.")
+	{
+		var codes []string
+
+		t.Log("\tTest 0:\tWhen enabling a second factor.")
+		{
+			tkn := ut.signIn(t, "user@example.com", "gophers").Token
+
+			w := ut.serve(t, "POST", "/v1/user/mfa", tkn, nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould receive a status code of 200 for the response : %v", tests.Failed, w.Code)
+			}
+			var enroll struct {
+				Secret string `json:"secret"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&enroll); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould receive a secret.", tests.Success)
+
+			if w := ut.serve(t, "PUT", "/v1/user/mfa", tkn, map[string]string{"code": "000000"}); w.Code != http.StatusForbidden {
+				t.Fatalf("\t%s\tShould not enable it with a wrong code : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould not enable it with a wrong code.", tests.Success)
+
+			w = ut.serve(t, "PUT", "/v1/user/mfa", tkn, map[string]string{"code": code(t, enroll.Secret, step)})
+			if w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould receive a status code of 200 for the response : %v", tests.Failed, w.Code)
+			}
+			var resp struct {
+				RecoveryCodes []string `json:"recovery_codes"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || len(resp.RecoveryCodes) != user.RecoveryCodeCount {
+				t.Fatalf("\t%s\tShould receive recovery codes : %v", tests.Failed, err)
+			}
+			codes = resp.RecoveryCodes
+			t.Logf("\t%s\tShould receive recovery codes.", tests.Success)
+
+			// The code can't be used again, the next one is accepted since
+			// clocks may differ.
+			challenge := ut.signIn(t, "user@example.com", "gophers")
+			if challenge.Token != "" || challenge.MFAToken == "" || challenge.Enroll {
+				t.Fatalf("\t%s\tShould receive a challenge when signing in : %+v", tests.Failed, challenge)
+			}
+			t.Logf("\t%s\tShould receive a challenge when signing in.", tests.Success)
+
+			if w := ut.serve(t, "POST", "/v1/users/token/mfa/enroll", "", map[string]string{"mfa_token": challenge.MFAToken}); w.Code != http.StatusConflict {
+				t.Fatalf("\t%s\tShould not enroll another second factor : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould not enroll another second factor.", tests.Success)
+
+			if w, _ := ut.verify(t, challenge.MFAToken, code(t, enroll.Secret, step)); w.Code != http.StatusUnauthorized {
+				t.Fatalf("\t%s\tShould not accept a code twice : %v", tests.Failed, w.Code)
+			}
+			if w, _ := ut.verify(t, challenge.MFAToken, code(t, enroll.Secret, step+1)); w.Code != http.StatusUnauthorized {
+				t.Fatalf("\t%s\tShould not accept a challenge twice : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould accept codes and challenges once.", tests.Success)
+
+			challenge = ut.signIn(t, "user@example.com", "gophers")
+			w, resp2 := ut.verify(t, challenge.MFAToken, code(t, enroll.Secret, step+1))
+			if w.Code != http.StatusOK || resp2.Token == "" {
+				t.Fatalf("\t%s\tShould receive tokens for a valid code : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive tokens for a valid code.", tests.Success)
+		}
+
+		t.Log("\tTest 1:\tWhen using a recovery code.")
+		{
+			challenge := ut.signIn(t, "user@example.com", "gophers")
+			w, resp := ut.verify(t, challenge.MFAToken, codes[0])
+			if w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould receive tokens : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive tokens.", tests.Success)
+
+			challenge = ut.signIn(t, "user@example.com", "gophers")
+			if w, _ := ut.verify(t, challenge.MFAToken, codes[0]); w.Code != http.StatusUnauthorized {
+				t.Fatalf("\t%s\tShould not accept the code twice : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould not accept the code twice.", tests.Success)
+
+			if w := ut.serve(t, "DELETE", "/v1/user/mfa", resp.Token, map[string]string{"code": codes[1]}); w.Code != http.StatusNoContent {
+				t.Fatalf("\t%s\tShould be able to disable the second factor : %v", tests.Failed, w.Code)
+			}
+			if ut.signIn(t, "user@example.com", "gophers").Token == "" {
+				t.Fatalf("\t%s\tShould sign in with the password only.", tests.Failed)
+			}
+			t.Logf("\t%s\tShould sign in with the password only after disabling it.", tests.Success)
+		}
+	}
+}
+
+// requiredMFA validates users whose role requires a second factor enroll one
+// when they sign in.
+func (ut *UserTests) requiredMFA(t *testing.T) {
+	step := totp.Step(time.Now())
+
+	t.Log("Given the need to require a second factor for admins.")
+	{
+		t.Log("\tTest 0:\tWhen an admin without a second factor signs in.")
+		{
+			challenge := ut.signIn(t, "admin@example.com", "gophers")
+			if challenge.Token != "" || challenge.MFAToken == "" || !challenge.Enroll {
+				t.Fatalf("\t%s\tShould have to enroll : %+v", tests.Failed, challenge)
+			}
+			t.Logf("\t%s\tShould have to enroll.", tests.Success)
+
+			if w := ut.serve(t, "POST", "/v1/users/token/mfa/enroll", "", map[string]string{"mfa_token": "nope"}); w.Code != http.StatusUnauthorized {
+				t.Fatalf("\t%s\tShould not enroll without a challenge : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould not enroll without a challenge.", tests.Success)
+
+			secret := ut.enroll(t, challenge.MFAToken)
+			if again := ut.enroll(t, challenge.MFAToken); again != secret {
+				t.Fatalf("\t%s\tShould get the same secret enrolling again with the challenge.", tests.Failed)
+			}
+			t.Logf("\t%s\tShould get the same secret enrolling again with the challenge.", tests.Success)
+
+			// Signing in with only the password again doesn't replace the
+			// secret being enrolled.
+			other := ut.signIn(t, "admin@example.com", "gophers")
+			if !other.Enroll || ut.enroll(t, other.MFAToken) == secret {
+				t.Fatalf("\t%s\tShould get another secret with another challenge.", tests.Failed)
+			}
+			t.Logf("\t%s\tShould get another secret with another challenge.", tests.Success)
+
+			w, resp := ut.verify(t, challenge.MFAToken, code(t, secret, step))
+			if w.Code != http.StatusOK || resp.Token == "" || len(resp.RecoveryCodes) != user.RecoveryCodeCount {
+				t.Fatalf("\t%s\tShould receive tokens and recovery codes : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive tokens and recovery codes.", tests.Success)
+
+			if w := ut.serve(t, "DELETE", "/v1/user/mfa", resp.Token, map[string]string{"code": resp.RecoveryCodes[0]}); w.Code != http.StatusForbidden {
+				t.Fatalf("\t%s\tShould not be able to disable it : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould not be able to disable it.", tests.Success)
+
+			var u user.User
+			if err := json.NewDecoder(ut.serve(t, "GET", "/v1/user", resp.Token, nil).Body).Decode(&u); err != nil || !u.MFA.Enabled {
+				t.Fatalf("\t%s\tShould show the second factor is enabled : %v", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould show the second factor is enabled.", tests.Success)
+
+			// An admin resets the second factor of a user who lost it.
+			if w := ut.serve(t, "DELETE", "/v1/users/"+u.ID+"/mfa", ut.adminToken, nil); w.Code != http.StatusNoContent {
+				t.Fatalf("\t%s\tShould be able to reset the second factor : %v", tests.Failed, w.Code)
+			}
+			if challenge := ut.signIn(t, "admin@example.com", "gophers"); !challenge.Enroll {
+				t.Fatalf("\t%s\tShould have to enroll again after a reset.", tests.Failed)
+			}
+			t.Logf("\t%s\tShould have to enroll again after a reset.", tests.Success)
+		}
+	}
+}
@@ -5,20 +5,15 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
-	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
-	"github.com/os-foundry/vetpms/cmd/vetpms-api/internal/handlers"
 	"github.com/os-foundry/vetpms/internal/platform/web"
 	"github.com/os-foundry/vetpms/internal/product"
-	productBolt "github.com/os-foundry/vetpms/internal/product/bolt"
-	productPq "github.com/os-foundry/vetpms/internal/product/postgres"
 	"github.com/os-foundry/vetpms/internal/tests"
-	userBolt "github.com/os-foundry/vetpms/internal/user/bolt"
-	userPq "github.com/os-foundry/vetpms/internal/user/postgres"
 )
 
 // TestProducts runs a series of tests to exercise Product behavior from the
@@ -33,27 +28,21 @@ func TestProducts(t *testing.T) {
 		test := tests.NewIntegration(t, tc)
 		defer test.Teardown()
 
-		var handler http.Handler
-		shutdown := make(chan os.Signal, 1)
-		switch tc {
-		case "postgres":
-			handler = handlers.API(shutdown, test.Log, userPq.Postgres{test.Pq}, productPq.Postgres{test.Pq}, test.Authenticator)
-		case "bolt":
-			handler = handlers.API(shutdown, test.Log, userBolt.Bolt{test.Bolt}, productBolt.Bolt{test.Bolt}, test.Authenticator)
-		default:
-			t.Fatalf("test case should be bolt or postgres")
-		}
+		handler := newAPI(test, apiConfig(t, test, tc))
 		tests := ProductTests{
-			app:       handler,
-			userToken: test.Token("admin@example.com", "gophers"),
+			app:        handler,
+			userToken:  test.Token("admin@example.com", "gophers"),
+			clerkToken: test.Token("user@example.com", "gophers"),
 		}
 
 		t.Run("postProduct400", tests.postProduct400)
+		t.Run("translateErrors", tests.translateErrors)
 		t.Run("postProduct401", tests.postProduct401)
 		t.Run("getProduct404", tests.getProduct404)
 		t.Run("getProduct400", tests.getProduct400)
 		t.Run("deleteProductNotFound", tests.deleteProductNotFound)
 		t.Run("putProduct404", tests.putProduct404)
+		t.Run("listDeleted403", tests.listDeleted403)
 		t.Run("crudProducts", tests.crudProduct)
 	}
 }
@@ -64,6 +53,9 @@ func TestProducts(t *testing.T) {
 type ProductTests struct {
 	app       http.Handler
 	userToken string
+
+	// clerkToken is the token of a user without the admin role.
+	clerkToken string
 }
 
 // postProduct400 validates a product can't be created with the endpoint
@@ -94,6 +86,7 @@ func (pt *ProductTests) postProduct400(t *testing.T) {
 
 			// Define what we want to see.
 			want := web.ErrorResponse{
+				Code:  "validation.failed",
 				Error: "field validation error",
 				Fields: []web.FieldError{
 					{Field: "name", Error: "name is a required field"},
@@ -116,6 +109,97 @@ func (pt *ProductTests) postProduct400(t *testing.T) {
 	}
 }
 
+// translateErrors validates errors are sent in the language the client
+// accepts, and in English when none of the languages is supported.
+func (pt *ProductTests) translateErrors(t *testing.T) {
+	tt := []struct {
+		accept   string
+		language string
+		invalid  web.ErrorResponse
+		notFound string
+	}{
+		{"nl-BE, nl;q=0.9, en;q=0.8", "nl", web.ErrorResponse{
+			Code:  "validation.failed",
+			Error: "ongeldige velden",
+			Fields: []web.FieldError{
+				{Field: "name", Error: "name is een verplicht veld"},
+				{Field: "cost", Error: "cost is een verplicht veld"},
+				{Field: "quantity", Error: "quantity moet 1 of groter zijn"},
+			},
+		}, "Product niet gevonden"},
+		{"fr, bg;q=0.5", "bg", web.ErrorResponse{
+			Code:  "validation.failed",
+			Error: "невалидни полета",
+			Fields: []web.FieldError{
+				{Field: "name", Error: "name е задължително поле"},
+				{Field: "cost", Error: "cost е задължително поле"},
+				{Field: "quantity", Error: "quantity трябва да е 1 или повече"},
+			},
+		}, "Продуктът не е намерен"},
+		{"fr, nl;q=0", "en", web.ErrorResponse{
+			Code:  "validation.failed",
+			Error: "field validation error",
+			Fields: []web.FieldError{
+				{Field: "name", Error: "name is a required field"},
+				{Field: "cost", Error: "cost is a required field"},
+				{Field: "quantity", Error: "quantity must be 1 or greater"},
+			},
+		}, "Product not found"},
+	}
+
+	// serve serves a request accepting the languages.
+	serve := func(method, url, accept string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+pt.userToken)
+		r.Header.Set("Accept-Language", accept)
+		w := httptest.NewRecorder()
+		pt.app.ServeHTTP(w, r)
+		return w
+	}
+
+	sorter := cmpopts.SortSlices(func(a, b web.FieldError) bool {
+		return a.Field < b.Field
+	})
+
+	t.Log("Given the need to send errors in the language of the user.")
+	{
+		for i, tc := range tt {
+			t.Logf("\tTest %d:\tWhen accepting %q.", i, tc.accept)
+			{
+				w := serve("POST", "/v1/products", tc.accept, `{}`)
+				if w.Code != http.StatusBadRequest {
+					t.Fatalf("\t%s\tShould receive a status code of 400 for the response : %v", tests.Failed, w.Code)
+				}
+				if got := w.Header().Get("Content-Language"); got != tc.language {
+					t.Fatalf("\t%s\tShould respond in %s : %q.", tests.Failed, tc.language, got)
+				}
+				t.Logf("\t%s\tShould respond in %s.", tests.Success, tc.language)
+
+				var got web.ErrorResponse
+				if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+					t.Fatalf("\t%s\tShould be able to unmarshal the response to an error type : %v", tests.Failed, err)
+				}
+				if diff := cmp.Diff(tc.invalid, got, sorter); diff != "" {
+					t.Fatalf("\t%s\tShould translate the validation errors. Diff:\n%s", tests.Failed, diff)
+				}
+				t.Logf("\t%s\tShould translate the validation errors.", tests.Success)
+
+				w = serve("GET", "/v1/products/a224a8d6-3f9e-4b11-9900-e81a25d80702", tc.accept, "")
+				got = web.ErrorResponse{}
+				if err := json.NewDecoder(w.Body).Decode(&got); err != nil || got.Error != tc.notFound {
+					t.Fatalf("\t%s\tShould translate the error : %q, %v.", tests.Failed, got.Error, err)
+				}
+				t.Logf("\t%s\tShould translate the error.", tests.Success)
+
+				if got.Code != "product.not_found" {
+					t.Fatalf("\t%s\tShould keep the code of the error : %q.", tests.Failed, got.Code)
+				}
+				t.Logf("\t%s\tShould keep the code of the error.", tests.Success)
+			}
+		}
+	}
+}
+
 // postProduct401 validates a product can't be created with the endpoint
 // unless the user is authenticated
 func (pt *ProductTests) postProduct401(t *testing.T) {
@@ -170,7 +254,7 @@ func (pt *ProductTests) getProduct400(t *testing.T) {
 			t.Logf("\t%s\tShould receive a status code of 400 for the response.", tests.Success)
 
 			recv := w.Body.String()
-			resp := `{"error":"ID is not in its proper form"}`
+			resp := `{"code":"product.invalid_id","error":"ID is not in its proper form"}`
 			if resp != recv {
 				t.Log("Got :", recv)
 				t.Log("Want:", resp)
@@ -236,6 +320,38 @@ func (pt *ProductTests) deleteProductNotFound(t *testing.T) {
 	}
 }
 
+// listDeleted403 validates only admins can list the deleted products.
+func (pt *ProductTests) listDeleted403(t *testing.T) {
+	t.Log("Given the need to keep deleted products from users who aren't admins.")
+	{
+		t.Log("\tTest 0:\tWhen a user lists the deleted products.")
+		{
+			r := httptest.NewRequest("GET", "/v1/products?deleted=true", nil)
+			r.Header.Set("Authorization", "Bearer "+pt.clerkToken)
+			w := httptest.NewRecorder()
+			pt.app.ServeHTTP(w, r)
+
+			if w.Code != http.StatusForbidden {
+				t.Fatalf("\t%s\tShould receive a status code of 403 for the response : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 403 for the response.", tests.Success)
+		}
+
+		t.Log("\tTest 1:\tWhen an admin lists the deleted products.")
+		{
+			r := httptest.NewRequest("GET", "/v1/products?deleted=true", nil)
+			r.Header.Set("Authorization", "Bearer "+pt.userToken)
+			w := httptest.NewRecorder()
+			pt.app.ServeHTTP(w, r)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould receive a status code of 200 for the response : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 200 for the response.", tests.Success)
+		}
+	}
+}
+
 // putProduct404 validates updating a product that does not exist.
 func (pt *ProductTests) putProduct404(t *testing.T) {
 	up := product.UpdateProduct{
@@ -283,6 +399,10 @@ func (pt *ProductTests) crudProduct(t *testing.T) {
 	defer pt.deleteProduct204(t, p.ID)
 
 	pt.getProduct200(t, p.ID)
+	pt.deleteProduct204(t, p.ID)
+	pt.restoreProduct204(t, p.ID)
+	pt.getProduct200(t, p.ID)
+	pt.putProduct412(t, p)
 	pt.putProduct204(t, p.ID)
 }
 
@@ -360,6 +480,27 @@ func (pt *ProductTests) deleteProduct204(t *testing.T, id string) {
 	}
 }
 
+// restoreProduct204 validates a deleted product can be restored.
+func (pt *ProductTests) restoreProduct204(t *testing.T, id string) {
+	r := httptest.NewRequest("POST", "/v1/products/"+id+"/restore", nil)
+	w := httptest.NewRecorder()
+
+	r.Header.Set("Authorization", "Bearer "+pt.userToken)
+
+	pt.app.ServeHTTP(w, r)
+
+	t.Log("Given the need to validate restoring a deleted product.")
+	{
+		t.Logf("\tTest 0:\tWhen using the deleted product %s.", id)
+		{
+			if w.Code != http.StatusNoContent {
+				t.Fatalf("\t%s\tShould receive a status code of 204 for the response : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 204 for the response.", tests.Success)
+		}
+	}
+}
+
 // getProduct200 validates a product request for an existing id.
 func (pt *ProductTests) getProduct200(t *testing.T, id string) {
 	r := httptest.NewRequest("GET", "/v1/products/"+id, nil)
@@ -399,6 +540,58 @@ func (pt *ProductTests) getProduct200(t *testing.T, id string) {
 	}
 }
 
+// putProduct412 validates a product can't be updated based on a version that
+// is no longer current, and that If-Match lists are compared strongly.
+func (pt *ProductTests) putProduct412(t *testing.T, p product.Product) {
+	put := func(ifMatch string) int {
+		body := `{"name": "Graphic Novels"}`
+		r := httptest.NewRequest("PUT", "/v1/products/"+p.ID, strings.NewReader(body))
+		w := httptest.NewRecorder()
+
+		r.Header.Set("Authorization", "Bearer "+pt.userToken)
+		r.Header.Set("If-Match", ifMatch)
+
+		pt.app.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	r := httptest.NewRequest("GET", "/v1/products/"+p.ID, nil)
+	w := httptest.NewRecorder()
+	r.Header.Set("Authorization", "Bearer "+pt.userToken)
+	pt.app.ServeHTTP(w, r)
+	current := w.Header().Get("ETag")
+
+	p.DateUpdated = p.DateUpdated.Add(-time.Second)
+	outdated := p.ETag()
+
+	t.Log("Given the need to prevent overwriting changes made by someone else.")
+	{
+		t.Log("\tTest 0:\tWhen using an outdated entity tag.")
+		{
+			if code := put(outdated); code != http.StatusPreconditionFailed {
+				t.Fatalf("\t%s\tShould receive a status code of 412 for the response : %v", tests.Failed, code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 412 for the response.", tests.Success)
+		}
+
+		t.Log("\tTest 1:\tWhen using the weak form of the current entity tag.")
+		{
+			if code := put("W/" + current); code != http.StatusPreconditionFailed {
+				t.Fatalf("\t%s\tShould receive a status code of 412 for the response : %v", tests.Failed, code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 412 for the response.", tests.Success)
+		}
+
+		t.Log("\tTest 2:\tWhen listing the current entity tag after an outdated one.")
+		{
+			if code := put(outdated + ", " + current); code != http.StatusNoContent {
+				t.Fatalf("\t%s\tShould receive a status code of 204 for the response : %v", tests.Failed, code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 204 for the response.", tests.Success)
+		}
+	}
+}
+
 // putProduct204 validates updating a product that does exist.
 func (pt *ProductTests) putProduct204(t *testing.T, id string) {
 	body := `{"name": "Graphic Novels", "cost": 100}`
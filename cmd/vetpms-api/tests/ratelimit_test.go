@@ -0,0 +1,84 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/os-foundry/vetpms/cmd/vetpms-api/internal/handlers"
+	"github.com/os-foundry/vetpms/internal/platform/ratelimit"
+	"github.com/os-foundry/vetpms/internal/tests"
+)
+
+// TestRateLimit validates clients are limited to their quota.
+func TestRateLimit(t *testing.T) {
+	tt := []string{"postgres", "bolt"}
+	for _, tc := range tt {
+		test := tests.NewIntegration(t, tc)
+		defer test.Teardown()
+
+		limits := handlers.RateLimits{
+			Auth: ratelimit.Quota{Limit: 2, Per: time.Minute},
+			API:  ratelimit.Quota{Limit: 2, Per: time.Minute},
+		}
+
+		if tc == "postgres" {
+			limits.Limiter = ratelimit.NewPostgres(test.Pq)
+		} else {
+			limits.Limiter = ratelimit.NewMemory()
+		}
+
+		cfg := apiConfig(t, test, tc)
+		cfg.RateLimits = limits
+		handler := newAPI(test, cfg)
+
+		ut := UserTests{
+			app:        handler,
+			userToken:  test.Token("user@example.com", "gophers"),
+			adminToken: test.Token("admin@example.com", "gophers"),
+		}
+
+		t.Log("Given the need to limit how often clients make requests.")
+		{
+			t.Log("\tTest 0:\tWhen a client signs in too often.")
+			{
+				for i := 0; i < 2; i++ {
+					if tkn := ut.login(t, "user@example.com", "gophers"); tkn == "" {
+						t.Fatalf("\t%s\tShould be able to sign in within the quota.", tests.Failed)
+					}
+				}
+				t.Logf("\t%s\tShould be able to sign in within the quota.", tests.Success)
+
+				r := httptest.NewRequest("GET", "/v1/users/token", nil)
+				r.SetBasicAuth("user@example.com", "gophers")
+				w := httptest.NewRecorder()
+				ut.app.ServeHTTP(w, r)
+				if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "30" {
+					t.Fatalf("\t%s\tShould receive a status code of 429 for the response : %v %q", tests.Failed, w.Code, w.Header().Get("Retry-After"))
+				}
+				t.Logf("\t%s\tShould receive a status code of 429 for the response.", tests.Success)
+			}
+
+			t.Log("\tTest 1:\tWhen a user makes too many requests.")
+			{
+				for i := 0; i < 2; i++ {
+					if w := ut.serve(t, "GET", "/v1/user", ut.adminToken, nil); w.Code != http.StatusOK {
+						t.Fatalf("\t%s\tShould receive a status code of 200 within the quota : %v", tests.Failed, w.Code)
+					}
+				}
+				t.Logf("\t%s\tShould receive a status code of 200 within the quota.", tests.Success)
+
+				if w := ut.serve(t, "GET", "/v1/products", ut.adminToken, nil); w.Code != http.StatusTooManyRequests {
+					t.Fatalf("\t%s\tShould receive a status code of 429 for the response : %v", tests.Failed, w.Code)
+				}
+				t.Logf("\t%s\tShould receive a status code of 429 for the response.", tests.Success)
+
+				if w := ut.serve(t, "GET", "/v1/user", ut.userToken, nil); w.Code != http.StatusOK {
+					t.Fatalf("\t%s\tShould not limit other users : %v", tests.Failed, w.Code)
+				}
+				t.Logf("\t%s\tShould not limit other users.", tests.Success)
+			}
+		}
+	}
+}
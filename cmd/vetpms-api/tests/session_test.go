@@ -0,0 +1,163 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/os-foundry/vetpms/internal/tests"
+)
+
+// TestSessions validates users see the devices they are signed in on and can
+// sign them out, and admins can do so for everyone. Ended sessions stop
+// working at once.
+func TestSessions(t *testing.T) {
+	tt := []string{"postgres", "bolt"}
+	for _, tc := range tt {
+		test := tests.NewIntegration(t, tc)
+		defer test.Teardown()
+
+		handler := newAPI(test, apiConfig(t, test, tc))
+
+		ut := UserTests{
+			app:        handler,
+			userToken:  test.Token("user@example.com", "gophers"),
+			adminToken: test.Token("admin@example.com", "gophers"),
+		}
+
+		// signIn signs in on the named device and returns the access token.
+		signIn := func(email, device string) string {
+			t.Helper()
+			r := httptest.NewRequest("GET", "/v1/users/token", nil)
+			r.SetBasicAuth(email, "gophers")
+			r.Header.Set("X-Device-Name", device)
+			r.Header.Set("User-Agent", "vetpms-test/1.0")
+			w := httptest.NewRecorder()
+			ut.app.ServeHTTP(w, r)
+
+			var got struct {
+				Token string `json:"token"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&got); err != nil || got.Token == "" {
+				t.Fatalf("\t%s\tShould be able to sign in : %v", tests.Failed, err)
+			}
+			return got.Token
+		}
+
+		type session struct {
+			ID         string `json:"id"`
+			UserID     string `json:"user_id"`
+			DeviceName string `json:"device_name"`
+			UserAgent  string `json:"user_agent"`
+			Current    bool   `json:"current"`
+		}
+
+		// list fetches the sessions at the URL.
+		list := func(url, token string) []session {
+			t.Helper()
+			w := ut.serve(t, "GET", url, token, nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould receive a status code of 200 for the response : %v %s", tests.Failed, w.Code, w.Body)
+			}
+			var got []session
+			if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the sessions : %v", tests.Failed, err)
+			}
+			return got
+		}
+
+		desk := signIn("user@example.com", "Reception PC")
+		phone := signIn("user@example.com", "Phone")
+		admin := signIn("admin@example.com", "Office")
+
+		t.Log("Given the need to manage the devices users are signed in on.")
+		{
+			var own []session
+
+			t.Log("\tTest 0:\tWhen a user lists their sessions.")
+			{
+				own = list("/v1/user/sessions", desk)
+				if len(own) != 2 || own[0].DeviceName != "Reception PC" || own[1].DeviceName != "Phone" {
+					t.Fatalf("\t%s\tShould get the devices they are signed in on : %+v", tests.Failed, own)
+				}
+				if own[0].UserID != tests.UserID || own[0].UserAgent != "vetpms-test/1.0" {
+					t.Fatalf("\t%s\tShould get the devices they are signed in on : %+v", tests.Failed, own[0])
+				}
+				t.Logf("\t%s\tShould get the devices they are signed in on.", tests.Success)
+
+				if !own[0].Current || own[1].Current {
+					t.Fatalf("\t%s\tShould mark the session of the request : %+v", tests.Failed, own)
+				}
+				t.Logf("\t%s\tShould mark the session of the request.", tests.Success)
+
+				w := ut.serve(t, "GET", "/v1/user/sessions?limit=1", desk, nil)
+				cursor := w.Header().Get("X-Next-Cursor")
+				if w.Code != http.StatusOK || cursor == "" {
+					t.Fatalf("\t%s\tShould get the cursor of the next page : %v %q", tests.Failed, w.Code, cursor)
+				}
+				if next := list("/v1/user/sessions?limit=1&cursor="+cursor, desk); len(next) != 1 || next[0].DeviceName != "Phone" {
+					t.Fatalf("\t%s\tShould get the next page : %+v", tests.Failed, next)
+				}
+				t.Logf("\t%s\tShould get their sessions page by page.", tests.Success)
+
+				if got := list("/v1/user/sessions?user_id="+tests.AdminID, desk); len(got) != 2 || got[0].UserID != tests.UserID {
+					t.Fatalf("\t%s\tShould only get their own sessions : %+v", tests.Failed, got)
+				}
+				t.Logf("\t%s\tShould only get their own sessions.", tests.Success)
+			}
+
+			t.Log("\tTest 1:\tWhen a user signs out a device.")
+			{
+				other := list("/v1/sessions?user_id="+tests.AdminID, ut.adminToken)
+				if len(other) != 1 {
+					t.Fatalf("\t%s\tShould get the sessions of the admin : %+v", tests.Failed, other)
+				}
+				if w := ut.serve(t, "DELETE", "/v1/user/sessions/"+other[0].ID, desk, nil); w.Code != http.StatusNotFound {
+					t.Fatalf("\t%s\tShould not end the sessions of others : %v", tests.Failed, w.Code)
+				}
+				t.Logf("\t%s\tShould not end the sessions of others.", tests.Success)
+
+				if w := ut.serve(t, "DELETE", "/v1/user/sessions/"+own[1].ID, desk, nil); w.Code != http.StatusNoContent {
+					t.Fatalf("\t%s\tShould receive a status code of 204 for the response : %v %s", tests.Failed, w.Code, w.Body)
+				}
+				t.Logf("\t%s\tShould receive a status code of 204 for the response.", tests.Success)
+
+				if w := ut.serve(t, "GET", "/v1/user", phone, nil); w.Code != http.StatusUnauthorized {
+					t.Fatalf("\t%s\tShould reject the token of the device at once : %v", tests.Failed, w.Code)
+				}
+				if w := ut.serve(t, "GET", "/v1/user", desk, nil); w.Code != http.StatusOK {
+					t.Fatalf("\t%s\tShould keep the other devices signed in : %v", tests.Failed, w.Code)
+				}
+				t.Logf("\t%s\tShould reject the token of the device at once.", tests.Success)
+			}
+
+			t.Log("\tTest 2:\tWhen an admin manages the sessions of everyone.")
+			{
+				if w := ut.serve(t, "GET", "/v1/sessions", desk, nil); w.Code != http.StatusForbidden {
+					t.Fatalf("\t%s\tShould not let users see the sessions of everyone : %v", tests.Failed, w.Code)
+				}
+				t.Logf("\t%s\tShould not let users see the sessions of everyone.", tests.Success)
+
+				all := list("/v1/sessions", admin)
+				if len(all) != 2 || all[0].ID != own[0].ID || !all[1].Current {
+					t.Fatalf("\t%s\tShould get the active sessions of everyone : %+v", tests.Failed, all)
+				}
+				t.Logf("\t%s\tShould get the active sessions of everyone.", tests.Success)
+
+				if w := ut.serve(t, "DELETE", "/v1/sessions/"+own[0].ID, admin, nil); w.Code != http.StatusNoContent {
+					t.Fatalf("\t%s\tShould receive a status code of 204 for the response : %v %s", tests.Failed, w.Code, w.Body)
+				}
+				if w := ut.serve(t, "GET", "/v1/user", desk, nil); w.Code != http.StatusUnauthorized {
+					t.Fatalf("\t%s\tShould reject the token of the session at once : %v", tests.Failed, w.Code)
+				}
+				t.Logf("\t%s\tShould reject the token of the session at once.", tests.Success)
+
+				if w := ut.serve(t, "DELETE", "/v1/sessions/"+own[0].ID, admin, nil); w.Code != http.StatusNotFound {
+					t.Fatalf("\t%s\tShould not find an ended session : %v", tests.Failed, w.Code)
+				}
+				t.Logf("\t%s\tShould not find an ended session.", tests.Success)
+			}
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/google/go-cmp/cmp"
+	"github.com/os-foundry/vetpms/cmd/vetpms-api/internal/handlers"
+	"github.com/os-foundry/vetpms/internal/platform/auth"
+	"github.com/os-foundry/vetpms/internal/platform/oidc"
+	"github.com/os-foundry/vetpms/internal/platform/oidc/oidctest"
+	"github.com/os-foundry/vetpms/internal/tests"
+	"github.com/os-foundry/vetpms/internal/user"
+)
+
+// TestSSO validates staff sign in with an identity provider, which links or
+// creates their user and sets their roles.
+func TestSSO(t *testing.T) {
+	mock := oidctest.NewProvider(t)
+	defer mock.Close()
+
+	provider, err := oidc.NewProvider(oidc.Config{
+		Issuer:       mock.URL,
+		ClientID:     oidctest.ClientID,
+		ClientSecret: oidctest.ClientSecret,
+		RedirectURL:  "http://vetpms.example.com/v1/users/sso/callback",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	roles, err := oidc.ParseRoleMap([]string{"vets=USER", "it=ADMIN"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sso := handlers.SSO{Provider: provider, RoleClaim: "groups", Roles: roles}
+
+	tt := []string{"postgres", "bolt"}
+	for _, tc := range tt {
+		test := tests.NewIntegration(t, tc)
+		defer test.Teardown()
+
+		cfg := apiConfig(t, test, tc)
+		cfg.SSO = sso
+		handler := newAPI(test, cfg)
+
+		ut := UserTests{
+			app:        handler,
+			adminToken: test.Token("admin@example.com", "gophers"),
+		}
+
+		// signIn signs in at the provider as the account with the claims and
+		// returns the response of coming back from the provider.
+		signIn := func(claims jwt.MapClaims) *httptest.ResponseRecorder {
+			t.Helper()
+			mock.SignInAs(claims)
+
+			w := ut.serve(t, "GET", "/v1/users/sso/login", "", nil)
+			if w.Code != http.StatusFound {
+				t.Fatalf("\t%s\tShould be sent to the provider : %v", tests.Failed, w.Code)
+			}
+
+			client := http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+			resp, err := client.Get(w.Header().Get("Location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			back, err := url.Parse(resp.Header.Get("Location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest("GET", back.RequestURI(), nil)
+			for _, c := range w.Result().Cookies() {
+				r.AddCookie(c)
+			}
+			w = httptest.NewRecorder()
+			ut.app.ServeHTTP(w, r)
+			return w
+		}
+
+		// signedIn returns the user signed in by a response of the callback.
+		signedIn := func(w *httptest.ResponseRecorder) user.User {
+			t.Helper()
+			if w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould receive a status code of 200 for the response : %v %s", tests.Failed, w.Code, w.Body)
+			}
+			var tkn struct {
+				Token string `json:"token"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&tkn); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the token : %v", tests.Failed, err)
+			}
+
+			w = ut.serve(t, "GET", "/v1/user", tkn.Token, nil)
+			var u user.User
+			if err := json.NewDecoder(w.Body).Decode(&u); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the user : %v", tests.Failed, err)
+			}
+			return u
+		}
+
+		t.Log("Given the need to sign staff in with an identity provider.")
+		{
+			var janeID string
+
+			t.Log("\tTest 0:\tWhen a new member of staff signs in.")
+			{
+				u := signedIn(signIn(jwt.MapClaims{"sub": "jane", "email": "jane@example.com", "email_verified": true, "name": "Jane Doe", "groups": []string{"vets"}}))
+				if u.Email != "jane@example.com" || u.Name != "Jane Doe" {
+					t.Fatalf("\t%s\tShould create a user : %+v", tests.Failed, u)
+				}
+				if diff := cmp.Diff([]string{auth.RoleUser}, []string(u.Roles)); diff != "" {
+					t.Fatalf("\t%s\tShould map the groups to roles. Diff:\n%s", tests.Failed, diff)
+				}
+				t.Logf("\t%s\tShould create a user with the mapped roles.", tests.Success)
+				janeID = u.ID
+			}
+
+			t.Log("\tTest 1:\tWhen the groups of the member change.")
+			{
+				u := signedIn(signIn(jwt.MapClaims{"sub": "jane", "email": "jane.doe@example.com", "groups": []string{"it"}}))
+				if u.ID != janeID {
+					t.Fatalf("\t%s\tShould sign in the linked user : %s", tests.Failed, u.ID)
+				}
+				if diff := cmp.Diff([]string{auth.RoleAdmin}, []string(u.Roles)); diff != "" {
+					t.Fatalf("\t%s\tShould update the roles. Diff:\n%s", tests.Failed, diff)
+				}
+				t.Logf("\t%s\tShould sign in the linked user with the new roles.", tests.Success)
+			}
+
+			t.Log("\tTest 2:\tWhen an existing user signs in.")
+			{
+				u := signedIn(signIn(jwt.MapClaims{"sub": "user", "email": "user@example.com", "email_verified": true, "groups": []string{"vets"}}))
+				if u.ID != tests.UserID {
+					t.Fatalf("\t%s\tShould link the user with the verified email : %s", tests.Failed, u.ID)
+				}
+				t.Logf("\t%s\tShould link the user with the verified email.", tests.Success)
+
+				w := signIn(jwt.MapClaims{"sub": "mallory", "email": "admin@example.com", "groups": []string{"vets"}})
+				if w.Code != http.StatusForbidden {
+					t.Fatalf("\t%s\tShould not link a user by an unverified email : %v", tests.Failed, w.Code)
+				}
+				t.Logf("\t%s\tShould not link a user by an unverified email.", tests.Success)
+			}
+
+			t.Log("\tTest 3:\tWhen an account without a role signs in.")
+			{
+				w := signIn(jwt.MapClaims{"sub": "bob", "email": "bob@example.com", "email_verified": true, "groups": []string{"kennel"}})
+				if w.Code != http.StatusForbidden {
+					t.Fatalf("\t%s\tShould refuse the account : %v", tests.Failed, w.Code)
+				}
+				t.Logf("\t%s\tShould refuse the account.", tests.Success)
+			}
+
+			t.Log("\tTest 4:\tWhen a sign in wasn't started in the browser.")
+			{
+				w := ut.serve(t, "GET", "/v1/users/sso/callback?code=x&state=y", "", nil)
+				if w.Code != http.StatusUnauthorized {
+					t.Fatalf("\t%s\tShould refuse the sign in : %v", tests.Failed, w.Code)
+				}
+				t.Logf("\t%s\tShould refuse the sign in.", tests.Success)
+			}
+
+			t.Log("\tTest 5:\tWhen a service account signs in.")
+			{
+				nu := user.NewUser{
+					Name:            "Lab analyzer",
+					Email:           "lab@example.com",
+					Roles:           []string{auth.RoleService, auth.RoleUser},
+					Password:        "gophers",
+					PasswordConfirm: "gophers",
+				}
+				if w := ut.serve(t, "POST", "/v1/users", ut.adminToken, nu); w.Code != http.StatusCreated {
+					t.Fatalf("\t%s\tShould be able to create the service account : %v %s", tests.Failed, w.Code, w.Body)
+				}
+
+				w := signIn(jwt.MapClaims{"sub": "lab", "email": "lab@example.com", "email_verified": true, "groups": []string{"vets"}})
+				if w.Code != http.StatusUnauthorized {
+					t.Fatalf("\t%s\tShould refuse the service account : %v", tests.Failed, w.Code)
+				}
+				t.Logf("\t%s\tShould refuse the service account.", tests.Success)
+			}
+		}
+	}
+}
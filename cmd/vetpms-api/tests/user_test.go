@@ -1,25 +1,26 @@
 package tests
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
-	"os"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
-	"github.com/os-foundry/vetpms/cmd/vetpms-api/internal/handlers"
+	"github.com/os-foundry/vetpms/internal/audit"
+	"github.com/os-foundry/vetpms/internal/backup"
 	"github.com/os-foundry/vetpms/internal/platform/auth"
+	"github.com/os-foundry/vetpms/internal/platform/mail"
 	"github.com/os-foundry/vetpms/internal/platform/web"
-	productBolt "github.com/os-foundry/vetpms/internal/product/bolt"
-	productPq "github.com/os-foundry/vetpms/internal/product/postgres"
 	"github.com/os-foundry/vetpms/internal/tests"
 	"github.com/os-foundry/vetpms/internal/user"
-	userBolt "github.com/os-foundry/vetpms/internal/user/bolt"
-	userPq "github.com/os-foundry/vetpms/internal/user/postgres"
 )
 
 // TestUsers is the entry point for testing user management functions.
@@ -29,25 +30,24 @@ func TestUsers(t *testing.T) {
 		test := tests.NewIntegration(t, tc)
 		defer test.Teardown()
 
-		var handler http.Handler
-		shutdown := make(chan os.Signal, 1)
-		switch tc {
-		case "postgres":
-			handler = handlers.API(shutdown, test.Log, userPq.Postgres{test.Pq}, productPq.Postgres{test.Pq}, test.Authenticator)
-		case "bolt":
-			handler = handlers.API(shutdown, test.Log, userBolt.Bolt{test.Bolt}, productBolt.Bolt{test.Bolt}, test.Authenticator)
-		default:
-			t.Fatalf("test case should be bolt or postgres")
-		}
+		mails := &mailbox{}
+		cfg := audited(apiConfig(t, test, tc))
+		cfg.Mailer = mails
+		handler := newAPI(test, cfg)
 
 		tests := UserTests{
 			app:        handler,
+			mails:      mails,
 			userToken:  test.Token("user@example.com", "gophers"),
 			adminToken: test.Token("admin@example.com", "gophers"),
 		}
 
 		t.Run("getToken401", tests.getToken401)
 		t.Run("getToken200", tests.getToken200)
+		t.Run("refreshToken", tests.refreshToken)
+		t.Run("getJWKS200", tests.getJWKS200)
+		t.Run("changePassword", tests.changePassword)
+		t.Run("resetPassword", tests.resetPassword)
 		t.Run("postUser400", tests.postUser400)
 		t.Run("postUser401", tests.postUser401)
 		t.Run("postUser403", tests.postUser403)
@@ -57,6 +57,8 @@ func TestUsers(t *testing.T) {
 		t.Run("deleteUserNotFound", tests.deleteUserNotFound)
 		t.Run("putUser404", tests.putUser404)
 		t.Run("crudUsers", tests.crudUser)
+		t.Run("getBackup200", tests.getBackup200)
+		t.Run("getBackup403", tests.getBackup403)
 	}
 }
 
@@ -65,6 +67,7 @@ func TestUsers(t *testing.T) {
 // subtests are registered.
 type UserTests struct {
 	app        http.Handler
+	mails      *mailbox
 	userToken  string
 	adminToken string
 }
@@ -122,6 +125,347 @@ func (ut *UserTests) getToken200(t *testing.T) {
 	}
 }
 
+// refreshToken validates refresh tokens issue new tokens once and that
+// revoked sessions are rejected.
+func (ut *UserTests) refreshToken(t *testing.T) {
+
+	// do serves a request with an optional bearer token and JSON body.
+	do := func(method, url, token string, body interface{}) *httptest.ResponseRecorder {
+		t.Helper()
+		var buf bytes.Buffer
+		if body != nil {
+			if err := json.NewEncoder(&buf).Encode(body); err != nil {
+				t.Fatal(err)
+			}
+		}
+		r := httptest.NewRequest(method, url, &buf)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		ut.app.ServeHTTP(w, r)
+		return w
+	}
+
+	type tokens struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	// login authenticates the user with their password.
+	login := func() tokens {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/v1/users/token", nil)
+		r.SetBasicAuth("user@example.com", "gophers")
+		w := httptest.NewRecorder()
+		ut.app.ServeHTTP(w, r)
+
+		var got tokens
+		if err := json.NewDecoder(w.Body).Decode(&got); err != nil || got.RefreshToken == "" {
+			t.Fatalf("\t%s\tShould receive a refresh token : %v", tests.Failed, err)
+		}
+		return got
+	}
+
+	refresh := func(tkn string) *httptest.ResponseRecorder {
+		return do("POST", "/v1/users/token/refresh", "", map[string]string{"refresh_token": tkn})
+	}
+
+	t.Log("Given the need to keep users signed in.")
+	{
+		t.Log("\tTest 0:\tWhen refreshing a token.")
+		{
+			first := login()
+
+			w := refresh(first.RefreshToken)
+			if w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould receive a status code of 200 for the response : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 200 for the response.", tests.Success)
+
+			var next tokens
+			if err := json.NewDecoder(w.Body).Decode(&next); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+			}
+			if w := do("GET", "/v1/user", next.Token, nil); w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould be able to use the new token : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould be able to use the new token.", tests.Success)
+
+			if w := refresh(first.RefreshToken); w.Code != http.StatusUnauthorized {
+				t.Fatalf("\t%s\tShould not be able to reuse a refresh token : %v", tests.Failed, w.Code)
+			}
+			if w := do("GET", "/v1/user", next.Token, nil); w.Code != http.StatusUnauthorized {
+				t.Fatalf("\t%s\tShould revoke the session of a reused refresh token : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould revoke the session of a reused refresh token.", tests.Success)
+		}
+
+		t.Log("\tTest 1:\tWhen an admin revokes the sessions of a user.")
+		{
+			tkn := login()
+
+			var u user.User
+			if err := json.NewDecoder(do("GET", "/v1/user", tkn.Token, nil).Body).Decode(&u); err != nil {
+				t.Fatalf("\t%s\tShould be able to retrieve the user : %v", tests.Failed, err)
+			}
+
+			if w := do("DELETE", "/v1/users/"+u.ID+"/sessions", ut.userToken, nil); w.Code != http.StatusForbidden {
+				t.Fatalf("\t%s\tShould receive a status code of 403 for a regular user : %v", tests.Failed, w.Code)
+			}
+			if w := do("DELETE", "/v1/users/"+u.ID+"/sessions", ut.adminToken, nil); w.Code != http.StatusNoContent {
+				t.Fatalf("\t%s\tShould receive a status code of 204 for the response : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 204 for the response.", tests.Success)
+
+			if w := do("GET", "/v1/user", tkn.Token, nil); w.Code != http.StatusUnauthorized {
+				t.Fatalf("\t%s\tShould reject the access token : %v", tests.Failed, w.Code)
+			}
+			if w := refresh(tkn.RefreshToken); w.Code != http.StatusUnauthorized {
+				t.Fatalf("\t%s\tShould reject the refresh token : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould reject the tokens of the sessions.", tests.Success)
+		}
+	}
+}
+
+// TestResetWithoutMail validates passwords can't be reset when no mail server
+// is configured, as reset tokens are never logged.
+func TestResetWithoutMail(t *testing.T) {
+	tt := []string{"postgres", "bolt"}
+	for _, tc := range tt {
+		test := tests.NewIntegration(t, tc)
+		defer test.Teardown()
+
+		cfg := apiConfig(t, test, tc)
+		cfg.Mailer = nil
+		ut := UserTests{app: newAPI(test, cfg)}
+
+		t.Log("Given the need to keep reset tokens out of the logs.")
+		{
+			t.Log("\tTest 0:\tWhen no mail server is configured.")
+			{
+				if w := ut.serve(t, "POST", "/v1/users/password/reset", "", user.RequestReset{Email: "user@example.com"}); w.Code != http.StatusNotFound {
+					t.Fatalf("\t%s\tShould not offer password resets : %v", tests.Failed, w.Code)
+				}
+				t.Logf("\t%s\tShould not offer password resets.", tests.Success)
+			}
+		}
+	}
+}
+
+// mailbox is a mail.Mailer keeping the messages it is sent.
+type mailbox struct {
+	mu   sync.Mutex
+	sent []mail.Message
+}
+
+// Send keeps the message.
+func (mb *mailbox) Send(ctx context.Context, m mail.Message) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.sent = append(mb.sent, m)
+	return nil
+}
+
+// count returns the number of messages sent.
+func (mb *mailbox) count() int {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	return len(mb.sent)
+}
+
+// resetToken returns the recipient of the last message sent and the password
+// reset token in it, which is on a line of its own.
+func (mb *mailbox) resetToken() (string, string) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if len(mb.sent) == 0 {
+		return "", ""
+	}
+	m := mb.sent[len(mb.sent)-1]
+	for _, line := range strings.Split(m.Body, "\n") {
+		if _, _, err := user.ParseResetToken(line); err == nil {
+			return m.To, line
+		}
+	}
+	return m.To, ""
+}
+
+// serve serves a request with an optional bearer token and JSON body.
+func (ut *UserTests) serve(t *testing.T, method, url, token string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := httptest.NewRequest(method, url, &buf)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	ut.app.ServeHTTP(w, r)
+	return w
+}
+
+// login fetches a token with basic authentication. It returns an empty token
+// when the credentials are rejected.
+func (ut *UserTests) login(t *testing.T, email, password string) string {
+	t.Helper()
+	r := httptest.NewRequest("GET", "/v1/users/token", nil)
+	r.SetBasicAuth(email, password)
+	w := httptest.NewRecorder()
+	ut.app.ServeHTTP(w, r)
+
+	var got struct {
+		Token string `json:"token"`
+	}
+	if w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+			t.Fatalf("\t%s\tShould be able to unmarshal the token : %v", tests.Failed, err)
+		}
+	}
+	return got.Token
+}
+
+// changePassword validates users can change their own password, which ends
+// their sessions.
+func (ut *UserTests) changePassword(t *testing.T) {
+	nu := user.NewUser{
+		Name:            "Carol Doe",
+		Email:           "carol@example.com",
+		Roles:           []string{auth.RoleUser},
+		Password:        "gophers",
+		PasswordConfirm: "gophers",
+	}
+	var u user.User
+	if err := json.NewDecoder(ut.serve(t, "POST", "/v1/users", ut.adminToken, nu).Body).Decode(&u); err != nil {
+		t.Fatalf("\t%s\tShould be able to create a user : %v", tests.Failed, err)
+	}
+	defer ut.serve(t, "DELETE", "/v1/users/"+u.ID, ut.adminToken, nil)
+
+	tkn := ut.login(t, nu.Email, nu.Password)
+
+	t.Log("Given the need for users to change their password.")
+	{
+		t.Log("\tTest 0:\tWhen giving the wrong current password.")
+		{
+			cp := user.ChangePassword{CurrentPassword: "wrong", Password: "new gophers", PasswordConfirm: "new gophers"}
+			if w := ut.serve(t, "PUT", "/v1/user/password", tkn, cp); w.Code != http.StatusForbidden {
+				t.Fatalf("\t%s\tShould receive a status code of 403 for the response : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 403 for the response.", tests.Success)
+		}
+
+		t.Log("\tTest 1:\tWhen giving the current password.")
+		{
+			cp := user.ChangePassword{CurrentPassword: "gophers", Password: "new gophers", PasswordConfirm: "new gophers"}
+			if w := ut.serve(t, "PUT", "/v1/user/password", tkn, cp); w.Code != http.StatusNoContent {
+				t.Fatalf("\t%s\tShould receive a status code of 204 for the response : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 204 for the response.", tests.Success)
+
+			if ut.login(t, nu.Email, "new gophers") == "" {
+				t.Fatalf("\t%s\tShould be able to log in with the new password.", tests.Failed)
+			}
+			if ut.login(t, nu.Email, "gophers") != "" {
+				t.Fatalf("\t%s\tShould not be able to log in with the old password.", tests.Failed)
+			}
+			t.Logf("\t%s\tShould only be able to log in with the new password.", tests.Success)
+
+			if w := ut.serve(t, "GET", "/v1/user", tkn, nil); w.Code != http.StatusUnauthorized {
+				t.Fatalf("\t%s\tShould end the session : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould end the session.", tests.Success)
+		}
+	}
+}
+
+// resetPassword validates users can choose a new password with a token they
+// are mailed.
+func (ut *UserTests) resetPassword(t *testing.T) {
+	t.Log("Given the need for users to reset a forgotten password.")
+	{
+		t.Log("\tTest 0:\tWhen requesting a reset for an unknown email.")
+		{
+			sent := ut.mails.count()
+			if w := ut.serve(t, "POST", "/v1/users/password/reset", "", user.RequestReset{Email: "unknown@example.com"}); w.Code != http.StatusNoContent {
+				t.Fatalf("\t%s\tShould receive a status code of 204 for the response : %v", tests.Failed, w.Code)
+			}
+			if ut.mails.count() != sent {
+				t.Fatalf("\t%s\tShould not send a mail.", tests.Failed)
+			}
+			t.Logf("\t%s\tShould respond without sending a mail.", tests.Success)
+		}
+
+		t.Log("\tTest 1:\tWhen resetting the password with the mailed token.")
+		{
+			if w := ut.serve(t, "POST", "/v1/users/password/reset", "", user.RequestReset{Email: "user@example.com"}); w.Code != http.StatusNoContent {
+				t.Fatalf("\t%s\tShould receive a status code of 204 for the response : %v", tests.Failed, w.Code)
+			}
+			to, tkn := ut.mails.resetToken()
+			if to != "user@example.com" || tkn == "" {
+				t.Fatalf("\t%s\tShould mail the token to the user : %q", tests.Failed, to)
+			}
+			t.Logf("\t%s\tShould mail the token to the user.", tests.Success)
+
+			rp := user.ResetPassword{Token: tkn, Password: "new gophers", PasswordConfirm: "new gophers"}
+			if w := ut.serve(t, "PUT", "/v1/users/password/reset", "", rp); w.Code != http.StatusNoContent {
+				t.Fatalf("\t%s\tShould receive a status code of 204 for the response : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 204 for the response.", tests.Success)
+
+			if ut.login(t, "user@example.com", "new gophers") == "" {
+				t.Fatalf("\t%s\tShould be able to log in with the new password.", tests.Failed)
+			}
+			t.Logf("\t%s\tShould be able to log in with the new password.", tests.Success)
+
+			if w := ut.serve(t, "PUT", "/v1/users/password/reset", "", rp); w.Code != http.StatusBadRequest {
+				t.Fatalf("\t%s\tShould not be able to use the token again : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould not be able to use the token again.", tests.Success)
+
+			// Restore the password the other tests use.
+			ut.serve(t, "POST", "/v1/users/password/reset", "", user.RequestReset{Email: "user@example.com"})
+			_, tkn = ut.mails.resetToken()
+			restore := user.ResetPassword{Token: tkn, Password: "gophers", PasswordConfirm: "gophers"}
+			if w := ut.serve(t, "PUT", "/v1/users/password/reset", "", restore); w.Code != http.StatusNoContent {
+				t.Fatalf("\t%s\tShould be able to restore the password : %v", tests.Failed, w.Code)
+			}
+		}
+	}
+}
+
+// getJWKS200 validates the keys verifying tokens are published.
+func (ut *UserTests) getJWKS200(t *testing.T) {
+	r := httptest.NewRequest("GET", "/v1/.well-known/jwks.json", nil)
+	w := httptest.NewRecorder()
+
+	ut.app.ServeHTTP(w, r)
+
+	t.Log("Given the need to let other services verify our tokens.")
+	{
+		t.Log("\tTest 0:\tWhen fetching the key set.")
+		{
+			if w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould receive a status code of 200 for the response : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 200 for the response.", tests.Success)
+
+			var set auth.JWKS
+			if err := json.NewDecoder(w.Body).Decode(&set); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+			}
+			if len(set.Keys) != 1 || set.Keys[0].KeyType != "RSA" || set.Keys[0].N == "" {
+				t.Fatalf("\t%s\tShould publish the signing key : %+v", tests.Failed, set)
+			}
+			t.Logf("\t%s\tShould publish the signing key.", tests.Success)
+		}
+	}
+}
+
 // postUser400 validates a user can't be created with the endpoint
 // unless a valid user document is submitted.
 func (ut *UserTests) postUser400(t *testing.T) {
@@ -155,6 +499,7 @@ func (ut *UserTests) postUser400(t *testing.T) {
 
 			// Define what we want to see.
 			want := web.ErrorResponse{
+				Code:  "validation.failed",
 				Error: "field validation error",
 				Fields: []web.FieldError{
 					{Field: "name", Error: "name is a required field"},
@@ -253,7 +598,7 @@ func (ut *UserTests) getUser400(t *testing.T) {
 			t.Logf("\t%s\tShould receive a status code of 400 for the response.", tests.Success)
 
 			recv := w.Body.String()
-			resp := `{"error":"ID is not in its proper form"}`
+			resp := `{"code":"user.invalid_id","error":"ID is not in its proper form"}`
 			if resp != recv {
 				t.Log("Got :", recv)
 				t.Log("Want:", resp)
@@ -283,7 +628,7 @@ func (ut *UserTests) getUser403(t *testing.T) {
 			t.Logf("\t%s\tShould receive a status code of 403 for the response.", tests.Success)
 
 			recv := w.Body.String()
-			resp := `{"error":"Attempted action is not allowed"}`
+			resp := `{"code":"user.forbidden","error":"Attempted action is not allowed"}`
 			if resp != recv {
 				t.Log("Got :", recv)
 				t.Log("Want:", resp)
@@ -413,6 +758,7 @@ func (ut *UserTests) crudUser(t *testing.T) {
 	ut.getUser200(t, nu.ID)
 	ut.putUser204(t, nu.ID)
 	ut.putUser403(t, nu.ID)
+	ut.getAudit200(t, nu.ID)
 }
 
 // postUser201 validates a user can be created with the endpoint.
@@ -580,6 +926,130 @@ func (ut *UserTests) putUser204(t *testing.T, id string) {
 	}
 }
 
+// getAudit200 validates the changes made to a user are recorded in the audit
+// trail.
+func (ut *UserTests) getAudit200(t *testing.T, id string) {
+	r := httptest.NewRequest("GET", "/v1/audit?entity_id="+id, nil)
+	w := httptest.NewRecorder()
+
+	r.Header.Set("Authorization", "Bearer "+ut.adminToken)
+
+	ut.app.ServeHTTP(w, r)
+
+	t.Log("Given the need to review the changes made to a user.")
+	{
+		t.Logf("\tTest 0:\tWhen listing the audit trail for user %s.", id)
+		{
+			if w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould receive a status code of 200 for the response : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 200 for the response.", tests.Success)
+
+			var entries []audit.Entry
+			if err := json.NewDecoder(w.Body).Decode(&entries); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+			}
+
+			var actions []string
+			for _, e := range entries {
+				actions = append(actions, e.Action)
+			}
+			want := []string{audit.ActionUpdate, audit.ActionCreate}
+			if diff := cmp.Diff(want, actions); diff != "" {
+				t.Fatalf("\t%s\tShould get the most recent changes first. Diff:\n%s", tests.Failed, diff)
+			}
+			t.Logf("\t%s\tShould get the most recent changes first.", tests.Success)
+
+			if _, ok := entries[0].Diff["name"]; !ok {
+				t.Fatalf("\t%s\tShould see the updated Name in the diff : %v", tests.Failed, entries[0].Diff)
+			}
+			t.Logf("\t%s\tShould see the updated Name in the diff.", tests.Success)
+
+			if entries[0].Actor != tests.AdminID {
+				t.Fatalf("\t%s\tShould record the admin as the actor : got %q", tests.Failed, entries[0].Actor)
+			}
+			t.Logf("\t%s\tShould record the admin as the actor.", tests.Success)
+		}
+
+		t.Log("\tTest 1:\tWhen listing the audit trail page by page.")
+		{
+			r := httptest.NewRequest("GET", "/v1/audit?limit=1&entity_id="+id, nil)
+			w := httptest.NewRecorder()
+			r.Header.Set("Authorization", "Bearer "+ut.adminToken)
+			ut.app.ServeHTTP(w, r)
+
+			r = httptest.NewRequest("GET", "/v1/audit?limit=1&entity_id="+id+"&cursor="+w.Header().Get("X-Next-Cursor"), nil)
+			w = httptest.NewRecorder()
+			r.Header.Set("Authorization", "Bearer "+ut.adminToken)
+			ut.app.ServeHTTP(w, r)
+
+			var entries []audit.Entry
+			if err := json.NewDecoder(w.Body).Decode(&entries); err != nil || len(entries) != 1 || entries[0].Action != audit.ActionCreate {
+				t.Fatalf("\t%s\tShould get the older change on the next page : %v %+v %v", tests.Failed, w.Code, entries, err)
+			}
+			t.Logf("\t%s\tShould get the older change on the next page.", tests.Success)
+		}
+	}
+}
+
+// getBackup200 validates an admin can download a backup that holds the seeded
+// users.
+func (ut *UserTests) getBackup200(t *testing.T) {
+	r := httptest.NewRequest("GET", "/v1/backup", nil)
+	w := httptest.NewRecorder()
+
+	r.Header.Set("Authorization", "Bearer "+ut.adminToken)
+
+	ut.app.ServeHTTP(w, r)
+
+	t.Log("Given the need to back up all data through the API.")
+	{
+		t.Log("\tTest 0:\tWhen downloading a backup as an admin.")
+		{
+			if w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould receive a status code of 200 for the response : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 200 for the response.", tests.Success)
+
+			if ct := w.Header().Get("Content-Type"); ct != "application/gzip" {
+				t.Fatalf("\t%s\tShould receive a gzip archive : got %q", tests.Failed, ct)
+			}
+			t.Logf("\t%s\tShould receive a gzip archive.", tests.Success)
+
+			gz, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to read the archive : %v", tests.Failed, err)
+			}
+			hdr, err := tar.NewReader(gz).Next()
+			if err != nil || hdr.Name != backup.ManifestName {
+				t.Fatalf("\t%s\tShould find the manifest first in the archive : %v", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould find the manifest first in the archive.", tests.Success)
+		}
+	}
+}
+
+// getBackup403 validates that only admins can download backups.
+func (ut *UserTests) getBackup403(t *testing.T) {
+	r := httptest.NewRequest("GET", "/v1/backup", nil)
+	w := httptest.NewRecorder()
+
+	r.Header.Set("Authorization", "Bearer "+ut.userToken)
+
+	ut.app.ServeHTTP(w, r)
+
+	t.Log("Given the need to keep backups away from regular users.")
+	{
+		t.Log("\tTest 0:\tWhen downloading a backup as a regular user.")
+		{
+			if w.Code != http.StatusForbidden {
+				t.Fatalf("\t%s\tShould receive a status code of 403 for the response : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 403 for the response.", tests.Success)
+		}
+	}
+}
+
 // putUser403 validates that a user can't modify users unless they are an admin.
 func (ut *UserTests) putUser403(t *testing.T, id string) {
 	body := `{"name": "Jane Doe"}`
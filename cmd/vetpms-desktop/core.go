@@ -74,10 +74,12 @@ func (c *Core) Localize(lc *i18n.LocalizeConfig) string {
 	return str
 }
 
-// ServerError is a custom error in which server errors are wrapped.
+// ServerError is a custom error in which server errors are wrapped. Reason
+// is the code of the error, such as user.not_found, to react to it.
 type ServerError struct {
-	Code int
-	Err  string `json:"error"`
+	Code   int
+	Reason string `json:"code"`
+	Err    string `json:"error"`
 }
 
 // Implemented the Error interface.
@@ -110,7 +112,7 @@ func (c *Core) doRequest(r *http.Request) ([]byte, error) {
 	// Server returned an error, so let's wrap it into a ServerError.
 	if resp.StatusCode < http.StatusOK || resp.StatusCode > http.StatusIMUsed {
 		servErr := ServerError{Code: resp.StatusCode}
-		if err := json.NewDecoder(resp.Body).Decode(&err); err != nil {
+		if err := json.NewDecoder(resp.Body).Decode(&servErr); err != nil {
 			servErr.Err = resp.Status
 		}
 		return nil, &servErr
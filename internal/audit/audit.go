@@ -0,0 +1,84 @@
+// Package audit records who changed what and when. Domain storages are
+// wrapped so every Create, Update, Delete and Purge appends an Entry to the
+// trail.
+package audit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/os-foundry/vetpms/internal/platform/auth"
+	"github.com/os-foundry/vetpms/internal/platform/database"
+	"github.com/os-foundry/vetpms/internal/platform/web"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// Trail records the mutations made in a single clinic.
+type Trail struct {
+	Storage Storage
+	Clinic  string
+
+	// UnitOfWork makes a mutation and its entry atomic. Without it the
+	// mutation is kept when recording the entry fails.
+	UnitOfWork database.UnitOfWork
+}
+
+// Atomic runs fn, which makes a mutation and records it, in the unit of work
+// of the trail.
+func (t Trail) Atomic(ctx context.Context, fn func(ctx context.Context) error) error {
+	if t.UnitOfWork == nil {
+		return fn(ctx)
+	}
+	return t.UnitOfWork(ctx, fn)
+}
+
+// Record appends an entry for a mutation of an entity to the trail. The actor
+// is taken from the claims and the trace ID from the web values in the
+// context. before is nil for created entities and after for deleted ones.
+func (t Trail) Record(ctx context.Context, entityType, entityID, action string, before, after interface{}, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.audit.Record")
+	defer span.End()
+
+	diff, err := NewDiff(before, after)
+	if err != nil {
+		return errors.Wrap(err, "computing diff")
+	}
+
+	e := Entry{
+		ID:          NewID(now),
+		Actor:       ActorSystem,
+		Clinic:      t.Clinic,
+		EntityType:  entityType,
+		EntityID:    entityID,
+		Action:      action,
+		Diff:        diff,
+		DateCreated: now.UTC(),
+	}
+
+	if claims, ok := ctx.Value(auth.Key).(auth.Claims); ok {
+		e.Actor = claims.Subject
+	}
+	if v, ok := ctx.Value(web.KeyValues).(*web.Values); ok {
+		e.TraceID = v.TraceID
+	}
+
+	if err := t.Storage.Append(ctx, e); err != nil {
+		return errors.Wrapf(err, "recording %s of %s %q", action, entityType, entityID)
+	}
+
+	return nil
+}
+
+// NewID returns a unique entry ID that sorts in the order entries were
+// recorded, so the default order of the trail is chronological.
+func NewID(now time.Time) string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%016x-%s", now.UnixNano(), hex.EncodeToString(b[:]))
+}
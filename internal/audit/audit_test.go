@@ -0,0 +1,172 @@
+package audit_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/os-foundry/vetpms/internal/audit"
+	auditBolt "github.com/os-foundry/vetpms/internal/audit/bolt"
+	"github.com/os-foundry/vetpms/internal/platform/auth"
+	"github.com/os-foundry/vetpms/internal/platform/database"
+	"github.com/os-foundry/vetpms/internal/platform/query"
+	"github.com/os-foundry/vetpms/internal/tests"
+	"github.com/os-foundry/vetpms/internal/user"
+	userBolt "github.com/os-foundry/vetpms/internal/user/bolt"
+	"github.com/pkg/errors"
+)
+
+// TestNewDiff validates only the changed fields of a record end up in a diff.
+func TestNewDiff(t *testing.T) {
+	type record struct {
+		Name string `json:"name"`
+		Cost int    `json:"cost"`
+	}
+
+	t.Log("Given the need to record the changes made to a record.")
+	{
+		t.Log("\tTest 0:\tWhen updating one field.")
+		{
+			d, err := audit.NewDiff(record{"Vax", 10}, record{"Vax", 12})
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to build the diff : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to build the diff.", tests.Success)
+
+			if len(d) != 1 || string(d["cost"].Before) != "10" || string(d["cost"].After) != "12" {
+				t.Fatalf("\t%s\tShould only contain the changed field : %v.", tests.Failed, d)
+			}
+			t.Logf("\t%s\tShould only contain the changed field.", tests.Success)
+		}
+
+		t.Log("\tTest 1:\tWhen creating a record.")
+		{
+			d, err := audit.NewDiff(nil, &record{"Vax", 10})
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to build the diff : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to build the diff.", tests.Success)
+
+			if len(d) != 2 || d["name"].Before != nil {
+				t.Fatalf("\t%s\tShould contain every field without a previous value : %v.", tests.Failed, d)
+			}
+			t.Logf("\t%s\tShould contain every field without a previous value.", tests.Success)
+		}
+	}
+}
+
+// TestNewID validates entry IDs sort in the order they were recorded.
+func TestNewID(t *testing.T) {
+	now := time.Now()
+	a, b := audit.NewID(now), audit.NewID(now.Add(time.Nanosecond))
+	if a >= b {
+		t.Fatalf("\t%s\tShould sort IDs chronologically : %s >= %s.", tests.Failed, a, b)
+	}
+	t.Logf("\t%s\tShould sort IDs chronologically.", tests.Success)
+}
+
+// failingStorage is an audit storage that can't append entries.
+type failingStorage struct {
+	audit.Storage
+}
+
+var errAppend = errors.New("append failed")
+
+func (failingStorage) Append(ctx context.Context, e audit.Entry) error {
+	return errAppend
+}
+
+// TestAtomic validates that a mutation is rolled back when its entry can't
+// be recorded.
+func TestAtomic(t *testing.T) {
+	db, teardown := tests.NewBoltUnit(t)
+	defer teardown()
+
+	trail := audit.Trail{
+		Storage:    failingStorage{auditBolt.Bolt{db}},
+		UnitOfWork: database.BoltUnitOfWork(db),
+	}
+	st := user.Audited{Storage: userBolt.Bolt{db}, Trail: trail}
+
+	t.Log("Given the need to keep mutations and the audit trail in sync.")
+	{
+		t.Log("\tTest 0:\tWhen recording an entry fails.")
+		{
+			ctx := tests.Context()
+			now := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+			nu := user.NewUser{Name: "Jane Doe", Email: "jane@example.com", Roles: []string{auth.RoleUser}, Password: "gophers", PasswordConfirm: "gophers"}
+			if _, err := st.Create(ctx, nu, now); errors.Cause(err) != errAppend {
+				t.Fatalf("\t%s\tShould fail the mutation : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould fail the mutation.", tests.Success)
+
+			us, _, err := st.List(ctx, query.Options{})
+			if err != nil || len(us) != 0 {
+				t.Fatalf("\t%s\tShould roll back the mutation : %d users, %v.", tests.Failed, len(us), err)
+			}
+			t.Logf("\t%s\tShould roll back the mutation.", tests.Success)
+		}
+	}
+}
+
+// TestPurge validates that purges are recorded with their cutoff and count.
+func TestPurge(t *testing.T) {
+	db, teardown := tests.NewBoltUnit(t)
+	defer teardown()
+
+	trail := audit.Trail{
+		Storage:    auditBolt.Bolt{db},
+		UnitOfWork: database.BoltUnitOfWork(db),
+	}
+	st := user.Audited{Storage: userBolt.Bolt{db}, Trail: trail}
+
+	t.Log("Given the need to record purged users.")
+	{
+		t.Log("\tTest 0:\tWhen purging a deleted user.")
+		{
+			ctx := tests.Context()
+			now := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+			admin := auth.Claims{Roles: []string{auth.RoleAdmin}}
+
+			nu := user.NewUser{Name: "Jane Doe", Email: "jane@example.com", Roles: []string{auth.RoleUser}, Password: "gophers", PasswordConfirm: "gophers"}
+			u, err := st.Create(ctx, nu, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create a user : %s.", tests.Failed, err)
+			}
+			if err := st.Delete(ctx, admin, u.ID, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to delete the user : %s.", tests.Failed, err)
+			}
+
+			before := now.Add(time.Hour)
+			if n, err := st.Purge(ctx, before); err != nil || n != 1 {
+				t.Fatalf("\t%s\tShould purge the user : %d, %v.", tests.Failed, n, err)
+			}
+			t.Logf("\t%s\tShould purge the user.", tests.Success)
+
+			opts := query.Options{Filters: []query.Filter{{Field: "action", Value: audit.ActionPurge}}}
+			es, _, err := auditBolt.Bolt{db}.List(ctx, opts)
+			if err != nil || len(es) != 1 {
+				t.Fatalf("\t%s\tShould record the purge : %d entries, %v.", tests.Failed, len(es), err)
+			}
+			t.Logf("\t%s\tShould record the purge.", tests.Success)
+
+			want, err := audit.NewDiff(nil, audit.Purge{Before: before, Count: 1})
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to compute the diff : %s.", tests.Failed, err)
+			}
+			if e := es[0]; e.EntityType != user.EntityType || string(e.Diff["count"].After) != string(want["count"].After) || string(e.Diff["before"].After) != string(want["before"].After) {
+				t.Fatalf("\t%s\tShould record the cutoff and count : %+v.", tests.Failed, e)
+			}
+			t.Logf("\t%s\tShould record the cutoff and count.", tests.Success)
+
+			if n, err := st.Purge(ctx, before); err != nil || n != 0 {
+				t.Fatalf("\t%s\tShould purge nothing the second time : %d, %v.", tests.Failed, n, err)
+			}
+			if es, _, err := (auditBolt.Bolt{db}).List(ctx, opts); err != nil || len(es) != 1 {
+				t.Fatalf("\t%s\tShould not record empty purges : %d entries, %v.", tests.Failed, len(es), err)
+			}
+			t.Logf("\t%s\tShould not record empty purges.", tests.Success)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package bolt
+
+import (
+	"context"
+
+	"github.com/os-foundry/vetpms/internal/audit"
+	"github.com/os-foundry/vetpms/internal/platform/database"
+	"github.com/os-foundry/vetpms/internal/platform/query"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+	"go.opencensus.io/trace"
+)
+
+const auditCollection = "audit"
+
+// Indexes are the secondary indexes of the audit bucket. Every query field
+// has one, so lists seek on them.
+var Indexes = database.FieldIndexes(auditCollection, audit.QueryFields, entryValue)
+
+// entryValue returns the value of a query field of an encoded entry.
+func entryValue(v []byte, field string) (interface{}, error) {
+	e, err := audit.Decode(v)
+	if err != nil {
+		return nil, err
+	}
+	return e.Value(field), nil
+}
+
+// Bolt implements the Storage interface for
+// the bolt database
+type Bolt struct {
+	DB *bolt.DB
+}
+
+// entries adapts a slice of entries so it can be sorted and paged in memory.
+type entries []audit.Entry
+
+func (es entries) Len() int                              { return len(es) }
+func (es entries) ID(i int) string                       { return es[i].ID }
+func (es entries) Value(i int, field string) interface{} { return es[i].Value(field) }
+
+// Append adds an entry to the audit trail.
+func (st Bolt) Append(ctx context.Context, e audit.Entry) error {
+	ctx, span := trace.StartSpan(ctx, "internal.audit.bolt.Append")
+	defer span.End()
+
+	if err := database.BoltUpdate(ctx, st.DB, func(tx *bolt.Tx) error {
+		v, err := e.Encode()
+		if err != nil {
+			return errors.Wrap(err, "encoding audit entry")
+		}
+		return database.BoltPut(tx, auditCollection, Indexes, []byte(e.ID), v)
+	}); err != nil {
+		return errors.Wrap(err, "inserting audit entry")
+	}
+
+	return nil
+}
+
+// List retrieves a page of audit entries from the database. Entry IDs are
+// ordered by time, so chronological lists seek directly to the cursor. Other
+// orders seek on the index of the sort field. Filtered lists only read the
+// entries matching their first filter, which are sorted in memory unless they
+// are sorted by ID.
+func (st Bolt) List(ctx context.Context, opts query.Options) ([]audit.Entry, query.Page, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.audit.bolt.List")
+	defer span.End()
+
+	opts = opts.Normalize()
+	if err := audit.QueryFields.Validate(opts); err != nil {
+		return nil, query.Page{}, err
+	}
+
+	var (
+		list    entries
+		ordered bool
+	)
+	if err := database.BoltView(ctx, st.DB, func(tx *bolt.Tx) error {
+		visit := func(k []byte, v []byte) (bool, error) {
+			e, err := audit.Decode(v)
+			if err != nil {
+				return false, errors.Wrap(err, "decoding audit entry")
+			}
+			if !audit.QueryFields.Match(opts, e.Value) {
+				return false, nil
+			}
+			list = append(list, *e)
+			return true, nil
+		}
+
+		var err error
+		ordered, err = database.SeekBoltIndex(tx, auditCollection, Indexes, opts, audit.QueryFields, visit)
+		return err
+	}); err != nil {
+		return nil, query.Page{}, errors.Wrap(err, "selecting audit entries")
+	}
+
+	idx, page, err := database.PageBolt(list, opts, audit.QueryFields, ordered)
+	if err != nil {
+		return nil, query.Page{}, err
+	}
+
+	es := make([]audit.Entry, len(idx))
+	for i, j := range idx {
+		es[i] = list[j]
+	}
+
+	return es, page, nil
+}
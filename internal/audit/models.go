@@ -0,0 +1,203 @@
+package audit
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/os-foundry/vetpms/internal/platform/envelope"
+	"github.com/os-foundry/vetpms/internal/platform/query"
+	"github.com/pkg/errors"
+)
+
+// The actions that are recorded in the audit trail.
+const (
+	ActionCreate  = "create"
+	ActionUpdate  = "update"
+	ActionDelete  = "delete"
+	ActionRestore = "restore"
+	ActionPurge   = "purge"
+)
+
+// Purge is recorded after purging the entities of a type. It holds the cutoff
+// and the number of entities purged, as purged entities have no ID left to
+// record.
+type Purge struct {
+	Before time.Time `json:"before"`
+	Count  int       `json:"count"`
+}
+
+// ActorSystem is recorded as the actor of mutations that are not made on
+// behalf of an authenticated user, like those of the admin tool.
+const ActorSystem = "system"
+
+// Entry is a single mutation of an entity recorded in the audit trail.
+type Entry struct {
+	ID          string    `db:"entry_id" json:"id"`
+	Actor       string    `db:"actor" json:"actor"`
+	Clinic      string    `db:"clinic" json:"clinic"`
+	EntityType  string    `db:"entity_type" json:"entity_type"`
+	EntityID    string    `db:"entity_id" json:"entity_id"`
+	Action      string    `db:"action" json:"action"`
+	Diff        Diff      `db:"diff" json:"diff"`
+	TraceID     string    `db:"trace_id" json:"trace_id"`
+	DateCreated time.Time `db:"date_created" json:"date_created"`
+}
+
+// Change holds the JSON encoded values of a field before and after a
+// mutation. Before is empty for created entities and After for deleted ones.
+type Change struct {
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+}
+
+// Diff maps the JSON names of the fields that were changed by a mutation to
+// their change.
+type Diff map[string]Change
+
+// Value implements the driver.Valuer interface so a Diff can be stored as a
+// JSON document.
+func (d Diff) Value() (driver.Value, error) {
+	return json.Marshal(d)
+}
+
+// Scan implements the sql.Scanner interface to read a Diff stored as a JSON
+// document.
+func (d *Diff) Scan(src interface{}) error {
+	switch src := src.(type) {
+	case []byte:
+		return json.Unmarshal(src, d)
+	case string:
+		return json.Unmarshal([]byte(src), d)
+	case nil:
+		*d = nil
+		return nil
+	}
+	return fmt.Errorf("unsupported diff type %T", src)
+}
+
+// NewDiff compares the JSON representations of an entity before and after a
+// mutation. Either value may be nil. Fields that are not part of the JSON
+// representation, like password hashes, are never recorded.
+func NewDiff(before, after interface{}) (Diff, error) {
+	b, err := fieldsOf(before)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading fields before")
+	}
+	a, err := fieldsOf(after)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading fields after")
+	}
+
+	d := make(Diff)
+	for k, v := range b {
+		if !bytes.Equal(v, a[k]) {
+			d[k] = Change{Before: v, After: a[k]}
+		}
+	}
+	for k, v := range a {
+		if _, ok := b[k]; !ok {
+			d[k] = Change{After: v}
+		}
+	}
+
+	return d, nil
+}
+
+// fieldsOf returns the JSON encoded fields of a value.
+func fieldsOf(v interface{}) (map[string]json.RawMessage, error) {
+	fields := make(map[string]json.RawMessage)
+	if v == nil {
+		return fields, nil
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(b, []byte("null")) {
+		return fields, nil
+	}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+
+	return fields, nil
+}
+
+// QueryFields are the fields audit entries can be sorted and filtered by
+// when they are listed. Entry IDs are ordered by the time they were recorded.
+var QueryFields = query.Fields{
+	"id":           query.String,
+	"actor":        query.String,
+	"clinic":       query.String,
+	"entity_type":  query.String,
+	"entity_id":    query.String,
+	"action":       query.String,
+	"trace_id":     query.String,
+	"date_created": query.Time,
+}
+
+// Value returns the value of one of the QueryFields of the entry.
+func (e *Entry) Value(field string) interface{} {
+	switch field {
+	case "id":
+		return e.ID
+	case "actor":
+		return e.Actor
+	case "clinic":
+		return e.Clinic
+	case "entity_type":
+		return e.EntityType
+	case "entity_id":
+		return e.EntityID
+	case "action":
+		return e.Action
+	case "trace_id":
+		return e.TraceID
+	case "date_created":
+		return e.DateCreated
+	}
+	return nil
+}
+
+// codec encodes the entries stored in Bolt. Version 1 is the first version
+// stored in an envelope, older entries were gob encoded.
+var codec = envelope.Codec{
+	Version: 1,
+	Legacy: func(b []byte) (interface{}, error) {
+		var e Entry
+		if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&e); err != nil {
+			return nil, err
+		}
+		return e, nil
+	},
+}
+
+// Encode encodes all entry data into a slice of bytes stored in Bolt.
+func (e *Entry) Encode() ([]byte, error) {
+	return codec.Encode(e)
+}
+
+// Decode decodes a slice of bytes stored in Bolt into the entry. Records of
+// older versions are upgraded.
+func (e *Entry) Decode(b []byte) error {
+	var d Entry
+	if err := codec.Decode(b, &d); err != nil {
+		return err
+	}
+	*e = d
+	return nil
+}
+
+// Decode creates a new Entry from a slice of bytes stored in Bolt.
+func Decode(b []byte) (*Entry, error) {
+	var e Entry
+	if err := e.Decode(b); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
@@ -0,0 +1,83 @@
+package postgres
+
+import (
+	"context"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/os-foundry/vetpms/internal/audit"
+	"github.com/os-foundry/vetpms/internal/platform/database"
+	"github.com/os-foundry/vetpms/internal/platform/query"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// Postgres implements the Storage interface for
+// the postgres database
+type Postgres struct {
+	DB *sqlx.DB
+}
+
+// columns maps the audit query fields to their columns.
+var columns = map[string]string{
+	"id":           "entry_id",
+	"actor":        "actor",
+	"clinic":       "clinic",
+	"entity_type":  "entity_type",
+	"entity_id":    "entity_id",
+	"action":       "action",
+	"trace_id":     "trace_id",
+	"date_created": "date_created",
+}
+
+// Append adds an entry to the audit trail. Appending an entry that is already
+// in the trail, like when a backup is restored twice, keeps the existing one.
+func (st Postgres) Append(ctx context.Context, e audit.Entry) error {
+	ctx, span := trace.StartSpan(ctx, "internal.audit.postgres.Append")
+	defer span.End()
+
+	// ON CONFLICT can't be used because of the rules protecting the table.
+	const q = `INSERT INTO audit
+		(entry_id, actor, clinic, entity_type, entity_id, action, diff, trace_id, date_created)
+		SELECT $1, $2, $3, $4, $5, $6, $7, $8, $9
+		WHERE NOT EXISTS (SELECT 1 FROM audit WHERE entry_id = $1)`
+
+	_, err := database.PqDB(ctx, st.DB).ExecContext(ctx, q,
+		e.ID, e.Actor, e.Clinic,
+		e.EntityType, e.EntityID, e.Action,
+		e.Diff, e.TraceID, e.DateCreated,
+	)
+	if err != nil {
+		return errors.Wrap(err, "inserting audit entry")
+	}
+
+	return nil
+}
+
+// List retrieves a page of audit entries from the database.
+func (st Postgres) List(ctx context.Context, opts query.Options) ([]audit.Entry, query.Page, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.audit.postgres.List")
+	defer span.End()
+
+	opts = opts.Normalize()
+
+	where, args, err := database.Where(opts, audit.QueryFields, columns)
+	if err != nil {
+		return nil, query.Page{}, err
+	}
+
+	entries := []audit.Entry{}
+	q := `SELECT * FROM audit` + where + database.OrderBy(opts, columns)
+
+	if err := sqlx.SelectContext(ctx, database.PqDB(ctx, st.DB), &entries, q, args...); err != nil {
+		return nil, query.Page{}, errors.Wrap(err, "selecting audit entries")
+	}
+
+	var page query.Page
+	if len(entries) > opts.Limit {
+		entries = entries[:opts.Limit]
+		last := entries[len(entries)-1]
+		page.NextCursor = query.NewCursor(opts, last.Value(opts.Sort), last.ID)
+	}
+
+	return entries, page, nil
+}
@@ -0,0 +1,14 @@
+package audit
+
+import (
+	"context"
+
+	"github.com/os-foundry/vetpms/internal/platform/query"
+)
+
+// Storage is an entity providing access to the audit trail. Entries can only
+// be appended and read, they are never modified or removed.
+type Storage interface {
+	Append(ctx context.Context, e Entry) error
+	List(ctx context.Context, opts query.Options) ([]Entry, query.Page, error)
+}
@@ -0,0 +1,208 @@
+// Package backup writes all data of the service to a portable archive and
+// restores it. Archives are independent of the database backend, so a backup
+// of a Bolt database can be restored into Postgres and the other way around.
+//
+// An archive is a gzip compressed tar file. Its first entry is manifest.json,
+// followed by one JSON Lines file per entity.
+//
+// Convert copies all data from one backend to another directly, for example
+// when a clinic outgrows Bolt and moves to Postgres.
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/os-foundry/vetpms/internal/audit"
+	"github.com/os-foundry/vetpms/internal/platform/query"
+	"github.com/os-foundry/vetpms/internal/product"
+	"github.com/os-foundry/vetpms/internal/user"
+	"github.com/pkg/errors"
+)
+
+// FormatVersion is the version of the archive format written by this
+// package. It is raised whenever a change would break older readers.
+const FormatVersion = 1
+
+// ManifestName is the name of the manifest entry of an archive.
+const ManifestName = "manifest.json"
+
+var (
+	// ErrChecksum occurs when an entity file doesn't match the checksum of
+	// the manifest.
+	ErrChecksum = errors.New("checksum mismatch")
+
+	// ErrVersion occurs when an archive was written by a newer version of
+	// the service.
+	ErrVersion = errors.New("archive is newer than this version of the service")
+)
+
+// Manifest describes the contents of an archive.
+type Manifest struct {
+	Version int       `json:"version"`
+	Schema  float64   `json:"schema"`
+	Created time.Time `json:"created"`
+	Files   []File    `json:"files"`
+}
+
+// File describes one entity file of an archive.
+type File struct {
+	Entity string `json:"entity"`
+	Name   string `json:"name"`
+	Count  int    `json:"count"`
+	SHA256 string `json:"sha256"`
+}
+
+// Snapshot runs fn with a context in which all reads see the same state of
+// the database.
+type Snapshot func(ctx context.Context, fn func(ctx context.Context) error) error
+
+// Stores are the storages that are backed up, restored and converted.
+type Stores struct {
+	Users    user.Storage
+	Products product.Storage
+	Audit    audit.Storage
+
+	// Snapshot makes the backup consistent. Without it every page is read
+	// on its own, which is only safe while nothing writes to the database.
+	Snapshot Snapshot
+}
+
+// userRecord is how users are stored in an archive. Unlike the API, backups
+// need the password hash and the second factor. The MFA secret stays sealed,
+// so it can only be used with the key of the service.
+type userRecord struct {
+	user.User
+	PasswordHash     []byte   `json:"password_hash"`
+	MFASecret        []byte   `json:"mfa_secret,omitempty"`
+	MFALastStep      int64    `json:"mfa_last_step,omitempty"`
+	MFARecoveryCodes [][]byte `json:"mfa_recovery_codes,omitempty"`
+}
+
+// newUserRecord returns the record the user is archived as.
+func newUserRecord(u user.User) userRecord {
+	return userRecord{
+		User:             u,
+		PasswordHash:     u.PasswordHash,
+		MFASecret:        u.MFA.Secret,
+		MFALastStep:      u.MFA.LastStep,
+		MFARecoveryCodes: u.MFA.RecoveryCodes,
+	}
+}
+
+// entity describes how the records of an entity are read from and written to
+// the storages.
+type entity struct {
+	name string
+
+	// list returns a page of records, all records are listed when it is
+	// called with deleted set to false and true. Records hold everything
+	// that is stored, including what the API leaves out, like password
+	// hashes.
+	list func(ctx context.Context, st Stores, opts query.Options) ([]interface{}, query.Page, error)
+
+	// deleted reports whether list is called for soft deleted records too.
+	deleted bool
+
+	// put decodes and stores a single record.
+	put func(ctx context.Context, st Stores, b []byte) error
+}
+
+// entities are backed up in the order they are restored, which satisfies the
+// references between them.
+var entities = []entity{
+	{
+		name:    "users",
+		deleted: true,
+		list: func(ctx context.Context, st Stores, opts query.Options) ([]interface{}, query.Page, error) {
+			us, page, err := st.Users.List(ctx, opts)
+			recs := make([]interface{}, len(us))
+			for i := range us {
+				recs[i] = newUserRecord(us[i])
+			}
+			return recs, page, err
+		},
+		put: func(ctx context.Context, st Stores, b []byte) error {
+			var r userRecord
+			if err := json.Unmarshal(b, &r); err != nil {
+				return err
+			}
+			r.User.PasswordHash = r.PasswordHash
+			r.User.MFA.Secret = r.MFASecret
+			r.User.MFA.LastStep = r.MFALastStep
+			r.User.MFA.RecoveryCodes = r.MFARecoveryCodes
+			return st.Users.Put(ctx, r.User)
+		},
+	},
+	{
+		name:    "products",
+		deleted: true,
+		list: func(ctx context.Context, st Stores, opts query.Options) ([]interface{}, query.Page, error) {
+			ps, page, err := st.Products.List(ctx, opts)
+			recs := make([]interface{}, len(ps))
+			for i := range ps {
+				recs[i] = ps[i]
+			}
+			return recs, page, err
+		},
+		put: func(ctx context.Context, st Stores, b []byte) error {
+			var p product.Product
+			if err := json.Unmarshal(b, &p); err != nil {
+				return err
+			}
+			return st.Products.Put(ctx, p)
+		},
+	},
+	{
+		name: "sales",
+		list: func(ctx context.Context, st Stores, opts query.Options) ([]interface{}, query.Page, error) {
+			ss, page, err := st.Products.ListSales(ctx, opts)
+			recs := make([]interface{}, len(ss))
+			for i := range ss {
+				recs[i] = ss[i]
+			}
+			return recs, page, err
+		},
+		put: func(ctx context.Context, st Stores, b []byte) error {
+			var s product.Sale
+			if err := json.Unmarshal(b, &s); err != nil {
+				return err
+			}
+			return st.Products.PutSale(ctx, s)
+		},
+	},
+	{
+		name: "audit",
+		list: func(ctx context.Context, st Stores, opts query.Options) ([]interface{}, query.Page, error) {
+			es, page, err := st.Audit.List(ctx, opts)
+			recs := make([]interface{}, len(es))
+			for i := range es {
+				recs[i] = es[i]
+			}
+			return recs, page, err
+		},
+		put: func(ctx context.Context, st Stores, b []byte) error {
+			var e audit.Entry
+			if err := json.Unmarshal(b, &e); err != nil {
+				return err
+			}
+			return st.Audit.Append(ctx, e)
+		},
+	},
+}
+
+// passes returns the values of the deleted option the records of the entity
+// are listed with.
+func (e entity) passes() []bool {
+	if e.deleted {
+		return []bool{false, true}
+	}
+	return []bool{false}
+}
+
+// fileName returns the name of the archive entry holding the records of an
+// entity.
+func (e entity) fileName() string {
+	return e.name + ".jsonl"
+}
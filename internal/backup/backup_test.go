@@ -0,0 +1,272 @@
+package backup_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/os-foundry/vetpms/internal/audit"
+	boltAudit "github.com/os-foundry/vetpms/internal/audit/bolt"
+	pqAudit "github.com/os-foundry/vetpms/internal/audit/postgres"
+	"github.com/os-foundry/vetpms/internal/backup"
+	"github.com/os-foundry/vetpms/internal/platform/auth"
+	"github.com/os-foundry/vetpms/internal/platform/database"
+	"github.com/os-foundry/vetpms/internal/platform/query"
+	"github.com/os-foundry/vetpms/internal/product"
+	boltProduct "github.com/os-foundry/vetpms/internal/product/bolt"
+	pqProduct "github.com/os-foundry/vetpms/internal/product/postgres"
+	"github.com/os-foundry/vetpms/internal/schema"
+	"github.com/os-foundry/vetpms/internal/tests"
+	"github.com/os-foundry/vetpms/internal/user"
+	boltUser "github.com/os-foundry/vetpms/internal/user/bolt"
+	pqUser "github.com/os-foundry/vetpms/internal/user/postgres"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// newStores creates the storages of an empty database of type tp.
+func newStores(t *testing.T, tp string) (backup.Stores, func()) {
+	t.Helper()
+
+	switch tp {
+	case "postgres":
+		db, teardown := tests.NewPqUnit(t)
+		return backup.Stores{
+			Users:    pqUser.Postgres{DB: db},
+			Products: pqProduct.Postgres{DB: db},
+			Audit:    pqAudit.Postgres{DB: db},
+		}, teardown
+	case "bolt":
+		db, teardown := tests.NewBoltUnit(t)
+		return backup.Stores{
+			Users:    boltUser.Bolt{DB: db},
+			Products: boltProduct.Bolt{DB: db},
+			Audit:    boltAudit.Bolt{DB: db},
+			Snapshot: database.BoltSnapshot(db),
+		}, teardown
+	}
+	t.Fatal("tp should be bolt or postgres")
+	return backup.Stores{}, nil
+}
+
+// TestBackup validates that a backup restores all records unchanged.
+func TestBackup(t *testing.T) {
+	tt := []string{"postgres", "bolt"}
+	for _, tc := range tt {
+		t.Log("Given the need to back up and restore all data.")
+		{
+			t.Logf("\tWhen backing up a %s database.", tc)
+			{
+				ctx := context.Background()
+				now := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+				st, teardown := newStores(t, tc)
+				trail := audit.Trail{Storage: st.Audit, Clinic: "main"}
+				ust := user.Audited{Storage: st.Users, Trail: trail}
+				pst := product.Audited{Storage: st.Products, Trail: trail}
+
+				claims := auth.NewClaims("718ffbea-f4a1-4667-8ae3-b349da52675e", []string{auth.RoleAdmin}, now, time.Hour)
+
+				u, err := ust.Create(ctx, user.NewUser{
+					Name:     "Bill Kennedy",
+					Email:    "bill@ardanlabs.com",
+					Roles:    []string{auth.RoleAdmin},
+					Password: "gophers",
+				}, now)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to create a user : %s.", tests.Failed, err)
+				}
+				p, err := pst.Create(ctx, claims, product.NewProduct{Name: "Comic Books", Cost: 10, Quantity: 55}, now)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to create a product : %s.", tests.Failed, err)
+				}
+				if _, err := pst.AddSale(ctx, product.NewSale{Quantity: 2, Paid: 20}, p.ID, now); err != nil {
+					t.Fatalf("\t%s\tShould be able to add a sale : %s.", tests.Failed, err)
+				}
+				if err := ust.Delete(ctx, claims, u.ID, now); err != nil {
+					t.Fatalf("\t%s\tShould be able to delete the user : %s.", tests.Failed, err)
+				}
+
+				var buf bytes.Buffer
+				m, err := backup.Write(ctx, &buf, st, now)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to write a backup : %s.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould be able to write a backup.", tests.Success)
+
+				want := map[string]int{"users": 1, "products": 1, "sales": 1, "audit": 4}
+				for _, f := range m.Files {
+					if f.Count != want[f.Entity] {
+						t.Fatalf("\t%s\tShould back up %d %s : got %d.", tests.Failed, want[f.Entity], f.Entity, f.Count)
+					}
+				}
+				t.Logf("\t%s\tShould back up all records.", tests.Success)
+
+				wantUsers, _, _ := st.Users.List(ctx, query.Options{Deleted: true})
+				wantProducts, _, _ := st.Products.List(ctx, query.Options{})
+				wantSales, _, _ := st.Products.ListSales(ctx, query.Options{})
+				wantEntries, _, _ := st.Audit.List(ctx, query.Options{})
+				teardown()
+
+				dst, teardown := newStores(t, tc)
+				defer teardown()
+
+				// Restoring twice must not duplicate anything.
+				for i := 0; i < 2; i++ {
+					if _, err := backup.Restore(ctx, bytes.NewReader(buf.Bytes()), dst); err != nil {
+						t.Fatalf("\t%s\tShould be able to restore the backup : %s.", tests.Failed, err)
+					}
+				}
+				t.Logf("\t%s\tShould be able to restore the backup.", tests.Success)
+
+				users, _, _ := dst.Users.List(ctx, query.Options{Deleted: true})
+				products, _, _ := dst.Products.List(ctx, query.Options{})
+				sales, _, _ := dst.Products.ListSales(ctx, query.Options{})
+				entries, _, _ := dst.Audit.List(ctx, query.Options{})
+
+				for _, d := range []string{
+					cmp.Diff(wantUsers, users),
+					cmp.Diff(wantProducts, products),
+					cmp.Diff(wantSales, sales),
+					cmp.Diff(wantEntries, entries),
+				} {
+					if d != "" {
+						t.Fatalf("\t%s\tShould restore the same records. Diff:\n%s", tests.Failed, d)
+					}
+				}
+				t.Logf("\t%s\tShould restore the same records.", tests.Success)
+
+				buf.Truncate(buf.Len() - 10)
+				if _, err := backup.Restore(ctx, &buf, dst); err == nil {
+					t.Fatalf("\t%s\tShould not restore a damaged backup.", tests.Failed)
+				}
+				t.Logf("\t%s\tShould not restore a damaged backup.", tests.Success)
+			}
+		}
+	}
+}
+
+// TestConvert validates that an interrupted conversion resumes and copies all
+// records.
+func TestConvert(t *testing.T) {
+	tt := []string{"postgres", "bolt"}
+	for _, tc := range tt {
+		t.Log("Given the need to convert all data to another database.")
+		{
+			t.Logf("\tWhen converting a %s database to bolt.", tc)
+			{
+				ctx := context.Background()
+				now := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+				src, teardown := newStores(t, tc)
+				defer teardown()
+
+				nu := user.NewUser{
+					Name:            "Anna Walker",
+					Email:           "anna@example.com",
+					Roles:           []string{auth.RoleAdmin},
+					Password:        "goroutines",
+					PasswordConfirm: "goroutines",
+				}
+				u, err := src.Users.Create(ctx, nu, now)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to create a user : %s.", tests.Failed, err)
+				}
+
+				claims := auth.NewClaims("718ffbea-f4a1-4667-8ae3-b349da52675e", []string{auth.RoleAdmin}, now, time.Hour)
+				for _, name := range []string{"Comic Books", "McDonalds Toys"} {
+					p, err := src.Products.Create(ctx, claims, product.NewProduct{Name: name, Cost: 10, Quantity: 5}, now)
+					if err != nil {
+						t.Fatalf("\t%s\tShould be able to create a product : %s.", tests.Failed, err)
+					}
+					if _, err := src.Products.AddSale(ctx, product.NewSale{Quantity: 1, Paid: 10}, p.ID, now); err != nil {
+						t.Fatalf("\t%s\tShould be able to add a sale : %s.", tests.Failed, err)
+					}
+				}
+
+				db, err := bolt.Open("convert.db", 0600, &bolt.Options{Timeout: time.Second})
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to open the target : %s.", tests.Failed, err)
+				}
+				defer os.Remove("convert.db")
+				defer db.Close()
+				if err := schema.Migrate(db); err != nil {
+					t.Fatalf("\t%s\tShould be able to migrate the target : %s.", tests.Failed, err)
+				}
+				dst := backup.Stores{
+					Users:    boltUser.Bolt{DB: db},
+					Products: boltProduct.Bolt{DB: db},
+					Audit:    boltAudit.Bolt{DB: db},
+				}
+
+				// Interrupt the conversion after the products were copied.
+				errInterrupted := errors.New("interrupted")
+				var saved backup.Progress
+				_, err = backup.Convert(ctx, src, dst, backup.Progress{}, func(p backup.Progress) error {
+					if p.Entity == "sales" {
+						return errInterrupted
+					}
+					saved = p
+					return nil
+				})
+				if errors.Cause(err) != errInterrupted {
+					t.Fatalf("\t%s\tShould stop when interrupted : %v.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould stop when interrupted.", tests.Success)
+
+				if _, err := backup.Verify(ctx, src, dst); errors.Cause(err) != backup.ErrMismatch {
+					t.Fatalf("\t%s\tShould detect the missing sales : %v.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould detect the missing sales.", tests.Success)
+
+				// Interrupt it again after the sales were copied, before the
+				// progress was saved, so the page is copied again.
+				_, err = backup.Convert(ctx, src, dst, saved, func(p backup.Progress) error {
+					if p.Entity == "audit" {
+						return errInterrupted
+					}
+					saved = p
+					return nil
+				})
+				if errors.Cause(err) != errInterrupted {
+					t.Fatalf("\t%s\tShould stop when interrupted : %v.", tests.Failed, err)
+				}
+
+				p, err := backup.Convert(ctx, src, dst, saved, func(backup.Progress) error { return nil })
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to resume the conversion : %s.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould be able to resume the conversion.", tests.Success)
+
+				if !p.Done || p.Copied["users"] != 1 || p.Copied["products"] != 2 || p.Copied["sales"] != 2 {
+					t.Fatalf("\t%s\tShould copy every record once : got %v.", tests.Failed, p.Copied)
+				}
+				t.Logf("\t%s\tShould copy every record once.", tests.Success)
+
+				files, err := backup.Verify(ctx, src, dst)
+				if err != nil {
+					t.Fatalf("\t%s\tShould verify the converted records : %s.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould verify the converted records : %v.", tests.Success, files)
+
+				// Only the password hash of the copy differs.
+				copied, err := dst.Users.Retrieve(ctx, claims, u.ID)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to retrieve the copied user : %s.", tests.Failed, err)
+				}
+				copied.PasswordHash = append([]byte(nil), copied.PasswordHash...)
+				copied.PasswordHash[len(copied.PasswordHash)-1]++
+				if err := dst.Users.Put(ctx, *copied); err != nil {
+					t.Fatalf("\t%s\tShould be able to change the copied user : %s.", tests.Failed, err)
+				}
+				if _, err := backup.Verify(ctx, src, dst); errors.Cause(err) != backup.ErrMismatch {
+					t.Fatalf("\t%s\tShould detect a different password hash : %v.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould detect a different password hash.", tests.Success)
+			}
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/os-foundry/vetpms/internal/platform/query"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// ErrMismatch occurs when the records of the target of a conversion don't
+// match those of the source.
+var ErrMismatch = errors.New("converted records don't match")
+
+// Progress records how far a conversion got, so an interrupted conversion
+// resumes where it stopped. Entity, Deleted and Cursor point at the next page
+// to copy.
+type Progress struct {
+	Entity  string         `json:"entity"`
+	Deleted bool           `json:"deleted"`
+	Cursor  string         `json:"cursor"`
+	Copied  map[string]int `json:"copied"`
+	Done    bool           `json:"done"`
+}
+
+// clone returns a copy of the progress that doesn't share the counts of
+// copied records, so progress handed to save is never changed afterwards.
+func (p Progress) clone() Progress {
+	copied := make(map[string]int, len(p.Copied))
+	for k, v := range p.Copied {
+		copied[k] = v
+	}
+	p.Copied = copied
+	return p
+}
+
+// pass is the listing of the live or deleted records of an entity.
+type pass struct {
+	entity  entity
+	deleted bool
+}
+
+// Convert copies all records from src to dst, page by page, starting at the
+// position of p. The progress is passed to save after every page. Records
+// keep their IDs and timestamps and replace existing records with the same
+// ID, so copying a page again after an interruption is safe. A page only
+// counts as copied once its progress was saved, so a page copied again isn't
+// counted twice. The returned progress is the last one saved.
+func Convert(ctx context.Context, src, dst Stores, p Progress, save func(Progress) error) (Progress, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.backup.Convert")
+	defer span.End()
+
+	if p.Done {
+		return p, nil
+	}
+	p = p.clone()
+
+	var passes []pass
+	for _, e := range entities {
+		for _, deleted := range e.passes() {
+			passes = append(passes, pass{entity: e, deleted: deleted})
+		}
+	}
+
+	// Skip the passes that were completed before an interruption.
+	i := 0
+	if p.Entity != "" {
+		for i < len(passes) && (passes[i].entity.name != p.Entity || passes[i].deleted != p.Deleted) {
+			i++
+		}
+		if i == len(passes) {
+			return p, errors.Errorf("unknown position %s", p.Entity)
+		}
+	}
+
+	for ; i < len(passes); i++ {
+		e, deleted := passes[i].entity, passes[i].deleted
+
+		for {
+			opts := query.Options{Limit: query.MaxLimit, Cursor: p.Cursor, Deleted: deleted}
+			recs, page, err := e.list(ctx, src, opts)
+			if err != nil {
+				return p, errors.Wrapf(err, "reading %s", e.name)
+			}
+
+			for _, r := range recs {
+				b, err := json.Marshal(r)
+				if err != nil {
+					return p, errors.Wrapf(err, "encoding %s", e.name)
+				}
+				if err := e.put(ctx, dst, b); err != nil {
+					return p, errors.Wrapf(err, "writing %s", e.name)
+				}
+			}
+
+			// Count the page, and move on to the next pass when it was the
+			// last page.
+			next := p.clone()
+			next.Entity, next.Deleted = e.name, deleted
+			next.Copied[e.name] += len(recs)
+			next.Cursor = page.NextCursor
+			if next.Cursor == "" {
+				if i+1 < len(passes) {
+					next.Entity, next.Deleted = passes[i+1].entity.name, passes[i+1].deleted
+				} else {
+					next.Done = true
+				}
+			}
+
+			if err := save(next); err != nil {
+				return p, errors.Wrap(err, "saving progress")
+			}
+			p = next
+
+			if page.NextCursor == "" {
+				break
+			}
+		}
+	}
+
+	return p, nil
+}
+
+// Verify compares the number of records and their checksums between src and
+// dst. It returns the files describing the records of src.
+func Verify(ctx context.Context, src, dst Stores) ([]File, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.backup.Verify")
+	defer span.End()
+
+	var files []File
+	for _, e := range entities {
+		want, err := summarize(ctx, src, e)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading source %s", e.name)
+		}
+		got, err := summarize(ctx, dst, e)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading target %s", e.name)
+		}
+
+		if got != want {
+			return nil, errors.Wrap(ErrMismatch, fmt.Sprintf("%s: source has %d records with checksum %s, target has %d with %s",
+				e.name, want.Count, want.SHA256, got.Count, got.SHA256))
+		}
+		files = append(files, want)
+	}
+
+	return files, nil
+}
+
+// summarize counts the records of an entity and computes their checksum.
+// Records are checksummed in the layout they are archived and converted in,
+// which holds everything that is stored, like the password hashes and second
+// factors of users. Backends may order records and encode values like JSON
+// documents differently, so the checksum is computed over the sorted
+// checksums of the canonical JSON encoding of every record.
+func summarize(ctx context.Context, st Stores, e entity) (File, error) {
+	file := File{Entity: e.name}
+
+	var sums []string
+	for _, deleted := range e.passes() {
+		opts := query.Options{Limit: query.MaxLimit, Deleted: deleted}
+		for {
+			recs, page, err := e.list(ctx, st, opts)
+			if err != nil {
+				return File{}, err
+			}
+
+			for _, r := range recs {
+				b, err := canonical(r)
+				if err != nil {
+					return File{}, errors.Wrap(err, "encoding record")
+				}
+				sum := sha256.Sum256(b)
+				sums = append(sums, hex.EncodeToString(sum[:]))
+			}
+
+			if page.NextCursor == "" {
+				break
+			}
+			opts.Cursor = page.NextCursor
+		}
+	}
+
+	sort.Strings(sums)
+
+	h := sha256.New()
+	for _, s := range sums {
+		h.Write([]byte(s))
+	}
+
+	file.Count = len(sums)
+	file.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return file, nil
+}
+
+// canonical returns the JSON encoding of v with sorted keys and without
+// insignificant whitespace.
+func canonical(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc interface{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(doc)
+}
@@ -0,0 +1,150 @@
+package backup
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/os-foundry/vetpms/internal/schema"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// Restore stores all records of the archive read from r in the storages.
+// Records keep their IDs and timestamps and replace existing records with the
+// same ID, so restoring an archive twice is safe. The whole archive is
+// verified against the manifest before anything is stored.
+func Restore(ctx context.Context, r io.Reader, st Stores) (Manifest, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.backup.Restore")
+	defer span.End()
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return Manifest{}, errors.Wrap(err, "reading archive")
+	}
+	tr := tar.NewReader(gz)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return Manifest{}, errors.Wrap(err, "reading archive")
+	}
+	if hdr.Name != ManifestName {
+		return Manifest{}, errors.Errorf("archive starts with %s instead of %s", hdr.Name, ManifestName)
+	}
+
+	var m Manifest
+	if err := json.NewDecoder(tr).Decode(&m); err != nil {
+		return Manifest{}, errors.Wrap(err, "decoding manifest")
+	}
+	if m.Version > FormatVersion || m.Schema > schema.Version() {
+		return Manifest{}, ErrVersion
+	}
+
+	// Extract the entity files, verifying them as they are read.
+	files := make(map[string]*os.File)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	sums := make(map[string]string, len(m.Files))
+	for _, f := range m.Files {
+		sums[f.Name] = f.SHA256
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			// Reading the rest of the stream verifies the gzip checksum.
+			if _, err := io.Copy(ioutil.Discard, gz); err != nil {
+				return Manifest{}, errors.Wrap(err, "reading archive")
+			}
+			break
+		}
+		if err != nil {
+			return Manifest{}, errors.Wrap(err, "reading archive")
+		}
+
+		sum, ok := sums[hdr.Name]
+		if !ok {
+			return Manifest{}, errors.Errorf("%s is not in the manifest", hdr.Name)
+		}
+
+		f, err := ioutil.TempFile("", "vetpms-restore")
+		if err != nil {
+			return Manifest{}, errors.Wrap(err, "creating temporary file")
+		}
+		files[hdr.Name] = f
+
+		h := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(f, h), tr); err != nil {
+			return Manifest{}, errors.Wrapf(err, "reading %s", hdr.Name)
+		}
+		if hex.EncodeToString(h.Sum(nil)) != sum {
+			return Manifest{}, errors.Wrap(ErrChecksum, hdr.Name)
+		}
+	}
+
+	for _, f := range m.Files {
+		if files[f.Name] == nil {
+			return Manifest{}, errors.Errorf("%s is missing from the archive", f.Name)
+		}
+	}
+
+	// Store the records in the order of the entities, not of the manifest.
+	for _, e := range entities {
+		for _, file := range m.Files {
+			if file.Entity != e.name {
+				continue
+			}
+
+			f := files[file.Name]
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return Manifest{}, errors.Wrap(err, "reading temporary file")
+			}
+
+			n, err := restoreEntity(ctx, st, e, f)
+			if err != nil {
+				return Manifest{}, errors.Wrapf(err, "restoring %s", file.Name)
+			}
+			if n != file.Count {
+				return Manifest{}, fmt.Errorf("restoring %s: restored %d records instead of %d", file.Name, n, file.Count)
+			}
+		}
+	}
+
+	return m, nil
+}
+
+// restoreEntity stores the JSON Lines records of an entity read from r and
+// returns their number.
+func restoreEntity(ctx context.Context, st Stores, e entity, r io.Reader) (int, error) {
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 16<<20)
+
+	var n int
+	for s.Scan() {
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+		if err := e.put(ctx, st, s.Bytes()); err != nil {
+			return n, errors.Wrapf(err, "record %d", n+1)
+		}
+		n++
+	}
+	if err := s.Err(); err != nil {
+		return n, err
+	}
+
+	return n, nil
+}
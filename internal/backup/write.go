@@ -0,0 +1,140 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/os-foundry/vetpms/internal/platform/query"
+	"github.com/os-foundry/vetpms/internal/schema"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// Write writes a backup of all data in the storages to w. The records are
+// spooled to temporary files first, since the manifest at the start of the
+// archive holds their counts and checksums.
+func Write(ctx context.Context, w io.Writer, st Stores, now time.Time) (Manifest, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.backup.Write")
+	defer span.End()
+
+	m := Manifest{
+		Version: FormatVersion,
+		Schema:  schema.Version(),
+		Created: now.UTC(),
+	}
+
+	files := make([]*os.File, 0, len(entities))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	read := func(ctx context.Context) error {
+		for _, e := range entities {
+			f, err := ioutil.TempFile("", "vetpms-backup-"+e.name)
+			if err != nil {
+				return errors.Wrap(err, "creating temporary file")
+			}
+			files = append(files, f)
+
+			file, err := writeEntity(ctx, st, e, f)
+			if err != nil {
+				return errors.Wrapf(err, "backing up %s", e.name)
+			}
+			m.Files = append(m.Files, file)
+		}
+		return nil
+	}
+
+	if st.Snapshot != nil {
+		if err := st.Snapshot(ctx, read); err != nil {
+			return Manifest{}, err
+		}
+	} else if err := read(ctx); err != nil {
+		return Manifest{}, err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	mb, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return Manifest{}, errors.Wrap(err, "encoding manifest")
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: ManifestName, Mode: 0600, Size: int64(len(mb)), ModTime: m.Created}); err != nil {
+		return Manifest{}, errors.Wrap(err, "writing manifest")
+	}
+	if _, err := tw.Write(mb); err != nil {
+		return Manifest{}, errors.Wrap(err, "writing manifest")
+	}
+
+	for i, f := range files {
+		info, err := f.Stat()
+		if err != nil {
+			return Manifest{}, errors.Wrap(err, "reading temporary file")
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return Manifest{}, errors.Wrap(err, "reading temporary file")
+		}
+
+		hdr := tar.Header{Name: m.Files[i].Name, Mode: 0600, Size: info.Size(), ModTime: m.Created}
+		if err := tw.WriteHeader(&hdr); err != nil {
+			return Manifest{}, errors.Wrapf(err, "writing %s", hdr.Name)
+		}
+		if _, err := io.Copy(tw, f); err != nil {
+			return Manifest{}, errors.Wrapf(err, "writing %s", hdr.Name)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return Manifest{}, errors.Wrap(err, "writing archive")
+	}
+	if err := gz.Close(); err != nil {
+		return Manifest{}, errors.Wrap(err, "writing archive")
+	}
+
+	return m, nil
+}
+
+// writeEntity writes all records of an entity to w as JSON Lines.
+func writeEntity(ctx context.Context, st Stores, e entity, w io.Writer) (File, error) {
+	h := sha256.New()
+	enc := json.NewEncoder(io.MultiWriter(w, h))
+
+	file := File{Entity: e.name, Name: e.fileName()}
+
+	for _, deleted := range e.passes() {
+		opts := query.Options{Limit: query.MaxLimit, Deleted: deleted}
+		for {
+			recs, page, err := e.list(ctx, st, opts)
+			if err != nil {
+				return File{}, err
+			}
+
+			for _, r := range recs {
+				if err := enc.Encode(r); err != nil {
+					return File{}, errors.Wrap(err, "writing record")
+				}
+				file.Count++
+			}
+
+			if page.NextCursor == "" {
+				break
+			}
+			opts.Cursor = page.NextCursor
+		}
+	}
+
+	file.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return file, nil
+}
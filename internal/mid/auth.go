@@ -4,22 +4,44 @@ import (
 	"context"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/os-foundry/vetpms/internal/platform/auth"
 	"github.com/os-foundry/vetpms/internal/platform/web"
+	"github.com/os-foundry/vetpms/internal/user"
 	"github.com/pkg/errors"
 	"go.opencensus.io/trace"
 )
 
+// errForbidden is the message of ErrForbidden.
+var errForbidden = errors.New("you are not authorized for that action")
+
 // ErrForbidden is returned when an authenticated user does not have a
 // sufficient role for an action.
-var ErrForbidden = web.NewRequestError(
-	errors.New("you are not authorized for that action"),
-	http.StatusForbidden,
+var ErrForbidden = web.NewRequestError(errForbidden, http.StatusForbidden)
+
+// These errors are returned when a request is not authenticated.
+var (
+	errAuthHeader   = errors.New("expected authorization header format: Bearer <token> or ApiKey <key>")
+	errSessionEnded = errors.New("session was revoked or expired")
 )
 
-// Authenticate validates a JWT from the `Authorization` header.
-func Authenticate(authenticator *auth.Authenticator) web.Middleware {
+// Sessions reports whether the session a token was issued for is still
+// active, and records when it was last seen.
+type Sessions interface {
+	SeeSession(ctx context.Context, id string, now time.Time) (bool, error)
+}
+
+// APIKeys authenticates the API keys of integrations and service accounts.
+type APIKeys interface {
+	AuthenticateAPIKey(ctx context.Context, now time.Time, key string) (auth.Claims, error)
+}
+
+// Authenticate validates a JWT from the `Authorization` header. Tokens issued
+// for a session are rejected as soon as the session is revoked, every request
+// checks it. Instead of a token, clients can send an API key in the
+// `X-API-Key` header or as `Authorization: ApiKey <key>`.
+func Authenticate(authenticator *auth.Authenticator, sessions Sessions, keys APIKeys) web.Middleware {
 
 	// This is the actual middleware function to be executed.
 	f := func(after web.Handler) web.Handler {
@@ -30,11 +52,18 @@ func Authenticate(authenticator *auth.Authenticator) web.Middleware {
 			defer span.End()
 
 			// Parse the authorization header. Expected header is of
-			// the format `Bearer <token>`.
+			// the format `Bearer <token>` or `ApiKey <key>`.
 			parts := strings.Split(r.Header.Get("Authorization"), " ")
+			key := r.Header.Get("X-API-Key")
+			if len(parts) == 2 && strings.ToLower(parts[0]) == "apikey" {
+				key = parts[1]
+			}
+			if key != "" {
+				return authenticateKey(ctx, w, r, params, keys, key, after)
+			}
+
 			if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
-				err := errors.New("expected authorization header format: Bearer <token>")
-				return web.NewRequestError(err, http.StatusUnauthorized)
+				return web.NewRequestError(errAuthHeader, http.StatusUnauthorized)
 			}
 
 			claims, err := authenticator.ParseClaims(parts[1])
@@ -42,6 +71,21 @@ func Authenticate(authenticator *auth.Authenticator) web.Middleware {
 				return web.NewRequestError(err, http.StatusUnauthorized)
 			}
 
+			if claims.SessionID != "" {
+				v, ok := ctx.Value(web.KeyValues).(*web.Values)
+				if !ok {
+					return web.NewShutdownError("web value missing from context")
+				}
+
+				active, err := sessions.SeeSession(ctx, claims.SessionID, v.Now)
+				if err != nil {
+					return errors.Wrap(err, "checking session")
+				}
+				if !active {
+					return web.NewRequestError(errSessionEnded, http.StatusUnauthorized)
+				}
+			}
+
 			// Add claims to the context so they can be retrieved later.
 			ctx = context.WithValue(ctx, auth.Key, claims)
 
@@ -54,6 +98,56 @@ func Authenticate(authenticator *auth.Authenticator) web.Middleware {
 	return f
 }
 
+// authenticateKey authenticates a request with an API key.
+func authenticateKey(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string, keys APIKeys, key string, after web.Handler) error {
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	claims, err := keys.AuthenticateAPIKey(ctx, v.Now, key)
+	if err != nil {
+		if err == user.ErrAuthenticationFailure {
+			return web.NewRequestError(err, http.StatusUnauthorized)
+		}
+		return errors.Wrap(err, "authenticating api key")
+	}
+
+	// Add claims to the context so they can be retrieved later.
+	ctx = context.WithValue(ctx, auth.Key, claims)
+
+	return after(ctx, w, r, params)
+}
+
+// HasScope validates that the claims of a request authenticated with an API
+// key allow the scope. Other requests are allowed every scope.
+func HasScope(scope string) web.Middleware {
+
+	// This is the actual middleware function to be executed.
+	f := func(after web.Handler) web.Handler {
+
+		h := func(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+			ctx, span := trace.StartSpan(ctx, "internal.mid.HasScope")
+			defer span.End()
+
+			claims, ok := ctx.Value(auth.Key).(auth.Claims)
+			if !ok {
+				return errors.New("claims missing from context: HasScope called without/before Authenticate")
+			}
+
+			if !claims.HasScope(scope) {
+				return ErrForbidden
+			}
+
+			return after(ctx, w, r, params)
+		}
+
+		return h
+	}
+
+	return f
+}
+
 // HasRole validates that an authenticated user has at least one role from a
 // specified list. This method constructs the actual function that is used.
 func HasRole(roles ...string) web.Middleware {
@@ -0,0 +1,24 @@
+package mid
+
+import "github.com/os-foundry/vetpms/internal/platform/web"
+
+// The errors sent to clients have stable codes and are translated to the
+// languages of the API.
+func init() {
+	web.RegisterError(errForbidden, "auth.forbidden", "The role or the scopes of the API key don't allow the request.", web.Translations{
+		"nl": "u bent niet bevoegd voor deze actie",
+		"bg": "нямате право на това действие",
+	})
+	web.RegisterError(errAuthHeader, "auth.invalid_header", "The Authorization header isn't a bearer token or an API key.", web.Translations{
+		"nl": "verwachte vorm van de authorization header: Bearer <token> of ApiKey <key>",
+		"bg": "очакван формат на заглавката authorization: Bearer <token> или ApiKey <key>",
+	})
+	web.RegisterError(errSessionEnded, "auth.session_ended", "The session of the token was ended or expired. Sign in again.", web.Translations{
+		"nl": "sessie is ingetrokken of verlopen",
+		"bg": "сесията е прекратена или изтекла",
+	})
+	web.RegisterError(errTooManyRequests, "ratelimit.exceeded", "The quota of requests is used up. The Retry-After header tells when to retry.", web.Translations{
+		"nl": "te veel verzoeken, probeer het later opnieuw",
+		"bg": "твърде много заявки, опитайте отново по-късно",
+	})
+}
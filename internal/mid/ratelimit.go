@@ -0,0 +1,70 @@
+package mid
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+
+	"github.com/os-foundry/vetpms/internal/platform/auth"
+	"github.com/os-foundry/vetpms/internal/platform/ratelimit"
+	"github.com/os-foundry/vetpms/internal/platform/web"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// errTooManyRequests is the message of ErrTooManyRequests.
+var errTooManyRequests = errors.New("too many requests, try again later")
+
+// ErrTooManyRequests is returned when a client used up its quota for a route.
+var ErrTooManyRequests = web.NewRequestError(errTooManyRequests, http.StatusTooManyRequests)
+
+// RateLimit limits requests to the quota, counted separately for every
+// principal. Requests are counted by their API key or the subject of their
+// claims when they are authenticated and otherwise by the IP address they
+// come from, so the middleware counts by principal only when it is used after
+// Authenticate. Routes sharing a name share their quota. A nil limiter or
+// unlimited quota allows every request.
+func RateLimit(limiter ratelimit.Limiter, name string, q ratelimit.Quota) web.Middleware {
+
+	// This is the actual middleware function to be executed.
+	f := func(after web.Handler) web.Handler {
+		if limiter == nil || q.Unlimited() {
+			return after
+		}
+
+		// Wrap this handler around the next one provided.
+		h := func(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+			ctx, span := trace.StartSpan(ctx, "internal.mid.RateLimit")
+			defer span.End()
+
+			v, ok := ctx.Value(web.KeyValues).(*web.Values)
+			if !ok {
+				return web.NewShutdownError("web value missing from context")
+			}
+
+			key := name + ":ip:" + web.RemoteIP(r)
+			if claims, ok := ctx.Value(auth.Key).(auth.Claims); ok {
+				key = name + ":sub:" + claims.Subject
+				if claims.APIKeyID != "" {
+					key = name + ":key:" + claims.APIKeyID
+				}
+			}
+
+			wait, err := limiter.Take(ctx, key, q, v.Now)
+			if err != nil {
+				return errors.Wrap(err, "limiting rate")
+			}
+			if wait > 0 {
+				w.Header().Set("Retry-After", fmt.Sprint(math.Ceil(wait.Seconds())))
+				return ErrTooManyRequests
+			}
+
+			return after(ctx, w, r, params)
+		}
+
+		return h
+	}
+
+	return f
+}
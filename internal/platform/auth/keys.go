@@ -0,0 +1,210 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+)
+
+// reloadInterval is how often a KeyStore reads its directory again at most
+// when it is asked for an unknown key.
+const reloadInterval = 10 * time.Second
+
+// KeyStore holds the keys tokens are signed and verified with, identified by
+// their key id (kid). The active key signs new tokens, the others only verify
+// the tokens signed before they were rotated out.
+type KeyStore struct {
+	dir       string
+	activeKID string
+	active    *rsa.PrivateKey
+
+	mu     sync.RWMutex
+	public map[string]*rsa.PublicKey
+	loaded time.Time
+}
+
+// NewKeyStore constructs a KeyStore holding a single key.
+func NewKeyStore(kid string, key *rsa.PrivateKey) *KeyStore {
+	return &KeyStore{
+		activeKID: kid,
+		active:    key,
+		public:    map[string]*rsa.PublicKey{kid: &key.PublicKey},
+	}
+}
+
+// LoadKeyDir constructs a KeyStore from the PEM files in a directory. The kid
+// of a key is the name of its file without the .pem extension. The private
+// key with the highest kid is active, so keys are best named by the time they
+// were created. Public keys can be added to verify tokens of other services.
+//
+// Keys added to the directory later are picked up when a token signed with
+// them is verified, so replicas can be restarted one at a time after a
+// rotation.
+func LoadKeyDir(dir string) (*KeyStore, error) {
+	public, private, err := readKeyDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(private) == 0 {
+		return nil, errors.Errorf("no private keys in %s", dir)
+	}
+
+	kids := make([]string, 0, len(private))
+	for kid := range private {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+	kid := kids[len(kids)-1]
+
+	ks := KeyStore{
+		dir:       dir,
+		activeKID: kid,
+		active:    private[kid],
+		public:    public,
+		loaded:    time.Now(),
+	}
+	return &ks, nil
+}
+
+// readKeyDir reads the public keys of all PEM files in a directory, and the
+// private keys of those holding one.
+func readKeyDir(dir string) (map[string]*rsa.PublicKey, map[string]*rsa.PrivateKey, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "listing keys")
+	}
+
+	public := make(map[string]*rsa.PublicKey)
+	private := make(map[string]*rsa.PrivateKey)
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "reading key")
+		}
+		kid := strings.TrimSuffix(filepath.Base(file), ".pem")
+
+		if strings.Contains(string(b), "PRIVATE KEY") {
+			key, err := jwt.ParseRSAPrivateKeyFromPEM(b)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "parsing key %s", kid)
+			}
+			private[kid] = key
+			public[kid] = &key.PublicKey
+			continue
+		}
+
+		key, err := jwt.ParseRSAPublicKeyFromPEM(b)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "parsing key %s", kid)
+		}
+		public[kid] = key
+	}
+
+	return public, private, nil
+}
+
+// Active returns the key new tokens are signed with and its kid.
+func (ks *KeyStore) Active() (string, *rsa.PrivateKey) {
+	return ks.activeKID, ks.active
+}
+
+// PublicKey returns the key verifying tokens with the kid. It is a
+// KeyLookupFunc.
+func (ks *KeyStore) PublicKey(kid string) (*rsa.PublicKey, error) {
+	ks.mu.RLock()
+	key, ok := ks.public[kid]
+	reload := ks.dir != "" && time.Since(ks.loaded) > reloadInterval
+	ks.mu.RUnlock()
+
+	if ok {
+		return key, nil
+	}
+
+	// The key may have been added by a rotation since the keys were read.
+	if reload {
+		ks.mu.Lock()
+		defer ks.mu.Unlock()
+
+		if time.Since(ks.loaded) > reloadInterval {
+			ks.loaded = time.Now()
+			if public, _, err := readKeyDir(ks.dir); err == nil {
+				public[ks.activeKID] = &ks.active.PublicKey
+				ks.public = public
+			}
+		}
+		if key, ok := ks.public[kid]; ok {
+			return key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unrecognized key id %q", kid)
+}
+
+// JWK is a public key in the JSON Web Key format of RFC 7517.
+type JWK struct {
+	KeyType string `json:"kty"`
+	Use     string `json:"use"`
+	KeyID   string `json:"kid"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+}
+
+// PublicKey decodes the RSA public key of the JWK.
+func (k JWK) PublicKey() (*rsa.PublicKey, error) {
+	if k.KeyType != "RSA" {
+		return nil, errors.Errorf("unsupported key type %q", k.KeyType)
+	}
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding modulus")
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding exponent")
+	}
+
+	key := rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}
+	if key.N.Sign() == 0 || key.E == 0 {
+		return nil, errors.New("empty modulus or exponent")
+	}
+	return &key, nil
+}
+
+// JWKS is a JSON Web Key Set, the format services publish the keys verifying
+// their tokens in.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys of the store ordered by kid.
+func (ks *KeyStore) JWKS() JWKS {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	set := JWKS{Keys: []JWK{}}
+	for kid, key := range ks.public {
+		set.Keys = append(set.Keys, JWK{
+			KeyType: "RSA",
+			Use:     "sig",
+			KeyID:   kid,
+			N:       base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:       base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].KeyID < set.Keys[j].KeyID })
+
+	return set
+}
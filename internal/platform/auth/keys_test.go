@@ -0,0 +1,105 @@
+package auth_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/os-foundry/vetpms/internal/platform/auth"
+	"github.com/os-foundry/vetpms/internal/tests"
+)
+
+// TestKeyStore validates the newest key of a directory signs tokens and the
+// others still verify them.
+func TestKeyStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// write stores a new key in the directory, either with the private key
+	// or only the public one.
+	write := func(kid string, private bool) *rsa.PrivateKey {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block := pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+		if !private {
+			b, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			block = pem.Block{Type: "PUBLIC KEY", Bytes: b}
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, kid+".pem"), pem.EncodeToMemory(&block), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+
+	old := write("20190101T000000Z", true)
+	cur := write("20190201T000000Z", true)
+	other := write("other-service", false)
+
+	t.Log("Given the need to rotate signing keys.")
+	{
+		keys, err := auth.LoadKeyDir(dir)
+		if err != nil {
+			t.Fatalf("\t%s\tShould be able to load the keys : %s.", tests.Failed, err)
+		}
+		t.Logf("\t%s\tShould be able to load the keys.", tests.Success)
+
+		kid, key := keys.Active()
+		if kid != "20190201T000000Z" || key.N.Cmp(cur.N) != 0 {
+			t.Fatalf("\t%s\tShould sign with the newest private key : %s.", tests.Failed, kid)
+		}
+		t.Logf("\t%s\tShould sign with the newest private key.", tests.Success)
+
+		a, err := auth.NewAuthenticator(old, "20190101T000000Z", "RS256", keys.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tkn, err := a.GenerateToken(auth.Claims{Roles: []string{auth.RoleUser}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, err = auth.NewAuthenticator(key, kid, "RS256", keys.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := a.ParseClaims(tkn); err != nil {
+			t.Fatalf("\t%s\tShould verify tokens signed with an older key : %s.", tests.Failed, err)
+		}
+		t.Logf("\t%s\tShould verify tokens signed with an older key.", tests.Success)
+
+		if _, err := keys.PublicKey("unknown"); err == nil {
+			t.Fatalf("\t%s\tShould not find unknown keys.", tests.Failed)
+		}
+		t.Logf("\t%s\tShould not find unknown keys.", tests.Success)
+
+		set := keys.JWKS()
+		if len(set.Keys) != 3 || set.Keys[2].KeyID != "other-service" {
+			t.Fatalf("\t%s\tShould publish all keys : %+v.", tests.Failed, set)
+		}
+		n, err := base64.RawURLEncoding.DecodeString(set.Keys[2].N)
+		if err != nil || new(big.Int).SetBytes(n).Cmp(other.N) != 0 || set.Keys[2].E != "AQAB" {
+			t.Fatalf("\t%s\tShould publish the public keys : %+v.", tests.Failed, set.Keys[2])
+		}
+		t.Logf("\t%s\tShould publish the public keys.", tests.Success)
+
+		pub, err := set.Keys[2].PublicKey()
+		if err != nil || pub.N.Cmp(other.N) != 0 || pub.E != other.E {
+			t.Fatalf("\t%s\tShould read the published keys back : %v.", tests.Failed, err)
+		}
+		t.Logf("\t%s\tShould read the published keys back.", tests.Success)
+	}
+}
@@ -8,12 +8,45 @@ import (
 	"github.com/pkg/errors"
 )
 
-// These are the expected values for Claims.Roles.
+// These are the expected values for Claims.Roles. RoleService marks service
+// accounts, which only authenticate with API keys. They get the other roles
+// for what their keys may do.
 const (
-	RoleAdmin = "ADMIN"
-	RoleUser  = "USER"
+	RoleAdmin   = "ADMIN"
+	RoleUser    = "USER"
+	RoleService = "SERVICE"
 )
 
+// These are the scopes API keys can be limited to. Write scopes don't include
+// the read scope.
+const (
+	ScopeUsersRead     = "users:read"
+	ScopeUsersWrite    = "users:write"
+	ScopeProductsRead  = "products:read"
+	ScopeProductsWrite = "products:write"
+	ScopeAuditRead     = "audit:read"
+	ScopeBackupRead    = "backup:read"
+	ScopeAPIKeys       = "apikeys"
+)
+
+// Scopes are all valid scopes.
+var Scopes = []string{
+	ScopeUsersRead, ScopeUsersWrite,
+	ScopeProductsRead, ScopeProductsWrite,
+	ScopeAuditRead, ScopeBackupRead,
+	ScopeAPIKeys,
+}
+
+// ValidScope reports whether the scope is one of Scopes.
+func ValidScope(scope string) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
 // ctxKey represents the type of value for the context key.
 type ctxKey int
 
@@ -23,6 +56,16 @@ const Key ctxKey = 1
 // Claims represents the authorization claims transmitted via a JWT.
 type Claims struct {
 	Roles []string `json:"roles"`
+
+	// SessionID identifies the refresh token the claims were issued with.
+	// Revoking it revokes the claims.
+	SessionID string `json:"sid,omitempty"`
+
+	// APIKeyID identifies the API key the claims were authenticated with.
+	// Such claims only allow what their Scopes allow.
+	APIKeyID string   `json:"api_key,omitempty"`
+	Scopes   []string `json:"scopes,omitempty"`
+
 	jwt.StandardClaims
 }
 
@@ -46,11 +89,16 @@ func NewClaims(subject string, roles []string, now time.Time, expires time.Durat
 func (c Claims) Valid() error {
 	for _, r := range c.Roles {
 		switch r {
-		case RoleAdmin, RoleUser: // Role is valid.
+		case RoleAdmin, RoleUser, RoleService: // Role is valid.
 		default:
 			return fmt.Errorf("invalid role %q", r)
 		}
 	}
+	for _, s := range c.Scopes {
+		if !ValidScope(s) {
+			return fmt.Errorf("invalid scope %q", s)
+		}
+	}
 	if err := c.StandardClaims.Valid(); err != nil {
 		return errors.Wrap(err, "validating standard claims")
 	}
@@ -68,3 +116,17 @@ func (c Claims) HasRole(roles ...string) bool {
 	}
 	return false
 }
+
+// HasScope returns true if the claims allow the scope. Claims that were not
+// authenticated with an API key allow every scope.
+func (c Claims) HasScope(scope string) bool {
+	if c.APIKeyID == "" {
+		return true
+	}
+	for _, has := range c.Scopes {
+		if has == scope {
+			return true
+		}
+	}
+	return false
+}
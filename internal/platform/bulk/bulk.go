@@ -0,0 +1,202 @@
+// Package bulk reads and writes records in bulk as CSV or JSON Lines. Records
+// are structs and the columns of a file are named after the JSON names of
+// their fields. A Mapping renames columns for files that use other names.
+package bulk
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The supported file formats.
+const (
+	CSV   = "csv"
+	JSONL = "jsonl"
+)
+
+// ErrFormat occurs when a file format is not supported.
+var ErrFormat = errors.New("format must be csv or jsonl")
+
+// FormatOf returns the format of a file based on its extension. It returns an
+// empty string if the extension is not known.
+func FormatOf(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".csv":
+		return CSV
+	case ".jsonl", ".ndjson":
+		return JSONL
+	}
+	return ""
+}
+
+// Mapping maps the columns of a file to the fields of a record. Columns that
+// are mapped to "-" are skipped when reading. Columns that are not in the
+// mapping hold the field with the same name.
+type Mapping map[string]string
+
+// ParseMapping parses a comma separated list of column=field pairs.
+func ParseMapping(s string) (Mapping, error) {
+	m := make(Mapping)
+	if strings.TrimSpace(s) == "" {
+		return m, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || strings.TrimSpace(kv[1]) == "" {
+			return nil, fmt.Errorf("mapping %q must be in the form column=field", pair)
+		}
+		m[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+
+	return m, nil
+}
+
+// field returns the record field held by a column.
+func (m Mapping) field(column string) string {
+	if f, ok := m[column]; ok {
+		return f
+	}
+	return column
+}
+
+// column returns the column holding a record field.
+func (m Mapping) column(field string) string {
+	for c, f := range m {
+		if f == field {
+			return c
+		}
+	}
+	return field
+}
+
+// RowError is returned when a single record can't be read. Reading can
+// continue with the next record.
+type RowError struct {
+	Line int
+	Err  error
+}
+
+// Error implements the error interface.
+func (e *RowError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+// field is a field of a record with the name of its column.
+type field struct {
+	name  string
+	index []int
+}
+
+// fieldsOf returns the fields of a struct type in order, including the fields
+// of embedded structs. Fields are named by their JSON name and fields that are
+// not encoded to JSON are left out.
+func fieldsOf(t reflect.Type) []field {
+	var fs []field
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.SplitN(f.Tag.Get("json"), ",", 2)[0]
+		if name == "-" || (f.PkgPath != "" && !f.Anonymous) {
+			continue
+		}
+
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			for _, sub := range fieldsOf(f.Type) {
+				sub.index = append([]int{i}, sub.index...)
+				fs = append(fs, sub)
+			}
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+		fs = append(fs, field{name: name, index: []int{i}})
+	}
+	return fs
+}
+
+var timeT = reflect.TypeOf(time.Time{})
+
+// set parses the text of a CSV cell into a field value. Lists are separated
+// by semicolons and times use the RFC 3339 format.
+func set(v reflect.Value, s string) error {
+	switch {
+	case v.Kind() == reflect.Ptr:
+		if s == "" {
+			return nil
+		}
+		e := reflect.New(v.Type().Elem())
+		if err := set(e.Elem(), s); err != nil {
+			return err
+		}
+		v.Set(e)
+
+	case v.Type() == timeT:
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(t))
+
+	case v.Kind() == reflect.String:
+		v.SetString(s)
+
+	case v.Kind() >= reflect.Int && v.Kind() <= reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return errors.New("must be a whole number")
+		}
+		v.SetInt(n)
+
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return errors.New("must be true or false")
+		}
+		v.SetBool(b)
+
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String:
+		parts := strings.Split(s, ";")
+		l := reflect.MakeSlice(v.Type(), len(parts), len(parts))
+		for i, p := range parts {
+			l.Index(i).SetString(strings.TrimSpace(p))
+		}
+		v.Set(l)
+
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+
+	return nil
+}
+
+// format returns the text of a field value for a CSV cell. It is the inverse
+// of set.
+func format(v reflect.Value) string {
+	switch {
+	case v.Kind() == reflect.Ptr:
+		if v.IsNil() {
+			return ""
+		}
+		return format(v.Elem())
+
+	case v.Type() == timeT:
+		return v.Interface().(time.Time).Format(time.RFC3339Nano)
+
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String:
+		parts := make([]string, v.Len())
+		for i := range parts {
+			parts[i] = v.Index(i).String()
+		}
+		return strings.Join(parts, ";")
+	}
+
+	return fmt.Sprint(v.Interface())
+}
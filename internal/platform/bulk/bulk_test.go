@@ -0,0 +1,135 @@
+package bulk_test
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/os-foundry/vetpms/internal/platform/bulk"
+)
+
+const (
+	success = "\u2713"
+	failed  = "\u2717"
+)
+
+type base struct {
+	ID string `json:"id"`
+}
+
+type record struct {
+	base
+	Name    string     `json:"name"`
+	Cost    int        `json:"cost"`
+	Roles   []string   `json:"roles"`
+	Created time.Time  `json:"date_created"`
+	Deleted *time.Time `json:"deleted_at,omitempty"`
+	Secret  []byte     `json:"-"`
+}
+
+// TestRoundTrip validates records written in each format are read back the
+// same, with columns renamed by a mapping.
+func TestRoundTrip(t *testing.T) {
+	created := time.Date(2019, time.March, 24, 0, 0, 0, 0, time.UTC)
+	want := []record{
+		{base{"1"}, "Comic Books", 50, []string{"ADMIN", "USER"}, created, nil, nil},
+		{base{"2"}, "McDonalds, Toys", 75, nil, created, &created, nil},
+	}
+
+	m, err := bulk.ParseMapping("title=name")
+	if err != nil {
+		t.Fatalf("\t%s\tShould be able to parse the mapping : %s.", failed, err)
+	}
+
+	t.Log("Given the need to write and read records in bulk.")
+	{
+		for i, format := range []string{bulk.CSV, bulk.JSONL} {
+			t.Logf("\tTest %d:\tWhen using the %s format.", i, format)
+			{
+				var buf bytes.Buffer
+				w, err := bulk.NewWriter(&buf, format, m)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to create a writer : %s.", failed, err)
+				}
+				for i := range want {
+					if err := w.Write(&want[i]); err != nil {
+						t.Fatalf("\t%s\tShould be able to write a record : %s.", failed, err)
+					}
+				}
+				if err := w.Flush(); err != nil {
+					t.Fatalf("\t%s\tShould be able to flush the records : %s.", failed, err)
+				}
+				t.Logf("\t%s\tShould be able to write the records.", success)
+
+				if !strings.Contains(buf.String(), "title") {
+					t.Fatalf("\t%s\tShould rename the mapped columns : %s.", failed, buf.String())
+				}
+				t.Logf("\t%s\tShould rename the mapped columns.", success)
+
+				r, err := bulk.NewReader(&buf, format, m)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to create a reader : %s.", failed, err)
+				}
+
+				var got []record
+				for {
+					var rec record
+					err := r.Read(&rec)
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						t.Fatalf("\t%s\tShould be able to read a record : %s.", failed, err)
+					}
+					got = append(got, rec)
+				}
+
+				if diff := cmp.Diff(want, got, cmp.AllowUnexported(record{})); diff != "" {
+					t.Fatalf("\t%s\tShould read back the same records. Diff:\n%s", failed, diff)
+				}
+				t.Logf("\t%s\tShould read back the same records.", success)
+			}
+		}
+	}
+}
+
+// TestRowErrors validates invalid records are reported with their line and
+// do not stop the reader.
+func TestRowErrors(t *testing.T) {
+	tests := []struct {
+		format string
+		data   string
+		line   int
+	}{
+		{bulk.CSV, "id,name,cost\n1,Vax,ten\n2,Collar,10\n", 2},
+		{bulk.JSONL, "{\"id\":\"1\",\"cost\":\"ten\"}\n\n{\"id\":\"2\",\"name\":\"Collar\",\"cost\":10}\n", 1},
+	}
+
+	t.Log("Given the need to report invalid records.")
+	{
+		for i, tt := range tests {
+			t.Logf("\tTest %d:\tWhen reading %s.", i, tt.format)
+			{
+				r, err := bulk.NewReader(strings.NewReader(tt.data), tt.format, nil)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to create a reader : %s.", failed, err)
+				}
+
+				var rec record
+				rerr, ok := r.Read(&rec).(*bulk.RowError)
+				if !ok || rerr.Line != tt.line {
+					t.Fatalf("\t%s\tShould report the line of the invalid record : %v.", failed, rerr)
+				}
+				t.Logf("\t%s\tShould report the line of the invalid record.", success)
+
+				if err := r.Read(&rec); err != nil || rec.Name != "Collar" {
+					t.Fatalf("\t%s\tShould continue with the next record : %v.", failed, err)
+				}
+				t.Logf("\t%s\tShould continue with the next record.", success)
+			}
+		}
+	}
+}
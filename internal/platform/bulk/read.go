@@ -0,0 +1,164 @@
+package bulk
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Reader reads records from a CSV or JSON Lines file. The first line of a CSV
+// file holds the names of the columns.
+type Reader struct {
+	mapping Mapping
+	line    int
+
+	csv    *csv.Reader
+	header []string
+
+	lines *bufio.Scanner
+}
+
+// NewReader returns a Reader of records in the given format.
+func NewReader(r io.Reader, format string, m Mapping) (*Reader, error) {
+	rd := Reader{mapping: m}
+
+	switch format {
+	case CSV:
+		rd.csv = csv.NewReader(r)
+		header, err := rd.csv.Read()
+		if err != nil {
+			return nil, errors.Wrap(err, "reading header")
+		}
+		for i, c := range header {
+			header[i] = m.field(strings.TrimSpace(c))
+		}
+		rd.header = header
+		rd.line = 1
+
+	case JSONL:
+		rd.lines = bufio.NewScanner(r)
+		rd.lines.Buffer(nil, 1<<20)
+
+	default:
+		return nil, ErrFormat
+	}
+
+	return &rd, nil
+}
+
+// Line returns the line of the last record read. Lines are counted from the
+// start of the file, including the header of a CSV file.
+func (r *Reader) Line() int {
+	return r.line
+}
+
+// Read decodes the next record into the struct val points to. It returns
+// io.EOF when all records are read. A record that can't be decoded is
+// reported as a *RowError, any other error means the file can't be read.
+func (r *Reader) Read(val interface{}) error {
+	v := reflect.ValueOf(val)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return errors.New("records must be read into a struct pointer")
+	}
+	v = v.Elem()
+	v.Set(reflect.Zero(v.Type()))
+
+	if r.csv != nil {
+		return r.readCSV(v)
+	}
+	return r.readJSON(val)
+}
+
+// readCSV decodes the next CSV record into v. Records are expected to span a
+// single line.
+func (r *Reader) readCSV(v reflect.Value) error {
+	rec, err := r.csv.Read()
+	if err == io.EOF {
+		return io.EOF
+	}
+	r.line++
+	if err != nil {
+		if perr, ok := err.(*csv.ParseError); ok && perr.Err == csv.ErrFieldCount {
+			return &RowError{Line: r.line, Err: perr.Err}
+		}
+		return errors.Wrap(err, "reading record")
+	}
+
+	fields := make(map[string][]int)
+	for _, f := range fieldsOf(v.Type()) {
+		fields[f.name] = f.index
+	}
+
+	for i, name := range r.header {
+		if name == "-" {
+			continue
+		}
+
+		index, ok := fields[name]
+		if !ok {
+			return fmt.Errorf("unknown column %q", name)
+		}
+
+		cell := strings.TrimSpace(rec[i])
+		if cell == "" {
+			continue
+		}
+		if err := set(v.FieldByIndex(index), cell); err != nil {
+			return &RowError{Line: r.line, Err: fmt.Errorf("%s: %v", name, err)}
+		}
+	}
+
+	return nil
+}
+
+// readJSON decodes the next non empty line into val.
+func (r *Reader) readJSON(val interface{}) error {
+	for r.lines.Scan() {
+		r.line++
+
+		line := bytes.TrimSpace(r.lines.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		if len(r.mapping) > 0 {
+			var obj map[string]json.RawMessage
+			if err := json.Unmarshal(line, &obj); err != nil {
+				return &RowError{Line: r.line, Err: err}
+			}
+
+			fields := make(map[string]json.RawMessage, len(obj))
+			for c, v := range obj {
+				if f := r.mapping.field(c); f != "-" {
+					fields[f] = v
+				}
+			}
+
+			var err error
+			if line, err = json.Marshal(fields); err != nil {
+				return &RowError{Line: r.line, Err: err}
+			}
+		}
+
+		dec := json.NewDecoder(bytes.NewReader(line))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(val); err != nil {
+			return &RowError{Line: r.line, Err: err}
+		}
+
+		return nil
+	}
+
+	if err := r.lines.Err(); err != nil {
+		return errors.Wrap(err, "reading record")
+	}
+
+	return io.EOF
+}
@@ -0,0 +1,112 @@
+package bulk
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"reflect"
+
+	"github.com/pkg/errors"
+)
+
+// Writer writes records to a CSV or JSON Lines file. Writes are buffered
+// until Flush is called.
+type Writer struct {
+	mapping Mapping
+
+	csv    *csv.Writer
+	fields []field
+
+	w *bufio.Writer
+}
+
+// NewWriter returns a Writer of records in the given format.
+func NewWriter(w io.Writer, format string, m Mapping) (*Writer, error) {
+	wr := Writer{mapping: m}
+
+	switch format {
+	case CSV:
+		wr.csv = csv.NewWriter(w)
+	case JSONL:
+		wr.w = bufio.NewWriter(w)
+	default:
+		return nil, ErrFormat
+	}
+
+	return &wr, nil
+}
+
+// Write writes a single record. The header of a CSV file is written with the
+// first record.
+func (w *Writer) Write(val interface{}) error {
+	if w.csv != nil {
+		return w.writeCSV(reflect.Indirect(reflect.ValueOf(val)))
+	}
+	return w.writeJSON(val)
+}
+
+// writeCSV writes the fields of the struct v as a CSV record.
+func (w *Writer) writeCSV(v reflect.Value) error {
+	if v.Kind() != reflect.Struct {
+		return errors.New("records must be structs")
+	}
+
+	if w.fields == nil {
+		w.fields = fieldsOf(v.Type())
+
+		header := make([]string, len(w.fields))
+		for i, f := range w.fields {
+			header[i] = w.mapping.column(f.name)
+		}
+		if err := w.csv.Write(header); err != nil {
+			return errors.Wrap(err, "writing header")
+		}
+	}
+
+	rec := make([]string, len(w.fields))
+	for i, f := range w.fields {
+		rec[i] = format(v.FieldByIndex(f.index))
+	}
+
+	return errors.Wrap(w.csv.Write(rec), "writing record")
+}
+
+// writeJSON writes val as a single line of JSON.
+func (w *Writer) writeJSON(val interface{}) error {
+	b, err := json.Marshal(val)
+	if err != nil {
+		return errors.Wrap(err, "encoding record")
+	}
+
+	if len(w.mapping) > 0 {
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(b, &obj); err != nil {
+			return errors.Wrap(err, "encoding record")
+		}
+
+		columns := make(map[string]json.RawMessage, len(obj))
+		for f, v := range obj {
+			columns[w.mapping.column(f)] = v
+		}
+
+		if b, err = json.Marshal(columns); err != nil {
+			return errors.Wrap(err, "encoding record")
+		}
+	}
+
+	if _, err := w.w.Write(append(b, '\n')); err != nil {
+		return errors.Wrap(err, "writing record")
+	}
+
+	return nil
+}
+
+// Flush writes any buffered records.
+func (w *Writer) Flush() error {
+	if w.csv != nil {
+		w.csv.Flush()
+		return w.csv.Error()
+	}
+	return w.w.Flush()
+}
@@ -0,0 +1,49 @@
+package database
+
+import (
+	"context"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltTxKey is the context key of the Bolt transaction reads run in.
+type boltTxKey struct{}
+
+// WithBoltTx returns a copy of ctx carrying a Bolt transaction. Reads through
+// BoltView run in this transaction instead of starting their own, so they all
+// see the same state of the database.
+func WithBoltTx(ctx context.Context, tx *bolt.Tx) context.Context {
+	return context.WithValue(ctx, boltTxKey{}, tx)
+}
+
+// BoltView runs fn in the transaction carried by ctx, or in a new read-only
+// transaction of db if there is none.
+func BoltView(ctx context.Context, db *bolt.DB, fn func(tx *bolt.Tx) error) error {
+	if tx, ok := ctx.Value(boltTxKey{}).(*bolt.Tx); ok {
+		return fn(tx)
+	}
+	return db.View(fn)
+}
+
+// BoltUpdate runs fn in the transaction carried by ctx, or in a new update
+// transaction of db if there is none. The transaction carried by ctx must be
+// writable.
+func BoltUpdate(ctx context.Context, db *bolt.DB, fn func(tx *bolt.Tx) error) error {
+	if tx, ok := ctx.Value(boltTxKey{}).(*bolt.Tx); ok {
+		if !tx.Writable() {
+			return bolt.ErrTxNotWritable
+		}
+		return fn(tx)
+	}
+	return db.Update(fn)
+}
+
+// BoltSnapshot returns a function running fn with a context in which all
+// reads of db see the same state. Writers are not blocked while it runs.
+func BoltSnapshot(db *bolt.DB) func(ctx context.Context, fn func(ctx context.Context) error) error {
+	return func(ctx context.Context, fn func(ctx context.Context) error) error {
+		return db.View(func(tx *bolt.Tx) error {
+			return fn(WithBoltTx(ctx, tx))
+		})
+	}
+}
@@ -0,0 +1,367 @@
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"time"
+
+	"github.com/os-foundry/vetpms/internal/platform/query"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrDuplicate occurs when a record is added to a unique index under a key
+// that another record already has.
+var ErrDuplicate = errors.New("duplicate index key")
+
+// BoltIndex is a secondary index of the records of a Bolt bucket. Its entries
+// are kept in a bucket of their own and are maintained by BoltPut and
+// BoltDelete in the transaction that changes the record.
+//
+// Entries of unique indexes map the key to the ID of the record. Entries of
+// other indexes are the key followed by a zero byte and the ID, so the IDs
+// with a key are found by seeking to the key.
+//
+// Indexes of a query field order the records by the field and then by ID, so
+// lists sorted or filtered by the field seek on them, see SeekBoltIndex. Their
+// keys are encoded with SortKey.
+type BoltIndex struct {
+	Name   string // Bucket holding the entries.
+	Bucket string // Bucket holding the indexed records.
+	Field  string // Query field the records are ordered by, if any.
+	Unique bool
+
+	// Key returns the key of the record encoded in v. Records for which it
+	// returns nil are not indexed.
+	Key func(v []byte) ([]byte, error)
+}
+
+// SortKey encodes a string, int or time.Time so that the keys sort in the
+// order of the values, as compared by query.Compare. Numbers are stored big
+// endian with the sign bit flipped, so negative ones come first.
+func SortKey(v interface{}) []byte {
+	var n int64
+	switch v := v.(type) {
+	case string:
+		return []byte(v)
+	case int:
+		n = int64(v)
+	case time.Time:
+		n = v.UnixNano()
+	default:
+		return nil
+	}
+
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(n)^1<<63)
+	return k
+}
+
+// FieldIndexes returns an index of the bucket for every query field but the
+// ID, which is the key of the records already. The indexes are named after
+// the bucket and the field, and include deleted records. Fields that one of
+// the given indexes orders by already are skipped. value returns the value
+// of a field of the record encoded in v.
+func FieldIndexes(bucket string, fields query.Fields, value func(v []byte, field string) (interface{}, error), have ...BoltIndex) []BoltIndex {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var indexes []BoltIndex
+next:
+	for _, name := range names {
+		if name == query.DefaultSort {
+			continue
+		}
+		for _, ix := range have {
+			if ix.Bucket == bucket && ix.Field == name {
+				continue next
+			}
+		}
+
+		name := name
+		indexes = append(indexes, BoltIndex{
+			Name:   bucket + "_by_" + name,
+			Bucket: bucket,
+			Field:  name,
+			Key: func(v []byte) ([]byte, error) {
+				fv, err := value(v, name)
+				if err != nil {
+					return nil, err
+				}
+				return SortKey(fv), nil
+			},
+		})
+	}
+
+	return indexes
+}
+
+// fieldIndex returns the index of the bucket ordering its records by the
+// field.
+func fieldIndex(indexes []BoltIndex, bucket, field string) (BoltIndex, bool) {
+	for _, ix := range indexes {
+		if ix.Bucket == bucket && ix.Field == field && !ix.Unique {
+			return ix, true
+		}
+	}
+	return BoltIndex{}, false
+}
+
+// IndexReport describes the differences between an index and the records of
+// its bucket.
+type IndexReport struct {
+	Index   string
+	Entries int // Entries found in the index.
+	Missing int // Records without an entry.
+	Stale   int // Entries without a matching record.
+}
+
+// OK reports whether the index matches the records.
+func (r IndexReport) OK() bool {
+	return r.Missing == 0 && r.Stale == 0
+}
+
+// entry returns the key and value of the entry for the record with the ID.
+func (ix BoltIndex) entry(key, id []byte) ([]byte, []byte) {
+	if ix.Unique {
+		return key, id
+	}
+	k := make([]byte, 0, len(key)+1+len(id))
+	k = append(append(append(k, key...), 0), id...)
+	return k, id
+}
+
+// add writes the entry for the record with the ID. It returns ErrDuplicate if
+// the index is unique and another record has the key.
+func (ix BoltIndex) add(b *bolt.Bucket, key, id []byte) error {
+	k, v := ix.entry(key, id)
+	if ix.Unique {
+		if cur := b.Get(k); cur != nil && !bytes.Equal(cur, id) {
+			return errors.Wrapf(ErrDuplicate, "%s %q", ix.Name, key)
+		}
+	}
+	return b.Put(k, v)
+}
+
+// remove deletes the entry for the record with the ID, leaving the entry of
+// another record with the same key in a unique index alone.
+func (ix BoltIndex) remove(b *bolt.Bucket, key, id []byte) error {
+	k, _ := ix.entry(key, id)
+	if ix.Unique && !bytes.Equal(b.Get(k), id) {
+		return nil
+	}
+	return b.Delete(k)
+}
+
+// update replaces the entry for the old value of the record with the ID with
+// the entry for its new value. Either value is nil if there is none.
+func (ix BoltIndex) update(tx *bolt.Tx, id, old, new []byte) error {
+	b := tx.Bucket([]byte(ix.Name))
+	if b == nil {
+		return errors.Errorf("index %s doesn't exist, migrate the database", ix.Name)
+	}
+
+	var oldKey, newKey []byte
+	var err error
+	if old != nil {
+		if oldKey, err = ix.Key(old); err != nil {
+			return errors.Wrapf(err, "indexing %s %s", ix.Bucket, id)
+		}
+	}
+	if new != nil {
+		if newKey, err = ix.Key(new); err != nil {
+			return errors.Wrapf(err, "indexing %s %s", ix.Bucket, id)
+		}
+	}
+
+	if oldKey != nil && newKey != nil && bytes.Equal(oldKey, newKey) {
+		return nil
+	}
+	if oldKey != nil {
+		if err := ix.remove(b, oldKey, id); err != nil {
+			return err
+		}
+	}
+	if newKey != nil {
+		return ix.add(b, newKey, id)
+	}
+	return nil
+}
+
+// Lookup returns the ID of the record with the key in a unique index, or nil
+// if there is none. The ID is only valid during the transaction.
+func (ix BoltIndex) Lookup(tx *bolt.Tx, key []byte) []byte {
+	b := tx.Bucket([]byte(ix.Name))
+	if b == nil || !ix.Unique {
+		return nil
+	}
+	return b.Get(key)
+}
+
+// IDs returns the IDs of the records with the key in ascending order. The IDs
+// are only valid during the transaction.
+func (ix BoltIndex) IDs(tx *bolt.Tx, key []byte) [][]byte {
+	b := tx.Bucket([]byte(ix.Name))
+	if b == nil {
+		return nil
+	}
+
+	if ix.Unique {
+		if id := b.Get(key); id != nil {
+			return [][]byte{id}
+		}
+		return nil
+	}
+
+	var ids [][]byte
+	prefix := append(append([]byte(nil), key...), 0)
+	c := b.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		ids = append(ids, v)
+	}
+	return ids
+}
+
+// Rebuild replaces all entries of the index with entries for the records of
+// its bucket. It returns the number of entries written.
+func (ix BoltIndex) Rebuild(tx *bolt.Tx) (int, error) {
+	records := tx.Bucket([]byte(ix.Bucket))
+	if records == nil {
+		return 0, errors.Errorf("bucket %s doesn't exist", ix.Bucket)
+	}
+
+	if err := tx.DeleteBucket([]byte(ix.Name)); err != nil && err != bolt.ErrBucketNotFound {
+		return 0, errors.Wrapf(err, "deleting index %s", ix.Name)
+	}
+	b, err := tx.CreateBucket([]byte(ix.Name))
+	if err != nil {
+		return 0, errors.Wrapf(err, "creating index %s", ix.Name)
+	}
+
+	var n int
+	if err := records.ForEach(func(k, v []byte) error {
+		key, err := ix.Key(v)
+		if err != nil {
+			return errors.Wrapf(err, "indexing %s %s", ix.Bucket, k)
+		}
+		if key == nil {
+			return nil
+		}
+		if err := ix.add(b, key, k); err != nil {
+			return err
+		}
+		n++
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// Verify compares the entries of the index with the records of its bucket
+// without changing either.
+func (ix BoltIndex) Verify(tx *bolt.Tx) (IndexReport, error) {
+	r := IndexReport{Index: ix.Name}
+
+	records := tx.Bucket([]byte(ix.Bucket))
+	if records == nil {
+		return r, errors.Errorf("bucket %s doesn't exist", ix.Bucket)
+	}
+
+	// The entries the records need. A record whose key another record of a
+	// unique index already has can't be indexed and is missing.
+	want := make(map[string]string)
+	if err := records.ForEach(func(k, v []byte) error {
+		key, err := ix.Key(v)
+		if err != nil {
+			return errors.Wrapf(err, "indexing %s %s", ix.Bucket, k)
+		}
+		if key == nil {
+			return nil
+		}
+		ek, ev := ix.entry(key, k)
+		if _, ok := want[string(ek)]; ok {
+			r.Missing++
+			return nil
+		}
+		want[string(ek)] = string(ev)
+		return nil
+	}); err != nil {
+		return r, err
+	}
+
+	if b := tx.Bucket([]byte(ix.Name)); b != nil {
+		if err := b.ForEach(func(k, v []byte) error {
+			r.Entries++
+			if w, ok := want[string(k)]; ok && w == string(v) {
+				delete(want, string(k))
+				return nil
+			}
+			r.Stale++
+			return nil
+		}); err != nil {
+			return r, err
+		}
+	}
+	r.Missing += len(want)
+
+	return r, nil
+}
+
+// BoltPut stores v under the ID in the bucket and updates the indexes of the
+// bucket in the same transaction. Indexes of other buckets are ignored, so
+// all indexes of a storage can be passed.
+func BoltPut(tx *bolt.Tx, bucket string, indexes []BoltIndex, id, v []byte) error {
+	b := tx.Bucket([]byte(bucket))
+	if b == nil {
+		return errors.Errorf("bucket %s doesn't exist", bucket)
+	}
+
+	// The stored value is only valid until the bucket is changed.
+	var old []byte
+	if cur := b.Get(id); cur != nil {
+		old = append([]byte(nil), cur...)
+	}
+
+	for _, ix := range indexes {
+		if ix.Bucket != bucket {
+			continue
+		}
+		if err := ix.update(tx, id, old, v); err != nil {
+			return err
+		}
+	}
+
+	return b.Put(id, v)
+}
+
+// BoltDelete removes the record with the ID from the bucket together with its
+// index entries.
+func BoltDelete(tx *bolt.Tx, bucket string, indexes []BoltIndex, id []byte) error {
+	b := tx.Bucket([]byte(bucket))
+	if b == nil {
+		return errors.Errorf("bucket %s doesn't exist", bucket)
+	}
+
+	old := b.Get(id)
+	if old == nil {
+		return nil
+	}
+	old = append([]byte(nil), old...)
+
+	for _, ix := range indexes {
+		if ix.Bucket != bucket {
+			continue
+		}
+		if err := ix.update(tx, id, old, nil); err != nil {
+			return err
+		}
+	}
+
+	return b.Delete(id)
+}
@@ -0,0 +1,169 @@
+package database_test
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/os-foundry/vetpms/internal/platform/database"
+	"github.com/os-foundry/vetpms/internal/tests"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// TestBoltIndex validates that unique and non-unique indexes are maintained
+// when records change, and that they can be verified and rebuilt.
+func TestBoltIndex(t *testing.T) {
+	db, err := bolt.Open("index.db", 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("index.db")
+	defer db.Close()
+
+	// Records are "key,group", deleted records have an empty key.
+	field := func(i int) func(v []byte) ([]byte, error) {
+		return func(v []byte) ([]byte, error) {
+			f := bytes.Split(v, []byte(","))
+			if len(f[i]) == 0 {
+				return nil, nil
+			}
+			return f[i], nil
+		}
+	}
+	unique := database.BoltIndex{Name: "records_key", Bucket: "records", Unique: true, Key: field(0)}
+	group := database.BoltIndex{Name: "records_group", Bucket: "records", Key: field(1)}
+	indexes := []database.BoltIndex{unique, group}
+
+	put := func(id, v string) error {
+		return db.Update(func(tx *bolt.Tx) error {
+			return database.BoltPut(tx, "records", indexes, []byte(id), []byte(v))
+		})
+	}
+
+	t.Log("Given the need to find Bolt records by secondary keys.")
+	{
+		t.Log("\tWhen records are stored and changed.")
+		{
+			if err := db.Update(func(tx *bolt.Tx) error {
+				for _, name := range []string{"records", "records_key", "records_group"} {
+					if _, err := tx.CreateBucket([]byte(name)); err != nil {
+						return err
+					}
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, r := range [][2]string{{"1", "a,x"}, {"2", "b,x"}, {"3", "c,y"}} {
+				if err := put(r[0], r[1]); err != nil {
+					t.Fatalf("\t%s\tShould be able to store records : %s.", tests.Failed, err)
+				}
+			}
+			t.Logf("\t%s\tShould be able to store records.", tests.Success)
+
+			if err := put("3", "a,y"); errors.Cause(err) != database.ErrDuplicate {
+				t.Fatalf("\t%s\tShould refuse a duplicate unique key : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould refuse a duplicate unique key.", tests.Success)
+
+			if err := put("1", "d,y"); err != nil {
+				t.Fatalf("\t%s\tShould be able to change a record : %s.", tests.Failed, err)
+			}
+			if err := put("2", ",x"); err != nil {
+				t.Fatalf("\t%s\tShould be able to change a record : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to change a record.", tests.Success)
+
+			db.View(func(tx *bolt.Tx) error {
+				if unique.Lookup(tx, []byte("a")) != nil || string(unique.Lookup(tx, []byte("d"))) != "1" {
+					t.Fatalf("\t%s\tShould find records by their current unique key.", tests.Failed)
+				}
+				if unique.Lookup(tx, []byte("b")) != nil {
+					t.Fatalf("\t%s\tShould not index records without a key.", tests.Failed)
+				}
+				t.Logf("\t%s\tShould find records by their current unique key.", tests.Success)
+
+				ids := group.IDs(tx, []byte("y"))
+				if len(ids) != 2 || string(ids[0]) != "1" || string(ids[1]) != "3" {
+					t.Fatalf("\t%s\tShould find all records with a key : got %q.", tests.Failed, ids)
+				}
+				if ids := group.IDs(tx, []byte("x")); len(ids) != 1 || string(ids[0]) != "2" {
+					t.Fatalf("\t%s\tShould find all records with a key : got %q.", tests.Failed, ids)
+				}
+				t.Logf("\t%s\tShould find all records with a key.", tests.Success)
+				return nil
+			})
+
+			if err := db.Update(func(tx *bolt.Tx) error {
+				return database.BoltDelete(tx, "records", indexes, []byte("3"))
+			}); err != nil {
+				t.Fatalf("\t%s\tShould be able to delete a record : %s.", tests.Failed, err)
+			}
+			db.View(func(tx *bolt.Tx) error {
+				if unique.Lookup(tx, []byte("c")) != nil || len(group.IDs(tx, []byte("y"))) != 1 {
+					t.Fatalf("\t%s\tShould remove the entries of a deleted record.", tests.Failed)
+				}
+				return nil
+			})
+			t.Logf("\t%s\tShould remove the entries of a deleted record.", tests.Success)
+		}
+
+		t.Log("\tWhen an index doesn't match the records.")
+		{
+			if err := db.Update(func(tx *bolt.Tx) error {
+				b := tx.Bucket([]byte("records_group"))
+				if err := b.Delete([]byte("y\x001")); err != nil {
+					return err
+				}
+				return b.Put([]byte("z\x009"), []byte("9"))
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			db.Update(func(tx *bolt.Tx) error {
+				r, err := group.Verify(tx)
+				if err != nil || r.OK() || r.Missing != 1 || r.Stale != 1 {
+					t.Fatalf("\t%s\tShould report missing and stale entries : %+v, %v.", tests.Failed, r, err)
+				}
+				t.Logf("\t%s\tShould report missing and stale entries.", tests.Success)
+
+				n, err := group.Rebuild(tx)
+				if err != nil || n != 2 {
+					t.Fatalf("\t%s\tShould be able to rebuild the index : %d, %v.", tests.Failed, n, err)
+				}
+				if r, err := group.Verify(tx); err != nil || !r.OK() || r.Entries != 2 {
+					t.Fatalf("\t%s\tShould be able to rebuild the index : %+v, %v.", tests.Failed, r, err)
+				}
+				t.Logf("\t%s\tShould be able to rebuild the index.", tests.Success)
+				return nil
+			})
+		}
+	}
+}
+
+// TestSortKey validates the keys of values sort like the values.
+func TestSortKey(t *testing.T) {
+	now := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Log("Given the need to order index entries by the values of a field.")
+	{
+		t.Log("\tWhen encoding ordered values.")
+		{
+			for _, values := range [][]interface{}{
+				{"", "a", "ab", "b"},
+				{-300, -1, 0, 1, 255, 256, 70000},
+				{now.Add(-time.Hour), now, now.Add(time.Microsecond), now.Add(24 * time.Hour)},
+			} {
+				for i := 1; i < len(values); i++ {
+					if bytes.Compare(database.SortKey(values[i-1]), database.SortKey(values[i])) >= 0 {
+						t.Fatalf("\t%s\tShould sort the key of %v before the key of %v.", tests.Failed, values[i-1], values[i])
+					}
+				}
+			}
+			t.Logf("\t%s\tShould sort the keys like the values.", tests.Success)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/os-foundry/vetpms/internal/platform/query"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Where builds the WHERE clause for a keyset paginated list. It contains the
+// filters and, if a cursor is provided, the condition to continue after the
+// last item of the previous page. Any additional conditions are included as
+// well. columns maps the query fields to their (qualified) column and must
+// contain the "id" field.
+func Where(opts query.Options, fields query.Fields, columns map[string]string, conds ...string) (string, []interface{}, error) {
+	opts = opts.Normalize()
+
+	if err := fields.Validate(opts); err != nil {
+		return "", nil, err
+	}
+
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	for _, f := range opts.Filters {
+		col, ok := columns[f.Field]
+		if !ok {
+			return "", nil, query.ErrInvalidField
+		}
+		conds = append(conds, fmt.Sprintf("%s = %s", col, arg(f.Value)))
+	}
+
+	c, seek, err := fields.Position(opts)
+	if err != nil {
+		return "", nil, err
+	}
+	if seek {
+		col, ok := columns[opts.Sort]
+		if !ok {
+			return "", nil, query.ErrInvalidField
+		}
+		op := ">"
+		if opts.Desc {
+			op = "<"
+		}
+		conds = append(conds, fmt.Sprintf("(%s, %s) %s (%s, %s)", col, columns[query.DefaultSort], op, arg(c.Value), arg(c.ID)))
+	}
+
+	if len(conds) == 0 {
+		return "", nil, nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args, nil
+}
+
+// OrderBy builds the ORDER BY and LIMIT clauses for a keyset paginated list.
+// One more row than the limit is selected so the caller can tell whether
+// there is a next page.
+func OrderBy(opts query.Options, columns map[string]string) string {
+	opts = opts.Normalize()
+
+	dir := "ASC"
+	if opts.Desc {
+		dir = "DESC"
+	}
+
+	return fmt.Sprintf(" ORDER BY %s %s, %s %s LIMIT %d",
+		columns[opts.Sort], dir,
+		columns[query.DefaultSort], dir,
+		opts.Limit+1,
+	)
+}
+
+// SeekBolt walks the records of a bucket in key order for lists sorted by
+// ID, which in Bolt is the key of every record. It starts right after the
+// cursor of the options and walks backwards for descending lists. visit is
+// called for each record and reports whether it was added to the page.
+// Walking stops once one more record than the limit was added so the caller
+// can tell whether there is a next page.
+func SeekBolt(b *bolt.Bucket, opts query.Options, fields query.Fields, visit func(k, v []byte) (bool, error)) error {
+	opts = opts.Normalize()
+
+	pos, seek, err := fields.Position(opts)
+	if err != nil {
+		return err
+	}
+
+	var start []byte
+	if seek {
+		start = []byte(pos.ID)
+	}
+
+	c := b.Cursor()
+	next := c.Next
+	if opts.Desc {
+		next = c.Prev
+	}
+
+	k, v := seekBolt(c, nil, start, opts.Desc)
+	for n := 0; k != nil && n <= opts.Limit; k, v = next() {
+		added, err := visit(k, v)
+		if err != nil {
+			return err
+		}
+		if added {
+			n++
+		}
+	}
+
+	return nil
+}
+
+// SeekBoltIndex walks the records of a bucket for a page of a list without
+// reading the whole bucket. Lists sorted by ID and not filtered walk the
+// bucket like SeekBolt. Filtered lists sorted by ID walk the entries of the
+// index of their first filter with its value, which are ordered by ID. Lists
+// sorted by another field walk the index of the field, starting right after
+// the cursor.
+//
+// Lists that are filtered and sorted by another field can't be walked in
+// order. Only the records matching the first filter are visited then, and
+// SeekBoltIndex reports that they still have to be sorted, see PageBolt.
+//
+// visit is called for each record like in SeekBolt and must apply the
+// filters. Sorting or filtering on a field without an index is refused with
+// query.ErrInvalidField.
+func SeekBoltIndex(tx *bolt.Tx, bucket string, indexes []BoltIndex, opts query.Options, fields query.Fields, visit func(k, v []byte) (bool, error)) (bool, error) {
+	opts = opts.Normalize()
+
+	records := tx.Bucket([]byte(bucket))
+	if records == nil {
+		return false, errors.Errorf("bucket %s doesn't exist", bucket)
+	}
+
+	if len(opts.Filters) == 0 && opts.Sort == query.DefaultSort {
+		return true, SeekBolt(records, opts, fields, visit)
+	}
+
+	pos, seek, err := fields.Position(opts)
+	if err != nil {
+		return false, err
+	}
+
+	// Filters on the ID match a single record, which is paged in memory.
+	for _, flt := range opts.Filters {
+		if flt.Field != query.DefaultSort {
+			continue
+		}
+		if v := records.Get([]byte(flt.Value)); v != nil {
+			if _, err := visit([]byte(flt.Value), v); err != nil {
+				return false, err
+			}
+		}
+		return false, nil
+	}
+
+	if len(opts.Filters) > 0 {
+		flt := opts.Filters[0]
+		ix, ok := fieldIndex(indexes, bucket, flt.Field)
+		if !ok {
+			return false, errors.Wrapf(query.ErrInvalidField, "filter %q has no index", flt.Field)
+		}
+		want, err := fields[flt.Field].Parse(flt.Value)
+		if err != nil {
+			return false, errors.Wrapf(query.ErrInvalidValue, "filter %q", flt.Field)
+		}
+		prefix := append(SortKey(want), 0)
+
+		if opts.Sort != query.DefaultSort {
+			return false, walkBoltIndex(tx, ix, records, prefix, nil, false, -1, visit)
+		}
+
+		var start []byte
+		if seek {
+			start = append(append([]byte(nil), prefix...), pos.ID...)
+		}
+		return true, walkBoltIndex(tx, ix, records, prefix, start, opts.Desc, opts.Limit, visit)
+	}
+
+	ix, ok := fieldIndex(indexes, bucket, opts.Sort)
+	if !ok {
+		return false, errors.Wrapf(query.ErrInvalidField, "sort %q has no index", opts.Sort)
+	}
+
+	var start []byte
+	if seek {
+		// The cursor was validated by Position so parsing can't fail.
+		cv, _ := fields[opts.Sort].Parse(pos.Value)
+		start = append(append(SortKey(cv), 0), pos.ID...)
+	}
+	return true, walkBoltIndex(tx, ix, records, nil, start, opts.Desc, opts.Limit, visit)
+}
+
+// PageBolt returns the indexes of the records of src on the page and the
+// cursor of the next page, for records visited by SeekBoltIndex. Records
+// visited in order are cut off at the limit, the others are sorted and paged
+// in memory.
+func PageBolt(src query.Source, opts query.Options, fields query.Fields, ordered bool) ([]int, query.Page, error) {
+	if !ordered {
+		return fields.Slice(src, opts)
+	}
+	opts = opts.Normalize()
+
+	n := src.Len()
+	var page query.Page
+	if n > opts.Limit {
+		n = opts.Limit
+		page.NextCursor = query.NewCursor(opts, src.Value(n-1, opts.Sort), src.ID(n-1))
+	}
+
+	idx := make([]int, n)
+	for i := range idx {
+		idx[i] = i
+	}
+	return idx, page, nil
+}
+
+// walkBoltIndex visits the records of the entries of an index, in the order
+// of the entries or backwards if desc is set. Only the entries with the
+// prefix are walked, and the walk starts right after start if it is set.
+// Entries without a record are skipped. Walking stops once one more record
+// than the limit was added, or at the end of the entries if limit is
+// negative.
+func walkBoltIndex(tx *bolt.Tx, ix BoltIndex, records *bolt.Bucket, prefix, start []byte, desc bool, limit int, visit func(k, v []byte) (bool, error)) error {
+	b := tx.Bucket([]byte(ix.Name))
+	if b == nil {
+		return errors.Errorf("index %s doesn't exist, migrate the database", ix.Name)
+	}
+
+	c := b.Cursor()
+	next := c.Next
+	if desc {
+		next = c.Prev
+	}
+
+	k, id := seekBolt(c, prefix, start, desc)
+	for n := 0; k != nil && bytes.HasPrefix(k, prefix) && (limit < 0 || n <= limit); k, id = next() {
+		v := records.Get(id)
+		if v == nil {
+			continue
+		}
+		added, err := visit(id, v)
+		if err != nil {
+			return err
+		}
+		if added {
+			n++
+		}
+	}
+
+	return nil
+}
+
+// seekBolt positions the cursor on the first key of a walk through the keys
+// with the prefix, which may be empty. The walk starts right after start if
+// it is set, and runs backwards if desc is set.
+func seekBolt(c *bolt.Cursor, prefix, start []byte, desc bool) ([]byte, []byte) {
+	switch {
+	case start == nil && !desc:
+		if len(prefix) == 0 {
+			return c.First()
+		}
+		return c.Seek(prefix)
+	case start == nil:
+		if len(prefix) == 0 {
+			return c.Last()
+		}
+		// The keys with the prefix end before the prefix with its last byte
+		// increased. Prefixes end with a zero byte, so it can't overflow.
+		end := append([]byte(nil), prefix...)
+		end[len(end)-1]++
+		if k, _ := c.Seek(end); k == nil {
+			return c.Last()
+		}
+		return c.Prev()
+	case !desc:
+		k, v := c.Seek(start)
+		if bytes.Equal(k, start) {
+			return c.Next()
+		}
+		return k, v
+	default:
+		k, v := c.Seek(start)
+		if k == nil {
+			k, v = c.Last()
+		}
+		for k != nil && bytes.Compare(k, start) >= 0 {
+			k, v = c.Prev()
+		}
+		return k, v
+	}
+}
@@ -0,0 +1,101 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// UnitOfWork runs fn in a transaction. Storage calls made with the context
+// passed to fn share the transaction, which is committed when fn returns nil
+// and rolled back when it returns an error. When ctx already carries a
+// transaction fn joins it, so units of work can be nested.
+//
+// A storage call that fails may have written part of its changes, so fn must
+// return the error to roll the transaction back.
+type UnitOfWork func(ctx context.Context, fn func(ctx context.Context) error) error
+
+// pqTxKey is the context key of the Postgres transaction storages run in.
+type pqTxKey struct{}
+
+// PqDB returns the Postgres transaction carried by ctx, or db if there is
+// none. Storages run their statements on it so they take part in a unit of
+// work.
+func PqDB(ctx context.Context, db *sqlx.DB) sqlx.ExtContext {
+	if tx, ok := ctx.Value(pqTxKey{}).(*sqlx.Tx); ok {
+		return tx
+	}
+	return db
+}
+
+// PqUnitOfWork returns a unit of work running in transactions of db.
+func PqUnitOfWork(db *sqlx.DB) UnitOfWork {
+	return func(ctx context.Context, fn func(ctx context.Context) error) error {
+		if _, ok := ctx.Value(pqTxKey{}).(*sqlx.Tx); ok {
+			return fn(ctx)
+		}
+
+		tx, err := db.BeginTxx(ctx, nil)
+		if err != nil {
+			return errors.Wrap(err, "beginning transaction")
+		}
+
+		// Rolling back after a commit does nothing, this only cleans up when
+		// fn fails or panics.
+		defer tx.Rollback()
+
+		if err := fn(context.WithValue(ctx, pqTxKey{}, tx)); err != nil {
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return errors.Wrap(err, "committing transaction")
+		}
+		return nil
+	}
+}
+
+// PqSnapshot returns a function running fn with a context in which all reads
+// of db see the same state. They run in a read only transaction with the
+// repeatable read isolation level, so writers are not blocked while it runs.
+// When ctx already carries a transaction fn joins it.
+func PqSnapshot(db *sqlx.DB) func(ctx context.Context, fn func(ctx context.Context) error) error {
+	return func(ctx context.Context, fn func(ctx context.Context) error) error {
+		if _, ok := ctx.Value(pqTxKey{}).(*sqlx.Tx); ok {
+			return fn(ctx)
+		}
+
+		tx, err := db.BeginTxx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+		if err != nil {
+			return errors.Wrap(err, "beginning snapshot")
+		}
+		defer tx.Rollback()
+
+		if err := fn(context.WithValue(ctx, pqTxKey{}, tx)); err != nil {
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return errors.Wrap(err, "ending snapshot")
+		}
+		return nil
+	}
+}
+
+// BoltUnitOfWork returns a unit of work running in update transactions of
+// db. Bolt allows a single writer at a time, so other writes wait until the
+// unit of work is done.
+func BoltUnitOfWork(db *bolt.DB) UnitOfWork {
+	return func(ctx context.Context, fn func(ctx context.Context) error) error {
+		if _, ok := ctx.Value(boltTxKey{}).(*bolt.Tx); ok {
+			return fn(ctx)
+		}
+
+		return db.Update(func(tx *bolt.Tx) error {
+			return fn(WithBoltTx(ctx, tx))
+		})
+	}
+}
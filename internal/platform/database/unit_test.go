@@ -0,0 +1,149 @@
+package database_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/os-foundry/vetpms/internal/platform/auth"
+	"github.com/os-foundry/vetpms/internal/platform/database"
+	"github.com/os-foundry/vetpms/internal/platform/query"
+	"github.com/os-foundry/vetpms/internal/product"
+	productBolt "github.com/os-foundry/vetpms/internal/product/bolt"
+	productPq "github.com/os-foundry/vetpms/internal/product/postgres"
+	"github.com/os-foundry/vetpms/internal/tests"
+	"github.com/os-foundry/vetpms/internal/user"
+	userBolt "github.com/os-foundry/vetpms/internal/user/bolt"
+	userPq "github.com/os-foundry/vetpms/internal/user/postgres"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// TestUnitOfWork validates that calls of several storages made in a unit of
+// work are committed or rolled back together.
+func TestUnitOfWork(t *testing.T) {
+	tt := []string{"postgres", "bolt"}
+	for _, tc := range tt {
+		var (
+			ust      user.Storage
+			pst      product.Storage
+			uow      database.UnitOfWork
+			snapshot func(ctx context.Context, fn func(ctx context.Context) error) error
+			teardown func()
+		)
+		switch tc {
+		case "postgres":
+			db, td := tests.NewPqUnit(t)
+			ust, pst, uow, teardown = userPq.Postgres{db}, productPq.Postgres{db}, database.PqUnitOfWork(db), td
+			snapshot = database.PqSnapshot(db)
+		case "bolt":
+			db, td := tests.NewBoltUnit(t)
+			ust, pst, uow, teardown = userBolt.Bolt{db}, productBolt.Bolt{db}, database.BoltUnitOfWork(db), td
+			snapshot = database.BoltSnapshot(db)
+		}
+		defer teardown()
+
+		t.Logf("Given the need to change several storages atomically on %s.", tc)
+		{
+			ctx := tests.Context()
+			now := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+			claims := auth.NewClaims("718ffbea-f4a1-4667-8ae3-b349da52675e", []string{auth.RoleAdmin}, now, time.Hour)
+
+			create := func(ctx context.Context, email string) error {
+				nu := user.NewUser{Name: "Jane Doe", Email: email, Roles: []string{auth.RoleUser}, Password: "gophers", PasswordConfirm: "gophers"}
+				if _, err := ust.Create(ctx, nu, now); err != nil {
+					return err
+				}
+				_, err := pst.Create(ctx, claims, product.NewProduct{Name: "Collar", Cost: 15, Quantity: 10}, now)
+				return err
+			}
+
+			count := func(ctx context.Context) (int, int) {
+				us, _, err := ust.List(ctx, query.Options{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				ps, _, err := pst.List(ctx, query.Options{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return len(us), len(ps)
+			}
+
+			t.Log("\tWhen a unit of work fails.")
+			{
+				errFailed := errors.New("failed")
+				err := uow(ctx, func(ctx context.Context) error {
+					if err := create(ctx, "jane@example.com"); err != nil {
+						return err
+					}
+					return errFailed
+				})
+				if err != errFailed {
+					t.Fatalf("\t%s\tShould return the error of the unit of work : %v.", tests.Failed, err)
+				}
+				if u, p := count(ctx); u != 0 || p != 0 {
+					t.Fatalf("\t%s\tShould roll back the changes of all storages : %d users, %d products.", tests.Failed, u, p)
+				}
+				t.Logf("\t%s\tShould roll back the changes of all storages.", tests.Success)
+			}
+
+			t.Log("\tWhen a unit of work succeeds.")
+			{
+				err := uow(ctx, func(ctx context.Context) error {
+					if err := create(ctx, "jane@example.com"); err != nil {
+						return err
+					}
+
+					// Nested units of work join the outer one.
+					return uow(ctx, func(ctx context.Context) error {
+						return create(ctx, "john@example.com")
+					})
+				})
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to commit : %s.", tests.Failed, err)
+				}
+				if u, p := count(ctx); u != 2 || p != 2 {
+					t.Fatalf("\t%s\tShould commit the changes of all storages : %d users, %d products.", tests.Failed, u, p)
+				}
+				t.Logf("\t%s\tShould commit the changes of all storages.", tests.Success)
+			}
+
+			t.Log("\tWhen writing in a read-only snapshot.")
+			{
+				err := snapshot(ctx, func(ctx context.Context) error {
+					return create(ctx, "anna@example.com")
+				})
+				if err == nil || tc == "bolt" && errors.Cause(err) != bolt.ErrTxNotWritable {
+					t.Fatalf("\t%s\tShould refuse to write : %v.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould refuse to write.", tests.Success)
+			}
+
+			// Bolt can't write while the same goroutine holds a read
+			// transaction.
+			if tc == "postgres" {
+				t.Log("\tWhen others write during a snapshot.")
+				{
+					err := snapshot(ctx, func(sctx context.Context) error {
+						before, _ := count(sctx)
+						if err := create(ctx, "anna@example.com"); err != nil {
+							return err
+						}
+						if after, _ := count(sctx); after != before {
+							t.Fatalf("\t%s\tShould read the same state throughout : %d users, then %d.", tests.Failed, before, after)
+						}
+						return nil
+					})
+					if err != nil {
+						t.Fatalf("\t%s\tShould be able to read in a snapshot : %v.", tests.Failed, err)
+					}
+					if u, _ := count(ctx); u != 3 {
+						t.Fatalf("\t%s\tShould see the changes after the snapshot : %d users.", tests.Failed, u)
+					}
+					t.Logf("\t%s\tShould read the same state throughout.", tests.Success)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Package envelope encodes the records stored in key/value databases like
+// Bolt. Every record is wrapped in an envelope holding the version of its
+// layout next to its JSON encoding, so records can be inspected outside Go and
+// older layouts are upgraded when they are read.
+package envelope
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// ErrVersion occurs when a record was written by a newer version of the
+// service.
+var ErrVersion = errors.New("record is newer than this version of the service")
+
+// Envelope is the stored form of a record.
+type Envelope struct {
+	Version int             `json:"v"`
+	Data    json.RawMessage `json:"d"`
+}
+
+// Upgrade converts the JSON encoding of a record to the next version.
+type Upgrade func(data json.RawMessage) (json.RawMessage, error)
+
+// Codec encodes and decodes the records of one entity.
+type Codec struct {
+
+	// Version is the version of the current layout of the records. It is
+	// raised, and an Upgrade added, whenever the layout changes in a way
+	// older records can't be decoded into.
+	Version int
+
+	// Upgrades maps a version to the function converting records of that
+	// version to the next one.
+	Upgrades map[int]Upgrade
+
+	// Legacy decodes records written before envelopes were introduced. It
+	// returns the value of the record in the layout of version 1.
+	Legacy func(b []byte) (interface{}, error)
+}
+
+// Encode wraps the JSON encoding of val in an envelope of the current
+// version.
+func (c Codec) Encode(val interface{}) ([]byte, error) {
+	data, err := json.Marshal(val)
+	if err != nil {
+		return nil, errors.Wrap(err, "encoding record")
+	}
+
+	return json.Marshal(Envelope{Version: c.Version, Data: data})
+}
+
+// Decode decodes a record into val, upgrading it to the current version
+// first if it is older.
+func (c Codec) Decode(b []byte, val interface{}) error {
+	var e Envelope
+
+	switch {
+	case IsLegacy(b):
+		if c.Legacy == nil {
+			return errors.New("record is not in an envelope")
+		}
+		v, err := c.Legacy(b)
+		if err != nil {
+			return errors.Wrap(err, "decoding legacy record")
+		}
+		if e.Data, err = json.Marshal(v); err != nil {
+			return errors.Wrap(err, "decoding legacy record")
+		}
+		e.Version = 1
+
+	default:
+		if err := json.Unmarshal(b, &e); err != nil {
+			return errors.Wrap(err, "decoding envelope")
+		}
+	}
+
+	if e.Version > c.Version {
+		return errors.Wrapf(ErrVersion, "version %d", e.Version)
+	}
+
+	for ; e.Version < c.Version; e.Version++ {
+		up, ok := c.Upgrades[e.Version]
+		if !ok {
+			return errors.Errorf("no upgrade from version %d", e.Version)
+		}
+
+		var err error
+		if e.Data, err = up(e.Data); err != nil {
+			return errors.Wrapf(err, "upgrading from version %d", e.Version)
+		}
+	}
+
+	return errors.Wrap(json.Unmarshal(e.Data, val), "decoding record")
+}
+
+// IsLegacy reports whether b is a record written before envelopes were
+// introduced. Those were gob encoded, which is never a JSON object.
+func IsLegacy(b []byte) bool {
+	return !bytes.HasPrefix(b, []byte(`{"v":`)) && !json.Valid(b)
+}
@@ -0,0 +1,92 @@
+package envelope_test
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/os-foundry/vetpms/internal/platform/envelope"
+	"github.com/os-foundry/vetpms/internal/tests"
+	"github.com/pkg/errors"
+)
+
+// pet is the current layout of a record, version 1 stored Name as Nick.
+type pet struct {
+	Name string `json:"name"`
+	Age  int    `json:"age"`
+}
+
+var codec = envelope.Codec{
+	Version: 2,
+	Upgrades: map[int]envelope.Upgrade{
+		1: func(data json.RawMessage) (json.RawMessage, error) {
+			return json.RawMessage(strings.Replace(string(data), `"nick"`, `"name"`, 1)), nil
+		},
+	},
+	Legacy: func(b []byte) (interface{}, error) {
+		var p struct {
+			Nick string
+			Age  int
+		}
+		if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&p); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"nick": p.Nick, "age": p.Age}, nil
+	},
+}
+
+// TestCodec validates records are encoded in envelopes and older records are
+// upgraded when they are decoded.
+func TestCodec(t *testing.T) {
+	want := pet{Name: "Rex", Age: 3}
+
+	var legacy bytes.Buffer
+	if err := gob.NewEncoder(&legacy).Encode(struct {
+		Nick string
+		Age  int
+	}{"Rex", 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	current, err := codec.Encode(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		name string
+		b    []byte
+	}{
+		{"legacy", legacy.Bytes()},
+		{"version 1", []byte(`{"v":1,"d":{"nick":"Rex","age":3}}`)},
+		{"version 2", current},
+	}
+
+	t.Log("Given the need to decode records of every version.")
+	{
+		for i, tc := range tt {
+			t.Logf("\tTest: %d\tWhen decoding a %s record.", i, tc.name)
+			{
+				var got pet
+				if err := codec.Decode(tc.b, &got); err != nil {
+					t.Fatalf("\t%s\tShould be able to decode the record : %s.", tests.Failed, err)
+				}
+				if got != want {
+					t.Fatalf("\t%s\tShould get the upgraded record : got %+v.", tests.Failed, got)
+				}
+				t.Logf("\t%s\tShould get the upgraded record.", tests.Success)
+			}
+		}
+
+		t.Logf("\tTest: %d\tWhen decoding a record of a newer version.", len(tt))
+		{
+			var got pet
+			if err := codec.Decode([]byte(`{"v":3,"d":{}}`), &got); errors.Cause(err) != envelope.ErrVersion {
+				t.Fatalf("\t%s\tShould refuse to decode the record : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould refuse to decode the record.", tests.Success)
+		}
+	}
+}
@@ -0,0 +1,6 @@
+package health
+
+// freeSpace is not implemented on Windows.
+func freeSpace(path string) (uint64, error) {
+	return 0, errUnsupported
+}
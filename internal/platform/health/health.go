@@ -0,0 +1,70 @@
+// Package health provides status checks of the dependencies of the service
+// that are not storages, like the disk a Bolt database is kept on or the
+// exporter traces are sent to. All checks implement database.StatusChecker.
+package health
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// errUnsupported is returned by freeSpace on platforms where the free space
+// of a disk can't be determined.
+var errUnsupported = errors.New("unsupported platform")
+
+// DiskSpace checks that the disk holding Path has at least MinFree bytes
+// available.
+type DiskSpace struct {
+	Path    string
+	MinFree uint64
+}
+
+// StatusCheck returns an error when the disk is low on space. Platforms where
+// the free space can't be determined always pass.
+func (d DiskSpace) StatusCheck(ctx context.Context) error {
+	free, err := freeSpace(d.Path)
+	if err == errUnsupported {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "checking free space of %s", d.Path)
+	}
+	if free < d.MinFree {
+		return fmt.Errorf("%d bytes free on %s, need %d", free, d.Path, d.MinFree)
+	}
+	return nil
+}
+
+// Endpoint checks that an HTTP endpoint responds without a server error.
+type Endpoint struct {
+	URL    string
+	Client *http.Client
+}
+
+// StatusCheck requests the endpoint and returns an error when it can't be
+// reached or responds with a 5xx status.
+func (e Endpoint) StatusCheck(ctx context.Context) error {
+	req, err := http.NewRequest(http.MethodGet, e.URL, nil)
+	if err != nil {
+		return err
+	}
+
+	client := e.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("%s responded with %s", e.URL, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+// Package mail delivers the emails the service sends, like password reset
+// tokens. Deliveries go through a Mailer so the way they are sent can be
+// chosen by configuration and replaced in tests.
+package mail
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// Message is an email in plain text.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers messages.
+type Mailer interface {
+	Send(ctx context.Context, m Message) error
+}
+
+// Log writes the recipient and subject of messages to a logger instead of
+// delivering them. It is meant for development. Bodies are never logged, as
+// they hold secrets like reset tokens.
+type Log struct {
+	Log *log.Logger
+}
+
+// Send writes the recipient and subject of the message to the logger.
+func (l Log) Send(ctx context.Context, m Message) error {
+	ctx, span := trace.StartSpan(ctx, "internal.platform.mail.Log.Send")
+	defer span.End()
+
+	l.Log.Printf("mail : To %s : %s", m.To, m.Subject)
+	return nil
+}
+
+// SMTP delivers messages through an SMTP server. The server is authenticated
+// with User and Password when User is set.
+type SMTP struct {
+	Addr     string
+	From     string
+	User     string
+	Password string
+}
+
+// Send delivers the message.
+func (s SMTP) Send(ctx context.Context, m Message) error {
+	ctx, span := trace.StartSpan(ctx, "internal.platform.mail.SMTP.Send")
+	defer span.End()
+
+	// Header values can't contain line breaks, they would start new headers.
+	if strings.ContainsAny(m.To+m.Subject, "\r\n") {
+		return errors.New("line break in header")
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", m.To)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", m.Subject)
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.Replace(m.Body, "\n", "\r\n", -1))
+
+	var auth smtp.Auth
+	if s.User != "" {
+		host, _, err := net.SplitHostPort(s.Addr)
+		if err != nil {
+			return errors.Wrap(err, "parsing smtp address")
+		}
+		auth = smtp.PlainAuth("", s.User, s.Password, host)
+	}
+
+	if err := smtp.SendMail(s.Addr, auth, s.From, []string{m.To}, msg.Bytes()); err != nil {
+		return errors.Wrapf(err, "sending mail to %s", m.To)
+	}
+
+	return nil
+}
@@ -0,0 +1,36 @@
+package mail_test
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/os-foundry/vetpms/internal/platform/mail"
+	"github.com/os-foundry/vetpms/internal/tests"
+)
+
+// TestLog validates logged messages don't reveal their body.
+func TestLog(t *testing.T) {
+	var buf bytes.Buffer
+	l := mail.Log{Log: log.New(&buf, "", 0)}
+
+	t.Log("Given the need to keep secrets in mails out of the logs.")
+	{
+		m := mail.Message{To: "user@example.com", Subject: "Reset your password", Body: "secret-reset-token"}
+		if err := l.Send(context.Background(), m); err != nil {
+			t.Fatalf("\t%s\tShould log the message : %s.", tests.Failed, err)
+		}
+
+		if !strings.Contains(buf.String(), m.To) || !strings.Contains(buf.String(), m.Subject) {
+			t.Fatalf("\t%s\tShould log the recipient and subject : %q.", tests.Failed, buf.String())
+		}
+		t.Logf("\t%s\tShould log the recipient and subject.", tests.Success)
+
+		if strings.Contains(buf.String(), m.Body) {
+			t.Fatalf("\t%s\tShould not log the body : %q.", tests.Failed, buf.String())
+		}
+		t.Logf("\t%s\tShould not log the body.", tests.Success)
+	}
+}
@@ -0,0 +1,374 @@
+// Package oidc signs users in with an OpenID Connect provider using the
+// authorization code flow. It discovers the endpoints of the provider and
+// verifies the ID tokens it issues with the keys the provider publishes.
+package oidc
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/os-foundry/vetpms/internal/platform/auth"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+var (
+	// ErrRejected occurs when the provider refuses to sign a user in, or
+	// refuses to exchange the code it handed out.
+	ErrRejected = errors.New("identity provider rejected the sign in")
+
+	// ErrInvalidToken occurs when an ID token isn't signed by the provider,
+	// isn't meant for the client or has expired.
+	ErrInvalidToken = errors.New("ID token is invalid")
+)
+
+// DefaultScopes are requested when the Config doesn't list any.
+var DefaultScopes = []string{"openid", "email", "profile"}
+
+// keysInterval is how often the keys of the provider are fetched again at
+// most when a token is signed with an unknown key.
+const keysInterval = time.Minute
+
+// leeway is how far the clock of the provider may be off.
+const leeway = time.Minute
+
+// Config identifies the provider and the client registered with it.
+// RedirectURL is where the provider sends users back to, it must be
+// registered with the provider as well.
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	Client       *http.Client
+}
+
+// Discovery is the part of the metadata of a provider the client uses. It is
+// published at /.well-known/openid-configuration below the issuer.
+type Discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Identity is a user as the provider knows them, read from a verified ID
+// token. Claims holds all claims of the token.
+type Identity struct {
+	Issuer        string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Claims        jwt.MapClaims
+}
+
+// Strings returns the values of a claim holding a string or a list of
+// strings, such as the groups of a user.
+func (id Identity) Strings(claim string) []string {
+	switch v := id.Claims[claim].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var values []string
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// Provider is the client of an OpenID Connect provider. The metadata and keys
+// of the provider are fetched when they are first needed, so the service
+// starts while the provider is unreachable.
+type Provider struct {
+	cfg Config
+
+	mu        sync.Mutex
+	discovery *Discovery
+	keys      map[string]*rsa.PublicKey
+	loaded    time.Time
+}
+
+// NewProvider constructs a Provider. It will error if the issuer, client or
+// redirect URL are missing.
+func NewProvider(cfg Config) (*Provider, error) {
+	if cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, errors.New("issuer, client id and redirect url must be set")
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = DefaultScopes
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	return &Provider{cfg: cfg}, nil
+}
+
+// RedirectURL returns where the provider sends users back to.
+func (p *Provider) RedirectURL() string {
+	return p.cfg.RedirectURL
+}
+
+// AuthCodeURL returns the URL of the provider to send users to for signing
+// in. The provider sends them back to the redirect URL with a code and the
+// state. The nonce is included in the ID token the code is exchanged for.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce string) (string, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.platform.oidc.AuthCodeURL")
+	defer span.End()
+
+	d, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {p.cfg.ClientID},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"scope":         {strings.Join(p.cfg.Scopes, " ")},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// Exchange exchanges the code the provider sent the user back with for an ID
+// token, and returns the identity of the verified token. It returns
+// ErrRejected if the provider refuses the code.
+func (p *Provider) Exchange(ctx context.Context, code, nonce string, now time.Time) (Identity, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.platform.oidc.Exchange")
+	defer span.End()
+
+	d, err := p.discover(ctx)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {p.cfg.RedirectURL},
+	}
+	req, err := http.NewRequest(http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Identity{}, errors.Wrap(err, "creating token request")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+
+	resp, err := p.cfg.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return Identity{}, errors.Wrap(err, "requesting token")
+	}
+	defer resp.Body.Close()
+
+	var tkn struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tkn); err != nil {
+		return Identity{}, errors.Wrapf(err, "decoding token response with status %s", resp.Status)
+	}
+
+	switch {
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return Identity{}, errors.Errorf("token endpoint responded with %s", resp.Status)
+	case resp.StatusCode != http.StatusOK:
+		return Identity{}, errors.Wrapf(ErrRejected, "%s %s", tkn.Error, tkn.ErrorDescription)
+	case tkn.IDToken == "":
+		return Identity{}, errors.Wrap(ErrInvalidToken, "token response has no ID token")
+	}
+
+	return p.Verify(ctx, tkn.IDToken, nonce, now)
+}
+
+// Verify verifies that an ID token was signed by the provider for the client
+// and the nonce, and that it hasn't expired at now. It returns
+// ErrInvalidToken if it wasn't.
+func (p *Provider) Verify(ctx context.Context, raw, nonce string, now time.Time) (Identity, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.platform.oidc.Verify")
+	defer span.End()
+
+	d, err := p.discover(ctx)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	// The claims are checked below against now rather than the clock of the
+	// parser. Only RS256 is accepted, the algorithm every provider supports.
+	parser := jwt.Parser{
+		ValidMethods:         []string{"RS256"},
+		SkipClaimsValidation: true,
+	}
+	keyFunc := func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.publicKey(ctx, d, kid)
+	}
+
+	claims := jwt.MapClaims{}
+	if _, err := parser.ParseWithClaims(raw, claims, keyFunc); err != nil {
+		return Identity{}, errors.Wrap(ErrInvalidToken, err.Error())
+	}
+
+	if iss, _ := claims["iss"].(string); iss != d.Issuer {
+		return Identity{}, errors.Wrapf(ErrInvalidToken, "issued by %q", iss)
+	}
+	if !claims.VerifyAudience(p.cfg.ClientID, true) && !audience(claims, p.cfg.ClientID) {
+		return Identity{}, errors.Wrap(ErrInvalidToken, "issued for another client")
+	}
+	exp, _ := claims["exp"].(float64)
+	if now.Add(-leeway).Unix() >= int64(exp) {
+		return Identity{}, errors.Wrap(ErrInvalidToken, "expired")
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return Identity{}, errors.Wrap(ErrInvalidToken, "nonce doesn't match")
+	}
+
+	id := Identity{Issuer: d.Issuer, Claims: claims}
+	id.Subject, _ = claims["sub"].(string)
+	id.Email, _ = claims["email"].(string)
+	id.Name, _ = claims["name"].(string)
+	switch v := claims["email_verified"].(type) {
+	case bool:
+		id.EmailVerified = v
+	case string:
+		id.EmailVerified = v == "true"
+	}
+	if id.Subject == "" {
+		return Identity{}, errors.Wrap(ErrInvalidToken, "subject missing")
+	}
+
+	return id, nil
+}
+
+// audience reports whether a list of audiences holds the client id. The
+// parser only compares single audiences.
+func audience(claims jwt.MapClaims, clientID string) bool {
+	aud, _ := claims["aud"].([]interface{})
+	for _, a := range aud {
+		if s, _ := a.(string); s == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// discover fetches the metadata of the provider once it succeeds.
+func (p *Provider) discover(ctx context.Context) (*Discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var d Discovery
+	if err := p.get(ctx, strings.TrimSuffix(p.cfg.Issuer, "/")+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, errors.Wrap(err, "discovering provider")
+	}
+
+	// The metadata must belong to the issuer it was fetched from, otherwise
+	// tokens of another issuer would be accepted.
+	if d.Issuer != p.cfg.Issuer {
+		return nil, errors.Errorf("provider metadata is for issuer %q", d.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("provider metadata misses an endpoint")
+	}
+
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+// publicKey returns the key of the provider with the kid. The keys are
+// fetched again when the kid is unknown, since providers rotate their keys.
+// Tokens without a kid are verified with the only key of the provider.
+func (p *Provider) publicKey(ctx context.Context, d *Discovery, kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key := p.lookup(kid); key != nil {
+		return key, nil
+	}
+	if time.Since(p.loaded) < keysInterval {
+		return nil, fmt.Errorf("unrecognized key id %q", kid)
+	}
+	p.loaded = time.Now()
+
+	var set auth.JWKS
+	if err := p.get(ctx, d.JWKSURI, &set); err != nil {
+		return nil, errors.Wrap(err, "fetching provider keys")
+	}
+
+	p.keys = make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		// Keys of other types, such as elliptic curve keys, are skipped.
+		key, err := k.PublicKey()
+		if err != nil {
+			continue
+		}
+		p.keys[k.KeyID] = key
+	}
+
+	if key := p.lookup(kid); key != nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unrecognized key id %q", kid)
+}
+
+// lookup returns the known key with the kid. p.mu must be held.
+func (p *Provider) lookup(kid string) *rsa.PublicKey {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key
+		}
+	}
+	return p.keys[kid]
+}
+
+// get fetches a JSON document of the provider.
+func (p *Provider) get(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := p.cfg.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return errors.Errorf("%s responded with %s", url, resp.Status)
+	}
+
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
@@ -0,0 +1,160 @@
+package oidc_test
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/google/go-cmp/cmp"
+	"github.com/os-foundry/vetpms/internal/platform/oidc"
+	"github.com/os-foundry/vetpms/internal/platform/oidc/oidctest"
+	"github.com/os-foundry/vetpms/internal/tests"
+	"github.com/pkg/errors"
+)
+
+// TestProvider validates users are signed in with the authorization code
+// flow and only ID tokens of the provider for the client are accepted.
+func TestProvider(t *testing.T) {
+	mock := oidctest.NewProvider(t)
+	defer mock.Close()
+
+	p, err := oidc.NewProvider(oidc.Config{
+		Issuer:       mock.URL,
+		ClientID:     oidctest.ClientID,
+		ClientSecret: oidctest.ClientSecret,
+		RedirectURL:  "https://vetpms.example.com/callback",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock.SignInAs(jwt.MapClaims{
+		"sub":            "248289761001",
+		"email":          "jane@example.com",
+		"email_verified": true,
+		"name":           "Jane Doe",
+		"groups":         []string{"vets", "front-desk"},
+	})
+
+	t.Log("Given the need to sign users in with an identity provider.")
+	{
+		ctx := context.Background()
+
+		var code string
+
+		t.Log("\tWhen a user signs in at the provider.")
+		{
+			u, err := p.AuthCodeURL(ctx, "state", "nonce")
+			if err != nil {
+				t.Fatalf("\t%s\tShould discover the provider : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould discover the provider.", tests.Success)
+
+			client := http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+			resp, err := client.Get(u)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			back, err := url.Parse(resp.Header.Get("Location"))
+			if err != nil || back.Host != "vetpms.example.com" || back.Query().Get("state") != "state" {
+				t.Fatalf("\t%s\tShould be sent back with the state : %q.", tests.Failed, resp.Header.Get("Location"))
+			}
+			t.Logf("\t%s\tShould be sent back with the state.", tests.Success)
+			code = back.Query().Get("code")
+		}
+
+		t.Log("\tWhen the code is exchanged.")
+		{
+			id, err := p.Exchange(ctx, code, "nonce", time.Now())
+			if err != nil {
+				t.Fatalf("\t%s\tShould get the identity : %s.", tests.Failed, err)
+			}
+			if id.Issuer != mock.URL || id.Subject != "248289761001" || id.Email != "jane@example.com" || !id.EmailVerified || id.Name != "Jane Doe" {
+				t.Fatalf("\t%s\tShould get the identity : %+v.", tests.Failed, id)
+			}
+			t.Logf("\t%s\tShould get the identity.", tests.Success)
+
+			if diff := cmp.Diff([]string{"vets", "front-desk"}, id.Strings("groups")); diff != "" {
+				t.Fatalf("\t%s\tShould read the groups. Diff:\n%s", tests.Failed, diff)
+			}
+			t.Logf("\t%s\tShould read the groups.", tests.Success)
+
+			if _, err := p.Exchange(ctx, code, "nonce", time.Now()); errors.Cause(err) != oidc.ErrRejected {
+				t.Fatalf("\t%s\tShould not exchange a code twice : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould not exchange a code twice.", tests.Success)
+		}
+
+		t.Log("\tWhen verifying ID tokens.")
+		{
+			other := oidctest.NewProvider(t)
+			defer other.Close()
+
+			tt := []struct {
+				name  string
+				token string
+				nonce string
+				now   time.Time
+			}{
+				{"for another client", mock.Token(t, jwt.MapClaims{"sub": "1", "aud": "other"}), "", time.Now()},
+				{"of another issuer", mock.Token(t, jwt.MapClaims{"sub": "1", "iss": other.URL}), "", time.Now()},
+				{"signed by another provider", other.Token(t, jwt.MapClaims{"sub": "1", "iss": mock.URL}), "", time.Now()},
+				{"for another nonce", mock.Token(t, jwt.MapClaims{"sub": "1", "nonce": "other"}), "nonce", time.Now()},
+				{"that expired", mock.Token(t, jwt.MapClaims{"sub": "1"}), "", time.Now().Add(2 * time.Hour)},
+				{"without a subject", mock.Token(t, jwt.MapClaims{}), "", time.Now()},
+			}
+			for _, tc := range tt {
+				if _, err := p.Verify(ctx, tc.token, tc.nonce, tc.now); errors.Cause(err) != oidc.ErrInvalidToken {
+					t.Fatalf("\t%s\tShould refuse a token %s : %v.", tests.Failed, tc.name, err)
+				}
+				t.Logf("\t%s\tShould refuse a token %s.", tests.Success, tc.name)
+			}
+
+			tkn := mock.Token(t, jwt.MapClaims{"sub": "1", "aud": []string{"other", oidctest.ClientID}})
+			if _, err := p.Verify(ctx, tkn, "", time.Now()); err != nil {
+				t.Fatalf("\t%s\tShould accept a token for several clients : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould accept a token for several clients.", tests.Success)
+		}
+	}
+}
+
+// TestRoleMap validates claims of identities are mapped to roles.
+func TestRoleMap(t *testing.T) {
+	m, err := oidc.ParseRoleMap([]string{"vets=USER", "it=ADMIN", "it=USER", "*=GUEST"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		values []string
+		roles  []string
+	}{
+		{nil, []string{"GUEST"}},
+		{[]string{"vets"}, []string{"GUEST", "USER"}},
+		{[]string{"vets", "it"}, []string{"ADMIN", "GUEST", "USER"}},
+	}
+
+	t.Log("Given the need to map groups to roles.")
+	{
+		for i, tc := range tt {
+			t.Logf("\tTest %d:\tWhen mapping %v.", i, tc.values)
+			{
+				if diff := cmp.Diff(tc.roles, m.Roles(tc.values)); diff != "" {
+					t.Fatalf("\t%s\tShould get the roles. Diff:\n%s", tests.Failed, diff)
+				}
+				t.Logf("\t%s\tShould get the roles.", tests.Success)
+			}
+		}
+
+		if _, err := oidc.ParseRoleMap([]string{"vets"}); err == nil {
+			t.Fatalf("\t%s\tShould refuse entries without a role.", tests.Failed)
+		}
+		t.Logf("\t%s\tShould refuse entries without a role.", tests.Success)
+	}
+}
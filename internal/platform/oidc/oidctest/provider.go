@@ -0,0 +1,200 @@
+// Package oidctest runs a mock OpenID Connect provider for tests.
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/os-foundry/vetpms/internal/platform/auth"
+)
+
+// These are the credentials of the client registered with every Provider.
+const (
+	ClientID     = "vetpms"
+	ClientSecret = "gophers"
+)
+
+// keyID identifies the key of a Provider.
+const keyID = "mock"
+
+// Provider is a mock OpenID Connect provider. Everyone sent to it is signed
+// in at once as the user set with SignInAs.
+type Provider struct {
+	*httptest.Server
+
+	key *rsa.PrivateKey
+
+	mu     sync.Mutex
+	claims jwt.MapClaims
+	codes  map[string]grant
+}
+
+// grant is a code handed out by the provider, waiting to be exchanged.
+type grant struct {
+	redirect string
+	nonce    string
+	claims   jwt.MapClaims
+}
+
+// NewProvider starts a Provider. Close it at the end of the test.
+//
+// It does not return errors as this intended for testing only. Instead it
+// will call Fatal on the provided testing.T if anything goes wrong.
+func NewProvider(t *testing.T) *Provider {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := Provider{
+		key:   key,
+		codes: make(map[string]grant),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/authorize", p.authorize)
+	mux.HandleFunc("/token", p.token)
+	mux.HandleFunc("/jwks", p.jwks)
+	p.Server = httptest.NewServer(mux)
+
+	return &p
+}
+
+// SignInAs sets the claims of the user signed in from now on, such as sub,
+// email and groups.
+func (p *Provider) SignInAs(claims jwt.MapClaims) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.claims = claims
+}
+
+// Token returns an ID token signed by the provider. It holds the claims,
+// which can override the issuer, audience and expiry the token otherwise has.
+func (p *Provider) Token(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+
+	tkn, err := p.sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tkn
+}
+
+// sign signs an ID token with the claims.
+func (p *Provider) sign(claims jwt.MapClaims) (string, error) {
+	now := time.Now()
+	all := jwt.MapClaims{
+		"iss": p.URL,
+		"aud": ClientID,
+		"iat": now.Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	}
+	for k, v := range claims {
+		all[k] = v
+	}
+
+	tkn := jwt.NewWithClaims(jwt.SigningMethodRS256, all)
+	tkn.Header["kid"] = keyID
+	return tkn.SignedString(p.key)
+}
+
+// discovery publishes the metadata of the provider.
+func (p *Provider) discovery(w http.ResponseWriter, r *http.Request) {
+	respond(w, map[string]string{
+		"issuer":                 p.URL,
+		"authorization_endpoint": p.URL + "/authorize",
+		"token_endpoint":         p.URL + "/token",
+		"jwks_uri":               p.URL + "/jwks",
+	}, http.StatusOK)
+}
+
+// authorize signs the user in and sends them back to the client with a code.
+func (p *Provider) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != ClientID || q.Get("response_type") != "code" {
+		http.Error(w, "unknown client", http.StatusBadRequest)
+		return
+	}
+
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil {
+		http.Error(w, "invalid redirect", http.StatusBadRequest)
+		return
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	code := base64.RawURLEncoding.EncodeToString(b)
+
+	p.mu.Lock()
+	p.codes[code] = grant{redirect: redirect.String(), nonce: q.Get("nonce"), claims: p.claims}
+	p.mu.Unlock()
+
+	back := redirect.Query()
+	back.Set("code", code)
+	back.Set("state", q.Get("state"))
+	redirect.RawQuery = back.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+// token exchanges a code for an ID token. Every code can be used once.
+func (p *Provider) token(w http.ResponseWriter, r *http.Request) {
+	id, secret, ok := r.BasicAuth()
+	if !ok || id != ClientID || secret != ClientSecret {
+		respond(w, map[string]string{"error": "invalid_client"}, http.StatusUnauthorized)
+		return
+	}
+
+	p.mu.Lock()
+	g, ok := p.codes[r.PostFormValue("code")]
+	delete(p.codes, r.PostFormValue("code"))
+	p.mu.Unlock()
+
+	if !ok || r.PostFormValue("grant_type") != "authorization_code" || r.PostFormValue("redirect_uri") != g.redirect {
+		respond(w, map[string]string{"error": "invalid_grant"}, http.StatusBadRequest)
+		return
+	}
+
+	claims := jwt.MapClaims{"nonce": g.nonce}
+	for k, v := range g.claims {
+		claims[k] = v
+	}
+	tkn, err := p.sign(claims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	respond(w, map[string]string{
+		"access_token": "mock",
+		"token_type":   "Bearer",
+		"id_token":     tkn,
+	}, http.StatusOK)
+}
+
+// jwks publishes the key of the provider.
+func (p *Provider) jwks(w http.ResponseWriter, r *http.Request) {
+	respond(w, auth.NewKeyStore(keyID, p.key).JWKS(), http.StatusOK)
+}
+
+// respond writes a JSON response.
+func respond(w http.ResponseWriter, v interface{}, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,48 @@
+package oidc
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// RoleMap maps the values of a claim, such as the groups of a user at the
+// provider, to the roles they have in the service. The value * maps every
+// identity.
+type RoleMap map[string][]string
+
+// ParseRoleMap parses a RoleMap from entries of the form value=role. A
+// value can map to several roles with several entries.
+func ParseRoleMap(entries []string) (RoleMap, error) {
+	m := make(RoleMap)
+	for _, e := range entries {
+		i := strings.LastIndex(e, "=")
+		if i <= 0 || i == len(e)-1 {
+			return nil, errors.Errorf("role mapping %q must be of the form value=role", e)
+		}
+		value, role := strings.TrimSpace(e[:i]), strings.TrimSpace(e[i+1:])
+		m[value] = append(m[value], role)
+	}
+	return m, nil
+}
+
+// Roles returns the sorted roles the values map to.
+func (m RoleMap) Roles(values []string) []string {
+	set := make(map[string]bool)
+	for _, r := range m["*"] {
+		set[r] = true
+	}
+	for _, v := range values {
+		for _, r := range m[v] {
+			set[r] = true
+		}
+	}
+
+	roles := make([]string, 0, len(set))
+	for r := range set {
+		roles = append(roles, r)
+	}
+	sort.Strings(roles)
+	return roles
+}
@@ -0,0 +1,91 @@
+package query
+
+import "sort"
+
+// Source is a list of items held in memory, for example after they have been
+// read from a key/value store that can't sort or filter on its own.
+type Source interface {
+	Len() int
+	ID(i int) string
+	Value(i int, field string) interface{}
+}
+
+// Match reports whether the item with the field values provided by value
+// passes all filters of the options. The options must have been validated.
+func (f Fields) Match(o Options, value func(field string) interface{}) bool {
+	for _, flt := range o.Filters {
+		want, err := f[flt.Field].Parse(flt.Value)
+		if err != nil {
+			return false
+		}
+		if Compare(value(flt.Field), want) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// After reports whether an item with the provided sort value and id comes
+// after the cursor position in the order of the options.
+func (f Fields) After(o Options, c Cursor, value interface{}, id string) bool {
+	o = o.Normalize()
+
+	// The cursor was validated with the options so parsing can't fail.
+	cv, _ := f[o.Sort].Parse(c.Value)
+
+	cmp := Compare(value, cv)
+	if cmp == 0 {
+		cmp = Compare(id, c.ID)
+	}
+	if o.Desc {
+		return cmp < 0
+	}
+	return cmp > 0
+}
+
+// Slice filters, sorts and pages the items of src according to the options.
+// It returns the indexes of the items on the requested page in order.
+func (f Fields) Slice(src Source, o Options) ([]int, Page, error) {
+	o = o.Normalize()
+
+	if err := f.Validate(o); err != nil {
+		return nil, Page{}, err
+	}
+
+	c, seek, err := f.Position(o)
+	if err != nil {
+		return nil, Page{}, err
+	}
+
+	var idx []int
+	for i := 0; i < src.Len(); i++ {
+		i := i
+		if !f.Match(o, func(field string) interface{} { return src.Value(i, field) }) {
+			continue
+		}
+		if seek && !f.After(o, c, src.Value(i, o.Sort), src.ID(i)) {
+			continue
+		}
+		idx = append(idx, i)
+	}
+
+	sort.Slice(idx, func(a, b int) bool {
+		cmp := Compare(src.Value(idx[a], o.Sort), src.Value(idx[b], o.Sort))
+		if cmp == 0 {
+			cmp = Compare(src.ID(idx[a]), src.ID(idx[b]))
+		}
+		if o.Desc {
+			return cmp > 0
+		}
+		return cmp < 0
+	})
+
+	var page Page
+	if len(idx) > o.Limit {
+		idx = idx[:o.Limit]
+		last := idx[len(idx)-1]
+		page.NextCursor = NewCursor(o, src.Value(last, o.Sort), src.ID(last))
+	}
+
+	return idx, page, nil
+}
@@ -0,0 +1,240 @@
+// Package query provides the options shared by every List operation in the
+// service: limits, opaque cursors for keyset pagination, sorting and simple
+// equality filters.
+package query
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Limits applied to the number of items returned by a single List call.
+const (
+	DefaultLimit = 50
+	MaxLimit     = 500
+)
+
+// DefaultSort is the field lists are ordered by when no sort is requested.
+// Every entity can be sorted by its ID, which is also used to break ties.
+const DefaultSort = "id"
+
+var (
+	// ErrInvalidCursor occurs when a cursor can't be decoded or does not
+	// belong to the requested sort order.
+	ErrInvalidCursor = errors.New("cursor is not in its proper form")
+
+	// ErrInvalidField occurs when sorting or filtering on an unknown field.
+	ErrInvalidField = errors.New("field can not be used for sorting or filtering")
+
+	// ErrInvalidValue occurs when a filter value does not match the type of
+	// the field it filters on.
+	ErrInvalidValue = errors.New("filter value is not in its proper form")
+)
+
+// Filter restricts a list to the items where Field equals Value.
+type Filter struct {
+	Field string
+	Value string
+}
+
+// Options describes which page of a list is requested and how the list is
+// sorted and filtered. Deleted lists the soft deleted items instead of the
+// live ones.
+type Options struct {
+	Limit   int
+	Cursor  string
+	Sort    string
+	Desc    bool
+	Deleted bool
+	Filters []Filter
+}
+
+// Page is returned together with the items of a list. NextCursor is empty
+// when the last page has been reached.
+type Page struct {
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// Normalize returns a copy of the options with the defaults applied and the
+// limit clamped to MaxLimit.
+func (o Options) Normalize() Options {
+	if o.Limit <= 0 {
+		o.Limit = DefaultLimit
+	}
+	if o.Limit > MaxLimit {
+		o.Limit = MaxLimit
+	}
+	if o.Sort == "" {
+		o.Sort = DefaultSort
+	}
+	return o
+}
+
+// Kind is the type of value stored in a field. It defines how filter and
+// cursor values are parsed and how values are compared.
+type Kind int
+
+// The supported kinds of fields.
+const (
+	String Kind = iota
+	Int
+	Time
+)
+
+// Fields maps the public names of the fields of an entity, as used in query
+// strings, to their kind.
+type Fields map[string]Kind
+
+// Validate checks that the options only reference known fields and that the
+// filter values and cursor can be parsed.
+func (f Fields) Validate(o Options) error {
+	o = o.Normalize()
+
+	if _, ok := f[o.Sort]; !ok {
+		return errors.Wrapf(ErrInvalidField, "sort %q", o.Sort)
+	}
+
+	for _, flt := range o.Filters {
+		k, ok := f[flt.Field]
+		if !ok {
+			return errors.Wrapf(ErrInvalidField, "filter %q", flt.Field)
+		}
+		if _, err := k.Parse(flt.Value); err != nil {
+			return errors.Wrapf(ErrInvalidValue, "filter %q", flt.Field)
+		}
+	}
+
+	if _, _, err := f.Position(o); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Position decodes the cursor of the options. It returns false if the
+// options do not contain a cursor and the first page is requested.
+func (f Fields) Position(o Options) (Cursor, bool, error) {
+	o = o.Normalize()
+	if o.Cursor == "" {
+		return Cursor{}, false, nil
+	}
+
+	c, err := DecodeCursor(o.Cursor)
+	if err != nil {
+		return Cursor{}, false, err
+	}
+
+	// A cursor is only valid for the order it was created with.
+	if c.Sort != o.Sort || c.Desc != o.Desc {
+		return Cursor{}, false, ErrInvalidCursor
+	}
+
+	if _, err := f[o.Sort].Parse(c.Value); err != nil {
+		return Cursor{}, false, ErrInvalidCursor
+	}
+
+	return c, true, nil
+}
+
+// Parse converts s into a value of the kind.
+func (k Kind) Parse(s string) (interface{}, error) {
+	switch k {
+	case Int:
+		return strconv.Atoi(s)
+	case Time:
+		return time.Parse(time.RFC3339Nano, s)
+	default:
+		return s, nil
+	}
+}
+
+// Format converts a value of type string, int or time.Time into the string
+// representation used in cursors and filters.
+func Format(v interface{}) string {
+	switch v := v.(type) {
+	case int:
+		return strconv.Itoa(v)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	case string:
+		return v
+	}
+	return ""
+}
+
+// Compare returns -1, 0 or 1 depending on whether a is less than, equal to
+// or greater than b. Both values must be of the same type.
+func Compare(a, b interface{}) int {
+	switch a := a.(type) {
+	case int:
+		b := b.(int)
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+	case time.Time:
+		b := b.(time.Time)
+		switch {
+		case a.Before(b):
+			return -1
+		case a.After(b):
+			return 1
+		}
+	case string:
+		b := b.(string)
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+	}
+	return 0
+}
+
+// Cursor is the decoded position of the last item of a page. It contains the
+// sort order it was created for, the sort value and the ID of the item.
+type Cursor struct {
+	Sort  string `json:"s"`
+	Desc  bool   `json:"d,omitempty"`
+	Value string `json:"v"`
+	ID    string `json:"id"`
+}
+
+// NewCursor creates the opaque cursor pointing after the item with the
+// provided id and sort value.
+func NewCursor(o Options, value interface{}, id string) string {
+	o = o.Normalize()
+
+	c := Cursor{
+		Sort:  o.Sort,
+		Desc:  o.Desc,
+		Value: Format(value),
+		ID:    id,
+	}
+
+	// Marshaling a struct of strings can not fail.
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// DecodeCursor decodes an opaque cursor created by NewCursor.
+func DecodeCursor(s string) (Cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+
+	var c Cursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+
+	return c, nil
+}
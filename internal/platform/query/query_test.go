@@ -0,0 +1,140 @@
+package query_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/os-foundry/vetpms/internal/platform/query"
+)
+
+const (
+	success = "\u2713"
+	failed  = "\u2717"
+)
+
+// item is a minimal entity used to exercise in memory pagination.
+type item struct {
+	id      string
+	name    string
+	cost    int
+	created time.Time
+}
+
+type items []item
+
+func (is items) Len() int        { return len(is) }
+func (is items) ID(i int) string { return is[i].id }
+func (is items) Value(i int, field string) interface{} {
+	switch field {
+	case "id":
+		return is[i].id
+	case "name":
+		return is[i].name
+	case "cost":
+		return is[i].cost
+	case "date_created":
+		return is[i].created
+	}
+	return nil
+}
+
+var fields = query.Fields{
+	"id":           query.String,
+	"name":         query.String,
+	"cost":         query.Int,
+	"date_created": query.Time,
+}
+
+func TestSlice(t *testing.T) {
+	now := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+	list := items{
+		{"a", "Comics", 50, now.Add(3 * time.Hour)},
+		{"b", "Toys", 10, now.Add(1 * time.Hour)},
+		{"c", "Books", 50, now.Add(2 * time.Hour)},
+		{"d", "Comics", 20, now},
+		{"e", "Games", 30, now.Add(4 * time.Hour)},
+	}
+
+	tests := []struct {
+		name string
+		opts query.Options
+		want [][]string
+	}{
+		{"id", query.Options{Limit: 2}, [][]string{{"a", "b"}, {"c", "d"}, {"e"}}},
+		{"cost", query.Options{Limit: 2, Sort: "cost"}, [][]string{{"b", "d"}, {"e", "a"}, {"c"}}},
+		{"desc", query.Options{Limit: 3, Sort: "date_created", Desc: true}, [][]string{{"e", "a", "c"}, {"b", "d"}}},
+		{"filter", query.Options{Limit: 1, Filters: []query.Filter{{Field: "name", Value: "Comics"}}}, [][]string{{"a"}, {"d"}}},
+	}
+
+	t.Log("Given the need to page through a list in memory.")
+	{
+		for i, tt := range tests {
+			t.Logf("\tTest: %d\tWhen listing with options %+v", i, tt.opts)
+			{
+				f := func(t *testing.T) {
+					var got [][]string
+					opts := tt.opts
+					for {
+						idx, page, err := fields.Slice(list, opts)
+						if err != nil {
+							t.Fatalf("\t%s\tShould be able to slice the list : %s.", failed, err)
+						}
+
+						var ids []string
+						for _, j := range idx {
+							ids = append(ids, list[j].id)
+						}
+						got = append(got, ids)
+
+						if page.NextCursor == "" {
+							break
+						}
+						opts.Cursor = page.NextCursor
+					}
+					t.Logf("\t%s\tShould be able to slice the list.", success)
+
+					if diff := cmp.Diff(tt.want, got); diff != "" {
+						t.Fatalf("\t%s\tShould get the expected pages. Diff:\n%s", failed, diff)
+					}
+					t.Logf("\t%s\tShould get the expected pages.", success)
+				}
+
+				t.Run(tt.name, f)
+			}
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cursor := query.NewCursor(query.Options{Sort: "cost"}, 50, "a")
+
+	tests := []struct {
+		name string
+		opts query.Options
+		err  bool
+	}{
+		{"default", query.Options{}, false},
+		{"sort", query.Options{Sort: "cost"}, false},
+		{"unknown sort", query.Options{Sort: "password"}, true},
+		{"unknown filter", query.Options{Filters: []query.Filter{{Field: "roles", Value: "ADMIN"}}}, true},
+		{"filter value", query.Options{Filters: []query.Filter{{Field: "cost", Value: "ten"}}}, true},
+		{"cursor", query.Options{Sort: "cost", Cursor: cursor}, false},
+		{"cursor order", query.Options{Sort: "name", Cursor: cursor}, true},
+		{"cursor form", query.Options{Cursor: "not-a-cursor"}, true},
+	}
+
+	t.Log("Given the need to validate list options.")
+	{
+		for i, tt := range tests {
+			t.Logf("\tTest: %d\tWhen validating %s.", i, tt.name)
+			{
+				err := fields.Validate(tt.opts)
+				if (err != nil) != tt.err {
+					t.Fatalf("\t%s\tShould get an error only for invalid options : %v.", failed, err)
+				}
+				t.Logf("\t%s\tShould get an error only for invalid options.", success)
+			}
+		}
+	}
+}
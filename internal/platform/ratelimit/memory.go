@@ -0,0 +1,55 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Memory keeps the buckets in memory. It limits the requests of a single
+// instance.
+type Memory struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+	pruned  time.Time
+}
+
+// memoryBucket is a bucket and when it is full again.
+type memoryBucket struct {
+	Bucket
+	full time.Time
+}
+
+// NewMemory returns a Memory without any buckets.
+func NewMemory() *Memory {
+	return &Memory{buckets: make(map[string]*memoryBucket)}
+}
+
+// Take takes a token from the bucket of the key.
+func (m *Memory) Take(ctx context.Context, key string, q Quota, now time.Time) (time.Duration, error) {
+	if q.Unlimited() {
+		return 0, nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if now.Sub(m.pruned) > pruneInterval {
+		for k, b := range m.buckets {
+			if !now.Before(b.full) {
+				delete(m.buckets, k)
+			}
+		}
+		m.pruned = now
+	}
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &memoryBucket{Bucket: newBucket(q, now)}
+		m.buckets[key] = b
+	}
+
+	wait := b.take(q, now)
+	b.full = b.Bucket.full(q)
+	return wait, nil
+}
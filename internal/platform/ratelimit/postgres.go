@@ -0,0 +1,98 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/os-foundry/vetpms/internal/platform/database"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// Postgres keeps the buckets in the rate_limits table. It limits the
+// requests of all instances sharing the database.
+type Postgres struct {
+	DB *sqlx.DB
+
+	mu     sync.Mutex
+	pruned time.Time
+}
+
+// NewPostgres returns a Postgres keeping the buckets in db.
+func NewPostgres(db *sqlx.DB) *Postgres {
+	return &Postgres{DB: db}
+}
+
+// Take takes a token from the bucket of the key.
+func (p *Postgres) Take(ctx context.Context, key string, q Quota, now time.Time) (time.Duration, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.platform.ratelimit.Postgres.Take")
+	defer span.End()
+
+	if q.Unlimited() {
+		return 0, nil
+	}
+
+	const (
+		qi = `INSERT INTO rate_limits (bucket_key, tokens, updated, full_at)
+			VALUES ($1, $2, $3, $3) ON CONFLICT DO NOTHING`
+		qs = `SELECT tokens, updated FROM rate_limits WHERE bucket_key = $1 FOR UPDATE`
+		qu = `UPDATE rate_limits SET
+			"tokens" = $2,
+			"updated" = $3,
+			"full_at" = $4
+			WHERE bucket_key = $1`
+	)
+
+	if err := p.prune(ctx, now); err != nil {
+		return 0, err
+	}
+
+	now = now.UTC().Truncate(time.Microsecond)
+	full := newBucket(q, now)
+
+	var wait time.Duration
+	if err := database.PqUnitOfWork(p.DB)(ctx, func(ctx context.Context) error {
+		db := database.PqDB(ctx, p.DB)
+
+		// The row is created first, so concurrent requests take their
+		// tokens one after the other.
+		if _, err := db.ExecContext(ctx, qi, key, full.Tokens, full.Updated); err != nil {
+			return errors.Wrap(err, "inserting bucket")
+		}
+
+		var b Bucket
+		if err := sqlx.GetContext(ctx, db, &b, qs, key); err != nil {
+			return errors.Wrap(err, "selecting bucket")
+		}
+
+		wait = b.take(q, now)
+		if _, err := db.ExecContext(ctx, qu, key, b.Tokens, b.Updated, b.full(q)); err != nil {
+			return errors.Wrap(err, "updating bucket")
+		}
+		return nil
+	}); err != nil {
+		return 0, errors.Wrapf(err, "taking token of %q", key)
+	}
+
+	return wait, nil
+}
+
+// prune deletes the buckets that are full again, at most once a minute.
+func (p *Postgres) prune(ctx context.Context, now time.Time) error {
+	p.mu.Lock()
+	if now.Sub(p.pruned) <= pruneInterval {
+		p.mu.Unlock()
+		return nil
+	}
+	p.pruned = now
+	p.mu.Unlock()
+
+	const q = `DELETE FROM rate_limits WHERE full_at <= $1`
+
+	if _, err := p.DB.ExecContext(ctx, q, now.UTC()); err != nil {
+		return errors.Wrap(err, "pruning buckets")
+	}
+	return nil
+}
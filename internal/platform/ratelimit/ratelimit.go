@@ -0,0 +1,106 @@
+// Package ratelimit limits how often something may happen with token buckets.
+// A bucket holds up to Limit tokens and is refilled at Limit tokens per Per.
+// Every request takes one token, and is rejected while the bucket is empty.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// pruneInterval is how often buckets that are full again are removed.
+const pruneInterval = time.Minute
+
+// Quota allows Limit requests at once, which are available again after Per.
+// The zero value allows any number of requests.
+type Quota struct {
+	Limit int
+	Per   time.Duration
+}
+
+// ParseQuota parses a quota of the form "100/1m", which allows 100 requests
+// per minute. An empty string or "0" allows any number of requests.
+func ParseQuota(s string) (Quota, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "0" {
+		return Quota{}, nil
+	}
+
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return Quota{}, errors.Errorf("quota %q is not of the form limit/duration", s)
+	}
+	limit, err := strconv.Atoi(parts[0])
+	if err != nil || limit < 0 {
+		return Quota{}, errors.Errorf("quota %q has an invalid limit", s)
+	}
+	per, err := time.ParseDuration(parts[1])
+	if err != nil || per <= 0 {
+		return Quota{}, errors.Errorf("quota %q has an invalid duration", s)
+	}
+
+	return Quota{Limit: limit, Per: per}, nil
+}
+
+// Unlimited reports whether the quota allows any number of requests.
+func (q Quota) Unlimited() bool {
+	return q.Limit == 0
+}
+
+// String returns the quota in the form ParseQuota reads.
+func (q Quota) String() string {
+	if q.Unlimited() {
+		return "0"
+	}
+	return strconv.Itoa(q.Limit) + "/" + q.Per.String()
+}
+
+// Limiter takes tokens from the buckets identified by a key. Take returns
+// zero when a request is allowed, and otherwise how long to wait until it
+// would be.
+type Limiter interface {
+	Take(ctx context.Context, key string, q Quota, now time.Time) (time.Duration, error)
+}
+
+// Bucket is the state of a token bucket. Tokens are counted as of Updated.
+type Bucket struct {
+	Tokens  float64   `db:"tokens"`
+	Updated time.Time `db:"updated"`
+}
+
+// refill adds the tokens refilled since the bucket was updated.
+func (b *Bucket) refill(q Quota, now time.Time) {
+	rate := float64(q.Limit) / float64(q.Per)
+	b.Tokens = math.Min(float64(q.Limit), b.Tokens+rate*float64(now.Sub(b.Updated)))
+	b.Updated = now
+}
+
+// take takes a token at now. It returns how long to wait for one when the
+// bucket is empty.
+func (b *Bucket) take(q Quota, now time.Time) time.Duration {
+	b.refill(q, now)
+	if b.Tokens >= 1 {
+		b.Tokens--
+		return 0
+	}
+
+	rate := float64(q.Limit) / float64(q.Per)
+	return time.Duration(math.Ceil((1 - b.Tokens) / rate))
+}
+
+// full returns when the bucket is full again, from when on it is the same as
+// a new one.
+func (b *Bucket) full(q Quota) time.Time {
+	rate := float64(q.Limit) / float64(q.Per)
+	return b.Updated.Add(time.Duration((float64(q.Limit) - b.Tokens) / rate))
+}
+
+// newBucket returns a full bucket.
+func newBucket(q Quota, now time.Time) Bucket {
+	return Bucket{Tokens: float64(q.Limit), Updated: now}
+}
@@ -0,0 +1,115 @@
+package ratelimit_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/os-foundry/vetpms/internal/platform/ratelimit"
+	"github.com/os-foundry/vetpms/internal/tests"
+)
+
+// TestParseQuota validates quotas are read from configuration.
+func TestParseQuota(t *testing.T) {
+	tt := []struct {
+		in    string
+		quota ratelimit.Quota
+		ok    bool
+	}{
+		{"100/1m", ratelimit.Quota{Limit: 100, Per: time.Minute}, true},
+		{" 5/30s ", ratelimit.Quota{Limit: 5, Per: 30 * time.Second}, true},
+		{"0", ratelimit.Quota{}, true},
+		{"", ratelimit.Quota{}, true},
+		{"100", ratelimit.Quota{}, false},
+		{"x/1m", ratelimit.Quota{}, false},
+		{"100/0s", ratelimit.Quota{}, false},
+	}
+
+	t.Log("Given the need to configure quotas.")
+	{
+		for i, tc := range tt {
+			t.Logf("\tTest %d:\tWhen parsing %q.", i, tc.in)
+			{
+				q, err := ratelimit.ParseQuota(tc.in)
+				if (err == nil) != tc.ok || q != tc.quota {
+					t.Fatalf("\t%s\tShould get %v, %v : %v, %v.", tests.Failed, tc.quota, tc.ok, q, err)
+				}
+				t.Logf("\t%s\tShould get %v, %v.", tests.Success, tc.quota, tc.ok)
+			}
+		}
+	}
+}
+
+// TestTake validates requests are limited to their quota and allowed again
+// as the bucket refills.
+func TestTake(t *testing.T) {
+	q := ratelimit.Quota{Limit: 3, Per: 3 * time.Minute}
+
+	tt := []string{"postgres", "memory"}
+	for _, tc := range tt {
+		var l ratelimit.Limiter
+		switch tc {
+		case "postgres":
+			db, teardown := tests.NewPqUnit(t)
+			defer teardown()
+			l = ratelimit.NewPostgres(db)
+		case "memory":
+			l = ratelimit.NewMemory()
+		}
+
+		t.Logf("Given the need to limit requests on %s.", tc)
+		{
+			ctx := tests.Context()
+			now := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+			// take takes a token of the key.
+			take := func(key string) time.Duration {
+				t.Helper()
+				wait, err := l.Take(ctx, key, q, now)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to take a token : %s.", tests.Failed, err)
+				}
+				return wait
+			}
+
+			t.Log("\tWhen a client uses up its quota.")
+			{
+				for i := 0; i < q.Limit; i++ {
+					if wait := take("a"); wait != 0 {
+						t.Fatalf("\t%s\tShould allow the quota : %v.", tests.Failed, wait)
+					}
+				}
+				t.Logf("\t%s\tShould allow the quota.", tests.Success)
+
+				if wait := take("a"); wait != time.Minute {
+					t.Fatalf("\t%s\tShould wait for the next token : %v.", tests.Failed, wait)
+				}
+				t.Logf("\t%s\tShould wait for the next token.", tests.Success)
+
+				if wait := take("b"); wait != 0 {
+					t.Fatalf("\t%s\tShould allow other clients : %v.", tests.Failed, wait)
+				}
+				t.Logf("\t%s\tShould allow other clients.", tests.Success)
+			}
+
+			t.Log("\tWhen the bucket refills.")
+			{
+				now = now.Add(time.Minute)
+				if wait := take("a"); wait != 0 {
+					t.Fatalf("\t%s\tShould allow a request : %v.", tests.Failed, wait)
+				}
+				if wait := take("a"); wait != time.Minute {
+					t.Fatalf("\t%s\tShould allow only one : %v.", tests.Failed, wait)
+				}
+				t.Logf("\t%s\tShould allow a request per refilled token.", tests.Success)
+
+				now = now.Add(time.Hour)
+				for i := 0; i < q.Limit; i++ {
+					if wait := take("a"); wait != 0 {
+						t.Fatalf("\t%s\tShould allow the quota again : %v.", tests.Failed, wait)
+					}
+				}
+				t.Logf("\t%s\tShould allow the quota again.", tests.Success)
+			}
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Package seal encrypts secrets the service has to read back, like the seeds
+// of one-time passwords, before they are stored. A copy of the database is
+// useless without the key, which is kept in the configuration instead.
+package seal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+
+	"github.com/pkg/errors"
+)
+
+// KeySize is the length of keys in bytes. Keys are AES-256 keys.
+const KeySize = 32
+
+// ErrOpen occurs when a sealed value was not sealed with the key or was
+// modified.
+var ErrOpen = errors.New("sealed value can't be opened with this key")
+
+// Box seals and opens values with AES-GCM.
+type Box struct {
+	aead cipher.AEAD
+}
+
+// NewBox constructs a Box sealing with the key.
+func NewBox(key []byte) (*Box, error) {
+	if len(key) != KeySize {
+		return nil, errors.Errorf("key must be %d bytes, got %d", KeySize, len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating cipher")
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating cipher")
+	}
+
+	return &Box{aead: aead}, nil
+}
+
+// ParseKey decodes a key in the base64 form it is configured in, like the
+// output of `openssl rand -base64 32`.
+func ParseKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding key")
+	}
+	return key, nil
+}
+
+// Seal encrypts the value. The random nonce is prepended to the result.
+func (b *Box) Seal(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.Wrap(err, "generating nonce")
+	}
+	return b.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Open decrypts a value returned by Seal. It returns ErrOpen if the value was
+// sealed with another key or was modified.
+func (b *Box) Open(sealed []byte) ([]byte, error) {
+	n := b.aead.NonceSize()
+	if len(sealed) < n {
+		return nil, ErrOpen
+	}
+	plaintext, err := b.aead.Open(nil, sealed[:n], sealed[n:], nil)
+	if err != nil {
+		return nil, ErrOpen
+	}
+	return plaintext, nil
+}
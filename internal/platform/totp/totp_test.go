@@ -0,0 +1,91 @@
+package totp_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/os-foundry/vetpms/internal/platform/totp"
+	"github.com/os-foundry/vetpms/internal/tests"
+)
+
+// TestCode validates codes against the SHA1 test vectors of RFC 6238, which
+// are eight digits long. Our six digit codes are their last six digits.
+func TestCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+
+	tt := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+
+	t.Log("Given the need to generate the codes of authenticator apps.")
+	{
+		for i, tc := range tt {
+			t.Logf("\tTest %d:\tWhen the time is %d.", i, tc.unix)
+			{
+				want := tc.code[len(tc.code)-totp.Digits:]
+				got := totp.Code(secret, totp.Step(time.Unix(tc.unix, 0)))
+				if got != want {
+					t.Fatalf("\t%s\tShould get code %s : %s.", tests.Failed, want, got)
+				}
+				t.Logf("\t%s\tShould get code %s.", tests.Success, want)
+			}
+		}
+	}
+}
+
+// TestVerify validates codes are accepted within the allowed skew and only
+// once.
+func TestVerify(t *testing.T) {
+	secret, err := totp.NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2018, time.October, 1, 0, 0, 0, 0, time.UTC)
+	code := totp.Code(secret, totp.Step(now))
+
+	t.Log("Given the need to verify codes.")
+	{
+		t.Log("\tTest 0:\tWhen the code is current.")
+		{
+			step, ok := totp.Verify(secret, code, now, 0)
+			if !ok || step != totp.Step(now) {
+				t.Fatalf("\t%s\tShould accept the code.", tests.Failed)
+			}
+			t.Logf("\t%s\tShould accept the code.", tests.Success)
+
+			if _, ok := totp.Verify(secret, code, now, step); ok {
+				t.Fatalf("\t%s\tShould not accept the code twice.", tests.Failed)
+			}
+			t.Logf("\t%s\tShould not accept the code twice.", tests.Success)
+		}
+
+		t.Log("\tTest 1:\tWhen the clocks differ.")
+		{
+			if _, ok := totp.Verify(secret, code, now.Add(totp.Period), 0); !ok {
+				t.Fatalf("\t%s\tShould accept the code of the last period.", tests.Failed)
+			}
+			if _, ok := totp.Verify(secret, code, now.Add(2*totp.Period), 0); ok {
+				t.Fatalf("\t%s\tShould not accept older codes.", tests.Failed)
+			}
+			t.Logf("\t%s\tShould accept codes within the skew only.", tests.Success)
+		}
+
+		t.Log("\tTest 2:\tWhen provisioning an app.")
+		{
+			uri := totp.URI("VetPMS", "anna@example.com", secret)
+			if !strings.HasPrefix(uri, "otpauth://totp/VetPMS:anna@example.com?") || !strings.Contains(uri, "secret="+totp.Encode(secret)) {
+				t.Fatalf("\t%s\tShould get a provisioning URI : %s.", tests.Failed, uri)
+			}
+			t.Logf("\t%s\tShould get a provisioning URI.", tests.Success)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package web
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/os-foundry/vetpms/internal/platform/query"
+	"github.com/pkg/errors"
+)
+
+// Translations holds the translations of a message by language. English is
+// not included, it is the message itself.
+type Translations map[string]string
+
+// ErrorCode documents a code of the errors sent to clients. Codes are stable,
+// so clients can react to an error and show their own message for it.
+// Messages holds the message of the error by language, including English.
+// Generic codes have no messages, their errors vary.
+type ErrorCode struct {
+	Code        string            `json:"code"`
+	Description string            `json:"description"`
+	Messages    map[string]string `json:"messages,omitempty"`
+}
+
+var (
+	// registered holds the codes of the errors sent to clients.
+	registered = make(map[error]ErrorCode)
+
+	// codes holds every code by name, including the generic ones.
+	codes = make(map[string]ErrorCode)
+)
+
+// RegisterError adds the code of an error sent to clients, with a description
+// of when it occurs and translations of its message. It is meant to be called
+// from init functions, like RegisterValidation. Codes must be unique, as
+// clients rely on them.
+func RegisterError(err error, code, description string, t Translations) {
+	ec := ErrorCode{
+		Code:        code,
+		Description: description,
+		Messages:    map[string]string{languages[0]: err.Error()},
+	}
+	for lang, msg := range t {
+		ec.Messages[lang] = msg
+	}
+
+	registerCode(ec)
+	registered[err] = ec
+}
+
+// registerCode adds a code to the list of codes. It panics if the code was
+// registered already.
+func registerCode(ec ErrorCode) {
+	if _, ok := codes[ec.Code]; ok {
+		panic("web: error code " + ec.Code + " registered twice")
+	}
+	codes[ec.Code] = ec
+}
+
+// ErrorCodes returns every code of the errors sent to clients, sorted by
+// code.
+func ErrorCodes() []ErrorCode {
+	list := make([]ErrorCode, 0, len(codes))
+	for _, ec := range codes {
+		list = append(list, ec)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Code < list[j].Code })
+	return list
+}
+
+// Message returns the message of an error in the language. Errors without a
+// translation keep their own message.
+func Message(err error, lang string) string {
+	if msg, ok := registered[err].Messages[lang]; ok {
+		return msg
+	}
+	return err.Error()
+}
+
+// statusCodes are the generic codes of errors without a code of their own,
+// by HTTP status.
+var statusCodes = map[int]string{
+	http.StatusBadRequest:         codeInvalid,
+	http.StatusUnauthorized:       "request.unauthorized",
+	http.StatusForbidden:          "request.forbidden",
+	http.StatusNotFound:           "request.not_found",
+	http.StatusConflict:           "request.conflict",
+	http.StatusPreconditionFailed: "request.precondition_failed",
+}
+
+// Codes of errors that don't map to a single HTTP status.
+const (
+	codeInvalid  = "request.invalid"
+	codeFailed   = "request.failed"
+	codeInternal = "internal"
+)
+
+// errorCode returns the code of an error sent with the HTTP status. Wrapped
+// errors have the code of their cause. Other errors get the generic code of
+// the status.
+func errorCode(err error, status int) string {
+	if ec, ok := registered[err]; ok {
+		return ec.Code
+	}
+	if ec, ok := registered[errors.Cause(err)]; ok {
+		return ec.Code
+	}
+	if code, ok := statusCodes[status]; ok {
+		return code
+	}
+	if status >= http.StatusInternalServerError {
+		return codeInternal
+	}
+	return codeFailed
+}
+
+// Generic errors sent to clients.
+var (
+	errValidation = errors.New("field validation error")
+	errInternal   = errors.New(http.StatusText(http.StatusInternalServerError))
+)
+
+func init() {
+	RegisterError(errValidation, "validation.failed", "Fields of the request are invalid. The fields of the response hold the error of every field.", Translations{
+		"nl": "ongeldige velden",
+		"bg": "невалидни полета",
+	})
+	RegisterError(errInternal, codeInternal, "The service failed to handle the request. Retrying later may succeed.", Translations{
+		"nl": "Interne serverfout",
+		"bg": "Вътрешна грешка на сървъра",
+	})
+
+	RegisterError(query.ErrInvalidField, "query.invalid_field", "A list is sorted or filtered on a field it doesn't support.", Translations{
+		"nl": "op dit veld kan niet worden gesorteerd of gefilterd",
+		"bg": "не може да се сортира или филтрира по това поле",
+	})
+	RegisterError(query.ErrInvalidValue, "query.invalid_value", "A list is filtered on a value that doesn't match the type of the field.", Translations{
+		"nl": "filterwaarde heeft niet de juiste vorm",
+		"bg": "стойността на филтъра не е в правилния формат",
+	})
+
+	registerCode(ErrorCode{Code: codeInvalid, Description: "The request is malformed, such as a body that isn't valid JSON or a bad query parameter."})
+	registerCode(ErrorCode{Code: "request.unauthorized", Description: "The request isn't authenticated, or its token or key is invalid or expired."})
+	registerCode(ErrorCode{Code: "request.forbidden", Description: "The authenticated user may not make the request."})
+	registerCode(ErrorCode{Code: "request.not_found", Description: "The requested resource doesn't exist."})
+	registerCode(ErrorCode{Code: "request.conflict", Description: "The request conflicts with the current state of a resource."})
+	registerCode(ErrorCode{Code: "request.precondition_failed", Description: "A precondition of the request, such as its If-Match header, doesn't hold."})
+	registerCode(ErrorCode{Code: codeFailed, Description: "The request failed for another reason, given by the HTTP status."})
+}
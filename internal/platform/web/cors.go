@@ -0,0 +1,195 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultCORSHeaders are the request headers browsers may send when CORS
+// doesn't list any.
+var DefaultCORSHeaders = []string{"Authorization", "Content-Type", "If-Match", "X-API-Key", "X-Device-Name"}
+
+// DefaultCORSExposedHeaders are the response headers browsers may read when
+// CORS doesn't list any.
+var DefaultCORSExposedHeaders = []string{"Content-Disposition", "ETag", "Link", "Retry-After", "X-Next-Cursor"}
+
+// CORS decides which origins browsers may call the application from. An
+// origin of "*" allows any origin, but only without credentials. Methods are
+// limited to the methods of the requested route, and further to
+// AllowedMethods when it is set. A header of "*" allows any request header.
+// The zero value allows no origin.
+type CORS struct {
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           time.Duration
+}
+
+// ErrCORSWildcardCredentials occurs when any origin is allowed to send
+// credentials, which would let every website act on behalf of the user.
+var ErrCORSWildcardCredentials = errors.New("cors: origin * can't be allowed with credentials")
+
+// Validate checks the configuration. Any origin can't be allowed together
+// with credentials.
+func (c CORS) Validate() error {
+	if c.AllowCredentials && contains(c.AllowedOrigins, "*") {
+		return ErrCORSWildcardCredentials
+	}
+	return nil
+}
+
+// origin returns the value of the Access-Control-Allow-Origin header for the
+// origin of a request. It returns an empty string if the origin isn't
+// allowed. Only origins listed exactly are echoed back, so "*" allows no
+// origin when credentials are allowed.
+func (c CORS) origin(origin string) string {
+	if origin == "" {
+		return ""
+	}
+	for _, o := range c.AllowedOrigins {
+		switch {
+		case o == "*" && !c.AllowCredentials:
+			return "*"
+		case o != "*" && strings.EqualFold(o, origin):
+			return origin
+		}
+	}
+	return ""
+}
+
+// methodAllowed reports whether AllowedMethods allows the method.
+func (c CORS) methodAllowed(method string) bool {
+	if len(c.AllowedMethods) == 0 {
+		return true
+	}
+	for _, m := range c.AllowedMethods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// headersAllowed reports whether all headers of a comma separated list are
+// allowed.
+func (c CORS) headersAllowed(list string) bool {
+	allowed := c.AllowedHeaders
+	if len(allowed) == 0 {
+		allowed = DefaultCORSHeaders
+	}
+
+	for _, h := range strings.Split(list, ",") {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+
+		ok := false
+		for _, a := range allowed {
+			if a == "*" || strings.EqualFold(a, h) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// setHeaders adds the headers allowing the origin of the request to read the
+// response.
+func (c CORS) setHeaders(w http.ResponseWriter, r *http.Request) {
+	if len(c.AllowedOrigins) == 0 {
+		return
+	}
+
+	// Responses differ by origin, so caches must keep them apart.
+	w.Header().Add("Vary", "Origin")
+
+	origin := c.origin(r.Header.Get("Origin"))
+	if origin == "" {
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if c.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	exposed := c.ExposedHeaders
+	if len(exposed) == 0 {
+		exposed = DefaultCORSExposedHeaders
+	}
+	w.Header().Set("Access-Control-Expose-Headers", strings.Join(exposed, ", "))
+}
+
+// preflight answers OPTIONS requests of routes. It allows a preflight
+// request when its origin, method and headers are allowed, and otherwise
+// answers without the headers, which makes the browser refuse the request.
+// Plain OPTIONS requests get the methods of the route.
+func (a *App) preflight(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	methods := a.methods(w, r)
+	w.Header().Set("Allow", strings.Join(append(methods, http.MethodOptions), ", "))
+
+	method := r.Header.Get("Access-Control-Request-Method")
+	if method == "" || a.cors.origin(r.Header.Get("Origin")) == "" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var allowed []string
+	for _, m := range methods {
+		if a.cors.methodAllowed(m) {
+			allowed = append(allowed, m)
+		}
+	}
+
+	headers := r.Header.Get("Access-Control-Request-Headers")
+	if !contains(allowed, method) || !a.cors.headersAllowed(headers) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(allowed, ", "))
+	if headers != "" {
+		w.Header().Set("Access-Control-Allow-Headers", headers)
+	}
+	if a.cors.MaxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", fmt.Sprint(int(a.cors.MaxAge.Seconds())))
+	}
+	w.Header().Add("Vary", "Access-Control-Request-Method")
+	w.Header().Add("Vary", "Access-Control-Request-Headers")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// methods returns the methods with a handler for the path of a request.
+func (a *App) methods(w http.ResponseWriter, r *http.Request) []string {
+	var methods []string
+	for m := range a.verbs {
+		lr := *r
+		lr.Method = m
+		if res, ok := a.TreeMux.Lookup(w, &lr); ok && res.StatusCode == http.StatusOK {
+			methods = append(methods, m)
+		}
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// contains reports whether the list holds the string.
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -11,23 +11,27 @@ type FieldError struct {
 }
 
 // ErrorResponse is the form used for API responses from failures in the API.
+// Code is the stable, machine-readable code of the error, see ErrorCodes.
 type ErrorResponse struct {
+	Code   string       `json:"code"`
 	Error  string       `json:"error"`
 	Fields []FieldError `json:"fields,omitempty"`
 }
 
 // Error is used to pass an error during the request through the
-// application with web specific context.
+// application with web specific context. Code overrides the code registered
+// for Err, if set.
 type Error struct {
 	Err    error
 	Status int
+	Code   string
 	Fields []FieldError
 }
 
 // NewRequestError wraps a provided error with an HTTP status code. This
 // function should be used when handlers encounter expected errors.
 func NewRequestError(err error, status int) error {
-	return &Error{err, status, nil}
+	return &Error{Err: err, Status: status}
 }
 
 // Error implements the error interface. It uses the default message of the
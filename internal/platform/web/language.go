@@ -0,0 +1,133 @@
+package web
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	ut "github.com/go-playground/universal-translator"
+	validator "gopkg.in/go-playground/validator.v9"
+)
+
+// languages are the languages messages are translated to. The first one is
+// the default, the others match the translations of the desktop client.
+var languages = []string{"en", "nl", "bg"}
+
+// Language picks the language of the messages of a response from the
+// Accept-Language header of an HTTP request, such as `nl-BE, nl;q=0.9`. Only
+// the primary subtag is compared. It falls back to English when none of the
+// languages is accepted.
+func Language(r *http.Request) string {
+	best, bestQ := languages[0], 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, q := part, 1.0
+		if i := strings.Index(part, ";"); i >= 0 {
+			tag = part[:i]
+			param := strings.TrimSpace(part[i+1:])
+			if strings.HasPrefix(param, "q=") {
+				var err error
+				if q, err = strconv.ParseFloat(param[2:], 64); err != nil {
+					continue
+				}
+			}
+		}
+
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if i := strings.Index(tag, "-"); i >= 0 {
+			tag = tag[:i]
+		}
+		if q > bestQ && supported(tag) {
+			best, bestQ = tag, q
+		}
+	}
+	return best
+}
+
+// supported reports whether messages are translated to the language.
+func supported(lang string) bool {
+	for _, l := range languages {
+		if l == lang {
+			return true
+		}
+	}
+	return false
+}
+
+// bgMessages are the Bulgarian messages of validations, as the validator has
+// no Bulgarian translations. Validations of sizes have a message for strings,
+// numbers and items each.
+var bgMessages = map[string]string{
+	"required":   "{0} е задължително поле",
+	"eqfield":    "{0} трябва да е равно на {1}",
+	"uuid":       "{0} трябва да е валиден UUID",
+	"email":      "{0} трябва да е валиден имейл адрес",
+	"oneof":      "{0} трябва да е едно от [{1}]",
+	"min-string": "{0} трябва да съдържа поне {1} символа",
+	"min-number": "{0} трябва да е {1} или повече",
+	"min-items":  "{0} трябва да съдържа поне {1} елемента",
+	"max-string": "{0} трябва да съдържа най-много {1} символа",
+	"max-number": "{0} трябва да е {1} или по-малко",
+	"max-items":  "{0} трябва да съдържа най-много {1} елемента",
+	"len-string": "{0} трябва да съдържа точно {1} символа",
+	"len-number": "{0} трябва да е равно на {1}",
+	"len-items":  "{0} трябва да съдържа точно {1} елемента",
+}
+
+// bgSizes maps validations of sizes to the messages they use.
+var bgSizes = map[string]string{
+	"min": "min",
+	"gte": "min",
+	"max": "max",
+	"lte": "max",
+	"len": "len",
+}
+
+// registerBulgarian registers the Bulgarian messages of validations.
+func registerBulgarian(v *validator.Validate, lang ut.Translator) error {
+	register := func(t ut.Translator) error {
+		return nil
+	}
+
+	for key, msg := range bgMessages {
+		if err := lang.Add(key, msg, false); err != nil {
+			return err
+		}
+	}
+
+	for _, tag := range []string{"required", "eqfield", "uuid", "email", "oneof"} {
+		translate := func(t ut.Translator, fe validator.FieldError) string {
+			msg, err := t.T(fe.Tag(), fe.Field(), fe.Param())
+			if err != nil {
+				return fe.(error).Error()
+			}
+			return msg
+		}
+		if err := v.RegisterTranslation(tag, lang, register, translate); err != nil {
+			return err
+		}
+	}
+
+	for tag, key := range bgSizes {
+		key := key
+		translate := func(t ut.Translator, fe validator.FieldError) string {
+			kind := "number"
+			switch fe.Kind() {
+			case reflect.String:
+				kind = "string"
+			case reflect.Slice, reflect.Map, reflect.Array:
+				kind = "items"
+			}
+			msg, err := t.T(key+"-"+kind, fe.Field(), fe.Param())
+			if err != nil {
+				return fe.(error).Error()
+			}
+			return msg
+		}
+		if err := v.RegisterTranslation(tag, lang, register, translate); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
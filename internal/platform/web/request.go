@@ -3,14 +3,20 @@ package web
 import (
 	"encoding/json"
 	"errors"
+	"net"
 	"net/http"
 	"reflect"
+	"strconv"
 	"strings"
 
+	bg "github.com/go-playground/locales/bg"
 	en "github.com/go-playground/locales/en"
+	nl "github.com/go-playground/locales/nl"
 	ut "github.com/go-playground/universal-translator"
+	"github.com/os-foundry/vetpms/internal/platform/query"
 	validator "gopkg.in/go-playground/validator.v9"
 	en_translations "gopkg.in/go-playground/validator.v9/translations/en"
+	nl_translations "gopkg.in/go-playground/validator.v9/translations/nl"
 )
 
 // validate holds the settings and caches for validating request struct values.
@@ -21,16 +27,21 @@ var translator *ut.UniversalTranslator
 
 func init() {
 
-	// Instantiate the english locale for the validator library.
+	// Create a value using English as the fallback locale (first argument),
+	// supporting the other languages of the API as well.
 	enLocale := en.New()
+	translator = ut.New(enLocale, enLocale, nl.New(), bg.New())
 
-	// Create a value using English as the fallback locale (first argument).
-	// Provide one or more arguments for additional supported locales.
-	translator = ut.New(enLocale, enLocale)
-
-	// Register the english error messages for validation errors.
+	// Register the error messages for validation errors. The validator has
+	// English and Dutch ones, the Bulgarian ones are our own.
 	lang, _ := translator.GetTranslator("en")
 	en_translations.RegisterDefaultTranslations(validate, lang)
+	lang, _ = translator.GetTranslator("nl")
+	nl_translations.RegisterDefaultTranslations(validate, lang)
+	lang, _ = translator.GetTranslator("bg")
+	if err := registerBulgarian(validate, lang); err != nil {
+		panic(err)
+	}
 
 	// Use JSON tag names for errors instead of Go struct names.
 	validate.RegisterTagNameFunc(func(fld reflect.StructField) string {
@@ -42,10 +53,48 @@ func init() {
 	})
 }
 
+// RegisterValidation adds a validation tag checked by fn. message is the
+// English error message of a failed validation and t holds its translations,
+// {0} is replaced with the field name.
+func RegisterValidation(tag string, fn validator.Func, message string, t Translations) error {
+	if err := validate.RegisterValidation(tag, fn); err != nil {
+		return err
+	}
+
+	translate := func(t ut.Translator, fe validator.FieldError) string {
+		msg, err := t.T(tag, fe.Field())
+		if err != nil {
+			return fe.(error).Error()
+		}
+		return msg
+	}
+
+	all := map[string]string{"en": message}
+	for l, msg := range t {
+		all[l] = msg
+	}
+	for l, msg := range all {
+		msg := msg
+		register := func(t ut.Translator) error {
+			return t.Add(tag, msg, true)
+		}
+		lang, ok := translator.GetTranslator(l)
+		if !ok {
+			return errors.New("no translator for language " + l)
+		}
+		if err := validate.RegisterTranslation(tag, lang, register, translate); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // Decode reads the body of an HTTP request looking for a JSON document. The
 // body is decoded into the provided value.
 //
 // If the provided value is a struct then it is checked for validation tags.
+// The errors are in the language the request accepts.
 func Decode(r *http.Request, val interface{}) error {
 	decoder := json.NewDecoder(r.Body)
 	decoder.DisallowUnknownFields()
@@ -53,6 +102,19 @@ func Decode(r *http.Request, val interface{}) error {
 		return NewRequestError(err, http.StatusBadRequest)
 	}
 
+	return check(val, Language(r))
+}
+
+// Validate checks the validation tags of a struct value. A failed validation
+// is returned as an *Error holding a FieldError for every invalid field, with
+// English messages.
+func Validate(val interface{}) error {
+	return check(val, languages[0])
+}
+
+// check checks the validation tags of a struct value like Validate, with
+// messages in the language. Messages without a translation are in English.
+func check(val interface{}, l string) error {
 	if err := validate.Struct(val); err != nil {
 
 		// Use a type assertion to get the real error value.
@@ -61,21 +123,26 @@ func Decode(r *http.Request, val interface{}) error {
 			return err
 		}
 
-		// lang controls the language of the error messages. You could look at the
-		// Accept-Language header if you intend to support multiple languages.
-		lang, _ := translator.GetTranslator("en")
+		// lang controls the language of the error messages. A message the
+		// validator can't translate is its raw error.
+		lang, _ := translator.GetTranslator(l)
+		fallback, _ := translator.GetTranslator(languages[0])
 
 		var fields []FieldError
 		for _, verror := range verrors {
+			msg := verror.Translate(lang)
+			if msg == verror.(error).Error() {
+				msg = verror.Translate(fallback)
+			}
 			field := FieldError{
 				Field: verror.Field(),
-				Error: verror.Translate(lang),
+				Error: msg,
 			}
 			fields = append(fields, field)
 		}
 
 		return &Error{
-			Err:    errors.New("field validation error"),
+			Err:    errValidation,
 			Status: http.StatusBadRequest,
 			Fields: fields,
 		}
@@ -83,3 +150,111 @@ func Decode(r *http.Request, val interface{}) error {
 
 	return nil
 }
+
+// IfMatch returns the entity tags of the If-Match header of an HTTP request
+// that a version has to match. It returns nil if the header is missing or is
+// "*", which matches any version. If-Match uses the strong comparison, so
+// weak tags never match and are left out. A header with only weak tags
+// returns an empty list, which no version matches.
+func IfMatch(r *http.Request) []string {
+	values, ok := r.Header["If-Match"]
+	if !ok {
+		return nil
+	}
+
+	tags := []string{}
+	for s := strings.Join(values, ","); ; {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			break
+		}
+		if s[0] == '*' {
+			return nil
+		}
+
+		weak := strings.HasPrefix(s, "W/")
+		if weak {
+			s = s[2:]
+		}
+
+		// Tags are quoted and can contain commas. The rest of a malformed
+		// header is ignored.
+		if s == "" || s[0] != '"' {
+			break
+		}
+		end := strings.IndexByte(s[1:], '"')
+		if end < 0 {
+			break
+		}
+		if !weak {
+			tags = append(tags, s[:end+2])
+		}
+		s = s[end+2:]
+	}
+
+	return tags
+}
+
+// RemoteIP returns the IP address an HTTP request was received from.
+func RemoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// DecodeQuery reads the list options from the query string of an HTTP
+// request. The limit, cursor, sort and deleted parameters are reserved, every
+// other parameter is treated as an equality filter on the field with that name.
+// Prefix the sort field with a minus sign to sort in descending order:
+//
+//	/v1/products?limit=20&sort=-date_created&user_id=<id>
+//
+// The options are validated against the fields the listed entity supports.
+func DecodeQuery(r *http.Request, fields query.Fields) (query.Options, error) {
+	return DecodeQuerySort(r, fields, "")
+}
+
+// DecodeQuerySort is DecodeQuery for lists with another order than by ID when
+// the request has no sort parameter. The default is given like the parameter,
+// so "-date_created" lists the newest items first. Cursors are validated with
+// the default too, so they keep working for the following pages.
+func DecodeQuerySort(r *http.Request, fields query.Fields, sort string) (query.Options, error) {
+	opts := query.Options{
+		Sort: strings.TrimPrefix(sort, "-"),
+		Desc: strings.HasPrefix(sort, "-"),
+	}
+
+	for key, values := range r.URL.Query() {
+		for _, value := range values {
+			switch key {
+			case "limit":
+				limit, err := strconv.Atoi(value)
+				if err != nil || limit < 0 {
+					return query.Options{}, NewRequestError(errors.New("limit must be a positive number"), http.StatusBadRequest)
+				}
+				opts.Limit = limit
+			case "cursor":
+				opts.Cursor = value
+			case "sort":
+				opts.Sort = strings.TrimPrefix(value, "-")
+				opts.Desc = strings.HasPrefix(value, "-")
+			case "deleted":
+				deleted, err := strconv.ParseBool(value)
+				if err != nil {
+					return query.Options{}, NewRequestError(errors.New("deleted must be true or false"), http.StatusBadRequest)
+				}
+				opts.Deleted = deleted
+			default:
+				opts.Filters = append(opts.Filters, query.Filter{Field: key, Value: value})
+			}
+		}
+	}
+
+	if err := fields.Validate(opts); err != nil {
+		return query.Options{}, NewRequestError(err, http.StatusBadRequest)
+	}
+
+	return opts.Normalize(), nil
+}
@@ -2,13 +2,37 @@ package web
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"strconv"
 
+	"github.com/os-foundry/vetpms/internal/platform/query"
 	"github.com/pkg/errors"
 )
 
-// Respond converts a Go value to JSON and sends it to the client.
+// Versioned is implemented by resources that carry an entity tag identifying
+// their current version.
+type Versioned interface {
+	ETag() string
+}
+
+// NewETag returns a strong entity tag derived from a hash of the JSON encoding
+// of v, so values that encode differently get different tags. v must be
+// encodable, like a stored record.
+func NewETag(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(errors.Wrap(err, "encoding entity tag"))
+	}
+	sum := sha256.Sum256(b)
+	return strconv.Quote(base64.RawURLEncoding.EncodeToString(sum[:16]))
+}
+
+// Respond converts a Go value to JSON and sends it to the client. If the value
+// is Versioned its entity tag is sent in the ETag header.
 func Respond(ctx context.Context, w http.ResponseWriter, data interface{}, statusCode int) error {
 
 	// Set the status code for the request logger middleware.
@@ -34,6 +58,9 @@ func Respond(ctx context.Context, w http.ResponseWriter, data interface{}, statu
 
 	// Set the content type and headers once we know marshaling has succeeded.
 	w.Header().Set("Content-Type", "application/json")
+	if vd, ok := data.(Versioned); ok && statusCode < http.StatusMultipleChoices {
+		w.Header().Set("ETag", vd.ETag())
+	}
 
 	// Write the status code to the response.
 	w.WriteHeader(statusCode)
@@ -46,14 +73,45 @@ func Respond(ctx context.Context, w http.ResponseWriter, data interface{}, statu
 	return nil
 }
 
-// RespondError sends an error reponse back to the client.
+// RespondPage sends a single page of a list to the client. The cursor of the
+// next page, if any, is sent in the X-Next-Cursor header and as a Link header
+// so the body remains a plain JSON array.
+func RespondPage(ctx context.Context, w http.ResponseWriter, r *http.Request, data interface{}, page query.Page) error {
+	if page.NextCursor != "" {
+		u := *r.URL
+		q := u.Query()
+		q.Set("cursor", page.NextCursor)
+		u.RawQuery = q.Encode()
+
+		w.Header().Set("X-Next-Cursor", page.NextCursor)
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, u.RequestURI()))
+	}
+
+	return Respond(ctx, w, data, http.StatusOK)
+}
+
+// RespondError sends an error reponse back to the client. The message is in
+// the language the request accepts if it was translated, the code is the one
+// registered for the error or the generic code of its status.
 func RespondError(ctx context.Context, w http.ResponseWriter, err error) error {
+	v, ok := ctx.Value(KeyValues).(*Values)
+	if !ok {
+		return NewShutdownError("web value missing from context")
+	}
+	if v.Language != "" {
+		w.Header().Set("Content-Language", v.Language)
+	}
 
 	// If the error was of the type *Error, the handler has
 	// a specific status code and error to return.
 	if webErr, ok := errors.Cause(err).(*Error); ok {
+		code := webErr.Code
+		if code == "" {
+			code = errorCode(webErr.Err, webErr.Status)
+		}
 		er := ErrorResponse{
-			Error:  webErr.Err.Error(),
+			Code:   code,
+			Error:  Message(webErr.Err, v.Language),
 			Fields: webErr.Fields,
 		}
 		if err := Respond(ctx, w, er, webErr.Status); err != nil {
@@ -64,7 +122,8 @@ func RespondError(ctx context.Context, w http.ResponseWriter, err error) error {
 
 	// If not, the handler sent any arbitrary error value so use 500.
 	er := ErrorResponse{
-		Error: http.StatusText(http.StatusInternalServerError),
+		Code:  codeInternal,
+		Error: Message(errInternal, v.Language),
 	}
 	if err := Respond(ctx, w, er, http.StatusInternalServerError); err != nil {
 		return err
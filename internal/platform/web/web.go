@@ -20,11 +20,13 @@ type ctxKey int
 // KeyValues is how request values or stored/retrieved.
 const KeyValues ctxKey = 1
 
-// Values represent state for each request.
+// Values represent state for each request. Language is the language of the
+// messages sent back.
 type Values struct {
 	TraceID    string
 	Now        time.Time
 	StatusCode int
+	Language   string
 }
 
 // A Handler is a type that handles an http request within our own little mini
@@ -40,17 +42,26 @@ type App struct {
 	shutdown chan os.Signal
 	log      *log.Logger
 	mw       []Middleware
+	cors     CORS
+	verbs    map[string]bool
 }
 
 // NewApp creates an App value that handle a set of routes for the application.
-func NewApp(shutdown chan os.Signal, log *log.Logger, mw ...Middleware) *App {
+// Browsers may call the routes from the origins cors allows.
+func NewApp(shutdown chan os.Signal, log *log.Logger, cors CORS, mw ...Middleware) *App {
 	app := App{
 		TreeMux:  httptreemux.New(),
 		shutdown: shutdown,
 		log:      log,
 		mw:       mw,
+		cors:     cors,
+		verbs:    make(map[string]bool),
 	}
 
+	// Answer OPTIONS requests and CORS preflight requests of every route
+	// instead of responding 405 Method Not Allowed.
+	app.TreeMux.OptionsHandler = app.preflight
+
 	// Create an OpenCensus HTTP Handler which wraps the router. This will start
 	// the initial span and annotate it with information about the request/response.
 	//
@@ -90,8 +101,9 @@ func (a *App) Handle(verb, path string, handler Handler, mw ...Middleware) {
 		// Set the context with the required values to
 		// process the request.
 		v := Values{
-			TraceID: span.SpanContext().TraceID.String(),
-			Now:     time.Now(),
+			TraceID:  span.SpanContext().TraceID.String(),
+			Now:      time.Now(),
+			Language: Language(r),
 		}
 		ctx = context.WithValue(ctx, KeyValues, &v)
 
@@ -105,11 +117,14 @@ func (a *App) Handle(verb, path string, handler Handler, mw ...Middleware) {
 
 	// Add this handler for the specified verb and route.
 	a.TreeMux.Handle(verb, path, h)
+	a.verbs[verb] = true
 }
 
 // ServeHTTP implements the http.Handler interface. It overrides the ServeHTTP
 // of the embedded TreeMux by using the ochttp.Handler instead. That Handler
-// wraps the TreeMux handler so the routes are served.
+// wraps the TreeMux handler so the routes are served. The CORS headers are
+// added to every response, errors included.
 func (a *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.cors.setHeaders(w, r)
 	a.och.ServeHTTP(w, r)
 }
@@ -0,0 +1,135 @@
+package product
+
+import (
+	"context"
+	"time"
+
+	"github.com/os-foundry/vetpms/internal/audit"
+	"github.com/os-foundry/vetpms/internal/platform/auth"
+)
+
+// Entity types of products and their sales in the audit trail.
+const (
+	EntityType     = "product"
+	SaleEntityType = "sale"
+)
+
+// Audited wraps a Storage and records every Create, Update, Delete, Restore
+// and Purge of Products, and every sale, in the audit trail.
+type Audited struct {
+	Storage
+	Trail audit.Trail
+}
+
+// Create adds a Product and records it in the audit trail.
+func (st Audited) Create(ctx context.Context, user auth.Claims, np NewProduct, now time.Time) (*Product, error) {
+	var p *Product
+	if err := st.Trail.Atomic(ctx, func(ctx context.Context) error {
+		var err error
+		if p, err = st.Storage.Create(ctx, user, np, now); err != nil {
+			return err
+		}
+		return st.Trail.Record(ctx, EntityType, p.ID, audit.ActionCreate, nil, p, now)
+	}); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Update modifies a Product and records the changes in the audit trail.
+func (st Audited) Update(ctx context.Context, user auth.Claims, id string, update UpdateProduct, now time.Time) error {
+	return st.Trail.Atomic(ctx, func(ctx context.Context) error {
+		before, err := st.Storage.Retrieve(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		if err := st.Storage.Update(ctx, user, id, update, now); err != nil {
+			return err
+		}
+
+		after, err := st.Storage.Retrieve(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		return st.Trail.Record(ctx, EntityType, id, audit.ActionUpdate, before, after, now)
+	})
+}
+
+// Delete marks a Product as deleted and records its last state in the audit
+// trail. Deleting a Product that does not exist is not recorded.
+func (st Audited) Delete(ctx context.Context, user auth.Claims, id string, now time.Time) error {
+	return st.Trail.Atomic(ctx, func(ctx context.Context) error {
+		before, err := st.Storage.Retrieve(ctx, id)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+
+		if err := st.Storage.Delete(ctx, user, id, now); err != nil {
+			return err
+		}
+
+		if before == nil {
+			return nil
+		}
+
+		return st.Trail.Record(ctx, EntityType, id, audit.ActionDelete, before, nil, now)
+	})
+}
+
+// Restore undoes the deletion of a Product and records the restored Product
+// in the audit trail.
+func (st Audited) Restore(ctx context.Context, id string, now time.Time) error {
+	return st.Trail.Atomic(ctx, func(ctx context.Context) error {
+		if err := st.Storage.Restore(ctx, id, now); err != nil {
+			return err
+		}
+
+		after, err := st.Storage.Retrieve(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		return st.Trail.Record(ctx, EntityType, id, audit.ActionRestore, nil, after, now)
+	})
+}
+
+// AddSale records a sale of a Product and adds it to the audit trail.
+func (st Audited) AddSale(ctx context.Context, ns NewSale, productID string, now time.Time) (*Sale, error) {
+	var s *Sale
+	if err := st.Trail.Atomic(ctx, func(ctx context.Context) error {
+		var err error
+		if s, err = st.Storage.AddSale(ctx, ns, productID, now); err != nil {
+			return err
+		}
+		return st.Trail.Record(ctx, SaleEntityType, s.ID, audit.ActionCreate, nil, s, now)
+	}); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Purge permanently removes the products deleted before the given time and
+// records the cutoff and the number of products purged in the audit trail.
+// Purges that remove nothing are not recorded.
+func (st Audited) Purge(ctx context.Context, before time.Time) (int, error) {
+	var n int
+	if err := st.Trail.Atomic(ctx, func(ctx context.Context) error {
+		var err error
+		if n, err = st.Storage.Purge(ctx, before); err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		purge := audit.Purge{Before: before.UTC(), Count: n}
+		return st.Trail.Record(ctx, EntityType, "", audit.ActionPurge, nil, purge, time.Now())
+	}); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
@@ -2,17 +2,72 @@ package postgres
 
 import (
 	"context"
+	"encoding/json"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/os-foundry/vetpms/internal/platform/auth"
+	"github.com/os-foundry/vetpms/internal/platform/database"
+	"github.com/os-foundry/vetpms/internal/platform/query"
 	"github.com/os-foundry/vetpms/internal/product"
 	"github.com/pkg/errors"
 	bolt "go.etcd.io/bbolt"
 	"go.opencensus.io/trace"
 )
 
-const productsCollection = "products"
+const (
+	productsCollection = "products"
+	salesCollection    = "sales"
+
+	// totalsCollection holds the totals of the sales of every product, so
+	// they don't have to be added up on every read.
+	totalsCollection = "sales_totals"
+)
+
+// totals are the aggregated sales of a product.
+type totals struct {
+	Sales   int `json:"sales"`
+	Sold    int `json:"sold"`
+	Revenue int `json:"revenue"`
+}
+
+// saleIndex finds the sales of a product.
+var saleIndex = database.BoltIndex{
+	Name:   "sales_product",
+	Bucket: salesCollection,
+	Field:  "product_id",
+	Key: func(v []byte) ([]byte, error) {
+		s, err := product.DecodeSale(v)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(s.ProductID), nil
+	},
+}
+
+// Indexes are the secondary indexes of the products and sales buckets. Every
+// query field has one, so lists seek on them.
+var Indexes = append(append([]database.BoltIndex{saleIndex},
+	database.FieldIndexes(productsCollection, product.QueryFields, productValue)...),
+	database.FieldIndexes(salesCollection, product.SaleQueryFields, saleValue, saleIndex)...)
+
+// productValue returns the value of a query field of an encoded product.
+func productValue(v []byte, field string) (interface{}, error) {
+	p, err := product.Decode(v)
+	if err != nil {
+		return nil, err
+	}
+	return p.Value(field), nil
+}
+
+// saleValue returns the value of a query field of an encoded sale.
+func saleValue(v []byte, field string) (interface{}, error) {
+	s, err := product.DecodeSale(v)
+	if err != nil {
+		return nil, err
+	}
+	return s.Value(field), nil
+}
 
 // Bolt implements the Storage interface for
 // the bolt database
@@ -20,61 +75,241 @@ type Bolt struct {
 	DB *bolt.DB
 }
 
-// List gets all Products from the database.
-func (st Bolt) List(ctx context.Context) ([]product.Product, error) {
+// products adapts a slice of products so it can be sorted and paged in memory.
+type products []product.Product
+
+func (ps products) Len() int                              { return len(ps) }
+func (ps products) ID(i int) string                       { return ps[i].ID }
+func (ps products) Value(i int, field string) interface{} { return ps[i].Value(field) }
+
+// sales adapts a slice of sales so it can be sorted and paged in memory.
+type sales []product.Sale
+
+func (ss sales) Len() int                              { return len(ss) }
+func (ss sales) ID(i int) string                       { return ss[i].ID }
+func (ss sales) Value(i int, field string) interface{} { return ss[i].Value(field) }
+
+// List gets a page of Products from the database. Lists seek directly to the
+// cursor on the bucket or the index of the sort field. Filtered lists only read
+// the products matching their first filter, which are sorted in memory unless
+// they are sorted by ID.
+func (st Bolt) List(ctx context.Context, opts query.Options) ([]product.Product, query.Page, error) {
 	ctx, span := trace.StartSpan(ctx, "internal.product.postgres.List")
 	defer span.End()
 
-	products := []product.Product{}
-	if err := st.DB.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(productsCollection))
-		if err := bucket.ForEach(func(k []byte, v []byte) error {
-			u, err := product.Decode(v)
+	opts = opts.Normalize()
+	if err := product.QueryFields.Validate(opts); err != nil {
+		return nil, query.Page{}, err
+	}
+
+	var (
+		list products
+		page query.Page
+	)
+	if err := database.BoltView(ctx, st.DB, func(tx *bolt.Tx) error {
+		visit := func(k []byte, v []byte) (bool, error) {
+			p, err := product.Decode(v)
 			if err != nil {
-				return errors.Wrap(err, "decoding product")
+				return false, errors.Wrap(err, "decoding product")
 			}
-			products = append(products, *u)
-			return nil
-		}); err != nil {
+			if (p.DeletedAt != nil) != opts.Deleted {
+				return false, nil
+			}
+			if !product.QueryFields.Match(opts, p.Value) {
+				return false, nil
+			}
+			list = append(list, *p)
+			return true, nil
+		}
+
+		ordered, err := database.SeekBoltIndex(tx, productsCollection, Indexes, opts, product.QueryFields, visit)
+		if err != nil {
+			return err
+		}
+
+		idx, p, err := database.PageBolt(list, opts, product.QueryFields, ordered)
+		if err != nil {
 			return err
 		}
 
-		pmap := make(map[string]int)
-		for k, v := range products {
-			pmap[v.ID] = k
+		paged := make(products, len(idx))
+		for i, j := range idx {
+			paged[i] = list[j]
 		}
+		list, page = paged, p
 
-		salesb := tx.Bucket([]byte("sales"))
-		if err := salesb.ForEach(func(k []byte, v []byte) error {
-			s, err := product.DecodeSale(v)
-			if err != nil {
-				return errors.Wrap(err, "decoding sale")
+		// Only the sales of the products on this page are aggregated.
+		for i := range list {
+			if err := aggregate(tx, &list[i]); err != nil {
+				return errors.Wrap(err, "getting sales")
 			}
+		}
+
+		return nil
+	}); err != nil {
+		return nil, query.Page{}, errors.Wrap(err, "selecting products")
+	}
+
+	if list == nil {
+		list = products{}
+	}
+
+	return list, page, nil
+}
+
+// aggregate sets the totals of the sales of the product.
+func aggregate(tx *bolt.Tx, p *product.Product) error {
+	t, err := getTotals(tx, p.ID)
+	if err != nil {
+		return err
+	}
+	p.Sold, p.Revenue = t.Sold, t.Revenue
+	return nil
+}
+
+// getTotals returns the totals of the sales of the product.
+func getTotals(tx *bolt.Tx, productID string) (totals, error) {
+	var t totals
+	b := tx.Bucket([]byte(totalsCollection))
+	if b == nil {
+		return t, errors.Errorf("bucket %s doesn't exist, migrate the database", totalsCollection)
+	}
+	if v := b.Get([]byte(productID)); v != nil {
+		if err := json.Unmarshal(v, &t); err != nil {
+			return t, errors.Wrapf(err, "decoding totals of product %s", productID)
+		}
+	}
+	return t, nil
+}
+
+// addTotals adds a sale to the totals of its product, or subtracts it when n
+// is -1.
+func addTotals(tx *bolt.Tx, s product.Sale, n int) error {
+	t, err := getTotals(tx, s.ProductID)
+	if err != nil {
+		return err
+	}
+
+	t.Sales += n
+	t.Sold += n * s.Quantity
+	t.Revenue += n * s.Paid
 
-			// Get the product index,
-			// skip if it doesn't exist in the map
-			i, ok := pmap[s.ProductID]
+	b := tx.Bucket([]byte(totalsCollection))
+	if t.Sales == 0 {
+		return b.Delete([]byte(s.ProductID))
+	}
+	v, err := json.Marshal(t)
+	if err != nil {
+		return errors.Wrapf(err, "encoding totals of product %s", s.ProductID)
+	}
+	return b.Put([]byte(s.ProductID), v)
+}
+
+// putSale stores the sale and updates the totals of the products of the
+// replaced and the new sale.
+func putSale(tx *bolt.Tx, s product.Sale) error {
+	if v := tx.Bucket([]byte(salesCollection)).Get([]byte(s.ID)); v != nil {
+		old, err := product.DecodeSale(v)
+		if err != nil {
+			return errors.Wrap(err, "decoding sale")
+		}
+		if err := addTotals(tx, *old, -1); err != nil {
+			return err
+		}
+	}
+	if err := addTotals(tx, s, 1); err != nil {
+		return err
+	}
+
+	v, err := s.Encode()
+	if err != nil {
+		return errors.Wrap(err, "encoding sale")
+	}
+	return database.BoltPut(tx, salesCollection, Indexes, []byte(s.ID), v)
+}
+
+// sumTotals adds up the sales of all products.
+func sumTotals(tx *bolt.Tx) (map[string]totals, error) {
+	sums := make(map[string]totals)
+	if err := tx.Bucket([]byte(salesCollection)).ForEach(func(k, v []byte) error {
+		s, err := product.DecodeSale(v)
+		if err != nil {
+			return errors.Wrapf(err, "decoding sale %s", k)
+		}
+		t := sums[s.ProductID]
+		t.Sales++
+		t.Sold += s.Quantity
+		t.Revenue += s.Paid
+		sums[s.ProductID] = t
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return sums, nil
+}
+
+// RebuildTotals replaces the totals of the sales of all products with totals
+// added up from the sales. It returns the number of products with sales.
+func RebuildTotals(tx *bolt.Tx) (int, error) {
+	sums, err := sumTotals(tx)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.DeleteBucket([]byte(totalsCollection)); err != nil && err != bolt.ErrBucketNotFound {
+		return 0, errors.Wrapf(err, "deleting %s", totalsCollection)
+	}
+	b, err := tx.CreateBucket([]byte(totalsCollection))
+	if err != nil {
+		return 0, errors.Wrapf(err, "creating %s", totalsCollection)
+	}
+
+	for id, t := range sums {
+		v, err := json.Marshal(t)
+		if err != nil {
+			return 0, errors.Wrapf(err, "encoding totals of product %s", id)
+		}
+		if err := b.Put([]byte(id), v); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(sums), nil
+}
+
+// VerifyTotals compares the totals of the sales of all products with totals
+// added up from the sales. Totals that are missing or differ are reported as
+// missing, totals of products without sales as stale.
+func VerifyTotals(tx *bolt.Tx) (database.IndexReport, error) {
+	r := database.IndexReport{Index: totalsCollection}
+
+	sums, err := sumTotals(tx)
+	if err != nil {
+		return r, err
+	}
+
+	if b := tx.Bucket([]byte(totalsCollection)); b != nil {
+		if err := b.ForEach(func(k, v []byte) error {
+			r.Entries++
+			want, ok := sums[string(k)]
 			if !ok {
+				r.Stale++
 				return nil
 			}
-			// Skip if another product ID
-			if s.ProductID != products[i].ID {
-				return nil
-			}
-			products[i].Sold += s.Quantity
-			products[i].Revenue += s.Paid
+			delete(sums, string(k))
 
+			var t totals
+			if err := json.Unmarshal(v, &t); err != nil || t != want {
+				r.Missing++
+			}
 			return nil
 		}); err != nil {
-			return errors.Wrap(err, "getting sales")
+			return r, err
 		}
-
-		return nil
-	}); err != nil {
-		return nil, errors.Wrap(err, "selecting products")
 	}
+	r.Missing += len(sums)
 
-	return products, nil
+	return r, nil
 }
 
 // Create adds a Product to the database. It returns the created Product with
@@ -83,6 +318,10 @@ func (st Bolt) Create(ctx context.Context, user auth.Claims, np product.NewProdu
 	ctx, span := trace.StartSpan(ctx, "internal.product.postgres.Create")
 	defer span.End()
 
+	// Timestamps are stored with microsecond precision so entity tags derived
+	// from them stay stable.
+	now = now.UTC().Truncate(time.Microsecond)
+
 	p := product.Product{
 		ID:          uuid.New().String(),
 		Name:        np.Name,
@@ -93,14 +332,12 @@ func (st Bolt) Create(ctx context.Context, user auth.Claims, np product.NewProdu
 		DateUpdated: now.UTC(),
 	}
 
-	if err := st.DB.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(productsCollection))
-
+	if err := database.BoltUpdate(ctx, st.DB, func(tx *bolt.Tx) error {
 		v, err := p.Encode()
 		if err != nil {
 			return errors.Wrapf(err, "encoding product")
 		}
-		if err := bucket.Put([]byte(p.ID), v); err != nil {
+		if err := database.BoltPut(tx, productsCollection, Indexes, []byte(p.ID), v); err != nil {
 			return err
 		}
 
@@ -122,7 +359,7 @@ func (st Bolt) Retrieve(ctx context.Context, id string) (*product.Product, error
 	}
 
 	var p product.Product
-	if err := st.DB.View(func(tx *bolt.Tx) error {
+	if err := database.BoltView(ctx, st.DB, func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(productsCollection))
 		v := bucket.Get([]byte(id))
 		if len(v) == 0 {
@@ -132,23 +369,11 @@ func (st Bolt) Retrieve(ctx context.Context, id string) (*product.Product, error
 		if err := p.Decode(v); err != nil {
 			return errors.Wrap(err, "decoding product")
 		}
+		if p.DeletedAt != nil {
+			return product.ErrNotFound
+		}
 
-		salesb := tx.Bucket([]byte("sales"))
-		if err := salesb.ForEach(func(k []byte, v []byte) error {
-			s, err := product.DecodeSale(v)
-			if err != nil {
-				return errors.Wrap(err, "decoding sale")
-			}
-
-			// Skip if another product ID
-			if s.ProductID != p.ID {
-				return nil
-			}
-			p.Sold += s.Quantity
-			p.Revenue += s.Paid
-
-			return nil
-		}); err != nil {
+		if err := aggregate(tx, &p); err != nil {
 			return errors.Wrap(err, "getting sales")
 		}
 
@@ -164,7 +389,8 @@ func (st Bolt) Retrieve(ctx context.Context, id string) (*product.Product, error
 }
 
 // Update modifies data about a Product. It will error if the specified ID is
-// invalid or does not reference an existing Product.
+// invalid or does not reference an existing Product, or with ErrModified if
+// the Product was modified since it was read.
 func (st Bolt) Update(ctx context.Context, user auth.Claims, id string, update product.UpdateProduct, now time.Time) error {
 	ctx, span := trace.StartSpan(ctx, "internal.product.postgres.Update")
 	defer span.End()
@@ -181,6 +407,11 @@ func (st Bolt) Update(ctx context.Context, user auth.Claims, id string, update p
 		return product.ErrForbidden
 	}
 
+	if !update.Matches(p.ETag()) {
+		return product.ErrModified
+	}
+	version := p.ETag()
+
 	if update.Name != nil {
 		p.Name = *update.Name
 	}
@@ -190,28 +421,53 @@ func (st Bolt) Update(ctx context.Context, user auth.Claims, id string, update p
 	if update.Quantity != nil {
 		p.Quantity = *update.Quantity
 	}
-	p.DateUpdated = now
+	p.DateUpdated = now.UTC().Truncate(time.Microsecond)
 
-	if err := st.DB.Update(func(tx *bolt.Tx) error {
+	if err := database.BoltUpdate(ctx, st.DB, func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(productsCollection))
+
+		// Writes are serialized so the stored product can be compared with the
+		// retrieved one before it is replaced.
+		old := bucket.Get([]byte(p.ID))
+		if len(old) == 0 {
+			return product.ErrNotFound
+		}
+		cur, err := product.Decode(old)
+		if err != nil {
+			return errors.Wrap(err, "decoding product")
+		}
+		if cur.DeletedAt != nil {
+			return product.ErrNotFound
+		}
+		if cur.ETag() != version {
+			return product.ErrModified
+		}
+
+		// Sold and Revenue are aggregates and are not stored.
+		p.Sold, p.Revenue = 0, 0
+
 		v, err := p.Encode()
 		if err != nil {
 			return errors.Wrapf(err, "encoding product")
 		}
-		if err := bucket.Put([]byte(p.ID), v); err != nil {
+		if err := database.BoltPut(tx, productsCollection, Indexes, []byte(p.ID), v); err != nil {
 			return errors.Wrap(err, "writing product data")
 		}
 
 		return nil
 	}); err != nil {
+		if err == product.ErrModified || err == product.ErrNotFound {
+			return err
+		}
 		return errors.Wrap(err, "updating product")
 	}
 
 	return nil
 }
 
-// Delete removes the product identified by a given ID.
-func (st Bolt) Delete(ctx context.Context, id string) error {
+// Delete marks the product identified by a given ID as deleted. Its sales are
+// kept so revenue reports stay intact.
+func (st Bolt) Delete(ctx context.Context, user auth.Claims, id string, now time.Time) error {
 	ctx, span := trace.StartSpan(ctx, "internal.product.postgres.Delete")
 	defer span.End()
 
@@ -219,16 +475,280 @@ func (st Bolt) Delete(ctx context.Context, id string) error {
 		return product.ErrInvalidID
 	}
 
-	if err := st.DB.Update(func(tx *bolt.Tx) error {
+	if err := database.BoltUpdate(ctx, st.DB, func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(productsCollection))
-		if err := bucket.Delete([]byte(id)); err != nil {
+		v := bucket.Get([]byte(id))
+		if len(v) == 0 {
+			return nil
+		}
+
+		p, err := product.Decode(v)
+		if err != nil {
+			return errors.Wrap(err, "decoding product")
+		}
+		if p.DeletedAt != nil {
+			return nil
+		}
+
+		deletedAt := now.UTC().Truncate(time.Microsecond)
+		p.DeletedAt = &deletedAt
+		p.DeletedBy = &user.Subject
+
+		if v, err = p.Encode(); err != nil {
+			return errors.Wrap(err, "encoding product")
+		}
+		return database.BoltPut(tx, productsCollection, Indexes, []byte(id), v)
+	}); err != nil {
+		return errors.Wrap(err, "deleting product")
+	}
+
+	return nil
+}
+
+// Restore undoes the deletion of a product. It returns ErrNotFound if there is
+// no deleted product with the ID.
+func (st Bolt) Restore(ctx context.Context, id string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.product.bolt.Restore")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return product.ErrInvalidID
+	}
+
+	if err := database.BoltUpdate(ctx, st.DB, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(productsCollection))
+		v := bucket.Get([]byte(id))
+		if len(v) == 0 {
+			return product.ErrNotFound
+		}
+
+		p, err := product.Decode(v)
+		if err != nil {
+			return errors.Wrap(err, "decoding product")
+		}
+		if p.DeletedAt == nil {
+			return product.ErrNotFound
+		}
+
+		p.DeletedAt, p.DeletedBy = nil, nil
+		p.DateUpdated = now.UTC().Truncate(time.Microsecond)
+
+		if v, err = p.Encode(); err != nil {
+			return errors.Wrap(err, "encoding product")
+		}
+		return database.BoltPut(tx, productsCollection, Indexes, []byte(id), v)
+	}); err != nil {
+		if err == product.ErrNotFound {
 			return err
 		}
+		return errors.Wrap(err, "restoring product")
+	}
+
+	return nil
+}
+
+// Purge permanently removes the products deleted before the given time
+// together with their sales. It returns the number of products removed.
+func (st Bolt) Purge(ctx context.Context, before time.Time) (int, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.bolt.Purge")
+	defer span.End()
+
+	var n int
+	if err := database.BoltUpdate(ctx, st.DB, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(productsCollection))
+
+		// Keys can't be deleted while iterating over a bucket.
+		purged := make(map[string]bool)
+		if err := bucket.ForEach(func(k []byte, v []byte) error {
+			p, err := product.Decode(v)
+			if err != nil {
+				return errors.Wrap(err, "decoding product")
+			}
+			if p.DeletedAt != nil && p.DeletedAt.Before(before) {
+				purged[p.ID] = true
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		if len(purged) == 0 {
+			return nil
+		}
+
+		for id := range purged {
+
+			// The IDs are only valid until the index is changed.
+			var sales [][]byte
+			for _, k := range saleIndex.IDs(tx, []byte(id)) {
+				sales = append(sales, append([]byte(nil), k...))
+			}
+			for _, k := range sales {
+				if err := database.BoltDelete(tx, salesCollection, Indexes, k); err != nil {
+					return err
+				}
+			}
+			if b := tx.Bucket([]byte(totalsCollection)); b != nil {
+				if err := b.Delete([]byte(id)); err != nil {
+					return err
+				}
+			}
+			if err := database.BoltDelete(tx, productsCollection, Indexes, []byte(id)); err != nil {
+				return err
+			}
+		}
+		n = len(purged)
 
 		return nil
 	}); err != nil {
-		return errors.Wrap(err, "deleting product")
+		return 0, errors.Wrap(err, "purging products")
+	}
+
+	return n, nil
+}
+
+// AddSale records a sale of the product identified by productID. It returns
+// ErrNotFound if the product does not exist or was deleted.
+func (st Bolt) AddSale(ctx context.Context, ns product.NewSale, productID string, now time.Time) (*product.Sale, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.bolt.AddSale")
+	defer span.End()
+
+	if _, err := uuid.Parse(productID); err != nil {
+		return nil, product.ErrInvalidID
+	}
+
+	s := product.Sale{
+		ID:          uuid.New().String(),
+		ProductID:   productID,
+		Quantity:    ns.Quantity,
+		Paid:        ns.Paid,
+		DateCreated: now.UTC().Truncate(time.Microsecond),
+	}
+
+	if err := database.BoltUpdate(ctx, st.DB, func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(productsCollection)).Get([]byte(productID))
+		if len(v) == 0 {
+			return product.ErrNotFound
+		}
+		p, err := product.Decode(v)
+		if err != nil {
+			return errors.Wrap(err, "decoding product")
+		}
+		if p.DeletedAt != nil {
+			return product.ErrNotFound
+		}
+
+		return putSale(tx, s)
+	}); err != nil {
+		if err == product.ErrNotFound {
+			return nil, err
+		}
+		return nil, errors.Wrap(err, "inserting sale")
+	}
+
+	return &s, nil
+}
+
+// ListSales gets a page of the sales of all products. Lists seek on the
+// bucket or the indexes of the sales like List.
+func (st Bolt) ListSales(ctx context.Context, opts query.Options) ([]product.Sale, query.Page, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.bolt.ListSales")
+	defer span.End()
+
+	opts = opts.Normalize()
+	if err := product.SaleQueryFields.Validate(opts); err != nil {
+		return nil, query.Page{}, err
+	}
+
+	var (
+		list    sales
+		ordered bool
+	)
+	if err := database.BoltView(ctx, st.DB, func(tx *bolt.Tx) error {
+		visit := func(k []byte, v []byte) (bool, error) {
+			s, err := product.DecodeSale(v)
+			if err != nil {
+				return false, errors.Wrap(err, "decoding sale")
+			}
+			if !product.SaleQueryFields.Match(opts, s.Value) {
+				return false, nil
+			}
+			list = append(list, *s)
+			return true, nil
+		}
+
+		var err error
+		ordered, err = database.SeekBoltIndex(tx, salesCollection, Indexes, opts, product.SaleQueryFields, visit)
+		return err
+	}); err != nil {
+		return nil, query.Page{}, errors.Wrap(err, "selecting sales")
+	}
+
+	idx, page, err := database.PageBolt(list, opts, product.SaleQueryFields, ordered)
+	if err != nil {
+		return nil, query.Page{}, err
+	}
+
+	paged := make([]product.Sale, len(idx))
+	for i, j := range idx {
+		paged[i] = list[j]
+	}
+
+	return paged, page, nil
+}
+
+// Put stores a product exactly as given, replacing the product with the same
+// ID if there is one. The Sold and Revenue aggregates are not stored. It is
+// meant for restoring and converting data and bypasses all checks.
+func (st Bolt) Put(ctx context.Context, p product.Product) error {
+	ctx, span := trace.StartSpan(ctx, "internal.product.bolt.Put")
+	defer span.End()
+
+	p.Sold, p.Revenue = 0, 0
+
+	v, err := p.Encode()
+	if err != nil {
+		return errors.Wrap(err, "encoding product")
+	}
+
+	if err := database.BoltUpdate(ctx, st.DB, func(tx *bolt.Tx) error {
+		return database.BoltPut(tx, productsCollection, Indexes, []byte(p.ID), v)
+	}); err != nil {
+		return errors.Wrapf(err, "putting product %s", p.ID)
 	}
 
 	return nil
 }
+
+// PutSale stores a sale exactly as given, replacing the sale with the same ID
+// if there is one. It is meant for restoring and converting data and bypasses
+// all checks.
+func (st Bolt) PutSale(ctx context.Context, s product.Sale) error {
+	ctx, span := trace.StartSpan(ctx, "internal.product.bolt.PutSale")
+	defer span.End()
+
+	if err := database.BoltUpdate(ctx, st.DB, func(tx *bolt.Tx) error {
+		return putSale(tx, s)
+	}); err != nil {
+		return errors.Wrapf(err, "putting sale %s", s.ID)
+	}
+
+	return nil
+}
+
+// StatusCheck returns nil if it can successfully talk to the database. It
+// returns a non-nil error otherwise.
+func (st Bolt) StatusCheck(ctx context.Context) error {
+	ctx, span := trace.StartSpan(ctx, "internal.product.bolt.StatusCheck")
+	defer span.End()
+
+	// Starting a transaction fails when the database was closed, and the
+	// buckets are missing when the database was not migrated.
+	return st.DB.View(func(tx *bolt.Tx) error {
+		for _, name := range []string{productsCollection, salesCollection, totalsCollection, saleIndex.Name} {
+			if tx.Bucket([]byte(name)) == nil {
+				return errors.Errorf("%s bucket missing, migrate the database", name)
+			}
+		}
+		return nil
+	})
+}
@@ -10,6 +10,10 @@ var (
 	// ErrInvalidID is used when an invalid UUID is provided.
 	ErrInvalidID = errors.New("ID is not in its proper form")
 
+	// ErrModified occurs when a product is updated based on a version that is
+	// no longer the stored version.
+	ErrModified = errors.New("Product was modified in the meantime")
+
 	// ErrForbidden occurs when a user tries to do something that is forbidden to
 	// them according to our access control policies.
 	ErrForbidden = errors.New("Attempted action is not allowed")
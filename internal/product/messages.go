@@ -0,0 +1,24 @@
+package product
+
+import "github.com/os-foundry/vetpms/internal/platform/web"
+
+// The errors sent to clients have stable codes and are translated to the
+// languages of the API.
+func init() {
+	web.RegisterError(ErrNotFound, "product.not_found", "The requested product doesn't exist or was deleted.", web.Translations{
+		"nl": "Product niet gevonden",
+		"bg": "Продуктът не е намерен",
+	})
+	web.RegisterError(ErrInvalidID, "product.invalid_id", "The ID of a product isn't a UUID.", web.Translations{
+		"nl": "ID heeft niet de juiste vorm",
+		"bg": "ID не е в правилния формат",
+	})
+	web.RegisterError(ErrModified, "product.modified", "The product changed since the version in the If-Match header. Fetch it again before retrying.", web.Translations{
+		"nl": "Product is intussen gewijzigd",
+		"bg": "Продуктът междувременно е променен",
+	})
+	web.RegisterError(ErrForbidden, "product.forbidden", "The authenticated user may not act on this product.", web.Translations{
+		"nl": "Deze actie is niet toegestaan",
+		"bg": "Това действие не е позволено",
+	})
+}
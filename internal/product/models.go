@@ -4,39 +4,106 @@ import (
 	"bytes"
 	"encoding/gob"
 	"time"
+
+	"github.com/os-foundry/vetpms/internal/platform/envelope"
+	"github.com/os-foundry/vetpms/internal/platform/query"
+	"github.com/os-foundry/vetpms/internal/platform/web"
 )
 
 // Product is an item we sell.
 type Product struct {
-	ID          string    `db:"product_id" json:"id"`             // Unique identifier.
-	Name        string    `db:"name" json:"name"`                 // Display name of the product.
-	Cost        int       `db:"cost" json:"cost"`                 // Price for one item in cents.
-	Quantity    int       `db:"quantity" json:"quantity"`         // Original number of items available.
-	Sold        int       `db:"sold" json:"sold"`                 // Aggregate field showing number of items sold.
-	Revenue     int       `db:"revenue" json:"revenue"`           // Aggregate field showing total cost of sold items.
-	UserID      string    `db:"user_id" json:"user_id"`           // ID of the user who created the product.
-	DateCreated time.Time `db:"date_created" json:"date_created"` // When the product was added.
-	DateUpdated time.Time `db:"date_updated" json:"date_updated"` // When the product record was last modified.
-}
-
-// Encode gob encodes all product data into a slice of bytes.
-func (p *Product) Encode() ([]byte, error) {
-	var buf bytes.Buffer
-	if err := gob.NewEncoder(&buf).Encode(p); err != nil {
-		return nil, err
+	ID          string     `db:"product_id" json:"id"`                   // Unique identifier.
+	Name        string     `db:"name" json:"name"`                       // Display name of the product.
+	Cost        int        `db:"cost" json:"cost"`                       // Price for one item in cents.
+	Quantity    int        `db:"quantity" json:"quantity"`               // Original number of items available.
+	Sold        int        `db:"sold" json:"sold"`                       // Aggregate field showing number of items sold.
+	Revenue     int        `db:"revenue" json:"revenue"`                 // Aggregate field showing total cost of sold items.
+	UserID      string     `db:"user_id" json:"user_id"`                 // ID of the user who created the product.
+	DateCreated time.Time  `db:"date_created" json:"date_created"`       // When the product was added.
+	DateUpdated time.Time  `db:"date_updated" json:"date_updated"`       // When the product record was last modified.
+	DeletedAt   *time.Time `db:"deleted_at" json:"deleted_at,omitempty"` // When the product was deleted, if it was.
+	DeletedBy   *string    `db:"deleted_by" json:"deleted_by,omitempty"` // ID of the user who deleted the product.
+}
+
+// QueryFields are the fields products can be sorted and filtered by when they
+// are listed.
+var QueryFields = query.Fields{
+	"id":           query.String,
+	"name":         query.String,
+	"cost":         query.Int,
+	"quantity":     query.Int,
+	"user_id":      query.String,
+	"date_created": query.Time,
+	"date_updated": query.Time,
+}
+
+// Value returns the value of one of the QueryFields of the product.
+func (p *Product) Value(field string) interface{} {
+	switch field {
+	case "id":
+		return p.ID
+	case "name":
+		return p.Name
+	case "cost":
+		return p.Cost
+	case "quantity":
+		return p.Quantity
+	case "user_id":
+		return p.UserID
+	case "date_created":
+		return p.DateCreated
+	case "date_updated":
+		return p.DateUpdated
+	}
+	return nil
+}
+
+// ETag returns the entity tag of the current version of the product. It is a
+// hash of the stored fields, so every change of the product changes it. The
+// aggregates are not stored and sales don't change it. Times are hashed at the
+// microsecond precision of the databases.
+func (p *Product) ETag() string {
+	r := *p
+	r.Sold, r.Revenue = 0, 0
+	r.DateCreated = r.DateCreated.UTC().Truncate(time.Microsecond)
+	r.DateUpdated = r.DateUpdated.UTC().Truncate(time.Microsecond)
+	if r.DeletedAt != nil {
+		t := r.DeletedAt.UTC().Truncate(time.Microsecond)
+		r.DeletedAt = &t
 	}
-	return buf.Bytes(), nil
+	return web.NewETag(r)
+}
+
+// codec encodes the products stored in Bolt. Version 1 is the first version
+// stored in an envelope, older products were gob encoded.
+var codec = envelope.Codec{
+	Version: 1,
+	Legacy: func(b []byte) (interface{}, error) {
+		var p Product
+		if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&p); err != nil {
+			return nil, err
+		}
+		return p, nil
+	},
+}
+
+// Encode encodes all product data into a slice of bytes stored in Bolt.
+func (p *Product) Encode() ([]byte, error) {
+	return codec.Encode(p)
 }
 
-// Decode gob decodes a slice of bytes into the product.
+// Decode decodes a slice of bytes stored in Bolt into the product. Records of
+// older versions are upgraded.
 func (p *Product) Decode(b []byte) error {
-	if err := gob.NewDecoder(bytes.NewBuffer(b)).Decode(&p); err != nil {
+	var d Product
+	if err := codec.Decode(b, &d); err != nil {
 		return err
 	}
+	*p = d
 	return nil
 }
 
-// Decode creates a new Product from a gob encoded byte slice.
+// Decode creates a new Product from a slice of bytes stored in Bolt.
 func Decode(b []byte) (*Product, error) {
 	var p Product
 	if err := p.Decode(b); err != nil {
@@ -62,6 +129,24 @@ type UpdateProduct struct {
 	Name     *string `json:"name"`
 	Cost     *int    `json:"cost" validate:"omitempty,gte=0"`
 	Quantity *int    `json:"quantity" validate:"omitempty,gte=1"`
+
+	// ETags make the update conditional. If not nil, the update fails with
+	// ErrModified unless the stored product has one of these entity tags.
+	ETags []string `json:"-"`
+}
+
+// Matches reports whether the update applies to the version of the product
+// with the entity tag.
+func (up UpdateProduct) Matches(etag string) bool {
+	if up.ETags == nil {
+		return true
+	}
+	for _, t := range up.ETags {
+		if t == etag {
+			return true
+		}
+	}
+	return false
 }
 
 // Sale represents one item of a transaction where some amount of a product was
@@ -76,24 +161,63 @@ type Sale struct {
 	DateCreated time.Time `db:"date_created" json:"date_created"`
 }
 
-// Encode gob encodes all Sale data into a slice of bytes.
-func (s *Sale) Encode() ([]byte, error) {
-	var buf bytes.Buffer
-	if err := gob.NewEncoder(&buf).Encode(s); err != nil {
-		return nil, err
+// SaleQueryFields are the fields sales can be sorted and filtered by when they
+// are listed.
+var SaleQueryFields = query.Fields{
+	"id":           query.String,
+	"product_id":   query.String,
+	"quantity":     query.Int,
+	"paid":         query.Int,
+	"date_created": query.Time,
+}
+
+// Value returns the value of one of the SaleQueryFields of the sale.
+func (s *Sale) Value(field string) interface{} {
+	switch field {
+	case "id":
+		return s.ID
+	case "product_id":
+		return s.ProductID
+	case "quantity":
+		return s.Quantity
+	case "paid":
+		return s.Paid
+	case "date_created":
+		return s.DateCreated
 	}
-	return buf.Bytes(), nil
+	return nil
+}
+
+// saleCodec encodes the sales stored in Bolt. Version 1 is the first version
+// stored in an envelope, older sales were gob encoded.
+var saleCodec = envelope.Codec{
+	Version: 1,
+	Legacy: func(b []byte) (interface{}, error) {
+		var s Sale
+		if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&s); err != nil {
+			return nil, err
+		}
+		return s, nil
+	},
+}
+
+// Encode encodes all Sale data into a slice of bytes stored in Bolt.
+func (s *Sale) Encode() ([]byte, error) {
+	return saleCodec.Encode(s)
 }
 
-// Decode gob decodes a slice of bytes into the Sale.
+// Decode decodes a slice of bytes stored in Bolt into the Sale. Records of
+// older versions are upgraded.
 func (s *Sale) Decode(b []byte) error {
-	if err := gob.NewDecoder(bytes.NewBuffer(b)).Decode(&s); err != nil {
+	var d Sale
+	if err := saleCodec.Decode(b, &d); err != nil {
 		return err
 	}
+	*s = d
 	return nil
 }
 
-// Decode creates a new Sale from a gob encoded byte slice.
+// Decode creates a new Sale from a slice of bytes stored in Bolt.
 func DecodeSale(b []byte) (*Sale, error) {
 	var s Sale
 	if err := s.Decode(b); err != nil {
@@ -8,6 +8,8 @@ import (
 	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
 	"github.com/os-foundry/vetpms/internal/platform/auth"
+	"github.com/os-foundry/vetpms/internal/platform/database"
+	"github.com/os-foundry/vetpms/internal/platform/query"
 	"github.com/os-foundry/vetpms/internal/product"
 	"github.com/pkg/errors"
 	"go.opencensus.io/trace"
@@ -19,25 +21,70 @@ type Postgres struct {
 	DB *sqlx.DB
 }
 
-// List gets all Products from the database.
-func (st Postgres) List(ctx context.Context) ([]product.Product, error) {
+// columns maps the product query fields to their columns.
+var columns = map[string]string{
+	"id":           "p.product_id",
+	"name":         "p.name",
+	"cost":         "p.cost",
+	"quantity":     "p.quantity",
+	"user_id":      "p.user_id",
+	"date_created": "p.date_created",
+	"date_updated": "p.date_updated",
+}
+
+// saleColumns maps the sale query fields to their columns.
+var saleColumns = map[string]string{
+	"id":           "sale_id",
+	"product_id":   "product_id",
+	"quantity":     "quantity",
+	"paid":         "paid",
+	"date_created": "date_created",
+}
+
+// deleted returns the condition selecting either the live or the soft deleted
+// products.
+func deleted(opts query.Options) string {
+	if opts.Deleted {
+		return "p.deleted_at IS NOT NULL"
+	}
+	return "p.deleted_at IS NULL"
+}
+
+// List gets a page of Products from the database.
+func (st Postgres) List(ctx context.Context, opts query.Options) ([]product.Product, query.Page, error) {
 	ctx, span := trace.StartSpan(ctx, "internal.product.postgres.List")
 	defer span.End()
 
+	opts = opts.Normalize()
+
+	where, args, err := database.Where(opts, product.QueryFields, columns, deleted(opts))
+	if err != nil {
+		return nil, query.Page{}, err
+	}
+
 	products := []product.Product{}
-	const q = `SELECT
+	q := `SELECT
 			p.*,
 			COALESCE(SUM(s.quantity) ,0) AS sold,
 			COALESCE(SUM(s.paid), 0) AS revenue
 		FROM products AS p
-		LEFT JOIN sales AS s ON p.product_id = s.product_id
-		GROUP BY p.product_id`
+		LEFT JOIN sales AS s ON p.product_id = s.product_id` +
+		where +
+		` GROUP BY p.product_id` +
+		database.OrderBy(opts, columns)
+
+	if err := sqlx.SelectContext(ctx, database.PqDB(ctx, st.DB), &products, q, args...); err != nil {
+		return nil, query.Page{}, errors.Wrap(err, "selecting products")
+	}
 
-	if err := st.DB.SelectContext(ctx, &products, q); err != nil {
-		return nil, errors.Wrap(err, "selecting products")
+	var page query.Page
+	if len(products) > opts.Limit {
+		products = products[:opts.Limit]
+		last := products[len(products)-1]
+		page.NextCursor = query.NewCursor(opts, last.Value(opts.Sort), last.ID)
 	}
 
-	return products, nil
+	return products, page, nil
 }
 
 // Create adds a Product to the database. It returns the created Product with
@@ -46,6 +93,10 @@ func (st Postgres) Create(ctx context.Context, user auth.Claims, np product.NewP
 	ctx, span := trace.StartSpan(ctx, "internal.product.postgres.Create")
 	defer span.End()
 
+	// Timestamps are stored with microsecond precision so entity tags derived
+	// from them stay stable.
+	now = now.UTC().Truncate(time.Microsecond)
+
 	p := product.Product{
 		ID:          uuid.New().String(),
 		Name:        np.Name,
@@ -61,7 +112,7 @@ func (st Postgres) Create(ctx context.Context, user auth.Claims, np product.NewP
 		(product_id, user_id, name, cost, quantity, date_created, date_updated)
 		VALUES ($1, $2, $3, $4, $5, $6, $7)`
 
-	_, err := st.DB.ExecContext(ctx, q,
+	_, err := database.PqDB(ctx, st.DB).ExecContext(ctx, q,
 		p.ID, p.UserID,
 		p.Name, p.Cost, p.Quantity,
 		p.DateCreated, p.DateUpdated)
@@ -89,10 +140,10 @@ func (st Postgres) Retrieve(ctx context.Context, id string) (*product.Product, e
 			COALESCE(SUM(s.paid), 0) AS revenue
 		FROM products AS p
 		LEFT JOIN sales AS s ON p.product_id = s.product_id
-		WHERE p.product_id = $1
+		WHERE p.product_id = $1 AND p.deleted_at IS NULL
 		GROUP BY p.product_id`
 
-	if err := st.DB.GetContext(ctx, &p, q, id); err != nil {
+	if err := sqlx.GetContext(ctx, database.PqDB(ctx, st.DB), &p, q, id); err != nil {
 		if err == sql.ErrNoRows {
 			return nil, product.ErrNotFound
 		}
@@ -104,65 +155,293 @@ func (st Postgres) Retrieve(ctx context.Context, id string) (*product.Product, e
 }
 
 // Update modifies data about a Product. It will error if the specified ID is
-// invalid or does not reference an existing Product.
+// invalid or does not reference an existing Product, or with ErrModified if
+// the update has an entity tag the Product no longer has. The Product is
+// locked while it is read and written.
 func (st Postgres) Update(ctx context.Context, user auth.Claims, id string, update product.UpdateProduct, now time.Time) error {
 	ctx, span := trace.StartSpan(ctx, "internal.product.postgres.Update")
 	defer span.End()
 
-	p, err := st.Retrieve(ctx, id)
+	if _, err := uuid.Parse(id); err != nil {
+		return product.ErrInvalidID
+	}
+
+	return database.PqUnitOfWork(st.DB)(ctx, func(ctx context.Context) error {
+
+		// Lock the product so it can't change between comparing its entity
+		// tag and writing it.
+		const ql = `SELECT 1 FROM products WHERE product_id = $1 FOR UPDATE`
+		if _, err := database.PqDB(ctx, st.DB).ExecContext(ctx, ql, id); err != nil {
+			return errors.Wrap(err, "locking product")
+		}
+
+		p, err := st.Retrieve(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		// If you do not have the admin role ...
+		// and you are not the owner of this product ...
+		// then get outta here!
+		if !user.HasRole(auth.RoleAdmin) && p.UserID != user.Subject {
+			return product.ErrForbidden
+		}
+
+		if !update.Matches(p.ETag()) {
+			return product.ErrModified
+		}
+
+		if update.Name != nil {
+			p.Name = *update.Name
+		}
+		if update.Cost != nil {
+			p.Cost = *update.Cost
+		}
+		if update.Quantity != nil {
+			p.Quantity = *update.Quantity
+		}
+		p.DateUpdated = now.UTC().Truncate(time.Microsecond)
+
+		const q = `UPDATE products SET
+			"name" = $2,
+			"cost" = $3,
+			"quantity" = $4,
+			"date_updated" = $5
+			WHERE product_id = $1`
+		if _, err := database.PqDB(ctx, st.DB).ExecContext(ctx, q, id,
+			p.Name, p.Cost,
+			p.Quantity, p.DateUpdated,
+		); err != nil {
+			return errors.Wrap(err, "updating product")
+		}
+
+		return nil
+	})
+}
+
+// Delete marks the product identified by a given ID as deleted. Its sales are
+// kept so revenue reports stay intact.
+func (st Postgres) Delete(ctx context.Context, user auth.Claims, id string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.product.postgres.Delete")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return product.ErrInvalidID
+	}
+
+	const q = `UPDATE products SET
+		"deleted_at" = $2,
+		"deleted_by" = $3
+		WHERE product_id = $1 AND deleted_at IS NULL`
+
+	if _, err := database.PqDB(ctx, st.DB).ExecContext(ctx, q, id, now.UTC().Truncate(time.Microsecond), user.Subject); err != nil {
+		return errors.Wrapf(err, "deleting product %s", id)
+	}
+
+	return nil
+}
+
+// Restore undoes the deletion of a product. It returns ErrNotFound if there is
+// no deleted product with the ID.
+func (st Postgres) Restore(ctx context.Context, id string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.product.postgres.Restore")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return product.ErrInvalidID
+	}
+
+	const q = `UPDATE products SET
+		"deleted_at" = NULL,
+		"deleted_by" = NULL,
+		"date_updated" = $2
+		WHERE product_id = $1 AND deleted_at IS NOT NULL`
+
+	res, err := database.PqDB(ctx, st.DB).ExecContext(ctx, q, id, now.UTC().Truncate(time.Microsecond))
+	if err != nil {
+		return errors.Wrapf(err, "restoring product %s", id)
+	}
+
+	n, err := res.RowsAffected()
 	if err != nil {
+		return errors.Wrapf(err, "restoring product %s", id)
+	}
+	if n == 0 {
+		return product.ErrNotFound
+	}
+
+	return nil
+}
+
+// Purge permanently removes the products deleted before the given time
+// together with their sales. It returns the number of products removed.
+func (st Postgres) Purge(ctx context.Context, before time.Time) (int, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.postgres.Purge")
+	defer span.End()
+
+	// The sales and products are removed together, in the unit of work of
+	// the caller if there is one.
+	var n int64
+	if err := database.PqUnitOfWork(st.DB)(ctx, func(ctx context.Context) error {
+		tx := database.PqDB(ctx, st.DB)
+
+		const qs = `DELETE FROM sales WHERE product_id IN
+		(SELECT product_id FROM products WHERE deleted_at < $1)`
+		if _, err := tx.ExecContext(ctx, qs, before.UTC()); err != nil {
+			return errors.Wrap(err, "purging sales")
+		}
+
+		const qp = `DELETE FROM products WHERE deleted_at < $1`
+		res, err := tx.ExecContext(ctx, qp, before.UTC())
+		if err != nil {
+			return err
+		}
+
+		n, err = res.RowsAffected()
 		return err
+	}); err != nil {
+		return 0, errors.Wrap(err, "purging products")
 	}
 
-	// If you do not have the admin role ...
-	// and you are not the owner of this product ...
-	// then get outta here!
-	if !user.HasRole(auth.RoleAdmin) && p.UserID != user.Subject {
-		return product.ErrForbidden
+	return int(n), nil
+}
+
+// AddSale records a sale of the product identified by productID. It returns
+// ErrNotFound if the product does not exist or was deleted.
+func (st Postgres) AddSale(ctx context.Context, ns product.NewSale, productID string, now time.Time) (*product.Sale, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.postgres.AddSale")
+	defer span.End()
+
+	if _, err := st.Retrieve(ctx, productID); err != nil {
+		return nil, err
 	}
 
-	if update.Name != nil {
-		p.Name = *update.Name
+	s := product.Sale{
+		ID:          uuid.New().String(),
+		ProductID:   productID,
+		Quantity:    ns.Quantity,
+		Paid:        ns.Paid,
+		DateCreated: now.UTC().Truncate(time.Microsecond),
 	}
-	if update.Cost != nil {
-		p.Cost = *update.Cost
+
+	const q = `INSERT INTO sales
+		(sale_id, product_id, quantity, paid, date_created)
+		VALUES ($1, $2, $3, $4, $5)`
+
+	_, err := database.PqDB(ctx, st.DB).ExecContext(ctx, q,
+		s.ID, s.ProductID,
+		s.Quantity, s.Paid,
+		s.DateCreated,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "inserting sale")
 	}
-	if update.Quantity != nil {
-		p.Quantity = *update.Quantity
+
+	return &s, nil
+}
+
+// ListSales gets a page of the sales of all products.
+func (st Postgres) ListSales(ctx context.Context, opts query.Options) ([]product.Sale, query.Page, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.postgres.ListSales")
+	defer span.End()
+
+	opts = opts.Normalize()
+
+	where, args, err := database.Where(opts, product.SaleQueryFields, saleColumns)
+	if err != nil {
+		return nil, query.Page{}, err
 	}
-	p.DateUpdated = now
 
-	const q = `UPDATE products SET
-		"name" = $2,
-		"cost" = $3,
-		"quantity" = $4,
-		"date_updated" = $5
-		WHERE product_id = $1`
-	_, err = st.DB.ExecContext(ctx, q, id,
-		p.Name, p.Cost,
-		p.Quantity, p.DateUpdated,
+	sales := []product.Sale{}
+	q := `SELECT * FROM sales` + where + database.OrderBy(opts, saleColumns)
+
+	if err := sqlx.SelectContext(ctx, database.PqDB(ctx, st.DB), &sales, q, args...); err != nil {
+		return nil, query.Page{}, errors.Wrap(err, "selecting sales")
+	}
+
+	var page query.Page
+	if len(sales) > opts.Limit {
+		sales = sales[:opts.Limit]
+		last := sales[len(sales)-1]
+		page.NextCursor = query.NewCursor(opts, last.Value(opts.Sort), last.ID)
+	}
+
+	return sales, page, nil
+}
+
+// Put stores a product exactly as given, replacing the product with the same
+// ID if there is one. The Sold and Revenue aggregates are not stored. It is
+// meant for restoring and converting data and bypasses all checks.
+func (st Postgres) Put(ctx context.Context, p product.Product) error {
+	ctx, span := trace.StartSpan(ctx, "internal.product.postgres.Put")
+	defer span.End()
+
+	const q = `INSERT INTO products
+		(product_id, user_id, name, cost, quantity, date_created, date_updated, deleted_at, deleted_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (product_id) DO UPDATE SET
+		"user_id" = EXCLUDED.user_id,
+		"name" = EXCLUDED.name,
+		"cost" = EXCLUDED.cost,
+		"quantity" = EXCLUDED.quantity,
+		"date_created" = EXCLUDED.date_created,
+		"date_updated" = EXCLUDED.date_updated,
+		"deleted_at" = EXCLUDED.deleted_at,
+		"deleted_by" = EXCLUDED.deleted_by`
+
+	_, err := database.PqDB(ctx, st.DB).ExecContext(ctx, q,
+		p.ID, p.UserID,
+		p.Name, p.Cost, p.Quantity,
+		p.DateCreated, p.DateUpdated,
+		p.DeletedAt, p.DeletedBy,
 	)
 	if err != nil {
-		return errors.Wrap(err, "updating product")
+		return errors.Wrapf(err, "putting product %s", p.ID)
 	}
 
 	return nil
 }
 
-// Delete removes the product identified by a given ID.
-func (st Postgres) Delete(ctx context.Context, id string) error {
-	ctx, span := trace.StartSpan(ctx, "internal.product.postgres.Delete")
+// PutSale stores a sale exactly as given, replacing the sale with the same ID
+// if there is one. It is meant for restoring and converting data and bypasses
+// all checks, but the product of the sale must exist.
+func (st Postgres) PutSale(ctx context.Context, s product.Sale) error {
+	ctx, span := trace.StartSpan(ctx, "internal.product.postgres.PutSale")
 	defer span.End()
 
-	if _, err := uuid.Parse(id); err != nil {
-		return product.ErrInvalidID
+	const q = `INSERT INTO sales
+		(sale_id, product_id, quantity, paid, date_created)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (sale_id) DO UPDATE SET
+		"product_id" = EXCLUDED.product_id,
+		"quantity" = EXCLUDED.quantity,
+		"paid" = EXCLUDED.paid,
+		"date_created" = EXCLUDED.date_created`
+
+	_, err := database.PqDB(ctx, st.DB).ExecContext(ctx, q,
+		s.ID, s.ProductID,
+		s.Quantity, s.Paid,
+		s.DateCreated,
+	)
+	if err != nil {
+		return errors.Wrapf(err, "putting sale %s", s.ID)
 	}
 
-	const q = `DELETE FROM products WHERE product_id = $1`
+	return nil
+}
 
-	if _, err := st.DB.ExecContext(ctx, q, id); err != nil {
-		return errors.Wrapf(err, "deleting product %s", id)
-	}
+// StatusCheck returns nil if it can successfully talk to the database. It
+// returns a non-nil error otherwise.
+func (st Postgres) StatusCheck(ctx context.Context) error {
+	ctx, span := trace.StartSpan(ctx, "internal.product.postgres.StatusCheck")
+	defer span.End()
 
+	// Selecting from the tables forces a round trip to the database and fails
+	// when it was not migrated.
+	const q = `SELECT true FROM products, sales LIMIT 1`
+	var tmp bool
+	if err := st.DB.QueryRowContext(ctx, q).Scan(&tmp); err != nil && err != sql.ErrNoRows {
+		return err
+	}
 	return nil
 }
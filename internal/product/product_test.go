@@ -2,12 +2,16 @@ package product_test
 
 import (
 	"context"
+	"fmt"
+	"sort"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/os-foundry/vetpms/internal/platform/auth"
+	"github.com/os-foundry/vetpms/internal/platform/query"
 	"github.com/os-foundry/vetpms/internal/product"
+	boltProduct "github.com/os-foundry/vetpms/internal/product/bolt"
 	"github.com/os-foundry/vetpms/internal/tests"
 	"github.com/pkg/errors"
 )
@@ -54,6 +58,18 @@ func TestProduct(t *testing.T) {
 				}
 				t.Logf("\t%s\tShould get back the same product.", tests.Success)
 
+				opts := query.Options{Filters: []query.Filter{{Field: "name", Value: np.Name}}}
+				list, page, err := st.List(ctx, opts)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to list products : %s.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould be able to list products.", tests.Success)
+
+				if len(list) != 1 || list[0].ID != p.ID || page.NextCursor != "" {
+					t.Fatalf("\t%s\tShould get a single page with the product : got %d products.", tests.Failed, len(list))
+				}
+				t.Logf("\t%s\tShould get a single page with the product.", tests.Success)
+
 				upd := product.UpdateProduct{
 					Name:     tests.StringPointer("Comics"),
 					Cost:     tests.IntPointer(50),
@@ -86,14 +102,30 @@ func TestProduct(t *testing.T) {
 				t.Logf("\t%s\tShould get back the same product.", tests.Success)
 
 				upd = product.UpdateProduct{
-					Name: tests.StringPointer("Graphic Novels"),
+					Name:  tests.StringPointer("Graphic Novels"),
+					ETags: []string{p.ETag()},
+				}
+
+				if err := st.Update(ctx, claims, p.ID, upd, updatedTime); errors.Cause(err) != product.ErrModified {
+					t.Fatalf("\t%s\tShould NOT be able to update a modified product : %v.", tests.Failed, err)
 				}
+				t.Logf("\t%s\tShould NOT be able to update a modified product.", tests.Success)
+
+				upd.ETags = []string{saved.ETag()}
 
 				if err := st.Update(ctx, claims, p.ID, upd, updatedTime); err != nil {
 					t.Fatalf("\t%s\tShould be able to update just some fields of product : %s.", tests.Failed, err)
 				}
 				t.Logf("\t%s\tShould be able to update just some fields of product.", tests.Success)
 
+				// The update kept DateUpdated, the entity tag changes anyway.
+				upd.Name = tests.StringPointer("Manga")
+				if err := st.Update(ctx, claims, p.ID, upd, updatedTime); errors.Cause(err) != product.ErrModified {
+					t.Fatalf("\t%s\tShould NOT be able to update a product modified at the same time : %v.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould NOT be able to update a product modified at the same time.", tests.Success)
+				upd.Name = tests.StringPointer("Graphic Novels")
+
 				saved, err = st.Retrieve(ctx, p.ID)
 				if err != nil {
 					t.Fatalf("\t%s\tShould be able to retrieve updated product : %s.", tests.Failed, err)
@@ -106,7 +138,7 @@ func TestProduct(t *testing.T) {
 					t.Logf("\t%s\tShould be able to see updated Name field.", tests.Success)
 				}
 
-				if err := st.Delete(ctx, p.ID); err != nil {
+				if err := st.Delete(ctx, claims, p.ID, updatedTime); err != nil {
 					t.Fatalf("\t%s\tShould be able to delete product : %s.", tests.Failed, err)
 				}
 				t.Logf("\t%s\tShould be able to delete product.", tests.Success)
@@ -116,7 +148,267 @@ func TestProduct(t *testing.T) {
 					t.Fatalf("\t%s\tShould NOT be able to retrieve deleted product : %s.", tests.Failed, err)
 				}
 				t.Logf("\t%s\tShould NOT be able to retrieve deleted product.", tests.Success)
+
+				deleted, _, err := st.List(ctx, query.Options{Deleted: true})
+				if err != nil || len(deleted) != 1 || deleted[0].ID != p.ID {
+					t.Fatalf("\t%s\tShould be able to list the deleted product : %v, %v.", tests.Failed, deleted, err)
+				}
+				t.Logf("\t%s\tShould be able to list the deleted product.", tests.Success)
+
+				if err := st.Restore(ctx, p.ID, updatedTime); err != nil {
+					t.Fatalf("\t%s\tShould be able to restore product : %s.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould be able to restore product.", tests.Success)
+
+				if _, err := st.Retrieve(ctx, p.ID); err != nil {
+					t.Fatalf("\t%s\tShould be able to retrieve restored product : %s.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould be able to retrieve restored product.", tests.Success)
+
+				if err := st.Delete(ctx, claims, p.ID, updatedTime); err != nil {
+					t.Fatalf("\t%s\tShould be able to delete product : %s.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould be able to delete product.", tests.Success)
+
+				n, err := st.Purge(ctx, updatedTime.Add(time.Hour))
+				if err != nil || n != 1 {
+					t.Fatalf("\t%s\tShould be able to purge the deleted product : %d, %v.", tests.Failed, n, err)
+				}
+				t.Logf("\t%s\tShould be able to purge the deleted product.", tests.Success)
+
+				if err := st.Restore(ctx, p.ID, updatedTime); errors.Cause(err) != product.ErrNotFound {
+					t.Fatalf("\t%s\tShould NOT be able to restore purged product : %v.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould NOT be able to restore purged product.", tests.Success)
+			}
+		}
+	}
+}
+
+// TestSales validates sales are recorded and aggregated for their product.
+func TestSales(t *testing.T) {
+	tt := []string{"postgres", "bolt"}
+	for _, tc := range tt {
+		st, teardown := tests.NewProductStorageUnit(t, tc)
+		defer teardown()
+
+		t.Log("Given the need to record the sales of a Product.")
+		{
+			t.Log("\tWhen selling a single Product.")
+			{
+				now := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+				ctx := context.Background()
+
+				claims := auth.NewClaims(
+					"718ffbea-f4a1-4667-8ae3-b349da52675e", // This is just some random UUID.
+					[]string{auth.RoleAdmin, auth.RoleUser},
+					now, time.Hour,
+				)
+
+				p, err := st.Create(ctx, claims, product.NewProduct{Name: "Collar", Cost: 15, Quantity: 10}, now)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to create a product : %s.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould be able to create a product.", tests.Success)
+
+				for _, ns := range []product.NewSale{{Quantity: 2, Paid: 30}, {Quantity: 1, Paid: 12}} {
+					if _, err := st.AddSale(ctx, ns, p.ID, now); err != nil {
+						t.Fatalf("\t%s\tShould be able to add a sale : %s.", tests.Failed, err)
+					}
+				}
+				t.Logf("\t%s\tShould be able to add sales.", tests.Success)
+
+				if _, err := st.AddSale(ctx, product.NewSale{Quantity: 1}, "718ffbea-f4a1-4667-8ae3-b349da52675e", now); errors.Cause(err) != product.ErrNotFound {
+					t.Fatalf("\t%s\tShould NOT be able to sell an unknown product : %v.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould NOT be able to sell an unknown product.", tests.Success)
+
+				opts := query.Options{Filters: []query.Filter{{Field: "product_id", Value: p.ID}}}
+				sales, _, err := st.ListSales(ctx, opts)
+				if err != nil || len(sales) != 2 {
+					t.Fatalf("\t%s\tShould be able to list the sales of the product : %d, %v.", tests.Failed, len(sales), err)
+				}
+				t.Logf("\t%s\tShould be able to list the sales of the product.", tests.Success)
+
+				saved, err := st.Retrieve(ctx, p.ID)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to retrieve the product : %s.", tests.Failed, err)
+				}
+				if saved.Sold != 3 || saved.Revenue != 42 {
+					t.Fatalf("\t%s\tShould see the sales in the aggregates : sold %d revenue %d.", tests.Failed, saved.Sold, saved.Revenue)
+				}
+				t.Logf("\t%s\tShould see the sales in the aggregates.", tests.Success)
+
+				sales[0].Quantity += 5
+				sales[0].Paid += 50
+				if err := st.PutSale(ctx, sales[0]); err != nil {
+					t.Fatalf("\t%s\tShould be able to replace a sale : %s.", tests.Failed, err)
+				}
+				saved, err = st.Retrieve(ctx, p.ID)
+				if err != nil || saved.Sold != 8 || saved.Revenue != 92 {
+					t.Fatalf("\t%s\tShould see the replaced sale in the aggregates : %+v, %v.", tests.Failed, saved, err)
+				}
+				t.Logf("\t%s\tShould see the replaced sale in the aggregates.", tests.Success)
+			}
+		}
+	}
+}
+
+// TestList validates lists of products are sorted, filtered and paged alike
+// by every storage.
+func TestList(t *testing.T) {
+	tt := []string{"postgres", "bolt"}
+	for _, tc := range tt {
+		st, teardown := tests.NewProductStorageUnit(t, tc)
+		defer teardown()
+
+		t.Log("Given the need to page through sorted and filtered lists of products.")
+		{
+			t.Log("\tWhen listing a few pages of products.")
+			{
+				now := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+				ctx := context.Background()
+
+				claims := auth.NewClaims(
+					"718ffbea-f4a1-4667-8ae3-b349da52675e", // This is just some random UUID.
+					[]string{auth.RoleAdmin, auth.RoleUser},
+					now, time.Hour,
+				)
+
+				var created []product.Product
+				for i, np := range []product.NewProduct{
+					{Name: "Collar", Cost: 30, Quantity: 1},
+					{Name: "Leash", Cost: 10, Quantity: 2},
+					{Name: "Bowl", Cost: 20, Quantity: 1},
+					{Name: "Brush", Cost: 10, Quantity: 1},
+					{Name: "Toy", Cost: 5, Quantity: 2},
+					{Name: "Bed", Cost: 45, Quantity: 1},
+					{Name: "Crate", Cost: 20, Quantity: 2},
+				} {
+					p, err := st.Create(ctx, claims, np, now.Add(time.Duration(i%3)*time.Hour))
+					if err != nil {
+						t.Fatalf("\t%s\tShould be able to create a product : %s.", tests.Failed, err)
+					}
+					created = append(created, *p)
+				}
+				deleted, err := st.Create(ctx, claims, product.NewProduct{Name: "Cage", Cost: 25, Quantity: 1}, now)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to create a product : %s.", tests.Failed, err)
+				}
+				if err := st.Delete(ctx, claims, deleted.ID, now); err != nil {
+					t.Fatalf("\t%s\tShould be able to delete a product : %s.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould be able to create products.", tests.Success)
+
+				cases := []query.Options{
+					{Sort: "cost"},
+					{Sort: "cost", Desc: true},
+					{Sort: "date_created", Desc: true},
+					{Sort: "name", Filters: []query.Filter{{Field: "quantity", Value: "1"}}},
+					{Filters: []query.Filter{{Field: "quantity", Value: "2"}}},
+					{Desc: true, Filters: []query.Filter{{Field: "cost", Value: "10"}}},
+				}
+				for _, opts := range cases {
+					opts.Limit = 2
+
+					// The expected order, by the sort field and then by ID.
+					var want []string
+					for _, p := range created {
+						p := p
+						if product.QueryFields.Match(opts, p.Value) {
+							want = append(want, p.ID)
+						}
+					}
+					sortField := opts.Normalize().Sort
+					value := func(id string) interface{} {
+						for _, p := range created {
+							if p.ID == id {
+								return p.Value(sortField)
+							}
+						}
+						return nil
+					}
+					sort.Slice(want, func(i, j int) bool {
+						c := query.Compare(value(want[i]), value(want[j]))
+						if c == 0 {
+							c = query.Compare(want[i], want[j])
+						}
+						if opts.Desc {
+							return c > 0
+						}
+						return c < 0
+					})
+
+					var got []string
+					for pages := 0; ; pages++ {
+						list, page, err := st.List(ctx, opts)
+						if err != nil {
+							t.Fatalf("\t%s\tShould be able to list products %+v : %s.", tests.Failed, opts, err)
+						}
+						if len(list) > opts.Limit || pages > len(created) {
+							t.Fatalf("\t%s\tShould get pages of at most %d products %+v : got %d.", tests.Failed, opts.Limit, opts, len(list))
+						}
+						for _, p := range list {
+							got = append(got, p.ID)
+						}
+						if page.NextCursor == "" {
+							break
+						}
+						opts.Cursor = page.NextCursor
+					}
+
+					if diff := cmp.Diff(want, got); diff != "" {
+						t.Fatalf("\t%s\tShould get every product once in order %+v. Diff:\n%s", tests.Failed, opts, diff)
+					}
+				}
+				t.Logf("\t%s\tShould get every product once in order.", tests.Success)
+			}
+		}
+	}
+}
+
+// BenchmarkRetrieveBolt measures retrieving a product with a few sales from
+// Bolt while the sales of another product grow. The aggregates are kept up
+// to date on every sale, so the time shouldn't grow with the other sales.
+func BenchmarkRetrieveBolt(b *testing.B) {
+	now := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+	ctx := context.Background()
+	claims := auth.NewClaims("718ffbea-f4a1-4667-8ae3-b349da52675e", []string{auth.RoleAdmin}, now, time.Hour)
+
+	for _, n := range []int{100, 1000, 10000} {
+		db, teardown := tests.NewBoltUnit(b)
+
+		// Syncing every sale to disk would make the setup slow.
+		db.NoSync = true
+		st := boltProduct.Bolt{db}
+
+		p, err := st.Create(ctx, claims, product.NewProduct{Name: "Collar", Cost: 15, Quantity: 10}, now)
+		if err != nil {
+			b.Fatal(err)
+		}
+		other, err := st.Create(ctx, claims, product.NewProduct{Name: "Leash", Cost: 20, Quantity: 10}, now)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			if _, err := st.AddSale(ctx, product.NewSale{Quantity: 1, Paid: 15}, p.ID, now); err != nil {
+				b.Fatal(err)
+			}
+		}
+		for i := 0; i < n; i++ {
+			if _, err := st.AddSale(ctx, product.NewSale{Quantity: 1, Paid: 20}, other.ID, now); err != nil {
+				b.Fatal(err)
 			}
 		}
+
+		b.Run(fmt.Sprintf("sales=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := st.Retrieve(ctx, p.ID); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		teardown()
 	}
 }
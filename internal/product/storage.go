@@ -5,12 +5,23 @@ import (
 	"time"
 
 	"github.com/os-foundry/vetpms/internal/platform/auth"
+	"github.com/os-foundry/vetpms/internal/platform/database"
+	"github.com/os-foundry/vetpms/internal/platform/query"
 )
 
+// Storage is an entity providing access to the product database. Deleted
+// products are kept, together with their sales, until they are purged.
 type Storage interface {
-	List(ctx context.Context) ([]Product, error)
+	database.StatusChecker
+	List(ctx context.Context, opts query.Options) ([]Product, query.Page, error)
 	Create(ctx context.Context, user auth.Claims, np NewProduct, now time.Time) (*Product, error)
 	Retrieve(ctx context.Context, id string) (*Product, error)
 	Update(ctx context.Context, user auth.Claims, id string, update UpdateProduct, now time.Time) error
-	Delete(ctx context.Context, id string) error
+	Delete(ctx context.Context, user auth.Claims, id string, now time.Time) error
+	Restore(ctx context.Context, id string, now time.Time) error
+	Purge(ctx context.Context, before time.Time) (int, error)
+	AddSale(ctx context.Context, ns NewSale, productID string, now time.Time) (*Sale, error)
+	ListSales(ctx context.Context, opts query.Options) ([]Sale, query.Page, error)
+	Put(ctx context.Context, p Product) error
+	PutSale(ctx context.Context, s Sale) error
 }
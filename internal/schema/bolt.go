@@ -0,0 +1,428 @@
+package schema
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/os-foundry/vetpms/internal/audit"
+	auditBolt "github.com/os-foundry/vetpms/internal/audit/bolt"
+	"github.com/os-foundry/vetpms/internal/platform/database"
+	"github.com/os-foundry/vetpms/internal/platform/envelope"
+	"github.com/os-foundry/vetpms/internal/product"
+	productBolt "github.com/os-foundry/vetpms/internal/product/bolt"
+	"github.com/os-foundry/vetpms/internal/user"
+	userBolt "github.com/os-foundry/vetpms/internal/user/bolt"
+	"github.com/pkg/errors"
+	bbolt "go.etcd.io/bbolt"
+)
+
+// metaBucket holds the data describing a Bolt database itself. The applied
+// migrations are kept in its migrations bucket, keyed by version.
+const (
+	metaBucket       = "meta"
+	migrationsBucket = "migrations"
+)
+
+// BoltIndexes are the secondary indexes of the Bolt storages.
+var BoltIndexes = append(append(append([]database.BoltIndex(nil), userBolt.Indexes...), productBolt.Indexes...), auditBolt.Indexes...)
+
+// boltMigration is a migration of a Bolt database. Migrate runs in its own
+// update transaction together with recording the migration, so a migration
+// that fails leaves the database unchanged.
+type boltMigration struct {
+	Version     float64
+	Description string
+	Migrate     func(tx *bbolt.Tx) error
+}
+
+// Checksum identifies the migration. Go code can't be checksummed like a SQL
+// script, so it covers the version and description. Migrations must never be
+// changed once released, add a new migration instead.
+func (m boltMigration) Checksum() string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%v %s", m.Version, m.Description))))
+}
+
+// boltRecord is the record of an applied Bolt migration.
+type boltRecord struct {
+	Version     float64   `json:"version"`
+	Description string    `json:"description"`
+	Checksum    string    `json:"checksum"`
+	AppliedAt   time.Time `json:"applied_at"`
+}
+
+// migrateBolt applies the migrations that have not been applied to db yet in
+// the order of their versions.
+func migrateBolt(db *bbolt.DB, migrations []boltMigration) error {
+	records, err := boltApplied(db)
+	if err != nil {
+		return err
+	}
+
+	sorted, err := sortBoltMigrations(migrations)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range records {
+		m, ok := findBoltMigration(sorted, r.Version)
+		if !ok {
+			return fmt.Errorf("migration %v was applied but is unknown, the database is newer than this version of the service", r.Version)
+		}
+		if m.Checksum() != r.Checksum {
+			return fmt.Errorf("migration %v was changed after it was applied", r.Version)
+		}
+	}
+
+	for _, m := range sorted {
+		if _, ok := records[boltKey(m.Version)]; ok {
+			continue
+		}
+
+		if err := db.Update(func(tx *bbolt.Tx) error {
+			if err := m.Migrate(tx); err != nil {
+				return err
+			}
+
+			meta, err := tx.CreateBucketIfNotExists([]byte(metaBucket))
+			if err != nil {
+				return errors.Wrap(err, "creating bolt meta bucket")
+			}
+			b, err := meta.CreateBucketIfNotExists([]byte(migrationsBucket))
+			if err != nil {
+				return errors.Wrap(err, "creating bolt migrations bucket")
+			}
+
+			v, err := json.Marshal(boltRecord{
+				Version:     m.Version,
+				Description: m.Description,
+				Checksum:    m.Checksum(),
+				AppliedAt:   time.Now().UTC(),
+			})
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte(boltKey(m.Version)), v)
+		}); err != nil {
+			return errors.Wrapf(err, "applying migration %v", m.Version)
+		}
+	}
+
+	return nil
+}
+
+// boltApplied returns the records of the migrations applied to db by key.
+func boltApplied(db *bbolt.DB) (map[string]boltRecord, error) {
+	records := make(map[string]boltRecord)
+
+	if err := db.View(func(tx *bbolt.Tx) error {
+		meta := tx.Bucket([]byte(metaBucket))
+		if meta == nil {
+			return nil
+		}
+		b := meta.Bucket([]byte(migrationsBucket))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			var r boltRecord
+			if err := json.Unmarshal(v, &r); err != nil {
+				return errors.Wrapf(err, "decoding migration %s", k)
+			}
+			records[string(k)] = r
+			return nil
+		})
+	}); err != nil {
+		return nil, errors.Wrap(err, "reading applied migrations")
+	}
+
+	return records, nil
+}
+
+// boltStatus returns the status of the migrations and of the applied
+// migrations that are unknown.
+func boltStatus(db *bbolt.DB, migrations []boltMigration) ([]MigrationStatus, error) {
+	records, err := boltApplied(db)
+	if err != nil {
+		return nil, err
+	}
+
+	sorted, err := sortBoltMigrations(migrations)
+	if err != nil {
+		return nil, err
+	}
+
+	var status []MigrationStatus
+	for _, m := range sorted {
+		s := MigrationStatus{Version: m.Version, Description: m.Description, Status: StatusPending}
+		if r, ok := records[boltKey(m.Version)]; ok {
+			s.Status = StatusApplied
+			s.AppliedAt = r.AppliedAt
+			if r.Checksum != m.Checksum() {
+				s.Status = StatusChanged
+			}
+		}
+		status = append(status, s)
+	}
+
+	for _, r := range records {
+		if _, ok := findBoltMigration(sorted, r.Version); !ok {
+			status = append(status, MigrationStatus{Version: r.Version, Description: r.Description, Status: StatusUnknown, AppliedAt: r.AppliedAt})
+		}
+	}
+
+	sort.Slice(status, func(i, j int) bool { return status[i].Version < status[j].Version })
+	return status, nil
+}
+
+// sortBoltMigrations returns the migrations ordered by version. Versions must
+// be unique and positive.
+func sortBoltMigrations(migrations []boltMigration) ([]boltMigration, error) {
+	sorted := make([]boltMigration, len(migrations))
+	copy(sorted, migrations)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+
+	for i, m := range sorted {
+		if m.Version <= 0 {
+			return nil, fmt.Errorf("migration %v has an invalid version", m.Version)
+		}
+		if i > 0 && sorted[i-1].Version == m.Version {
+			return nil, fmt.Errorf("migration %v is defined twice", m.Version)
+		}
+	}
+
+	return sorted, nil
+}
+
+// findBoltMigration returns the migration with the given version.
+func findBoltMigration(migrations []boltMigration, version float64) (boltMigration, bool) {
+	for _, m := range migrations {
+		if m.Version == version {
+			return m, true
+		}
+	}
+	return boltMigration{}, false
+}
+
+// boltKey returns the key of the record of the migration with the given
+// version.
+func boltKey(version float64) string {
+	return fmt.Sprint(version)
+}
+
+// createBuckets returns a migration function creating the named buckets.
+func createBuckets(names ...string) func(tx *bbolt.Tx) error {
+	return func(tx *bbolt.Tx) error {
+		for _, name := range names {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return errors.Wrapf(err, "creating bolt %s bucket", name)
+			}
+		}
+		return nil
+	}
+}
+
+// boltMigrations contains the functions migrating Bolt databases. Like the
+// Postgres migrations, entries should never be removed or changed once they
+// have been released. Databases created before the migrations were tracked
+// already have the buckets, creating them again is harmless.
+var boltMigrations = []boltMigration{
+	{
+		Version:     1,
+		Description: "Add users, products and sales",
+		Migrate:     createBuckets("users", "products", "sales"),
+	},
+	{
+		Version:     2,
+		Description: "Add audit",
+		Migrate:     createBuckets("audit"),
+	},
+	{
+		Version:     3,
+		Description: "Store records in versioned envelopes",
+		Migrate:     rewriteLegacy,
+	},
+	{
+		Version:     4,
+		Description: "Move indexes to their own buckets",
+		Migrate:     moveIndexes,
+	},
+	{
+		Version:     5,
+		Description: "Add sales totals",
+		Migrate: func(tx *bbolt.Tx) error {
+			_, err := productBolt.RebuildTotals(tx)
+			return err
+		},
+	},
+	{
+		Version:     6,
+		Description: "Add refresh tokens",
+		Migrate:     createBuckets("refresh_tokens", "refresh_tokens_user"),
+	},
+	{
+		Version:     7,
+		Description: "Add password reset tokens",
+		Migrate:     createBuckets("reset_tokens"),
+	},
+	{
+		Version:     8,
+		Description: "Add two-factor authentication",
+		Migrate:     createBuckets("mfa_challenges"),
+	},
+	{
+		Version:     9,
+		Description: "Add login attempts",
+		Migrate:     createBuckets("login_attempts"),
+	},
+	{
+		Version:     10,
+		Description: "Add API keys",
+		Migrate:     createBuckets("api_keys"),
+	},
+	{
+		Version:     11,
+		Description: "Add identities of identity providers",
+		Migrate:     createBuckets("identities"),
+	},
+	{
+		Version:     12,
+		Description: "Add indexes of the fields lists are sorted and filtered by",
+		Migrate:     buildFieldIndexes,
+	},
+}
+
+// buildFieldIndexes builds the indexes lists seek on to sort and filter by a
+// field.
+func buildFieldIndexes(tx *bbolt.Tx) error {
+	for _, ix := range BoltIndexes {
+		if ix.Field == "" {
+			continue
+		}
+		if _, err := ix.Rebuild(tx); err != nil {
+			return errors.Wrapf(err, "building index %s", ix.Name)
+		}
+	}
+	return nil
+}
+
+// rewriteLegacy rewrites the gob encoded records written before records were
+// stored in envelopes. Decoding upgrades them, so they only need to be encoded
+// again.
+func rewriteLegacy(tx *bbolt.Tx) error {
+	recoders := []struct {
+		bucket string
+		recode func(b []byte) ([]byte, error)
+	}{
+		{"users", func(b []byte) ([]byte, error) {
+			u, err := user.Decode(b)
+			if err != nil {
+				return nil, err
+			}
+			return u.Encode()
+		}},
+		{"products", func(b []byte) ([]byte, error) {
+			p, err := product.Decode(b)
+			if err != nil {
+				return nil, err
+			}
+			return p.Encode()
+		}},
+		{"sales", func(b []byte) ([]byte, error) {
+			s, err := product.DecodeSale(b)
+			if err != nil {
+				return nil, err
+			}
+			return s.Encode()
+		}},
+		{"audit", func(b []byte) ([]byte, error) {
+			e, err := audit.Decode(b)
+			if err != nil {
+				return nil, err
+			}
+			return e.Encode()
+		}},
+	}
+
+	for _, r := range recoders {
+		bucket := tx.Bucket([]byte(r.bucket))
+		if bucket == nil {
+			continue
+		}
+
+		// Buckets can't be changed while iterating over them.
+		var keys, values [][]byte
+		if err := bucket.ForEach(func(k, v []byte) error {
+			if !envelope.IsLegacy(v) {
+				return nil
+			}
+
+			// The users bucket also holds the email index, its values are
+			// the keys of users.
+			if r.bucket == "users" && bucket.Get(v) != nil {
+				return nil
+			}
+
+			nv, err := r.recode(v)
+			if err != nil {
+				return errors.Wrapf(err, "rewriting %s %s", r.bucket, k)
+			}
+			keys = append(keys, append([]byte(nil), k...))
+			values = append(values, nv)
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for i := range keys {
+			if err := bucket.Put(keys[i], values[i]); err != nil {
+				return errors.Wrapf(err, "writing %s %s", r.bucket, keys[i])
+			}
+		}
+	}
+
+	return nil
+}
+
+// moveIndexes removes the email index from the users bucket, where it was
+// kept together with the users, and builds the indexes in buckets of their
+// own.
+func moveIndexes(tx *bbolt.Tx) error {
+	users := tx.Bucket([]byte("users"))
+	if users == nil {
+		return errors.New("bucket users doesn't exist")
+	}
+
+	// The keys of users are UUIDs, those of the email index are addresses.
+	// Keys can't be deleted while iterating over the bucket.
+	var emails [][]byte
+	if err := users.ForEach(func(k, v []byte) error {
+		if _, err := uuid.ParseBytes(k); err != nil {
+			emails = append(emails, append([]byte(nil), k...))
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, k := range emails {
+		if err := users.Delete(k); err != nil {
+			return errors.Wrapf(err, "deleting email index entry %s", k)
+		}
+	}
+
+	// Indexes of buckets added by later migrations are created with them.
+	for _, ix := range BoltIndexes {
+		if tx.Bucket([]byte(ix.Bucket)) == nil {
+			continue
+		}
+		if _, err := ix.Rebuild(tx); err != nil {
+			return errors.Wrapf(err, "building index %s", ix.Name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,178 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/gob"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/os-foundry/vetpms/internal/platform/envelope"
+	"github.com/os-foundry/vetpms/internal/user"
+	"github.com/pkg/errors"
+	bbolt "go.etcd.io/bbolt"
+)
+
+// The tests package can't be used since it depends on this package.
+const (
+	success = "\u2713"
+	failed  = "\u2717"
+)
+
+// TestMigrateBolt validates that Bolt migrations are applied once, in order,
+// and that failing migrations leave the database unchanged.
+func TestMigrateBolt(t *testing.T) {
+	db, err := bbolt.Open("migrate.db", 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("migrate.db")
+	defer db.Close()
+
+	var order []float64
+	migration := func(version float64) boltMigration {
+		return boltMigration{
+			Version:     version,
+			Description: "Test",
+			Migrate: func(tx *bbolt.Tx) error {
+				if _, err := tx.CreateBucketIfNotExists([]byte("test")); err != nil {
+					return err
+				}
+				order = append(order, version)
+				return nil
+			},
+		}
+	}
+
+	t.Log("Given the need to migrate Bolt databases.")
+	{
+		t.Log("\tWhen applying migrations.")
+		{
+			ms := []boltMigration{migration(2), migration(1)}
+			for i := 0; i < 2; i++ {
+				if err := migrateBolt(db, ms); err != nil {
+					t.Fatalf("\t%s\tShould be able to migrate : %s.", failed, err)
+				}
+			}
+			if len(order) != 2 || order[0] != 1 || order[1] != 2 {
+				t.Fatalf("\t%s\tShould apply every migration once in order : got %v.", failed, order)
+			}
+			t.Logf("\t%s\tShould apply every migration once in order.", success)
+
+			errFailed := errors.New("failed")
+			ms = append(ms, boltMigration{
+				Version:     3,
+				Description: "Failing",
+				Migrate: func(tx *bbolt.Tx) error {
+					if _, err := tx.CreateBucket([]byte("failed")); err != nil {
+						return err
+					}
+					return errFailed
+				},
+			})
+			if err := migrateBolt(db, ms); errors.Cause(err) != errFailed {
+				t.Fatalf("\t%s\tShould report a failing migration : %v.", failed, err)
+			}
+			db.View(func(tx *bbolt.Tx) error {
+				if tx.Bucket([]byte("failed")) != nil {
+					t.Fatalf("\t%s\tShould roll back a failing migration.", failed)
+				}
+				return nil
+			})
+			t.Logf("\t%s\tShould roll back a failing migration.", success)
+
+			status, err := boltStatus(db, ms)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to get the status : %s.", failed, err)
+			}
+			want := []string{StatusApplied, StatusApplied, StatusPending}
+			for i, s := range status {
+				if s.Status != want[i] {
+					t.Fatalf("\t%s\tShould report the status of every migration : got %+v.", failed, status)
+				}
+			}
+			t.Logf("\t%s\tShould report the status of every migration.", success)
+
+			ms[0].Description = "Changed"
+			if err := migrateBolt(db, ms); err == nil {
+				t.Fatalf("\t%s\tShould refuse to migrate after a migration was changed.", failed)
+			}
+			t.Logf("\t%s\tShould refuse to migrate after a migration was changed.", success)
+
+			if err := migrateBolt(db, ms[1:2]); err == nil {
+				t.Fatalf("\t%s\tShould refuse to migrate when applied migrations are unknown.", failed)
+			}
+			t.Logf("\t%s\tShould refuse to migrate when applied migrations are unknown.", success)
+		}
+	}
+}
+
+// TestRewriteLegacy validates that gob encoded records are rewritten in
+// envelopes and that the email index kept with them is moved to its own
+// bucket.
+func TestRewriteLegacy(t *testing.T) {
+	db, err := bbolt.Open("legacy.db", 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("legacy.db")
+	defer db.Close()
+
+	u := user.User{
+		ID:           "5cf37266-3473-4006-984f-9325122678b7",
+		Email:        "admin@example.com",
+		PasswordHash: []byte("hash"),
+	}
+
+	t.Log("Given the need to rewrite records stored before envelopes.")
+	{
+		t.Log("\tWhen migrating a database with a gob encoded user.")
+		{
+			var buf bytes.Buffer
+			if err := gob.NewEncoder(&buf).Encode(&u); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Update(func(tx *bbolt.Tx) error {
+				b, err := tx.CreateBucket([]byte("users"))
+				if err != nil {
+					return err
+				}
+				if err := b.Put([]byte(u.ID), buf.Bytes()); err != nil {
+					return err
+				}
+				return b.Put([]byte(u.Email), []byte(u.ID))
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := migrateBolt(db, boltMigrations); err != nil {
+				t.Fatalf("\t%s\tShould be able to migrate : %s.", failed, err)
+			}
+			t.Logf("\t%s\tShould be able to migrate.", success)
+
+			db.View(func(tx *bbolt.Tx) error {
+				b := tx.Bucket([]byte("users"))
+
+				v := b.Get([]byte(u.ID))
+				if envelope.IsLegacy(v) {
+					t.Fatalf("\t%s\tShould rewrite the user : %q.", failed, v)
+				}
+				got, err := user.Decode(v)
+				if err != nil || got.Email != u.Email || string(got.PasswordHash) != "hash" {
+					t.Fatalf("\t%s\tShould rewrite the user : %v %+v.", failed, err, got)
+				}
+				t.Logf("\t%s\tShould rewrite the user.", success)
+
+				if b.Get([]byte(u.Email)) != nil {
+					t.Fatalf("\t%s\tShould move the email index out of the users bucket.", failed)
+				}
+				ix := tx.Bucket([]byte("users_email"))
+				if ix == nil || string(ix.Get([]byte(u.Email))) != u.ID {
+					t.Fatalf("\t%s\tShould move the email index out of the users bucket.", failed)
+				}
+				t.Logf("\t%s\tShould move the email index out of the users bucket.", success)
+				return nil
+			})
+		}
+	}
+}
@@ -2,6 +2,8 @@ package schema
 
 import (
 	"fmt"
+	"sort"
+	"time"
 
 	"github.com/GuiaBolso/darwin"
 	"github.com/jmoiron/sqlx"
@@ -23,28 +25,83 @@ func Migrate(dbi interface{}) error {
 		return d.Migrate()
 
 	case *bbolt.DB:
-		db := dbi.(*bbolt.DB)
-		if err := db.Update(func(tx *bbolt.Tx) error {
-			if _, err := tx.CreateBucketIfNotExists([]byte("users")); err != nil {
-				return errors.Wrap(err, "creating bolt user bucket")
-			}
+		return migrateBolt(dbi.(*bbolt.DB), boltMigrations)
+	}
+	return fmt.Errorf("unsupported database %T", dbi)
 
-			if _, err := tx.CreateBucketIfNotExists([]byte("products")); err != nil {
-				return errors.Wrap(err, "creating bolt products bucket")
-			}
+}
 
-			if _, err := tx.CreateBucketIfNotExists([]byte("sales")); err != nil {
-				return errors.Wrap(err, "creating bolt sales bucket")
-			}
+// The states a migration can be in.
+const (
+	StatusApplied = "applied"
+	StatusPending = "pending"
+	StatusChanged = "changed" // Applied, but changed since.
+	StatusUnknown = "unknown" // Applied by a newer version of the service.
+)
+
+// MigrationStatus describes whether a migration was applied to a database.
+type MigrationStatus struct {
+	Version     float64
+	Description string
+	Status      string
+	AppliedAt   time.Time
+}
+
+// Status reports the status of every migration of db.
+func Status(dbi interface{}) ([]MigrationStatus, error) {
+	switch db := dbi.(type) {
+	case *sqlx.DB:
+		driver := darwin.NewGenericDriver(db.DB, darwin.PostgresDialect{})
+		if err := driver.Create(); err != nil {
+			return nil, errors.Wrap(err, "creating migrations table")
+		}
+
+		records, err := driver.All()
+		if err != nil {
+			return nil, errors.Wrap(err, "reading applied migrations")
+		}
 
-			return nil
-		}); err != nil {
-			return err
+		applied := make(map[float64]darwin.MigrationRecord, len(records))
+		for _, r := range records {
+			applied[r.Version] = r
 		}
-		return nil
+
+		var status []MigrationStatus
+		for _, m := range migrations {
+			s := MigrationStatus{Version: m.Version, Description: m.Description, Status: StatusPending}
+			if r, ok := applied[m.Version]; ok {
+				s.Status = StatusApplied
+				s.AppliedAt = r.AppliedAt
+				if r.Checksum != m.Checksum() {
+					s.Status = StatusChanged
+				}
+				delete(applied, m.Version)
+			}
+			status = append(status, s)
+		}
+		for _, r := range applied {
+			status = append(status, MigrationStatus{Version: r.Version, Description: r.Description, Status: StatusUnknown, AppliedAt: r.AppliedAt})
+		}
+
+		sort.Slice(status, func(i, j int) bool { return status[i].Version < status[j].Version })
+		return status, nil
+
+	case *bbolt.DB:
+		return boltStatus(db, boltMigrations)
 	}
-	return fmt.Errorf("unsupported database %T", dbi)
+	return nil, fmt.Errorf("unsupported database %T", dbi)
+}
 
+// Version returns the version of the schema the migrations in this package
+// bring a database to.
+func Version() float64 {
+	var v float64
+	for _, m := range migrations {
+		if m.Version > v {
+			v = m.Version
+		}
+	}
+	return v
 }
 
 // migrations contains the queries needed to construct the database schema.
@@ -112,4 +169,173 @@ ALTER TABLE products
 	ADD COLUMN user_id UUID DEFAULT '00000000-0000-0000-0000-000000000000'
 `,
 	},
+	{
+		Version:     5,
+		Description: "Add audit",
+		Script: `
+CREATE TABLE audit (
+	entry_id     TEXT,
+	actor        TEXT,
+	clinic       TEXT,
+	entity_type  TEXT,
+	entity_id    TEXT,
+	action       TEXT,
+	diff         JSONB,
+	trace_id     TEXT,
+	date_created TIMESTAMP,
+
+	PRIMARY KEY (entry_id)
+);
+CREATE INDEX audit_entity_idx ON audit (entity_type, entity_id);
+CREATE RULE audit_no_update AS ON UPDATE TO audit DO INSTEAD NOTHING;
+CREATE RULE audit_no_delete AS ON DELETE TO audit DO INSTEAD NOTHING;`,
+	},
+	{
+		Version:     6,
+		Description: "Add soft deletion of users and products",
+		Script: `
+ALTER TABLE users
+	ADD COLUMN deleted_at TIMESTAMP,
+	ADD COLUMN deleted_by UUID,
+	DROP CONSTRAINT users_email_key;
+CREATE UNIQUE INDEX users_email_idx ON users (email) WHERE deleted_at IS NULL;
+ALTER TABLE products
+	ADD COLUMN deleted_at TIMESTAMP,
+	ADD COLUMN deleted_by UUID;
+ALTER TABLE sales
+	DROP CONSTRAINT sales_product_id_fkey,
+	ADD CONSTRAINT sales_product_id_fkey FOREIGN KEY (product_id) REFERENCES products(product_id);`,
+	},
+	{
+		Version:     7,
+		Description: "Add refresh tokens",
+		Script: `
+CREATE TABLE refresh_tokens (
+	token_id     UUID,
+	user_id      UUID,
+	token_hash   BYTEA,
+	date_created TIMESTAMP,
+	date_used    TIMESTAMP,
+	expires_at   TIMESTAMP,
+	revoked_at   TIMESTAMP,
+
+	PRIMARY KEY (token_id),
+	FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
+);
+CREATE INDEX refresh_tokens_user_idx ON refresh_tokens (user_id);`,
+	},
+	{
+		Version:     8,
+		Description: "Add password reset tokens",
+		Script: `
+CREATE TABLE reset_tokens (
+	token_id     UUID,
+	user_id      UUID,
+	token_hash   BYTEA,
+	date_created TIMESTAMP,
+	expires_at   TIMESTAMP,
+	used_at      TIMESTAMP,
+
+	PRIMARY KEY (token_id),
+	FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
+);`,
+	},
+	{
+		Version:     9,
+		Description: "Add two-factor authentication",
+		Script: `
+ALTER TABLE users
+	ADD COLUMN mfa_enabled        BOOLEAN NOT NULL DEFAULT false,
+	ADD COLUMN mfa_secret         BYTEA,
+	ADD COLUMN mfa_last_step      BIGINT NOT NULL DEFAULT 0,
+	ADD COLUMN mfa_recovery_codes BYTEA[];
+CREATE TABLE mfa_challenges (
+	challenge_id   UUID,
+	user_id        UUID,
+	challenge_hash BYTEA,
+	date_created   TIMESTAMP,
+	expires_at     TIMESTAMP,
+	used_at        TIMESTAMP,
+
+	PRIMARY KEY (challenge_id),
+	FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
+);`,
+	},
+	{
+		Version:     10,
+		Description: "Add login attempts",
+		Script: `
+CREATE TABLE login_attempts (
+	attempt_key  TEXT,
+	failures     INT,
+	last_failure TIMESTAMP,
+	locked_until TIMESTAMP,
+
+	PRIMARY KEY (attempt_key)
+);`,
+	},
+	{
+		Version:     11,
+		Description: "Add rate limits",
+		Script: `
+CREATE TABLE rate_limits (
+	bucket_key TEXT,
+	tokens     DOUBLE PRECISION,
+	updated    TIMESTAMP,
+	full_at    TIMESTAMP,
+
+	PRIMARY KEY (bucket_key)
+);`,
+	},
+	{
+		Version:     12,
+		Description: "Add API keys",
+		Script: `
+CREATE TABLE api_keys (
+	api_key_id   UUID,
+	user_id      UUID,
+	name         TEXT,
+	prefix       TEXT,
+	key_hash     BYTEA,
+	scopes       TEXT[],
+	date_created TIMESTAMP,
+	expires_at   TIMESTAMP,
+	last_used    TIMESTAMP,
+
+	PRIMARY KEY (api_key_id),
+	FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
+);`,
+	},
+	{
+		Version:     13,
+		Description: "Add identities of identity providers",
+		Script: `
+CREATE TABLE identities (
+	issuer       TEXT,
+	subject      TEXT,
+	user_id      UUID,
+	date_created TIMESTAMP,
+
+	PRIMARY KEY (issuer, subject),
+	FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
+);`,
+	},
+	{
+		Version:     14,
+		Description: "Add devices of sessions",
+		Script: `
+ALTER TABLE refresh_tokens
+	ADD COLUMN device_name TEXT NOT NULL DEFAULT '',
+	ADD COLUMN ip          TEXT NOT NULL DEFAULT '',
+	ADD COLUMN user_agent  TEXT NOT NULL DEFAULT '',
+	ADD COLUMN last_seen   TIMESTAMP;
+UPDATE refresh_tokens SET last_seen = date_used;`,
+	},
+	{
+		Version:     15,
+		Description: "Add secrets enrolled with two-factor challenges",
+		Script: `
+ALTER TABLE mfa_challenges
+	ADD COLUMN mfa_secret BYTEA;`,
+	},
 }
@@ -6,7 +6,9 @@ import (
 
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
+	"github.com/os-foundry/vetpms/internal/platform/database"
 	"github.com/os-foundry/vetpms/internal/product"
+	productBolt "github.com/os-foundry/vetpms/internal/product/bolt"
 	"github.com/os-foundry/vetpms/internal/user"
 	"github.com/pkg/errors"
 	bbolt "go.etcd.io/bbolt"
@@ -41,8 +43,7 @@ func Seed(dbi interface{}) error {
 
 		db := dbi.(*bbolt.DB)
 		err = db.Update(func(tx *bbolt.Tx) error {
-			users, err := tx.CreateBucketIfNotExists([]byte("users"))
-			if err != nil {
+			if _, err := tx.CreateBucketIfNotExists([]byte("users")); err != nil {
 				return errors.Wrap(err, "creating bolt user bucket")
 			}
 
@@ -71,19 +72,20 @@ func Seed(dbi interface{}) error {
 				if err != nil {
 					return err
 				}
-				users.Put([]byte(a.ID), ab)
-				users.Put([]byte(a.Email), []byte(a.ID))
+				if err := database.BoltPut(tx, "users", BoltIndexes, []byte(a.ID), ab); err != nil {
+					return err
+				}
 
 				ub, err := u.Encode()
 				if err != nil {
 					return err
 				}
-				users.Put([]byte(u.ID), ub)
-				users.Put([]byte(u.Email), []byte(u.ID))
+				if err := database.BoltPut(tx, "users", BoltIndexes, []byte(u.ID), ub); err != nil {
+					return err
+				}
 			}
 
-			products, err := tx.CreateBucketIfNotExists([]byte("products"))
-			if err != nil {
+			if _, err := tx.CreateBucketIfNotExists([]byte("products")); err != nil {
 				return errors.Wrap(err, "creating bolt products bucket")
 			}
 
@@ -110,17 +112,20 @@ func Seed(dbi interface{}) error {
 				if err != nil {
 					return err
 				}
-				products.Put([]byte(p1.ID), p1b)
+				if err := database.BoltPut(tx, "products", BoltIndexes, []byte(p1.ID), p1b); err != nil {
+					return err
+				}
 
 				p2b, err := p2.Encode()
 				if err != nil {
 					return err
 				}
-				products.Put([]byte(p2.ID), p2b)
+				if err := database.BoltPut(tx, "products", BoltIndexes, []byte(p2.ID), p2b); err != nil {
+					return err
+				}
 			}
 
-			sales, err := tx.CreateBucketIfNotExists([]byte("sales"))
-			if err != nil {
+			if _, err := tx.CreateBucketIfNotExists([]byte("sales")); err != nil {
 				return errors.Wrap(err, "creating bolt sales bucket")
 			}
 			{
@@ -160,14 +165,19 @@ func Seed(dbi interface{}) error {
 					return err
 				}
 
-				sales.Put([]byte(s1.ID), s1b)
-				sales.Put([]byte(s2.ID), s2b)
-				sales.Put([]byte(s3.ID), s3b)
+				for id, v := range map[string][]byte{s1.ID: s1b, s2.ID: s2b, s3.ID: s3b} {
+					if err := database.BoltPut(tx, "sales", BoltIndexes, []byte(id), v); err != nil {
+						return err
+					}
+				}
+				if _, err := productBolt.RebuildTotals(tx); err != nil {
+					return err
+				}
 			}
 
 			return nil
 		})
-		return nil
+		return err
 	}
 
 	return fmt.Errorf("unsupported database")
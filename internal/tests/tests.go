@@ -109,7 +109,7 @@ func NewPqUnit(t *testing.T) (*sqlx.DB, func()) {
 //
 // It returns the database to use as well as a function to call at the end of
 // the test.
-func NewBoltUnit(t *testing.T) (*bolt.DB, func()) {
+func NewBoltUnit(t testing.TB) (*bolt.DB, func()) {
 	t.Helper()
 
 	db, err := bolt.Open("test.db", 0600, &bolt.Options{Timeout: 1 * time.Second})
@@ -172,6 +172,7 @@ type Test struct {
 	Bolt          *bolt.DB
 	Log           *log.Logger
 	Authenticator *auth.Authenticator
+	Keys          *auth.KeyStore
 
 	t       *testing.T
 	cleanup func()
@@ -192,8 +193,8 @@ func NewIntegration(t *testing.T, tp string) *Test {
 
 	// Build an authenticator using this static key.
 	kid := "4754d86b-7a6d-4df5-9c65-224741361492"
-	kf := auth.NewSimpleKeyLookupFunc(kid, key.Public().(*rsa.PublicKey))
-	authenticator, err := auth.NewAuthenticator(key, kid, "RS256", kf)
+	keys := auth.NewKeyStore(kid, key)
+	authenticator, err := auth.NewAuthenticator(key, kid, "RS256", keys.PublicKey)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -201,6 +202,7 @@ func NewIntegration(t *testing.T, tp string) *Test {
 	test := Test{
 		Log:           logger,
 		Authenticator: authenticator,
+		Keys:          keys,
 		t:             t,
 	}
 
@@ -0,0 +1,181 @@
+package user
+
+import (
+	"crypto/subtle"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/os-foundry/vetpms/internal/platform/auth"
+	"github.com/os-foundry/vetpms/internal/platform/envelope"
+	"github.com/os-foundry/vetpms/internal/platform/query"
+	"github.com/os-foundry/vetpms/internal/platform/web"
+	"github.com/pkg/errors"
+	validator "gopkg.in/go-playground/validator.v9"
+)
+
+// APIKeyPrefix starts every API key, so keys are recognized in logs and by
+// secret scanners.
+const APIKeyPrefix = "vpk_"
+
+// APIKeyUseInterval is how often the last use of an API key is recorded. Keys
+// used more often are not written on every request.
+const APIKeyUseInterval = time.Minute
+
+// APIKey lets integrations and service accounts call the API without a
+// password. A key acts as its user, limited to its scopes. Only a hash of
+// the secret handed out is stored, Prefix is the start of the key which
+// tells keys apart in listings.
+type APIKey struct {
+	ID          string         `db:"api_key_id" json:"id"`
+	UserID      string         `db:"user_id" json:"user_id"`
+	Name        string         `db:"name" json:"name"`
+	Prefix      string         `db:"prefix" json:"prefix"`
+	Hash        []byte         `db:"key_hash" json:"-"`
+	Scopes      pq.StringArray `db:"scopes" json:"scopes"`
+	DateCreated time.Time      `db:"date_created" json:"date_created"`
+	ExpiresAt   *time.Time     `db:"expires_at" json:"expires_at,omitempty"`
+	LastUsed    *time.Time     `db:"last_used" json:"last_used,omitempty"`
+}
+
+// APIKeyQueryFields are the fields API keys can be sorted and filtered by when
+// they are listed.
+var APIKeyQueryFields = query.Fields{
+	"id":           query.String,
+	"user_id":      query.String,
+	"name":         query.String,
+	"date_created": query.Time,
+}
+
+// Value returns the value of one of the APIKeyQueryFields of the key.
+func (k *APIKey) Value(field string) interface{} {
+	switch field {
+	case "id":
+		return k.ID
+	case "user_id":
+		return k.UserID
+	case "name":
+		return k.Name
+	case "date_created":
+		return k.DateCreated
+	}
+	return nil
+}
+
+// NewAPIKey contains information needed to create a new API key. A key
+// without an expiry is valid until it is deleted.
+type NewAPIKey struct {
+	UserID    string     `json:"user_id" validate:"required,uuid"`
+	Name      string     `json:"name" validate:"required"`
+	Scopes    []string   `json:"scopes" validate:"required,dive,scope"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// Scopes are validated with the scope tag.
+func init() {
+	fn := func(fl validator.FieldLevel) bool {
+		return auth.ValidScope(fl.Field().String())
+	}
+	if err := web.RegisterValidation("scope", fn, "{0} is not a known scope", web.Translations{
+		"nl": "{0} is geen bekende scope",
+		"bg": "{0} не е познат обхват",
+	}); err != nil {
+		panic(err)
+	}
+}
+
+// NewKey creates an API key for the user. It returns the stored key and the
+// key to hand to the client, which is the only copy of the secret.
+func (n NewAPIKey) NewKey(now time.Time) (APIKey, string, error) {
+	now = now.UTC().Truncate(time.Microsecond)
+	k := APIKey{
+		ID:          uuid.New().String(),
+		UserID:      n.UserID,
+		Name:        n.Name,
+		Scopes:      n.Scopes,
+		DateCreated: now,
+	}
+	if n.ExpiresAt != nil {
+		exp := n.ExpiresAt.UTC().Truncate(time.Microsecond)
+		k.ExpiresAt = &exp
+	}
+
+	tkn, hash, err := newSecret(k.ID)
+	if err != nil {
+		return APIKey{}, "", errors.Wrap(err, "generating api key")
+	}
+	k.Hash = hash
+	k.Prefix = APIKeyPrefix + k.ID[:8]
+
+	return k, APIKeyPrefix + tkn, nil
+}
+
+// Valid reports whether the key can be used at now for the secret with the
+// given hash.
+func (k *APIKey) Valid(hash []byte, now time.Time) bool {
+	if subtle.ConstantTimeCompare(k.Hash, hash) != 1 {
+		return false
+	}
+	return k.ExpiresAt == nil || now.Before(*k.ExpiresAt)
+}
+
+// Used records a use of the key at now. It reports whether the use must be
+// stored, which it must at most every APIKeyUseInterval.
+func (k *APIKey) Used(now time.Time) bool {
+	if k.LastUsed != nil && now.Sub(*k.LastUsed) < APIKeyUseInterval {
+		return false
+	}
+	now = now.UTC().Truncate(time.Microsecond)
+	k.LastUsed = &now
+	return true
+}
+
+// Claims returns the claims of a request authenticated with the key on
+// behalf of the user.
+func (k *APIKey) Claims(u *User, now time.Time) auth.Claims {
+	c := auth.NewClaims(u.ID, u.Roles, now, AccessTokenTTL)
+	c.APIKeyID = k.ID
+	c.Scopes = k.Scopes
+	return c
+}
+
+// ParseAPIKey splits a key handed to a client into the ID of the stored key
+// and the hash of its secret. It returns ErrAuthenticationFailure if the key
+// is malformed.
+func ParseAPIKey(key string) (string, []byte, error) {
+	if !strings.HasPrefix(key, APIKeyPrefix) {
+		return "", nil, ErrAuthenticationFailure
+	}
+	id, hash, ok := parseSecret(strings.TrimPrefix(key, APIKeyPrefix))
+	if !ok {
+		return "", nil, ErrAuthenticationFailure
+	}
+	return id, hash, nil
+}
+
+// apiKeyRecord is the layout API keys are stored in. Unlike the API it
+// includes the hash.
+type apiKeyRecord struct {
+	APIKey
+	Hash []byte `json:"hash"`
+}
+
+// apiKeyCodec encodes the API keys stored in Bolt.
+var apiKeyCodec = envelope.Codec{Version: 1}
+
+// Encode encodes the API key into a slice of bytes stored in Bolt.
+func (k *APIKey) Encode() ([]byte, error) {
+	return apiKeyCodec.Encode(apiKeyRecord{APIKey: *k, Hash: k.Hash})
+}
+
+// DecodeAPIKey creates an APIKey from a slice of bytes stored in Bolt.
+func DecodeAPIKey(b []byte) (*APIKey, error) {
+	var r apiKeyRecord
+	if err := apiKeyCodec.Decode(b, &r); err != nil {
+		return nil, err
+	}
+	k := r.APIKey
+	k.Hash = r.Hash
+	return &k, nil
+}
@@ -0,0 +1,182 @@
+package user
+
+import (
+	"context"
+	"time"
+
+	"github.com/os-foundry/vetpms/internal/audit"
+	"github.com/os-foundry/vetpms/internal/platform/auth"
+)
+
+// EntityType identifies users in the audit trail.
+const EntityType = "user"
+
+// APIKeyEntityType identifies API keys in the audit trail.
+const APIKeyEntityType = "api_key"
+
+// Audited wraps a Storage and records every Create, Update, Delete, Restore
+// and Purge in the audit trail, as well as creating and deleting API keys.
+type Audited struct {
+	Storage
+	Trail audit.Trail
+}
+
+// auditor are the claims used to read the state of a user before it is
+// deleted or after it is restored. Both are restricted to admins.
+var auditor = auth.Claims{Roles: []string{auth.RoleAdmin}}
+
+// Create inserts a new user and records it in the audit trail.
+func (st Audited) Create(ctx context.Context, n NewUser, now time.Time) (*User, error) {
+	var u *User
+	if err := st.Trail.Atomic(ctx, func(ctx context.Context) error {
+		var err error
+		if u, err = st.Storage.Create(ctx, n, now); err != nil {
+			return err
+		}
+		return st.Trail.Record(ctx, EntityType, u.ID, audit.ActionCreate, nil, u, now)
+	}); err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// Update modifies a user and records the changes in the audit trail.
+func (st Audited) Update(ctx context.Context, claims auth.Claims, id string, upd UpdateUser, now time.Time) error {
+	return st.Trail.Atomic(ctx, func(ctx context.Context) error {
+		before, err := st.Storage.Retrieve(ctx, claims, id)
+		if err != nil {
+			return err
+		}
+
+		if err := st.Storage.Update(ctx, claims, id, upd, now); err != nil {
+			return err
+		}
+
+		after, err := st.Storage.Retrieve(ctx, claims, id)
+		if err != nil {
+			return err
+		}
+
+		return st.Trail.Record(ctx, EntityType, id, audit.ActionUpdate, before, after, now)
+	})
+}
+
+// Delete marks a user as deleted and records their last state in the audit
+// trail. Deleting a user that does not exist is not recorded.
+func (st Audited) Delete(ctx context.Context, claims auth.Claims, id string, now time.Time) error {
+	return st.Trail.Atomic(ctx, func(ctx context.Context) error {
+		before, err := st.Storage.Retrieve(ctx, auditor, id)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+
+		if err := st.Storage.Delete(ctx, claims, id, now); err != nil {
+			return err
+		}
+
+		if before == nil {
+			return nil
+		}
+
+		return st.Trail.Record(ctx, EntityType, id, audit.ActionDelete, before, nil, now)
+	})
+}
+
+// Restore undoes the deletion of a user and records the restored user in the
+// audit trail.
+func (st Audited) Restore(ctx context.Context, id string, now time.Time) error {
+	return st.Trail.Atomic(ctx, func(ctx context.Context) error {
+		if err := st.Storage.Restore(ctx, id, now); err != nil {
+			return err
+		}
+
+		after, err := st.Storage.Retrieve(ctx, auditor, id)
+		if err != nil {
+			return err
+		}
+
+		return st.Trail.Record(ctx, EntityType, id, audit.ActionRestore, nil, after, now)
+	})
+}
+
+// SetMFA replaces the second factor of a user. Enabling and disabling it are
+// recorded in the audit trail, using a code is not.
+func (st Audited) SetMFA(ctx context.Context, id string, m MFA, now time.Time) error {
+	return st.Trail.Atomic(ctx, func(ctx context.Context) error {
+		before, err := st.Storage.Retrieve(ctx, auditor, id)
+		if err != nil {
+			return err
+		}
+
+		if err := st.Storage.SetMFA(ctx, id, m, now); err != nil {
+			return err
+		}
+
+		if before.MFA.Enabled == m.Enabled {
+			return nil
+		}
+
+		after := *before
+		after.MFA = m
+		return st.Trail.Record(ctx, EntityType, id, audit.ActionUpdate, before, &after, now)
+	})
+}
+
+// CreateAPIKey creates an API key and records it in the audit trail.
+func (st Audited) CreateAPIKey(ctx context.Context, n NewAPIKey, now time.Time) (*APIKey, string, error) {
+	var (
+		k   *APIKey
+		key string
+	)
+	if err := st.Trail.Atomic(ctx, func(ctx context.Context) error {
+		var err error
+		if k, key, err = st.Storage.CreateAPIKey(ctx, n, now); err != nil {
+			return err
+		}
+		return st.Trail.Record(ctx, APIKeyEntityType, k.ID, audit.ActionCreate, nil, k, now)
+	}); err != nil {
+		return nil, "", err
+	}
+
+	return k, key, nil
+}
+
+// DeleteAPIKey deletes an API key and records its last state in the audit
+// trail.
+func (st Audited) DeleteAPIKey(ctx context.Context, id string, now time.Time) error {
+	return st.Trail.Atomic(ctx, func(ctx context.Context) error {
+		before, err := st.Storage.RetrieveAPIKey(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		if err := st.Storage.DeleteAPIKey(ctx, id, now); err != nil {
+			return err
+		}
+
+		return st.Trail.Record(ctx, APIKeyEntityType, id, audit.ActionDelete, before, nil, now)
+	})
+}
+
+// Purge permanently removes the users deleted before the given time and
+// records the cutoff and the number of users purged in the audit trail.
+// Purges that remove nothing are not recorded.
+func (st Audited) Purge(ctx context.Context, before time.Time) (int, error) {
+	var n int
+	if err := st.Trail.Atomic(ctx, func(ctx context.Context) error {
+		var err error
+		if n, err = st.Storage.Purge(ctx, before); err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		purge := audit.Purge{Before: before.UTC(), Count: n}
+		return st.Trail.Record(ctx, EntityType, "", audit.ActionPurge, nil, purge, time.Now())
+	}); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
@@ -6,6 +6,8 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/os-foundry/vetpms/internal/platform/auth"
+	"github.com/os-foundry/vetpms/internal/platform/database"
+	"github.com/os-foundry/vetpms/internal/platform/query"
 	"github.com/os-foundry/vetpms/internal/user"
 	"github.com/pkg/errors"
 	bolt "go.etcd.io/bbolt"
@@ -13,7 +15,83 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
-const usersCollection = "users"
+const (
+	usersCollection  = "users"
+	tokensCollection = "refresh_tokens"
+	resetCollection  = "reset_tokens"
+	mfaCollection    = "mfa_challenges"
+	loginCollection  = "login_attempts"
+	apiKeyCollection = "api_keys"
+	identCollection  = "identities"
+)
+
+// emailIndex finds users by their email address. Deleted users are not
+// indexed, so they can't authenticate and their address can be used by
+// another user.
+var emailIndex = database.BoltIndex{
+	Name:   "users_email",
+	Bucket: usersCollection,
+	Unique: true,
+	Key: func(v []byte) ([]byte, error) {
+		u, err := user.Decode(v)
+		if err != nil {
+			return nil, err
+		}
+		if u.DeletedAt != nil {
+			return nil, nil
+		}
+		return []byte(u.Email), nil
+	},
+}
+
+// tokenIndex finds the refresh tokens of a user.
+var tokenIndex = database.BoltIndex{
+	Name:   "refresh_tokens_user",
+	Bucket: tokensCollection,
+	Field:  "user_id",
+	Key: func(v []byte) ([]byte, error) {
+		t, err := user.DecodeRefreshToken(v)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(t.UserID), nil
+	},
+}
+
+// Indexes are the secondary indexes of the users, refresh tokens and API keys
+// buckets. Every query field of the users, the sessions and the API keys has
+// one, so lists seek on them.
+var Indexes = append(append(append([]database.BoltIndex{emailIndex, tokenIndex},
+	database.FieldIndexes(usersCollection, user.QueryFields, userValue)...),
+	database.FieldIndexes(tokensCollection, user.SessionQueryFields, tokenValue, tokenIndex)...),
+	database.FieldIndexes(apiKeyCollection, user.APIKeyQueryFields, apiKeyValue)...)
+
+// apiKeyValue returns the value of a query field of an encoded API key.
+func apiKeyValue(v []byte, field string) (interface{}, error) {
+	k, err := user.DecodeAPIKey(v)
+	if err != nil {
+		return nil, err
+	}
+	return k.Value(field), nil
+}
+
+// tokenValue returns the value of a query field of an encoded refresh token.
+func tokenValue(v []byte, field string) (interface{}, error) {
+	t, err := user.DecodeRefreshToken(v)
+	if err != nil {
+		return nil, err
+	}
+	return t.Value(field), nil
+}
+
+// userValue returns the value of a query field of an encoded user.
+func userValue(v []byte, field string) (interface{}, error) {
+	u, err := user.Decode(v)
+	if err != nil {
+		return nil, err
+	}
+	return u.Value(field), nil
+}
 
 // Bolt implements the Storage interface for
 // the bolt database
@@ -21,27 +99,79 @@ type Bolt struct {
 	DB *bolt.DB
 }
 
-// List retrieves a list of existing users from the database.
-func (st Bolt) List(ctx context.Context) ([]user.User, error) {
+// users adapts a slice of users so it can be sorted and paged in memory.
+type users []user.User
+
+func (us users) Len() int                              { return len(us) }
+func (us users) ID(i int) string                       { return us[i].ID }
+func (us users) Value(i int, field string) interface{} { return us[i].Value(field) }
+
+// sessions adapts a slice of refresh tokens so they can be sorted and paged in
+// memory.
+type sessions []user.RefreshToken
+
+func (ss sessions) Len() int                              { return len(ss) }
+func (ss sessions) ID(i int) string                       { return ss[i].ID }
+func (ss sessions) Value(i int, field string) interface{} { return ss[i].Value(field) }
+
+// apiKeys adapts a slice of API keys so they can be sorted and paged in memory.
+type apiKeys []user.APIKey
+
+func (ks apiKeys) Len() int                              { return len(ks) }
+func (ks apiKeys) ID(i int) string                       { return ks[i].ID }
+func (ks apiKeys) Value(i int, field string) interface{} { return ks[i].Value(field) }
+
+// List retrieves a page of existing users from the database. Lists seek
+// directly to the cursor on the bucket or the index of the sort field.
+// Filtered lists only read the users matching their first filter, which are
+// sorted in memory unless they are sorted by ID.
+func (st Bolt) List(ctx context.Context, opts query.Options) ([]user.User, query.Page, error) {
 	ctx, span := trace.StartSpan(ctx, "internal.user.bolt.List")
 	defer span.End()
 
-	users := []user.User{}
-	if err := st.DB.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(usersCollection))
-		return bucket.ForEach(func(k []byte, v []byte) error {
+	opts = opts.Normalize()
+	if err := user.QueryFields.Validate(opts); err != nil {
+		return nil, query.Page{}, err
+	}
+
+	var (
+		list    users
+		ordered bool
+	)
+	if err := database.BoltView(ctx, st.DB, func(tx *bolt.Tx) error {
+		visit := func(k []byte, v []byte) (bool, error) {
 			u, err := user.Decode(v)
 			if err != nil {
-				return errors.Wrap(err, "decoding user")
+				return false, errors.Wrap(err, "decoding user")
 			}
-			users = append(users, *u)
-			return nil
-		})
+			if (u.DeletedAt != nil) != opts.Deleted {
+				return false, nil
+			}
+			if !user.QueryFields.Match(opts, u.Value) {
+				return false, nil
+			}
+			list = append(list, *u)
+			return true, nil
+		}
+
+		var err error
+		ordered, err = database.SeekBoltIndex(tx, usersCollection, Indexes, opts, user.QueryFields, visit)
+		return err
 	}); err != nil {
-		return nil, errors.Wrap(err, "selecting users")
+		return nil, query.Page{}, errors.Wrap(err, "selecting users")
+	}
+
+	idx, page, err := database.PageBolt(list, opts, user.QueryFields, ordered)
+	if err != nil {
+		return nil, query.Page{}, err
 	}
 
-	return users, nil
+	usrs := make([]user.User, len(idx))
+	for i, j := range idx {
+		usrs[i] = list[j]
+	}
+
+	return usrs, page, nil
 }
 
 // Retrieve gets the specified user from the database.
@@ -59,7 +189,7 @@ func (st Bolt) Retrieve(ctx context.Context, claims auth.Claims, id string) (*us
 	}
 
 	var u user.User
-	if err := st.DB.View(func(tx *bolt.Tx) error {
+	if err := database.BoltView(ctx, st.DB, func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(usersCollection))
 		v := bucket.Get([]byte(id))
 		if len(v) == 0 {
@@ -69,6 +199,9 @@ func (st Bolt) Retrieve(ctx context.Context, claims auth.Claims, id string) (*us
 		if err := u.Decode(v); err != nil {
 			return errors.Wrap(err, "decoding user")
 		}
+		if u.DeletedAt != nil {
+			return user.ErrNotFound
+		}
 
 		return nil
 	}); err != nil {
@@ -81,11 +214,16 @@ func (st Bolt) Retrieve(ctx context.Context, claims auth.Claims, id string) (*us
 	return &u, nil
 }
 
-// Create inserts a new user into the database.
+// Create inserts a new user into the database. It returns ErrEmailInUse if
+// another user has the email address.
 func (st Bolt) Create(ctx context.Context, n user.NewUser, now time.Time) (*user.User, error) {
 	ctx, span := trace.StartSpan(ctx, "internal.user.bolt.Create")
 	defer span.End()
 
+	// Timestamps are stored with microsecond precision so entity tags derived
+	// from them stay stable.
+	now = now.UTC().Truncate(time.Microsecond)
+
 	hash, err := bcrypt.GenerateFromPassword([]byte(n.Password), bcrypt.DefaultCost)
 	if err != nil {
 		return nil, errors.Wrap(err, "generating password hash")
@@ -101,44 +239,44 @@ func (st Bolt) Create(ctx context.Context, n user.NewUser, now time.Time) (*user
 		DateUpdated:  now.UTC(),
 	}
 
-	if err := st.DB.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(usersCollection))
-
+	if err := database.BoltUpdate(ctx, st.DB, func(tx *bolt.Tx) error {
 		v, err := u.Encode()
 		if err != nil {
 			return errors.Wrapf(err, "encoding user")
 		}
-		if err := bucket.Put([]byte(u.ID), v); err != nil {
-			return errors.Wrap(err, "writing user data")
-		}
-		if err := bucket.Put([]byte(u.Email), []byte(u.ID)); err != nil {
-			return errors.Wrap(err, "writing user index")
-		}
-
-		return nil
+		return database.BoltPut(tx, usersCollection, Indexes, []byte(u.ID), v)
 	}); err != nil {
+		if errors.Cause(err) == database.ErrDuplicate {
+			return nil, user.ErrEmailInUse
+		}
 		return nil, errors.Wrap(err, "inserting user")
 	}
 
 	return &u, nil
 }
 
-// Update replaces a user document in the database.
+// Update replaces a user document in the database. The update only succeeds
+// if the user was not modified since it was read, otherwise it returns
+// ErrModified, and it returns ErrEmailInUse if another user has the new
+// email address.
 func (st Bolt) Update(ctx context.Context, claims auth.Claims, id string, upd user.UpdateUser, now time.Time) error {
 	ctx, span := trace.StartSpan(ctx, "internal.user.bolt.Update")
 	defer span.End()
 
-	var oldEmail string
 	u, err := st.Retrieve(ctx, claims, id)
 	if err != nil {
 		return err
 	}
 
+	if !upd.Matches(u.ETag()) {
+		return user.ErrModified
+	}
+	version := u.ETag()
+
 	if upd.Name != nil {
 		u.Name = *upd.Name
 	}
 	if upd.Email != nil {
-		oldEmail = u.Email
 		u.Email = *upd.Email
 	}
 	if upd.Roles != nil {
@@ -152,38 +290,50 @@ func (st Bolt) Update(ctx context.Context, claims auth.Claims, id string, upd us
 		u.PasswordHash = pw
 	}
 
-	u.DateUpdated = now
+	u.DateUpdated = now.UTC().Truncate(time.Microsecond)
 
-	if err := st.DB.Update(func(tx *bolt.Tx) error {
+	if err := database.BoltUpdate(ctx, st.DB, func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(usersCollection))
-		v, err := u.Encode()
+
+		// Writes are serialized so the stored user can be compared with the
+		// retrieved one before it is replaced.
+		old := bucket.Get([]byte(u.ID))
+		if len(old) == 0 {
+			return user.ErrNotFound
+		}
+		cur, err := user.Decode(old)
 		if err != nil {
-			return errors.Wrapf(err, "encoding user")
+			return errors.Wrap(err, "decoding user")
 		}
-		if err := bucket.Put([]byte(u.ID), v); err != nil {
-			return errors.Wrap(err, "writing user data")
+		if cur.DeletedAt != nil {
+			return user.ErrNotFound
 		}
-
-		// If the email address is updated, remove the old index and write a new one.
-		if upd.Email != nil {
-			if err := bucket.Delete([]byte(oldEmail)); err != nil {
-				return errors.Wrap(err, "deleting user index")
-			}
-			if err := bucket.Put([]byte(u.ID), v); err != nil {
-				return errors.Wrap(err, "writing user index")
-			}
+		if cur.ETag() != version {
+			return user.ErrModified
 		}
 
-		return nil
+		v, err := u.Encode()
+		if err != nil {
+			return errors.Wrapf(err, "encoding user")
+		}
+		return database.BoltPut(tx, usersCollection, Indexes, []byte(u.ID), v)
 	}); err != nil {
+		if err == user.ErrModified || err == user.ErrNotFound {
+			return err
+		}
+		if errors.Cause(err) == database.ErrDuplicate {
+			return user.ErrEmailInUse
+		}
 		return errors.Wrap(err, "updating user")
 	}
 
 	return nil
 }
 
-// Delete removes a user from the database.
-func (st Bolt) Delete(ctx context.Context, id string) error {
+// Delete marks a user as deleted and revokes their refresh tokens. Their email
+// index is removed so the user can no longer authenticate and the address can
+// be used by another user.
+func (st Bolt) Delete(ctx context.Context, claims auth.Claims, id string, now time.Time) error {
 	ctx, span := trace.StartSpan(ctx, "internal.user.bolt.Delete")
 	defer span.End()
 
@@ -191,37 +341,268 @@ func (st Bolt) Delete(ctx context.Context, id string) error {
 		return user.ErrInvalidID
 	}
 
-	var u user.User
-	if err := st.DB.View(func(tx *bolt.Tx) error {
+	if err := database.BoltUpdate(ctx, st.DB, func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(usersCollection))
 		v := bucket.Get([]byte(id))
 		if len(v) == 0 {
 			return nil
 		}
 
-		if err := u.Decode(v); err != nil {
+		u, err := user.Decode(v)
+		if err != nil {
 			return errors.Wrap(err, "decoding user")
 		}
+		if u.DeletedAt != nil {
+			return nil
+		}
 
-		return nil
+		deletedAt := now.UTC().Truncate(time.Microsecond)
+		u.DeletedAt = &deletedAt
+		u.DeletedBy = &claims.Subject
+
+		if v, err = u.Encode(); err != nil {
+			return errors.Wrap(err, "encoding user")
+		}
+		if err := database.BoltPut(tx, usersCollection, Indexes, []byte(id), v); err != nil {
+			return err
+		}
+		return revokeTokens(tx, id, deletedAt)
 	}); err != nil {
 		return errors.Wrapf(err, "deleting user %s", id)
 	}
 
-	if err := st.DB.Update(func(tx *bolt.Tx) error {
+	return nil
+}
+
+// Restore undoes the deletion of a user. It returns ErrNotFound if there is no
+// deleted user with the ID, and ErrEmailInUse if their email address was
+// taken by another user in the meantime.
+func (st Bolt) Restore(ctx context.Context, id string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.bolt.Restore")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return user.ErrInvalidID
+	}
+
+	if err := database.BoltUpdate(ctx, st.DB, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(usersCollection))
+		v := bucket.Get([]byte(id))
+		if len(v) == 0 {
+			return user.ErrNotFound
+		}
+
+		u, err := user.Decode(v)
+		if err != nil {
+			return errors.Wrap(err, "decoding user")
+		}
+		if u.DeletedAt == nil {
+			return user.ErrNotFound
+		}
+
+		u.DeletedAt, u.DeletedBy = nil, nil
+		u.DateUpdated = now.UTC().Truncate(time.Microsecond)
+
+		if v, err = u.Encode(); err != nil {
+			return errors.Wrap(err, "encoding user")
+		}
+		return database.BoltPut(tx, usersCollection, Indexes, []byte(id), v)
+	}); err != nil {
+		if err == user.ErrNotFound {
+			return err
+		}
+		if errors.Cause(err) == database.ErrDuplicate {
+			return user.ErrEmailInUse
+		}
+		return errors.Wrapf(err, "restoring user %s", id)
+	}
+
+	return nil
+}
+
+// Purge permanently removes the users deleted before the given time together
+// with their tokens. Refresh tokens that expired or were revoked before the
+// time, reset tokens, MFA challenges and API keys that expired before it, and
+// failed login attempts that are no longer locked, are removed as well. It
+// returns the number of users removed.
+func (st Bolt) Purge(ctx context.Context, before time.Time) (int, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.bolt.Purge")
+	defer span.End()
+
+	var n int
+	if err := database.BoltUpdate(ctx, st.DB, func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(usersCollection))
 
-		if err := bucket.Delete([]byte(id)); err != nil {
+		// Keys can't be deleted while iterating over the bucket.
+		var ids [][]byte
+		if err := bucket.ForEach(func(k []byte, v []byte) error {
+			u, err := user.Decode(v)
+			if err != nil {
+				return errors.Wrap(err, "decoding user")
+			}
+			if u.DeletedAt != nil && u.DeletedAt.Before(before) {
+				ids = append(ids, k)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			if err := database.BoltDelete(tx, usersCollection, Indexes, id); err != nil {
+				return err
+			}
+		}
+		n = len(ids)
+
+		var tokens [][]byte
+		if err := tx.Bucket([]byte(tokensCollection)).ForEach(func(k []byte, v []byte) error {
+			t, err := user.DecodeRefreshToken(v)
+			if err != nil {
+				return errors.Wrap(err, "decoding refresh token")
+			}
+			if bucket.Get([]byte(t.UserID)) == nil || t.ExpiresAt.Before(before) || (t.RevokedAt != nil && t.RevokedAt.Before(before)) {
+				tokens = append(tokens, k)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, id := range tokens {
+			if err := database.BoltDelete(tx, tokensCollection, Indexes, id); err != nil {
+				return err
+			}
+		}
+
+		resets := tx.Bucket([]byte(resetCollection))
+		tokens = nil
+		if err := resets.ForEach(func(k []byte, v []byte) error {
+			t, err := user.DecodeResetToken(v)
+			if err != nil {
+				return errors.Wrap(err, "decoding reset token")
+			}
+			if bucket.Get([]byte(t.UserID)) == nil || t.ExpiresAt.Before(before) {
+				tokens = append(tokens, k)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, id := range tokens {
+			if err := resets.Delete(id); err != nil {
+				return err
+			}
+		}
+
+		challenges := tx.Bucket([]byte(mfaCollection))
+		tokens = nil
+		if err := challenges.ForEach(func(k []byte, v []byte) error {
+			c, err := user.DecodeMFAChallenge(v)
+			if err != nil {
+				return errors.Wrap(err, "decoding mfa challenge")
+			}
+			if bucket.Get([]byte(c.UserID)) == nil || c.ExpiresAt.Before(before) {
+				tokens = append(tokens, k)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, id := range tokens {
+			if err := challenges.Delete(id); err != nil {
+				return err
+			}
+		}
+
+		logins := tx.Bucket([]byte(loginCollection))
+		tokens = nil
+		if err := logins.ForEach(func(k []byte, v []byte) error {
+			a, err := user.DecodeLoginAttempts(v)
+			if err != nil {
+				return errors.Wrap(err, "decoding login attempts")
+			}
+			if a.LastFailure.Before(before) && !a.Locked(before) {
+				tokens = append(tokens, k)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, key := range tokens {
+			if err := logins.Delete(key); err != nil {
+				return err
+			}
+		}
+
+		keys := tx.Bucket([]byte(apiKeyCollection))
+		tokens = nil
+		if err := keys.ForEach(func(k []byte, v []byte) error {
+			a, err := user.DecodeAPIKey(v)
+			if err != nil {
+				return errors.Wrap(err, "decoding api key")
+			}
+			if bucket.Get([]byte(a.UserID)) == nil || (a.ExpiresAt != nil && a.ExpiresAt.Before(before)) {
+				tokens = append(tokens, k)
+			}
+			return nil
+		}); err != nil {
 			return err
 		}
 
-		if err := bucket.Delete([]byte(u.Email)); err != nil {
+		for _, id := range tokens {
+			if err := database.BoltDelete(tx, apiKeyCollection, Indexes, id); err != nil {
+				return err
+			}
+		}
+
+		idents := tx.Bucket([]byte(identCollection))
+		tokens = nil
+		if err := idents.ForEach(func(k []byte, v []byte) error {
+			i, err := user.DecodeIdentity(v)
+			if err != nil {
+				return errors.Wrap(err, "decoding identity")
+			}
+			if bucket.Get([]byte(i.UserID)) == nil {
+				tokens = append(tokens, k)
+			}
+			return nil
+		}); err != nil {
 			return err
 		}
 
+		for _, key := range tokens {
+			if err := idents.Delete(key); err != nil {
+				return err
+			}
+		}
+
 		return nil
 	}); err != nil {
-		return errors.Wrapf(err, "deleting user %s", id)
+		return 0, errors.Wrap(err, "purging users")
+	}
+
+	return n, nil
+}
+
+// Put stores a user exactly as given, replacing the user with the same ID if
+// there is one. It is meant for restoring and converting data and bypasses
+// all checks.
+func (st Bolt) Put(ctx context.Context, u user.User) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.bolt.Put")
+	defer span.End()
+
+	if err := database.BoltUpdate(ctx, st.DB, func(tx *bolt.Tx) error {
+		v, err := u.Encode()
+		if err != nil {
+			return errors.Wrap(err, "encoding user")
+		}
+		return database.BoltPut(tx, usersCollection, Indexes, []byte(u.ID), v)
+	}); err != nil {
+		return errors.Wrapf(err, "putting user %s", u.ID)
 	}
 
 	return nil
@@ -229,15 +610,15 @@ func (st Bolt) Delete(ctx context.Context, id string) error {
 
 // Authenticate finds a user by their email and verifies their password. On
 // success it returns a Claims value representing this user. The claims can be
-// used to generate a token for future authentication.
+// used to generate a token for future authentication. Service accounts
+// can't authenticate with a password.
 func (st Bolt) Authenticate(ctx context.Context, now time.Time, email, password string) (auth.Claims, error) {
 	ctx, span := trace.StartSpan(ctx, "internal.user.bolt.Authenticate")
 	defer span.End()
 
 	var id string
-	if err := st.DB.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(usersCollection))
-		v := bucket.Get([]byte(email))
+	if err := database.BoltView(ctx, st.DB, func(tx *bolt.Tx) error {
+		v := emailIndex.Lookup(tx, []byte(email))
 		if len(v) == 0 {
 			return user.ErrNotFound
 		}
@@ -245,13 +626,13 @@ func (st Bolt) Authenticate(ctx context.Context, now time.Time, email, password
 		return nil
 	}); err != nil {
 		if err == user.ErrNotFound {
-			return auth.Claims{}, user.ErrAuthenticationFailure
+			return auth.Claims{}, user.CheckNoPassword(password)
 		}
 		return auth.Claims{}, errors.Wrap(err, "getting user id")
 	}
 
 	var u user.User
-	if err := st.DB.View(func(tx *bolt.Tx) error {
+	if err := database.BoltView(ctx, st.DB, func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(usersCollection))
 		v := bucket.Get([]byte(id))
 		if len(v) == 0 {
@@ -261,11 +642,14 @@ func (st Bolt) Authenticate(ctx context.Context, now time.Time, email, password
 		if err := u.Decode(v); err != nil {
 			return errors.Wrap(err, "decoding user")
 		}
+		if u.DeletedAt != nil {
+			return user.ErrNotFound
+		}
 
 		return nil
 	}); err != nil {
 		if err == user.ErrNotFound {
-			return auth.Claims{}, user.ErrAuthenticationFailure
+			return auth.Claims{}, user.CheckNoPassword(password)
 		}
 		return auth.Claims{}, errors.Wrapf(err, "selecting user %q", id)
 	}
@@ -275,25 +659,937 @@ func (st Bolt) Authenticate(ctx context.Context, now time.Time, email, password
 	if err := bcrypt.CompareHashAndPassword(u.PasswordHash, []byte(password)); err != nil {
 		return auth.Claims{}, user.ErrAuthenticationFailure
 	}
+	if u.ServiceAccount() {
+		return auth.Claims{}, user.ErrAuthenticationFailure
+	}
 
 	// If we are this far the request is valid. Create some claims for the user
 	// and generate their token.
-	claims := auth.NewClaims(u.ID, u.Roles, now, time.Hour)
+	claims := auth.NewClaims(u.ID, u.Roles, now, user.AccessTokenTTL)
 	return claims, nil
 }
 
-// StatusCheck returns nil if it can successfully talk to the database. It
-// returns a non-nil error otherwise.
-func (st Bolt) StatusCheck(ctx context.Context) error {
-	ctx, span := trace.StartSpan(ctx, "internal.user.bolt.StatusCheck")
+// CreateRefreshToken stores a new refresh token.
+func (st Bolt) CreateRefreshToken(ctx context.Context, t user.RefreshToken) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.bolt.CreateRefreshToken")
+	defer span.End()
+
+	if err := database.BoltUpdate(ctx, st.DB, func(tx *bolt.Tx) error {
+		return putToken(tx, &t)
+	}); err != nil {
+		return errors.Wrap(err, "inserting refresh token")
+	}
+
+	return nil
+}
+
+// Refresh exchanges a refresh token for claims of its user and a new refresh
+// token replacing it. A token that doesn't match the stored one was already
+// replaced, which means it leaked, so its session is revoked. All failures
+// return ErrAuthenticationFailure.
+func (st Bolt) Refresh(ctx context.Context, now time.Time, tkn string) (auth.Claims, string, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.bolt.Refresh")
+	defer span.End()
+
+	id, hash, err := user.ParseRefreshToken(tkn)
+	if err != nil {
+		return auth.Claims{}, "", err
+	}
+
+	// The revocation of a leaked session must be committed, so failures are
+	// reported after the transaction.
+	var (
+		claims auth.Claims
+		next   string
+		failed bool
+	)
+	if err := database.BoltUpdate(ctx, st.DB, func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(tokensCollection)).Get([]byte(id))
+		if len(v) == 0 {
+			failed = true
+			return nil
+		}
+
+		t, err := user.DecodeRefreshToken(v)
+		if err != nil {
+			return errors.Wrap(err, "decoding refresh token")
+		}
+		if !t.Valid(hash, now) {
+			failed = true
+			if t.RevokedAt != nil {
+				return nil
+			}
+			revokedAt := now.UTC().Truncate(time.Microsecond)
+			t.RevokedAt = &revokedAt
+			return putToken(tx, t)
+		}
+
+		v = tx.Bucket([]byte(usersCollection)).Get([]byte(t.UserID))
+		if len(v) == 0 {
+			failed = true
+			return nil
+		}
+		u, err := user.Decode(v)
+		if err != nil {
+			return errors.Wrap(err, "decoding user")
+		}
+		if u.DeletedAt != nil || u.ServiceAccount() {
+			failed = true
+			return nil
+		}
+
+		if next, err = t.Rotate(now); err != nil {
+			return err
+		}
+		claims = auth.NewClaims(u.ID, u.Roles, now, user.AccessTokenTTL)
+		claims.SessionID = t.ID
+
+		return putToken(tx, t)
+	}); err != nil {
+		return auth.Claims{}, "", errors.Wrap(err, "refreshing token")
+	}
+
+	if failed {
+		return auth.Claims{}, "", user.ErrAuthenticationFailure
+	}
+
+	return claims, next, nil
+}
+
+// RevokeRefreshTokens revokes all refresh tokens of a user, which ends all of
+// their sessions.
+func (st Bolt) RevokeRefreshTokens(ctx context.Context, userID string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.bolt.RevokeRefreshTokens")
 	defer span.End()
 
-	// Run a simple query to determine connectivity. The db has a "Ping" method
-	// but it can false-positive when it was previously able to talk to the
-	// database but the database has since gone away. Running this query forces a
-	// round trip to the database.
-	// const q = `SELECT true`
-	// var tmp bool
-	// return st.DB.QueryRowContext(ctx, q).Scan(&tmp)
+	if _, err := uuid.Parse(userID); err != nil {
+		return user.ErrInvalidID
+	}
+
+	if err := database.BoltUpdate(ctx, st.DB, func(tx *bolt.Tx) error {
+		return revokeTokens(tx, userID, now)
+	}); err != nil {
+		return errors.Wrapf(err, "revoking refresh tokens of user %s", userID)
+	}
+
 	return nil
 }
+
+// ListSessions retrieves a page of the active sessions of all users. Filter
+// on user_id for the sessions of a user. Lists seek on the refresh tokens
+// bucket or its indexes like List.
+func (st Bolt) ListSessions(ctx context.Context, opts query.Options, now time.Time) ([]user.RefreshToken, query.Page, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.bolt.ListSessions")
+	defer span.End()
+
+	opts = opts.Normalize()
+	if err := user.SessionQueryFields.Validate(opts); err != nil {
+		return nil, query.Page{}, err
+	}
+
+	var (
+		list    sessions
+		ordered bool
+	)
+	if err := database.BoltView(ctx, st.DB, func(tx *bolt.Tx) error {
+		visit := func(k []byte, v []byte) (bool, error) {
+			t, err := user.DecodeRefreshToken(v)
+			if err != nil {
+				return false, errors.Wrap(err, "decoding refresh token")
+			}
+			if !t.Active(now) || !user.SessionQueryFields.Match(opts, t.Value) {
+				return false, nil
+			}
+			list = append(list, *t)
+			return true, nil
+		}
+
+		var err error
+		ordered, err = database.SeekBoltIndex(tx, tokensCollection, Indexes, opts, user.SessionQueryFields, visit)
+		return err
+	}); err != nil {
+		return nil, query.Page{}, errors.Wrap(err, "selecting sessions")
+	}
+
+	idx, page, err := database.PageBolt(list, opts, user.SessionQueryFields, ordered)
+	if err != nil {
+		return nil, query.Page{}, err
+	}
+
+	paged := make([]user.RefreshToken, len(idx))
+	for i, j := range idx {
+		paged[i] = list[j]
+	}
+
+	return paged, page, nil
+}
+
+// RetrieveSession gets the specified session from the database. It returns
+// ErrSessionNotFound if the session was revoked or expired.
+func (st Bolt) RetrieveSession(ctx context.Context, id string, now time.Time) (*user.RefreshToken, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.bolt.RetrieveSession")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, user.ErrInvalidID
+	}
+
+	var t *user.RefreshToken
+	if err := database.BoltView(ctx, st.DB, func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(tokensCollection)).Get([]byte(id))
+		if len(v) == 0 {
+			return user.ErrSessionNotFound
+		}
+		var err error
+		if t, err = user.DecodeRefreshToken(v); err != nil {
+			return errors.Wrap(err, "decoding refresh token")
+		}
+		if !t.Active(now) {
+			return user.ErrSessionNotFound
+		}
+		return nil
+	}); err != nil {
+		if err == user.ErrSessionNotFound {
+			return nil, err
+		}
+		return nil, errors.Wrapf(err, "selecting session %q", id)
+	}
+
+	return t, nil
+}
+
+// RevokeSession revokes the refresh token of a session. Its access tokens
+// stop working immediately. It returns ErrSessionNotFound if the session
+// already ended.
+func (st Bolt) RevokeSession(ctx context.Context, id string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.bolt.RevokeSession")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return user.ErrInvalidID
+	}
+
+	if err := database.BoltUpdate(ctx, st.DB, func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(tokensCollection)).Get([]byte(id))
+		if len(v) == 0 {
+			return user.ErrSessionNotFound
+		}
+		t, err := user.DecodeRefreshToken(v)
+		if err != nil {
+			return errors.Wrap(err, "decoding refresh token")
+		}
+		if !t.Active(now) {
+			return user.ErrSessionNotFound
+		}
+		revokedAt := now.UTC().Truncate(time.Microsecond)
+		t.RevokedAt = &revokedAt
+		return putToken(tx, t)
+	}); err != nil {
+		if err == user.ErrSessionNotFound {
+			return err
+		}
+		return errors.Wrapf(err, "revoking session %s", id)
+	}
+
+	return nil
+}
+
+// SeeSession reports whether the session with the ID is still active and
+// records that it was seen at now. Sessions that don't exist anymore are not
+// active.
+func (st Bolt) SeeSession(ctx context.Context, id string, now time.Time) (bool, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.bolt.SeeSession")
+	defer span.End()
+
+	var t *user.RefreshToken
+	if err := database.BoltView(ctx, st.DB, func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(tokensCollection)).Get([]byte(id))
+		if len(v) == 0 {
+			return nil
+		}
+		var err error
+		t, err = user.DecodeRefreshToken(v)
+		return err
+	}); err != nil {
+		return false, errors.Wrapf(err, "selecting refresh token %s", id)
+	}
+
+	if t == nil || !t.Active(now) {
+		return false, nil
+	}
+
+	// Most requests are read only, so the use is recorded in a separate
+	// transaction only once in a while.
+	if t.Seen(now) {
+		if err := database.BoltUpdate(ctx, st.DB, func(tx *bolt.Tx) error {
+			v := tx.Bucket([]byte(tokensCollection)).Get([]byte(id))
+			if len(v) == 0 {
+				return nil
+			}
+			stored, err := user.DecodeRefreshToken(v)
+			if err != nil {
+				return errors.Wrap(err, "decoding refresh token")
+			}
+			if stored.LastSeen.Before(t.LastSeen) {
+				stored.LastSeen = t.LastSeen
+			}
+			return putToken(tx, stored)
+		}); err != nil {
+			return false, errors.Wrap(err, "recording use of session")
+		}
+	}
+
+	return true, nil
+}
+
+// CreateResetToken stores a new password reset token for the user with the
+// email address. It returns the user and the token to send them, or
+// ErrNotFound if there is no user with the address.
+func (st Bolt) CreateResetToken(ctx context.Context, email string, now time.Time) (*user.User, string, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.bolt.CreateResetToken")
+	defer span.End()
+
+	var (
+		u   *user.User
+		tkn string
+	)
+	if err := database.BoltUpdate(ctx, st.DB, func(tx *bolt.Tx) error {
+		id := emailIndex.Lookup(tx, []byte(email))
+		if len(id) == 0 {
+			return user.ErrNotFound
+		}
+
+		var err error
+		if u, err = user.Decode(tx.Bucket([]byte(usersCollection)).Get(id)); err != nil {
+			return errors.Wrap(err, "decoding user")
+		}
+
+		var t user.ResetToken
+		if t, tkn, err = user.NewResetToken(u.ID, now); err != nil {
+			return err
+		}
+		v, err := t.Encode()
+		if err != nil {
+			return errors.Wrap(err, "encoding reset token")
+		}
+		return tx.Bucket([]byte(resetCollection)).Put([]byte(t.ID), v)
+	}); err != nil {
+		if err == user.ErrNotFound {
+			return nil, "", err
+		}
+		return nil, "", errors.Wrap(err, "inserting reset token")
+	}
+
+	return u, tkn, nil
+}
+
+// UseResetToken marks a password reset token as used and returns the ID of
+// the user it was issued for. It returns ErrResetTokenInvalid if the token is
+// unknown, expired or was used before.
+func (st Bolt) UseResetToken(ctx context.Context, now time.Time, tkn string) (string, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.bolt.UseResetToken")
+	defer span.End()
+
+	id, hash, err := user.ParseResetToken(tkn)
+	if err != nil {
+		return "", err
+	}
+
+	var userID string
+	if err := database.BoltUpdate(ctx, st.DB, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(resetCollection))
+		v := bucket.Get([]byte(id))
+		if len(v) == 0 {
+			return user.ErrResetTokenInvalid
+		}
+
+		t, err := user.DecodeResetToken(v)
+		if err != nil {
+			return errors.Wrap(err, "decoding reset token")
+		}
+		if !t.Valid(hash, now) {
+			return user.ErrResetTokenInvalid
+		}
+
+		v = tx.Bucket([]byte(usersCollection)).Get([]byte(t.UserID))
+		if len(v) == 0 {
+			return user.ErrResetTokenInvalid
+		}
+		u, err := user.Decode(v)
+		if err != nil {
+			return errors.Wrap(err, "decoding user")
+		}
+		if u.DeletedAt != nil {
+			return user.ErrResetTokenInvalid
+		}
+
+		usedAt := now.UTC().Truncate(time.Microsecond)
+		t.UsedAt = &usedAt
+		if v, err = t.Encode(); err != nil {
+			return errors.Wrap(err, "encoding reset token")
+		}
+		userID = t.UserID
+		return bucket.Put([]byte(id), v)
+	}); err != nil {
+		if err == user.ErrResetTokenInvalid {
+			return "", err
+		}
+		return "", errors.Wrap(err, "using reset token")
+	}
+
+	return userID, nil
+}
+
+// SetMFA replaces the second factor of a user. It doesn't change the version
+// of the user, since the MFA also changes whenever a code is used.
+func (st Bolt) SetMFA(ctx context.Context, id string, m user.MFA, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.bolt.SetMFA")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return user.ErrInvalidID
+	}
+
+	if err := database.BoltUpdate(ctx, st.DB, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(usersCollection))
+		v := bucket.Get([]byte(id))
+		if len(v) == 0 {
+			return user.ErrNotFound
+		}
+
+		u, err := user.Decode(v)
+		if err != nil {
+			return errors.Wrap(err, "decoding user")
+		}
+		if u.DeletedAt != nil {
+			return user.ErrNotFound
+		}
+
+		u.MFA = m
+		if v, err = u.Encode(); err != nil {
+			return errors.Wrap(err, "encoding user")
+		}
+		return database.BoltPut(tx, usersCollection, Indexes, []byte(id), v)
+	}); err != nil {
+		if err == user.ErrNotFound {
+			return err
+		}
+		return errors.Wrapf(err, "updating mfa of user %q", id)
+	}
+
+	return nil
+}
+
+// CreateMFAChallenge stores a new MFA challenge for the user and returns the
+// token to hand to the client.
+func (st Bolt) CreateMFAChallenge(ctx context.Context, userID string, now time.Time) (string, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.bolt.CreateMFAChallenge")
+	defer span.End()
+
+	c, tkn, err := user.NewMFAChallenge(userID, now)
+	if err != nil {
+		return "", err
+	}
+
+	if err := database.BoltUpdate(ctx, st.DB, func(tx *bolt.Tx) error {
+		return putChallenge(tx, &c)
+	}); err != nil {
+		return "", errors.Wrap(err, "inserting mfa challenge")
+	}
+
+	return tkn, nil
+}
+
+// EnrollMFAChallenge stores the sealed secret of a second factor the user of
+// an MFA challenge enrolls, unless the challenge holds one already, and
+// returns the challenge. It returns ErrMFAChallengeInvalid if the challenge
+// is unknown, expired or was used before.
+func (st Bolt) EnrollMFAChallenge(ctx context.Context, now time.Time, tkn string, secret []byte) (*user.MFAChallenge, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.bolt.EnrollMFAChallenge")
+	defer span.End()
+
+	var c *user.MFAChallenge
+	if err := database.BoltUpdate(ctx, st.DB, func(tx *bolt.Tx) error {
+		var err error
+		if c, err = validChallenge(tx, now, tkn); err != nil {
+			return err
+		}
+		if len(c.Secret) > 0 {
+			return nil
+		}
+
+		c.Secret = secret
+		return putChallenge(tx, c)
+	}); err != nil {
+		if err == user.ErrMFAChallengeInvalid {
+			return nil, err
+		}
+		return nil, errors.Wrap(err, "enrolling with mfa challenge")
+	}
+
+	return c, nil
+}
+
+// UseMFAChallenge marks an MFA challenge as used and returns it. It returns
+// ErrMFAChallengeInvalid if the challenge is unknown, expired or was used
+// before.
+func (st Bolt) UseMFAChallenge(ctx context.Context, now time.Time, tkn string) (*user.MFAChallenge, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.bolt.UseMFAChallenge")
+	defer span.End()
+
+	var c *user.MFAChallenge
+	if err := database.BoltUpdate(ctx, st.DB, func(tx *bolt.Tx) error {
+		var err error
+		if c, err = validChallenge(tx, now, tkn); err != nil {
+			return err
+		}
+
+		usedAt := now.UTC().Truncate(time.Microsecond)
+		c.UsedAt = &usedAt
+		return putChallenge(tx, c)
+	}); err != nil {
+		if err == user.ErrMFAChallengeInvalid {
+			return nil, err
+		}
+		return nil, errors.Wrap(err, "using mfa challenge")
+	}
+
+	return c, nil
+}
+
+// LoginAttempts returns the failed login attempts with the key. Keys without
+// failures have none.
+func (st Bolt) LoginAttempts(ctx context.Context, key string) (*user.LoginAttempts, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.bolt.LoginAttempts")
+	defer span.End()
+
+	a := user.LoginAttempts{Key: key}
+	if err := database.BoltView(ctx, st.DB, func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(loginCollection)).Get([]byte(key))
+		if len(v) == 0 {
+			return nil
+		}
+		stored, err := user.DecodeLoginAttempts(v)
+		if err != nil {
+			return errors.Wrap(err, "decoding login attempts")
+		}
+		a = *stored
+		return nil
+	}); err != nil {
+		return nil, errors.Wrapf(err, "selecting login attempts %q", key)
+	}
+
+	return &a, nil
+}
+
+// FailLogin records a failed login attempt with the key and locks further
+// attempts according to the policy. It returns the updated attempts.
+func (st Bolt) FailLogin(ctx context.Context, key string, p user.LockoutPolicy, now time.Time) (*user.LoginAttempts, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.bolt.FailLogin")
+	defer span.End()
+
+	a := user.LoginAttempts{Key: key}
+	if err := database.BoltUpdate(ctx, st.DB, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(loginCollection))
+		if v := bucket.Get([]byte(key)); len(v) != 0 {
+			stored, err := user.DecodeLoginAttempts(v)
+			if err != nil {
+				return errors.Wrap(err, "decoding login attempts")
+			}
+			a = *stored
+		}
+
+		a.Fail(p, now)
+		v, err := a.Encode()
+		if err != nil {
+			return errors.Wrap(err, "encoding login attempts")
+		}
+		return bucket.Put([]byte(key), v)
+	}); err != nil {
+		return nil, errors.Wrapf(err, "updating login attempts %q", key)
+	}
+
+	return &a, nil
+}
+
+// ResetLoginAttempts forgets the failed login attempts with the key, which
+// unlocks it.
+func (st Bolt) ResetLoginAttempts(ctx context.Context, key string) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.bolt.ResetLoginAttempts")
+	defer span.End()
+
+	if err := database.BoltUpdate(ctx, st.DB, func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(loginCollection)).Delete([]byte(key))
+	}); err != nil {
+		return errors.Wrapf(err, "deleting login attempts %q", key)
+	}
+
+	return nil
+}
+
+// CreateAPIKey creates an API key for a user who isn't deleted. It returns
+// the stored key and the key to hand to the client.
+func (st Bolt) CreateAPIKey(ctx context.Context, n user.NewAPIKey, now time.Time) (*user.APIKey, string, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.bolt.CreateAPIKey")
+	defer span.End()
+
+	if _, err := uuid.Parse(n.UserID); err != nil {
+		return nil, "", user.ErrInvalidID
+	}
+
+	k, key, err := n.NewKey(now)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := database.BoltUpdate(ctx, st.DB, func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(usersCollection)).Get([]byte(n.UserID))
+		if len(v) == 0 {
+			return user.ErrNotFound
+		}
+		u, err := user.Decode(v)
+		if err != nil {
+			return errors.Wrap(err, "decoding user")
+		}
+		if u.DeletedAt != nil {
+			return user.ErrNotFound
+		}
+
+		return putAPIKey(tx, &k)
+	}); err != nil {
+		if err == user.ErrNotFound {
+			return nil, "", err
+		}
+		return nil, "", errors.Wrap(err, "inserting api key")
+	}
+
+	return &k, key, nil
+}
+
+// ListAPIKeys retrieves a page of the API keys of all users. Filter on
+// user_id for the keys of a user. Lists seek on the API keys bucket or its
+// indexes like List.
+func (st Bolt) ListAPIKeys(ctx context.Context, opts query.Options) ([]user.APIKey, query.Page, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.bolt.ListAPIKeys")
+	defer span.End()
+
+	opts = opts.Normalize()
+	if err := user.APIKeyQueryFields.Validate(opts); err != nil {
+		return nil, query.Page{}, err
+	}
+
+	var (
+		list    apiKeys
+		ordered bool
+	)
+	if err := database.BoltView(ctx, st.DB, func(tx *bolt.Tx) error {
+		visit := func(k []byte, v []byte) (bool, error) {
+			a, err := user.DecodeAPIKey(v)
+			if err != nil {
+				return false, errors.Wrap(err, "decoding api key")
+			}
+			if !user.APIKeyQueryFields.Match(opts, a.Value) {
+				return false, nil
+			}
+			list = append(list, *a)
+			return true, nil
+		}
+
+		var err error
+		ordered, err = database.SeekBoltIndex(tx, apiKeyCollection, Indexes, opts, user.APIKeyQueryFields, visit)
+		return err
+	}); err != nil {
+		return nil, query.Page{}, errors.Wrap(err, "selecting api keys")
+	}
+
+	idx, page, err := database.PageBolt(list, opts, user.APIKeyQueryFields, ordered)
+	if err != nil {
+		return nil, query.Page{}, err
+	}
+
+	paged := make([]user.APIKey, len(idx))
+	for i, j := range idx {
+		paged[i] = list[j]
+	}
+
+	return paged, page, nil
+}
+
+// RetrieveAPIKey gets the specified API key from the database.
+func (st Bolt) RetrieveAPIKey(ctx context.Context, id string) (*user.APIKey, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.bolt.RetrieveAPIKey")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, user.ErrInvalidID
+	}
+
+	var k *user.APIKey
+	if err := database.BoltView(ctx, st.DB, func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(apiKeyCollection)).Get([]byte(id))
+		if len(v) == 0 {
+			return user.ErrAPIKeyNotFound
+		}
+		var err error
+		k, err = user.DecodeAPIKey(v)
+		return err
+	}); err != nil {
+		if err == user.ErrAPIKeyNotFound {
+			return nil, err
+		}
+		return nil, errors.Wrapf(err, "selecting api key %q", id)
+	}
+
+	return k, nil
+}
+
+// DeleteAPIKey removes an API key, which can't be used from then on.
+func (st Bolt) DeleteAPIKey(ctx context.Context, id string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.bolt.DeleteAPIKey")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return user.ErrInvalidID
+	}
+
+	if err := database.BoltUpdate(ctx, st.DB, func(tx *bolt.Tx) error {
+		if len(tx.Bucket([]byte(apiKeyCollection)).Get([]byte(id))) == 0 {
+			return user.ErrAPIKeyNotFound
+		}
+		return database.BoltDelete(tx, apiKeyCollection, Indexes, []byte(id))
+	}); err != nil {
+		if err == user.ErrAPIKeyNotFound {
+			return err
+		}
+		return errors.Wrapf(err, "deleting api key %s", id)
+	}
+
+	return nil
+}
+
+// AuthenticateAPIKey finds the API key and the user it acts as. It returns
+// claims for the user limited to the scopes of the key, and records when the
+// key was used. All failures return ErrAuthenticationFailure.
+func (st Bolt) AuthenticateAPIKey(ctx context.Context, now time.Time, key string) (auth.Claims, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.bolt.AuthenticateAPIKey")
+	defer span.End()
+
+	id, hash, err := user.ParseAPIKey(key)
+	if err != nil {
+		return auth.Claims{}, err
+	}
+
+	var (
+		k *user.APIKey
+		u *user.User
+	)
+	if err := database.BoltView(ctx, st.DB, func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(apiKeyCollection)).Get([]byte(id))
+		if len(v) == 0 {
+			return nil
+		}
+		if k, err = user.DecodeAPIKey(v); err != nil {
+			return errors.Wrap(err, "decoding api key")
+		}
+
+		v = tx.Bucket([]byte(usersCollection)).Get([]byte(k.UserID))
+		if len(v) == 0 {
+			return nil
+		}
+		if u, err = user.Decode(v); err != nil {
+			return errors.Wrap(err, "decoding user")
+		}
+		return nil
+	}); err != nil {
+		return auth.Claims{}, errors.Wrap(err, "authenticating api key")
+	}
+
+	if k == nil || u == nil || u.DeletedAt != nil || !k.Valid(hash, now) {
+		return auth.Claims{}, user.ErrAuthenticationFailure
+	}
+
+	// Most requests are read only, so the use is recorded in a separate
+	// transaction only once in a while.
+	if k.Used(now) {
+		if err := database.BoltUpdate(ctx, st.DB, func(tx *bolt.Tx) error {
+			v := tx.Bucket([]byte(apiKeyCollection)).Get([]byte(id))
+			if len(v) == 0 {
+				return nil
+			}
+			stored, err := user.DecodeAPIKey(v)
+			if err != nil {
+				return errors.Wrap(err, "decoding api key")
+			}
+			stored.LastUsed = k.LastUsed
+			return putAPIKey(tx, stored)
+		}); err != nil {
+			return auth.Claims{}, errors.Wrap(err, "recording use of api key")
+		}
+	}
+
+	return k.Claims(u, now), nil
+}
+
+// RetrieveIdentity gets the link of an account at an identity provider. It
+// returns ErrIdentityNotFound if the account isn't linked to a user.
+func (st Bolt) RetrieveIdentity(ctx context.Context, issuer, subject string) (*user.Identity, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.bolt.RetrieveIdentity")
+	defer span.End()
+
+	var i *user.Identity
+	if err := database.BoltView(ctx, st.DB, func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(identCollection)).Get(identityKey(issuer, subject))
+		if len(v) == 0 {
+			return user.ErrIdentityNotFound
+		}
+		var err error
+		i, err = user.DecodeIdentity(v)
+		return err
+	}); err != nil {
+		if err == user.ErrIdentityNotFound {
+			return nil, err
+		}
+		return nil, errors.Wrapf(err, "selecting identity %q of %q", subject, issuer)
+	}
+
+	return i, nil
+}
+
+// LinkIdentity links an account at an identity provider to a user who isn't
+// deleted, replacing the user it was linked to before.
+func (st Bolt) LinkIdentity(ctx context.Context, issuer, subject, userID string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.bolt.LinkIdentity")
+	defer span.End()
+
+	if _, err := uuid.Parse(userID); err != nil {
+		return user.ErrInvalidID
+	}
+
+	i := user.Identity{
+		Issuer:      issuer,
+		Subject:     subject,
+		UserID:      userID,
+		DateCreated: now.UTC().Truncate(time.Microsecond),
+	}
+
+	if err := database.BoltUpdate(ctx, st.DB, func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(usersCollection)).Get([]byte(userID))
+		if len(v) == 0 {
+			return user.ErrNotFound
+		}
+		u, err := user.Decode(v)
+		if err != nil {
+			return errors.Wrap(err, "decoding user")
+		}
+		if u.DeletedAt != nil {
+			return user.ErrNotFound
+		}
+
+		v, err = i.Encode()
+		if err != nil {
+			return errors.Wrap(err, "encoding identity")
+		}
+		return tx.Bucket([]byte(identCollection)).Put(identityKey(issuer, subject), v)
+	}); err != nil {
+		if err == user.ErrNotFound {
+			return err
+		}
+		return errors.Wrap(err, "inserting identity")
+	}
+
+	return nil
+}
+
+// identityKey returns the key of an identity. Issuers are URLs, which can't
+// contain a space.
+func identityKey(issuer, subject string) []byte {
+	return []byte(issuer + " " + subject)
+}
+
+// validChallenge returns the MFA challenge of the token if it can be used at
+// now. It returns ErrMFAChallengeInvalid otherwise.
+func validChallenge(tx *bolt.Tx, now time.Time, tkn string) (*user.MFAChallenge, error) {
+	id, hash, err := user.ParseMFAChallenge(tkn)
+	if err != nil {
+		return nil, err
+	}
+
+	v := tx.Bucket([]byte(mfaCollection)).Get([]byte(id))
+	if len(v) == 0 {
+		return nil, user.ErrMFAChallengeInvalid
+	}
+
+	c, err := user.DecodeMFAChallenge(v)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding mfa challenge")
+	}
+	if !c.Valid(hash, now) {
+		return nil, user.ErrMFAChallengeInvalid
+	}
+	return c, nil
+}
+
+// putChallenge stores an MFA challenge.
+func putChallenge(tx *bolt.Tx, c *user.MFAChallenge) error {
+	v, err := c.Encode()
+	if err != nil {
+		return errors.Wrap(err, "encoding mfa challenge")
+	}
+	return tx.Bucket([]byte(mfaCollection)).Put([]byte(c.ID), v)
+}
+
+// putAPIKey stores an API key and updates its indexes.
+func putAPIKey(tx *bolt.Tx, k *user.APIKey) error {
+	v, err := k.Encode()
+	if err != nil {
+		return errors.Wrap(err, "encoding api key")
+	}
+	return database.BoltPut(tx, apiKeyCollection, Indexes, []byte(k.ID), v)
+}
+
+// putToken stores a refresh token and updates its index.
+func putToken(tx *bolt.Tx, t *user.RefreshToken) error {
+	v, err := t.Encode()
+	if err != nil {
+		return errors.Wrap(err, "encoding refresh token")
+	}
+	return database.BoltPut(tx, tokensCollection, Indexes, []byte(t.ID), v)
+}
+
+// revokeTokens revokes the refresh tokens of a user that are not revoked yet.
+func revokeTokens(tx *bolt.Tx, userID string, now time.Time) error {
+	revokedAt := now.UTC().Truncate(time.Microsecond)
+	bucket := tx.Bucket([]byte(tokensCollection))
+	for _, id := range tokenIndex.IDs(tx, []byte(userID)) {
+		t, err := user.DecodeRefreshToken(bucket.Get(id))
+		if err != nil {
+			return errors.Wrap(err, "decoding refresh token")
+		}
+		if t.RevokedAt != nil {
+			continue
+		}
+		t.RevokedAt = &revokedAt
+		if err := putToken(tx, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StatusCheck returns nil if it can successfully talk to the database. It
+// returns a non-nil error otherwise.
+func (st Bolt) StatusCheck(ctx context.Context) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.bolt.StatusCheck")
+	defer span.End()
+
+	// Starting a transaction fails when the database was closed, and the
+	// bucket is missing when the database was not migrated.
+	return st.DB.View(func(tx *bolt.Tx) error {
+		for _, name := range []string{usersCollection, emailIndex.Name, tokensCollection, tokenIndex.Name, resetCollection, mfaCollection, loginCollection, apiKeyCollection, identCollection} {
+			if tx.Bucket([]byte(name)) == nil {
+				return errors.Errorf("%s bucket missing, migrate the database", name)
+			}
+		}
+		return nil
+	})
+}
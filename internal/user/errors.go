@@ -13,6 +13,42 @@ var (
 	// anything goes wrong.
 	ErrAuthenticationFailure = errors.New("Authentication failed")
 
+	// ErrModified occurs when a user is updated based on a version that is no
+	// longer the stored version.
+	ErrModified = errors.New("User was modified in the meantime")
+
+	// ErrEmailInUse occurs when a user is created, updated or restored with
+	// an email address another user has.
+	ErrEmailInUse = errors.New("Email is used by another user")
+
+	// ErrResetTokenInvalid occurs when a password is reset with a token that
+	// is unknown, expired or was used before.
+	ErrResetTokenInvalid = errors.New("Password reset token is invalid or expired")
+
+	// ErrMFAEnabled occurs when a user enrolls a second factor while they
+	// already have one.
+	ErrMFAEnabled = errors.New("Two-factor authentication is already enabled")
+
+	// ErrMFACodeInvalid occurs when a one-time password or recovery code is
+	// wrong or was used before.
+	ErrMFACodeInvalid = errors.New("Two-factor authentication code is invalid")
+
+	// ErrMFAChallengeInvalid occurs when a code is entered for a challenge
+	// that is unknown, expired or was used before.
+	ErrMFAChallengeInvalid = errors.New("Two-factor authentication challenge is invalid or expired")
+
+	// ErrAPIKeyNotFound is used when a specific API key is requested but does
+	// not exist.
+	ErrAPIKeyNotFound = errors.New("API key not found")
+
+	// ErrIdentityNotFound is used when an account at an identity provider
+	// isn't linked to a user.
+	ErrIdentityNotFound = errors.New("Identity is not linked to a user")
+
+	// ErrSessionNotFound is used when a specific session is requested but
+	// does not exist or ended.
+	ErrSessionNotFound = errors.New("Session not found")
+
 	// ErrForbidden occurs when a user tries to do something that is forbidden to them according to our access control policies.
 	ErrForbidden = errors.New("Attempted action is not allowed")
 )
@@ -0,0 +1,34 @@
+package user
+
+import (
+	"time"
+
+	"github.com/os-foundry/vetpms/internal/platform/envelope"
+)
+
+// Identity links a user to their account at an identity provider. The
+// account is identified by the issuer and subject of the ID tokens of the
+// provider.
+type Identity struct {
+	Issuer      string    `db:"issuer" json:"issuer"`
+	Subject     string    `db:"subject" json:"subject"`
+	UserID      string    `db:"user_id" json:"user_id"`
+	DateCreated time.Time `db:"date_created" json:"date_created"`
+}
+
+// identityCodec encodes the identities stored in Bolt.
+var identityCodec = envelope.Codec{Version: 1}
+
+// Encode encodes the identity into a slice of bytes stored in Bolt.
+func (i *Identity) Encode() ([]byte, error) {
+	return identityCodec.Encode(i)
+}
+
+// DecodeIdentity creates an Identity from a slice of bytes stored in Bolt.
+func DecodeIdentity(b []byte) (*Identity, error) {
+	var i Identity
+	if err := identityCodec.Decode(b, &i); err != nil {
+		return nil, err
+	}
+	return &i, nil
+}
@@ -0,0 +1,104 @@
+package user
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/os-foundry/vetpms/internal/platform/envelope"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// LockoutPolicy decides how long sign ins are locked after they failed. Once
+// Threshold attempts failed, sign ins are locked for Delay, which doubles
+// with every further failure up to MaxDelay. Failures are forgotten when
+// none happened for MaxDelay. The zero value never locks.
+type LockoutPolicy struct {
+	Threshold int
+	Delay     time.Duration
+	MaxDelay  time.Duration
+}
+
+// LoginAttempts counts the failed sign ins with an email address or from an
+// IP address, identified by their key.
+type LoginAttempts struct {
+	Key         string    `db:"attempt_key" json:"key"`
+	Failures    int       `db:"failures" json:"failures"`
+	LastFailure time.Time `db:"last_failure" json:"last_failure"`
+	LockedUntil time.Time `db:"locked_until" json:"locked_until"`
+}
+
+// EmailAttempts returns the key of the attempts to sign in with an email
+// address. Addresses nobody has are counted as well, so a lockout doesn't
+// reveal whether an address is known.
+func EmailAttempts(email string) string {
+	return "email:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+// IPAttempts returns the key of the attempts to sign in from an IP address.
+func IPAttempts(ip string) string {
+	return "ip:" + ip
+}
+
+// Locked reports whether sign ins are locked at now.
+func (a *LoginAttempts) Locked(now time.Time) bool {
+	return now.Before(a.LockedUntil)
+}
+
+// Fail records a failed attempt at now and locks sign ins according to the
+// policy.
+func (a *LoginAttempts) Fail(p LockoutPolicy, now time.Time) {
+	now = now.UTC().Truncate(time.Microsecond)
+	if now.Sub(a.LastFailure) > p.MaxDelay {
+		a.Failures = 0
+	}
+	a.Failures++
+	a.LastFailure = now
+
+	if p.Threshold == 0 || a.Failures < p.Threshold {
+		return
+	}
+
+	delay := p.Delay
+	for i := p.Threshold; i < a.Failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	a.LockedUntil = now.Add(delay)
+}
+
+// attemptsCodec encodes the login attempts stored in Bolt.
+var attemptsCodec = envelope.Codec{Version: 1}
+
+// Encode encodes the attempts into a slice of bytes stored in Bolt.
+func (a *LoginAttempts) Encode() ([]byte, error) {
+	return attemptsCodec.Encode(a)
+}
+
+// DecodeLoginAttempts creates LoginAttempts from a slice of bytes stored in
+// Bolt.
+func DecodeLoginAttempts(b []byte) (*LoginAttempts, error) {
+	var a LoginAttempts
+	if err := attemptsCodec.Decode(b, &a); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+var (
+	dummyOnce sync.Once
+	dummyHash []byte
+)
+
+// CheckNoPassword fails like CheckPassword does for a wrong password. It is
+// used when there is no user with an email address, so the response takes
+// as long as when there is one.
+func CheckNoPassword(password string) error {
+	dummyOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+	})
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+	return ErrAuthenticationFailure
+}
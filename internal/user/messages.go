@@ -0,0 +1,60 @@
+package user
+
+import "github.com/os-foundry/vetpms/internal/platform/web"
+
+// The errors sent to clients have stable codes and are translated to the
+// languages of the API.
+func init() {
+	web.RegisterError(ErrNotFound, "user.not_found", "The requested user doesn't exist or was deleted.", web.Translations{
+		"nl": "Gebruiker niet gevonden",
+		"bg": "Потребителят не е намерен",
+	})
+	web.RegisterError(ErrInvalidID, "user.invalid_id", "The ID of a user, session or API key isn't a UUID.", web.Translations{
+		"nl": "ID heeft niet de juiste vorm",
+		"bg": "ID не е в правилния формат",
+	})
+	web.RegisterError(ErrAuthenticationFailure, "user.authentication_failed", "The email and password, token or API key are wrong, or the user is locked out.", web.Translations{
+		"nl": "Authenticatie mislukt",
+		"bg": "Неуспешно удостоверяване",
+	})
+	web.RegisterError(ErrModified, "user.modified", "The user changed since the version in the If-Match header. Fetch it again before retrying.", web.Translations{
+		"nl": "Gebruiker is intussen gewijzigd",
+		"bg": "Потребителят междувременно е променен",
+	})
+	web.RegisterError(ErrEmailInUse, "user.email_in_use", "Another user has the email address.", web.Translations{
+		"nl": "E-mailadres wordt door een andere gebruiker gebruikt",
+		"bg": "Имейл адресът се използва от друг потребител",
+	})
+	web.RegisterError(ErrResetTokenInvalid, "user.reset_token_invalid", "The password reset token is unknown, expired or was used before.", web.Translations{
+		"nl": "Token om het wachtwoord te herstellen is ongeldig of verlopen",
+		"bg": "Кодът за възстановяване на паролата е невалиден или изтекъл",
+	})
+	web.RegisterError(ErrMFAEnabled, "user.mfa_enabled", "The user already has two-factor authentication enabled.", web.Translations{
+		"nl": "Tweestapsverificatie is al ingeschakeld",
+		"bg": "Двуфакторното удостоверяване вече е включено",
+	})
+	web.RegisterError(ErrMFACodeInvalid, "user.mfa_code_invalid", "The one-time password or recovery code is wrong or was used before.", web.Translations{
+		"nl": "Code voor tweestapsverificatie is ongeldig",
+		"bg": "Кодът за двуфакторно удостоверяване е невалиден",
+	})
+	web.RegisterError(ErrMFAChallengeInvalid, "user.mfa_challenge_invalid", "The two-factor challenge is unknown, expired or was used before. Sign in again.", web.Translations{
+		"nl": "Verzoek om tweestapsverificatie is ongeldig of verlopen",
+		"bg": "Заявката за двуфакторно удостоверяване е невалидна или изтекла",
+	})
+	web.RegisterError(ErrAPIKeyNotFound, "user.api_key_not_found", "The requested API key doesn't exist or was deleted.", web.Translations{
+		"nl": "API-sleutel niet gevonden",
+		"bg": "API ключът не е намерен",
+	})
+	web.RegisterError(ErrIdentityNotFound, "user.identity_not_found", "The account at the identity provider isn't linked to a user.", web.Translations{
+		"nl": "Identiteit is niet aan een gebruiker gekoppeld",
+		"bg": "Самоличността не е свързана с потребител",
+	})
+	web.RegisterError(ErrSessionNotFound, "user.session_not_found", "The requested session doesn't exist or ended.", web.Translations{
+		"nl": "Sessie niet gevonden",
+		"bg": "Сесията не е намерена",
+	})
+	web.RegisterError(ErrForbidden, "user.forbidden", "The authenticated user may not access another user, or grant an API key scopes they lack.", web.Translations{
+		"nl": "Deze actie is niet toegestaan",
+		"bg": "Това действие не е позволено",
+	})
+}
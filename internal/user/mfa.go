@@ -0,0 +1,208 @@
+package user
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/os-foundry/vetpms/internal/platform/envelope"
+	"github.com/os-foundry/vetpms/internal/platform/seal"
+	"github.com/os-foundry/vetpms/internal/platform/totp"
+	"github.com/pkg/errors"
+)
+
+// RecoveryCodeCount is the number of recovery codes a user gets when they
+// enable a second factor.
+const RecoveryCodeCount = 10
+
+// MFA is the second factor of a user, the one-time passwords of an
+// authenticator app. The secret is sealed before it is stored and recovery
+// codes are only stored as hashes. A user with a secret that is not enabled
+// has started enrolling but not confirmed a code yet.
+type MFA struct {
+	Enabled       bool          `db:"mfa_enabled" json:"mfa_enabled"`
+	Secret        []byte        `db:"mfa_secret" json:"-"`
+	LastStep      int64         `db:"mfa_last_step" json:"-"`
+	RecoveryCodes pq.ByteaArray `db:"mfa_recovery_codes" json:"-"`
+}
+
+// NewMFA starts enrolling a second factor. It returns the MFA to store, with
+// the secret sealed by box, and the secret to provision the app of the user
+// with.
+func NewMFA(box *seal.Box) (MFA, []byte, error) {
+	secret, err := totp.NewSecret()
+	if err != nil {
+		return MFA{}, nil, errors.Wrap(err, "generating secret")
+	}
+	sealed, err := box.Seal(secret)
+	if err != nil {
+		return MFA{}, nil, errors.Wrap(err, "sealing secret")
+	}
+	return MFA{Secret: sealed}, secret, nil
+}
+
+// Enable confirms enrolment with the first code of the app. It returns the
+// recovery codes to show the user, which are the only copy of them.
+func (m *MFA) Enable(box *seal.Box, code string, now time.Time) ([]string, error) {
+	if m.Enabled {
+		return nil, ErrMFAEnabled
+	}
+	if err := m.verifyCode(box, code, now); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, RecoveryCodeCount)
+	hashes := make(pq.ByteaArray, RecoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, errors.Wrap(err, "generating recovery code")
+		}
+		c := strings.ToLower(base32.StdEncoding.EncodeToString(b))[:10]
+		codes[i] = c[:5] + "-" + c[5:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+
+	m.Enabled = true
+	m.RecoveryCodes = hashes
+	return codes, nil
+}
+
+// Verify checks a code of the app or one of the recovery codes. Codes can
+// only be used once, so the MFA must be stored again after a successful
+// check. It returns ErrMFACodeInvalid if the code is wrong.
+func (m *MFA) Verify(box *seal.Box, code string, now time.Time) error {
+	if !m.Enabled {
+		return ErrMFACodeInvalid
+	}
+	if err := m.verifyCode(box, code, now); err != ErrMFACodeInvalid {
+		return err
+	}
+
+	hash := hashRecoveryCode(code)
+	for i, h := range m.RecoveryCodes {
+		if subtle.ConstantTimeCompare(h, hash) == 1 {
+			m.RecoveryCodes = append(m.RecoveryCodes[:i:i], m.RecoveryCodes[i+1:]...)
+			return nil
+		}
+	}
+	return ErrMFACodeInvalid
+}
+
+// verifyCode checks a code of the app and records its period.
+func (m *MFA) verifyCode(box *seal.Box, code string, now time.Time) error {
+	if len(m.Secret) == 0 {
+		return ErrMFACodeInvalid
+	}
+	secret, err := box.Open(m.Secret)
+	if err != nil {
+		return errors.Wrap(err, "opening secret")
+	}
+	step, ok := totp.Verify(secret, code, now, m.LastStep)
+	if !ok {
+		return ErrMFACodeInvalid
+	}
+	m.LastStep = step
+	return nil
+}
+
+// hashRecoveryCode hashes a recovery code. Codes are compared without case
+// and separators, so they can be typed as they are read.
+func hashRecoveryCode(code string) []byte {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	return hashSecret([]byte(code))
+}
+
+// MFAChallengeTTL is how long a user has to enter their code after they
+// authenticated with their password, or to enroll a second factor.
+const MFAChallengeTTL = 5 * time.Minute
+
+// MFAChallenge is handed out instead of tokens when a user with a second
+// factor authenticates with their password. It is exchanged for tokens
+// together with a code, and can only be used once. Only a hash of the secret
+// is stored. Users who must enroll a second factor first enroll it with the
+// challenge, which holds the sealed secret of the app until the code
+// confirms it. Their stored second factor is only changed then.
+type MFAChallenge struct {
+	ID          string     `db:"challenge_id" json:"id"`
+	UserID      string     `db:"user_id" json:"user_id"`
+	Hash        []byte     `db:"challenge_hash" json:"-"`
+	Secret      []byte     `db:"mfa_secret" json:"-"`
+	DateCreated time.Time  `db:"date_created" json:"date_created"`
+	ExpiresAt   time.Time  `db:"expires_at" json:"expires_at"`
+	UsedAt      *time.Time `db:"used_at" json:"used_at,omitempty"`
+}
+
+// NewMFAChallenge creates a challenge for the user. It returns the stored
+// challenge and the token to hand to the client.
+func NewMFAChallenge(userID string, now time.Time) (MFAChallenge, string, error) {
+	now = now.UTC().Truncate(time.Microsecond)
+	c := MFAChallenge{
+		ID:          uuid.New().String(),
+		UserID:      userID,
+		DateCreated: now,
+		ExpiresAt:   now.Add(MFAChallengeTTL),
+	}
+
+	tkn, hash, err := newSecret(c.ID)
+	if err != nil {
+		return MFAChallenge{}, "", errors.Wrap(err, "generating challenge")
+	}
+	c.Hash = hash
+
+	return c, tkn, nil
+}
+
+// Valid reports whether the challenge can be used at now for the secret with
+// the given hash.
+func (c *MFAChallenge) Valid(hash []byte, now time.Time) bool {
+	if subtle.ConstantTimeCompare(c.Hash, hash) != 1 {
+		return false
+	}
+	return c.UsedAt == nil && now.Before(c.ExpiresAt)
+}
+
+// ParseMFAChallenge splits a challenge token into the ID of the stored
+// challenge and the hash of its secret. It returns ErrMFAChallengeInvalid if
+// the token is malformed.
+func ParseMFAChallenge(tkn string) (string, []byte, error) {
+	id, hash, ok := parseSecret(tkn)
+	if !ok {
+		return "", nil, ErrMFAChallengeInvalid
+	}
+	return id, hash, nil
+}
+
+// challengeRecord is the layout challenges are stored in. Unlike the API it
+// includes the hash and the secret being enrolled.
+type challengeRecord struct {
+	MFAChallenge
+	Hash   []byte `json:"hash"`
+	Secret []byte `json:"secret,omitempty"`
+}
+
+// challengeCodec encodes the challenges stored in Bolt.
+var challengeCodec = envelope.Codec{Version: 1}
+
+// Encode encodes the challenge into a slice of bytes stored in Bolt.
+func (c *MFAChallenge) Encode() ([]byte, error) {
+	return challengeCodec.Encode(challengeRecord{MFAChallenge: *c, Hash: c.Hash, Secret: c.Secret})
+}
+
+// DecodeMFAChallenge creates an MFAChallenge from a slice of bytes stored in
+// Bolt.
+func DecodeMFAChallenge(b []byte) (*MFAChallenge, error) {
+	var r challengeRecord
+	if err := challengeCodec.Decode(b, &r); err != nil {
+		return nil, err
+	}
+	c := r.MFAChallenge
+	c.Hash = r.Hash
+	c.Secret = r.Secret
+	return &c, nil
+}
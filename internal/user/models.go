@@ -7,6 +7,11 @@ import (
 	"encoding/gob"
 
 	"github.com/lib/pq"
+	"github.com/os-foundry/vetpms/internal/platform/auth"
+	"github.com/os-foundry/vetpms/internal/platform/envelope"
+	"github.com/os-foundry/vetpms/internal/platform/query"
+	"github.com/os-foundry/vetpms/internal/platform/web"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // User represents someone with access to our system.
@@ -18,26 +23,120 @@ type User struct {
 	PasswordHash []byte         `db:"password_hash" json:"-"`
 	DateCreated  time.Time      `db:"date_created" json:"date_created"`
 	DateUpdated  time.Time      `db:"date_updated" json:"date_updated"`
+	DeletedAt    *time.Time     `db:"deleted_at" json:"deleted_at,omitempty"`
+	DeletedBy    *string        `db:"deleted_by" json:"deleted_by,omitempty"`
+	MFA
 }
 
-// Encode gob encodes all user data into a slice of bytes.
-func (u *User) Encode() ([]byte, error) {
-	var buf bytes.Buffer
-	if err := gob.NewEncoder(&buf).Encode(u); err != nil {
-		return nil, err
+// QueryFields are the fields users can be sorted and filtered by when they are
+// listed.
+var QueryFields = query.Fields{
+	"id":           query.String,
+	"name":         query.String,
+	"email":        query.String,
+	"date_created": query.Time,
+	"date_updated": query.Time,
+}
+
+// Value returns the value of one of the QueryFields of the user.
+func (u *User) Value(field string) interface{} {
+	switch field {
+	case "id":
+		return u.ID
+	case "name":
+		return u.Name
+	case "email":
+		return u.Email
+	case "date_created":
+		return u.DateCreated
+	case "date_updated":
+		return u.DateUpdated
+	}
+	return nil
+}
+
+// ServiceAccount reports whether the user is a service account. Service
+// accounts only authenticate with API keys, never with a password, an
+// identity provider or a refresh token.
+func (u *User) ServiceAccount() bool {
+	for _, r := range u.Roles {
+		if r == auth.RoleService {
+			return true
+		}
+	}
+	return false
+}
+
+// ETag returns the entity tag of the current version of the user. It is a
+// hash of the stored record, including the password hash and the second
+// factor, so every change of the user changes it. Times are hashed at the
+// microsecond precision of the databases.
+func (u *User) ETag() string {
+	r := newRecord(*u)
+	r.DateCreated = r.DateCreated.UTC().Truncate(time.Microsecond)
+	r.DateUpdated = r.DateUpdated.UTC().Truncate(time.Microsecond)
+	if r.DeletedAt != nil {
+		t := r.DeletedAt.UTC().Truncate(time.Microsecond)
+		r.DeletedAt = &t
 	}
-	return buf.Bytes(), nil
+	return web.NewETag(r)
+}
+
+// record is the layout users are stored in. Unlike the API it includes the
+// password hash and the second factor.
+type record struct {
+	User
+	PasswordHash     []byte   `json:"password_hash"`
+	MFASecret        []byte   `json:"mfa_secret,omitempty"`
+	MFALastStep      int64    `json:"mfa_last_step,omitempty"`
+	MFARecoveryCodes [][]byte `json:"mfa_recovery_codes,omitempty"`
+}
+
+// newRecord returns the record the user is stored as.
+func newRecord(u User) record {
+	return record{
+		User:             u,
+		PasswordHash:     u.PasswordHash,
+		MFASecret:        u.MFA.Secret,
+		MFALastStep:      u.MFA.LastStep,
+		MFARecoveryCodes: u.MFA.RecoveryCodes,
+	}
+}
+
+// codec encodes the users stored in Bolt. Version 1 is the first version
+// stored in an envelope, older users were gob encoded.
+var codec = envelope.Codec{
+	Version: 1,
+	Legacy: func(b []byte) (interface{}, error) {
+		var u User
+		if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&u); err != nil {
+			return nil, err
+		}
+		return newRecord(u), nil
+	},
 }
 
-// Decode gob decodes a slice of bytes into the user.
+// Encode encodes all user data into a slice of bytes stored in Bolt.
+func (u *User) Encode() ([]byte, error) {
+	return codec.Encode(newRecord(*u))
+}
+
+// Decode decodes a slice of bytes stored in Bolt into the user. Records of
+// older versions are upgraded.
 func (u *User) Decode(b []byte) error {
-	if err := gob.NewDecoder(bytes.NewBuffer(b)).Decode(&u); err != nil {
+	var r record
+	if err := codec.Decode(b, &r); err != nil {
 		return err
 	}
+	*u = r.User
+	u.PasswordHash = r.PasswordHash
+	u.MFA.Secret = r.MFASecret
+	u.MFA.LastStep = r.MFALastStep
+	u.MFA.RecoveryCodes = r.MFARecoveryCodes
 	return nil
 }
 
-// Decode creates a new User from a gob encoded byte slice.
+// Decode creates a new User from a slice of bytes stored in Bolt.
 func Decode(b []byte) (*User, error) {
 	var u User
 	if err := u.Decode(b); err != nil {
@@ -51,7 +150,7 @@ type NewUser struct {
 	Name            string   `json:"name" validate:"required"`
 	Email           string   `json:"email" validate:"required"`
 	Roles           []string `json:"roles" validate:"required"`
-	Password        string   `json:"password" validate:"required"`
+	Password        string   `json:"password" validate:"required,password"`
 	PasswordConfirm string   `json:"password_confirm" validate:"eqfield=Password"`
 }
 
@@ -65,8 +164,57 @@ type UpdateUser struct {
 	Name            *string  `json:"name"`
 	Email           *string  `json:"email"`
 	Roles           []string `json:"roles"`
-	Password        *string  `json:"password"`
+	Password        *string  `json:"password" validate:"omitempty,password"`
 	PasswordConfirm *string  `json:"password_confirm" validate:"omitempty,eqfield=Password"`
+
+	// ETags make the update conditional. If not nil, the update fails with
+	// ErrModified unless the stored user has one of these entity tags.
+	ETags []string `json:"-"`
+}
+
+// Matches reports whether the update applies to the version of the user with
+// the entity tag.
+func (upd UpdateUser) Matches(etag string) bool {
+	if upd.ETags == nil {
+		return true
+	}
+	for _, t := range upd.ETags {
+		if t == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// ChangePassword contains the information needed for users to change their
+// own password.
+type ChangePassword struct {
+	CurrentPassword string `json:"current_password" validate:"required"`
+	Password        string `json:"password" validate:"required,password"`
+	PasswordConfirm string `json:"password_confirm" validate:"eqfield=Password"`
+}
+
+// RequestReset contains the information needed to send a password reset
+// token.
+type RequestReset struct {
+	Email string `json:"email" validate:"required"`
+}
+
+// ResetPassword contains the information needed to choose a new password with
+// a reset token.
+type ResetPassword struct {
+	Token           string `json:"token" validate:"required"`
+	Password        string `json:"password" validate:"required,password"`
+	PasswordConfirm string `json:"password_confirm" validate:"eqfield=Password"`
+}
+
+// CheckPassword returns ErrAuthenticationFailure unless the password is the
+// password of the user.
+func (u *User) CheckPassword(password string) error {
+	if err := bcrypt.CompareHashAndPassword(u.PasswordHash, []byte(password)); err != nil {
+		return ErrAuthenticationFailure
+	}
+	return nil
 }
 
 func init() {
@@ -0,0 +1,86 @@
+package user
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/os-foundry/vetpms/internal/platform/web"
+	"github.com/pkg/errors"
+	validator "gopkg.in/go-playground/validator.v9"
+)
+
+// PasswordPolicy are the requirements new passwords must meet. The zero
+// value accepts any password.
+type PasswordPolicy struct {
+
+	// MinLength is the minimum number of characters.
+	MinLength int
+
+	// Denylist holds passwords that must not be used, like those known from
+	// breaches, in lower case.
+	Denylist map[string]struct{}
+}
+
+// Allows reports whether the password meets the requirements.
+func (p PasswordPolicy) Allows(password string) bool {
+	if utf8.RuneCountInString(password) < p.MinLength {
+		return false
+	}
+	_, denied := p.Denylist[strings.ToLower(password)]
+	return !denied
+}
+
+// LoadDenylist reads a file with one denied password per line, like the
+// lists of breached passwords that are published.
+func LoadDenylist(path string) (map[string]struct{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening password denylist")
+	}
+	defer f.Close()
+
+	list := make(map[string]struct{})
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if pw := strings.TrimSpace(s.Text()); pw != "" {
+			list[strings.ToLower(pw)] = struct{}{}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading password denylist")
+	}
+
+	return list, nil
+}
+
+var (
+	policyMu sync.RWMutex
+	policy   PasswordPolicy
+)
+
+// SetPasswordPolicy sets the policy new passwords are validated against. It
+// is meant to be called once at startup.
+func SetPasswordPolicy(p PasswordPolicy) {
+	policyMu.Lock()
+	defer policyMu.Unlock()
+	policy = p
+}
+
+// Passwords are validated with the password tag, which checks them against
+// the policy.
+func init() {
+	fn := func(fl validator.FieldLevel) bool {
+		policyMu.RLock()
+		defer policyMu.RUnlock()
+		return policy.Allows(fl.Field().String())
+	}
+	if err := web.RegisterValidation("password", fn, "{0} is too short or too common", web.Translations{
+		"nl": "{0} is te kort of te gebruikelijk",
+		"bg": "{0} е твърде кратка или твърде често срещана",
+	}); err != nil {
+		panic(err)
+	}
+}
@@ -3,11 +3,15 @@ package postgres
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	"github.com/os-foundry/vetpms/internal/platform/auth"
+	"github.com/os-foundry/vetpms/internal/platform/database"
+	"github.com/os-foundry/vetpms/internal/platform/query"
 	"github.com/os-foundry/vetpms/internal/user"
 	"github.com/pkg/errors"
 	"go.opencensus.io/trace"
@@ -16,25 +20,61 @@ import (
 
 const usersCollection = "users"
 
+// uniqueViolation is the error code postgres returns when a unique constraint
+// is violated.
+const uniqueViolation = "23505"
+
 // Postgres implements the Storage interface for
 // the postgres database
 type Postgres struct {
 	DB *sqlx.DB
 }
 
-// List retrieves a list of existing users from the database.
-func (st Postgres) List(ctx context.Context) ([]user.User, error) {
+// columns maps the user query fields to their columns.
+var columns = map[string]string{
+	"id":           "user_id",
+	"name":         "name",
+	"email":        "email",
+	"date_created": "date_created",
+	"date_updated": "date_updated",
+}
+
+// deleted returns the condition selecting either the live or the soft deleted
+// users.
+func deleted(opts query.Options) string {
+	if opts.Deleted {
+		return "deleted_at IS NOT NULL"
+	}
+	return "deleted_at IS NULL"
+}
+
+// List retrieves a page of existing users from the database.
+func (st Postgres) List(ctx context.Context, opts query.Options) ([]user.User, query.Page, error) {
 	ctx, span := trace.StartSpan(ctx, "internal.user.postgres.List")
 	defer span.End()
 
+	opts = opts.Normalize()
+
+	where, args, err := database.Where(opts, user.QueryFields, columns, deleted(opts))
+	if err != nil {
+		return nil, query.Page{}, err
+	}
+
 	users := []user.User{}
-	const q = `SELECT * FROM users`
+	q := `SELECT * FROM users` + where + database.OrderBy(opts, columns)
 
-	if err := st.DB.SelectContext(ctx, &users, q); err != nil {
-		return nil, errors.Wrap(err, "selecting users")
+	if err := sqlx.SelectContext(ctx, database.PqDB(ctx, st.DB), &users, q, args...); err != nil {
+		return nil, query.Page{}, errors.Wrap(err, "selecting users")
 	}
 
-	return users, nil
+	var page query.Page
+	if len(users) > opts.Limit {
+		users = users[:opts.Limit]
+		last := users[len(users)-1]
+		page.NextCursor = query.NewCursor(opts, last.Value(opts.Sort), last.ID)
+	}
+
+	return users, page, nil
 }
 
 // Retrieve gets the specified user from the database.
@@ -52,8 +92,8 @@ func (st Postgres) Retrieve(ctx context.Context, claims auth.Claims, id string)
 	}
 
 	var u user.User
-	const q = `SELECT * FROM users WHERE user_id = $1`
-	if err := st.DB.GetContext(ctx, &u, q, id); err != nil {
+	const q = `SELECT * FROM users WHERE user_id = $1 AND deleted_at IS NULL`
+	if err := sqlx.GetContext(ctx, database.PqDB(ctx, st.DB), &u, q, id); err != nil {
 		if err == sql.ErrNoRows {
 			return nil, user.ErrNotFound
 		}
@@ -64,11 +104,16 @@ func (st Postgres) Retrieve(ctx context.Context, claims auth.Claims, id string)
 	return &u, nil
 }
 
-// Create inserts a new user into the database.
+// Create inserts a new user into the database. It returns ErrEmailInUse if
+// another user has the email address.
 func (st Postgres) Create(ctx context.Context, n user.NewUser, now time.Time) (*user.User, error) {
 	ctx, span := trace.StartSpan(ctx, "internal.user.postgres.Create")
 	defer span.End()
 
+	// Timestamps are stored with microsecond precision so entity tags derived
+	// from them stay stable.
+	now = now.UTC().Truncate(time.Microsecond)
+
 	hash, err := bcrypt.GenerateFromPassword([]byte(n.Password), bcrypt.DefaultCost)
 	if err != nil {
 		return nil, errors.Wrap(err, "generating password hash")
@@ -87,79 +132,230 @@ func (st Postgres) Create(ctx context.Context, n user.NewUser, now time.Time) (*
 	const q = `INSERT INTO users
 		(user_id, name, email, password_hash, roles, date_created, date_updated)
 		VALUES ($1, $2, $3, $4, $5, $6, $7)`
-	_, err = st.DB.ExecContext(
+	_, err = database.PqDB(ctx, st.DB).ExecContext(
 		ctx, q,
 		u.ID, u.Name, u.Email,
 		u.PasswordHash, u.Roles,
 		u.DateCreated, u.DateUpdated,
 	)
 	if err != nil {
+		if err, ok := err.(*pq.Error); ok && err.Code == uniqueViolation {
+			return nil, user.ErrEmailInUse
+		}
 		return nil, errors.Wrap(err, "inserting user")
 	}
 
 	return &u, nil
 }
 
-// Update replaces a user document in the database.
+// Update replaces a user document in the database. The user is locked while
+// it is read and written. If the update has an entity tag that the user no
+// longer has it returns ErrModified, and it returns ErrEmailInUse if another
+// user has the new email address.
 func (st Postgres) Update(ctx context.Context, claims auth.Claims, id string, upd user.UpdateUser, now time.Time) error {
 	ctx, span := trace.StartSpan(ctx, "internal.user.postgres.Update")
 	defer span.End()
 
-	u, err := st.Retrieve(ctx, claims, id)
-	if err != nil {
-		return err
+	if _, err := uuid.Parse(id); err != nil {
+		return user.ErrInvalidID
 	}
 
-	if upd.Name != nil {
-		u.Name = *upd.Name
-	}
-	if upd.Email != nil {
-		u.Email = *upd.Email
-	}
-	if upd.Roles != nil {
-		u.Roles = upd.Roles
-	}
-	if upd.Password != nil {
-		pw, err := bcrypt.GenerateFromPassword([]byte(*upd.Password), bcrypt.DefaultCost)
+	return database.PqUnitOfWork(st.DB)(ctx, func(ctx context.Context) error {
+
+		// Lock the user so it can't change between comparing its entity tag
+		// and writing it.
+		const ql = `SELECT 1 FROM users WHERE user_id = $1 FOR UPDATE`
+		if _, err := database.PqDB(ctx, st.DB).ExecContext(ctx, ql, id); err != nil {
+			return errors.Wrap(err, "locking user")
+		}
+
+		u, err := st.Retrieve(ctx, claims, id)
 		if err != nil {
-			return errors.Wrap(err, "generating password hash")
+			return err
+		}
+
+		if !upd.Matches(u.ETag()) {
+			return user.ErrModified
+		}
+
+		if upd.Name != nil {
+			u.Name = *upd.Name
 		}
-		u.PasswordHash = pw
+		if upd.Email != nil {
+			u.Email = *upd.Email
+		}
+		if upd.Roles != nil {
+			u.Roles = upd.Roles
+		}
+		if upd.Password != nil {
+			pw, err := bcrypt.GenerateFromPassword([]byte(*upd.Password), bcrypt.DefaultCost)
+			if err != nil {
+				return errors.Wrap(err, "generating password hash")
+			}
+			u.PasswordHash = pw
+		}
+
+		u.DateUpdated = now.UTC().Truncate(time.Microsecond)
+
+		const q = `UPDATE users SET
+			"name" = $2,
+			"email" = $3,
+			"roles" = $4,
+			"password_hash" = $5,
+			"date_updated" = $6
+			WHERE user_id = $1`
+		if _, err := database.PqDB(ctx, st.DB).ExecContext(ctx, q, id,
+			u.Name, u.Email, u.Roles,
+			u.PasswordHash, u.DateUpdated,
+		); err != nil {
+			if err, ok := err.(*pq.Error); ok && err.Code == uniqueViolation {
+				return user.ErrEmailInUse
+			}
+			return errors.Wrap(err, "updating user")
+		}
+
+		return nil
+	})
+}
+
+// Delete marks a user as deleted. The user can no longer authenticate and is
+// hidden until they are restored or purged.
+func (st Postgres) Delete(ctx context.Context, claims auth.Claims, id string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.postgres.Delete")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return user.ErrInvalidID
 	}
 
-	u.DateUpdated = now
+	const q = `UPDATE users SET
+		"deleted_at" = $2,
+		"deleted_by" = $3
+		WHERE user_id = $1 AND deleted_at IS NULL`
+
+	return database.PqUnitOfWork(st.DB)(ctx, func(ctx context.Context) error {
+		if _, err := database.PqDB(ctx, st.DB).ExecContext(ctx, q, id, now.UTC().Truncate(time.Microsecond), claims.Subject); err != nil {
+			return errors.Wrapf(err, "deleting user %s", id)
+		}
+		return st.RevokeRefreshTokens(ctx, id, now)
+	})
+}
+
+// Restore undoes the deletion of a user. It returns ErrNotFound if there is no
+// deleted user with the ID, and ErrEmailInUse if their email address was
+// taken by another user in the meantime.
+func (st Postgres) Restore(ctx context.Context, id string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.postgres.Restore")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return user.ErrInvalidID
+	}
 
 	const q = `UPDATE users SET
-		"name" = $2,
-		"email" = $3,
-		"roles" = $4,
-		"password_hash" = $5,
-		"date_updated" = $6
-		WHERE user_id = $1`
-	_, err = st.DB.ExecContext(ctx, q, id,
-		u.Name, u.Email, u.Roles,
-		u.PasswordHash, u.DateUpdated,
-	)
+		"deleted_at" = NULL,
+		"deleted_by" = NULL,
+		"date_updated" = $2
+		WHERE user_id = $1 AND deleted_at IS NOT NULL`
+
+	res, err := database.PqDB(ctx, st.DB).ExecContext(ctx, q, id, now.UTC().Truncate(time.Microsecond))
 	if err != nil {
-		return errors.Wrap(err, "updating user")
+		if err, ok := err.(*pq.Error); ok && err.Code == uniqueViolation {
+			return user.ErrEmailInUse
+		}
+		return errors.Wrapf(err, "restoring user %s", id)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrapf(err, "restoring user %s", id)
+	}
+	if n == 0 {
+		return user.ErrNotFound
 	}
 
 	return nil
 }
 
-// Delete removes a user from the database.
-func (st Postgres) Delete(ctx context.Context, id string) error {
-	ctx, span := trace.StartSpan(ctx, "internal.user.postgres.Delete")
+// Purge permanently removes the users deleted before the given time together
+// with their tokens. Refresh tokens that expired or were revoked before the
+// time, reset tokens, MFA challenges and API keys that expired before it, and
+// failed login attempts that are no longer locked, are removed as well. It
+// returns the number of users removed.
+func (st Postgres) Purge(ctx context.Context, before time.Time) (int, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.postgres.Purge")
 	defer span.End()
 
-	if _, err := uuid.Parse(id); err != nil {
-		return user.ErrInvalidID
+	const qt = `DELETE FROM refresh_tokens WHERE expires_at < $1 OR revoked_at < $1`
+	const qr = `DELETE FROM reset_tokens WHERE expires_at < $1`
+	const qc = `DELETE FROM mfa_challenges WHERE expires_at < $1`
+	const ql = `DELETE FROM login_attempts WHERE last_failure < $1 AND locked_until <= $1`
+	const qk = `DELETE FROM api_keys WHERE expires_at < $1`
+	const q = `DELETE FROM users WHERE deleted_at < $1`
+
+	// The tokens of purged users are removed by the database.
+	if _, err := database.PqDB(ctx, st.DB).ExecContext(ctx, qt, before.UTC()); err != nil {
+		return 0, errors.Wrap(err, "purging refresh tokens")
+	}
+	if _, err := database.PqDB(ctx, st.DB).ExecContext(ctx, qr, before.UTC()); err != nil {
+		return 0, errors.Wrap(err, "purging reset tokens")
+	}
+	if _, err := database.PqDB(ctx, st.DB).ExecContext(ctx, qc, before.UTC()); err != nil {
+		return 0, errors.Wrap(err, "purging mfa challenges")
+	}
+	if _, err := database.PqDB(ctx, st.DB).ExecContext(ctx, ql, before.UTC()); err != nil {
+		return 0, errors.Wrap(err, "purging login attempts")
+	}
+	if _, err := database.PqDB(ctx, st.DB).ExecContext(ctx, qk, before.UTC()); err != nil {
+		return 0, errors.Wrap(err, "purging api keys")
 	}
 
-	const q = `DELETE FROM users WHERE user_id = $1`
+	res, err := database.PqDB(ctx, st.DB).ExecContext(ctx, q, before.UTC())
+	if err != nil {
+		return 0, errors.Wrap(err, "purging users")
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "purging users")
+	}
 
-	if _, err := st.DB.ExecContext(ctx, q, id); err != nil {
-		return errors.Wrapf(err, "deleting user %s", id)
+	return int(n), nil
+}
+
+// Put stores a user exactly as given, replacing the user with the same ID if
+// there is one. It is meant for restoring and converting data and bypasses
+// all checks.
+func (st Postgres) Put(ctx context.Context, u user.User) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.postgres.Put")
+	defer span.End()
+
+	const q = `INSERT INTO users
+		(user_id, name, email, roles, password_hash, date_created, date_updated, deleted_at, deleted_by,
+		mfa_enabled, mfa_secret, mfa_last_step, mfa_recovery_codes)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		ON CONFLICT (user_id) DO UPDATE SET
+		"name" = EXCLUDED.name,
+		"email" = EXCLUDED.email,
+		"roles" = EXCLUDED.roles,
+		"password_hash" = EXCLUDED.password_hash,
+		"date_created" = EXCLUDED.date_created,
+		"date_updated" = EXCLUDED.date_updated,
+		"deleted_at" = EXCLUDED.deleted_at,
+		"deleted_by" = EXCLUDED.deleted_by,
+		"mfa_enabled" = EXCLUDED.mfa_enabled,
+		"mfa_secret" = EXCLUDED.mfa_secret,
+		"mfa_last_step" = EXCLUDED.mfa_last_step,
+		"mfa_recovery_codes" = EXCLUDED.mfa_recovery_codes`
+
+	_, err := database.PqDB(ctx, st.DB).ExecContext(ctx, q,
+		u.ID, u.Name, u.Email, u.Roles, u.PasswordHash,
+		u.DateCreated, u.DateUpdated,
+		u.DeletedAt, u.DeletedBy,
+		u.MFA.Enabled, u.MFA.Secret, u.MFA.LastStep, u.MFA.RecoveryCodes,
+	)
+	if err != nil {
+		return errors.Wrapf(err, "putting user %s", u.ID)
 	}
 
 	return nil
@@ -167,20 +363,21 @@ func (st Postgres) Delete(ctx context.Context, id string) error {
 
 // Authenticate finds a user by their email and verifies their password. On
 // success it returns a Claims value representing this user. The claims can be
-// used to generate a token for future authentication.
+// used to generate a token for future authentication. Service accounts
+// can't authenticate with a password.
 func (st Postgres) Authenticate(ctx context.Context, now time.Time, email, password string) (auth.Claims, error) {
 	ctx, span := trace.StartSpan(ctx, "internal.user.postgres.Authenticate")
 	defer span.End()
 
-	const q = `SELECT * FROM users WHERE email = $1`
+	const q = `SELECT * FROM users WHERE email = $1 AND deleted_at IS NULL`
 
 	var u user.User
-	if err := st.DB.GetContext(ctx, &u, q, email); err != nil {
+	if err := sqlx.GetContext(ctx, database.PqDB(ctx, st.DB), &u, q, email); err != nil {
 
 		// Normally we would return ErrNotFound in this scenario but we do not want
 		// to leak to an unauthenticated user which emails are in the system.
 		if err == sql.ErrNoRows {
-			return auth.Claims{}, user.ErrAuthenticationFailure
+			return auth.Claims{}, user.CheckNoPassword(password)
 		}
 
 		return auth.Claims{}, errors.Wrap(err, "selecting single user")
@@ -191,13 +388,334 @@ func (st Postgres) Authenticate(ctx context.Context, now time.Time, email, passw
 	if err := bcrypt.CompareHashAndPassword(u.PasswordHash, []byte(password)); err != nil {
 		return auth.Claims{}, user.ErrAuthenticationFailure
 	}
+	if u.ServiceAccount() {
+		return auth.Claims{}, user.ErrAuthenticationFailure
+	}
 
 	// If we are this far the request is valid. Create some claims for the user
 	// and generate their token.
-	claims := auth.NewClaims(u.ID, u.Roles, now, time.Hour)
+	claims := auth.NewClaims(u.ID, u.Roles, now, user.AccessTokenTTL)
 	return claims, nil
 }
 
+// CreateRefreshToken stores a new refresh token.
+func (st Postgres) CreateRefreshToken(ctx context.Context, t user.RefreshToken) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.postgres.CreateRefreshToken")
+	defer span.End()
+
+	const q = `INSERT INTO refresh_tokens
+		(token_id, user_id, token_hash, device_name, ip, user_agent, date_created, date_used, last_seen, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+
+	if _, err := database.PqDB(ctx, st.DB).ExecContext(
+		ctx, q,
+		t.ID, t.UserID, t.Hash, t.DeviceName, t.IP, t.UserAgent,
+		t.DateCreated.UTC(), t.DateUsed.UTC(), t.LastSeen.UTC(), t.ExpiresAt.UTC(),
+	); err != nil {
+		return errors.Wrap(err, "inserting refresh token")
+	}
+
+	return nil
+}
+
+// Refresh exchanges a refresh token for claims of its user and a new refresh
+// token replacing it. A token that doesn't match the stored one was already
+// replaced, which means it leaked, so its session is revoked. All failures
+// return ErrAuthenticationFailure.
+func (st Postgres) Refresh(ctx context.Context, now time.Time, tkn string) (auth.Claims, string, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.postgres.Refresh")
+	defer span.End()
+
+	id, hash, err := user.ParseRefreshToken(tkn)
+	if err != nil {
+		return auth.Claims{}, "", err
+	}
+
+	const (
+		qt = `SELECT * FROM refresh_tokens WHERE token_id = $1 FOR UPDATE`
+		qu = `SELECT * FROM users WHERE user_id = $1 AND deleted_at IS NULL`
+		qr = `UPDATE refresh_tokens SET revoked_at = $2 WHERE token_id = $1`
+		qn = `UPDATE refresh_tokens SET
+			"token_hash" = $2,
+			"date_used" = $3,
+			"last_seen" = $3,
+			"expires_at" = $4
+			WHERE token_id = $1`
+	)
+
+	// The revocation of a leaked session must be committed, so failures are
+	// reported after the transaction.
+	var (
+		claims auth.Claims
+		next   string
+		failed bool
+	)
+	if err := database.PqUnitOfWork(st.DB)(ctx, func(ctx context.Context) error {
+		db := database.PqDB(ctx, st.DB)
+
+		var t user.RefreshToken
+		if err := sqlx.GetContext(ctx, db, &t, qt, id); err != nil {
+			if err == sql.ErrNoRows {
+				failed = true
+				return nil
+			}
+			return errors.Wrap(err, "selecting refresh token")
+		}
+		if !t.Valid(hash, now) {
+			failed = true
+			if t.RevokedAt != nil {
+				return nil
+			}
+			if _, err := db.ExecContext(ctx, qr, id, now.UTC().Truncate(time.Microsecond)); err != nil {
+				return errors.Wrap(err, "revoking refresh token")
+			}
+			return nil
+		}
+
+		var u user.User
+		if err := sqlx.GetContext(ctx, db, &u, qu, t.UserID); err != nil {
+			if err == sql.ErrNoRows {
+				failed = true
+				return nil
+			}
+			return errors.Wrap(err, "selecting single user")
+		}
+		if u.ServiceAccount() {
+			failed = true
+			return nil
+		}
+
+		var err error
+		if next, err = t.Rotate(now); err != nil {
+			return err
+		}
+		if _, err := db.ExecContext(ctx, qn, id, t.Hash, t.DateUsed, t.ExpiresAt); err != nil {
+			return errors.Wrap(err, "updating refresh token")
+		}
+
+		claims = auth.NewClaims(u.ID, u.Roles, now, user.AccessTokenTTL)
+		claims.SessionID = t.ID
+		return nil
+	}); err != nil {
+		return auth.Claims{}, "", errors.Wrap(err, "refreshing token")
+	}
+
+	if failed {
+		return auth.Claims{}, "", user.ErrAuthenticationFailure
+	}
+
+	return claims, next, nil
+}
+
+// RevokeRefreshTokens revokes all refresh tokens of a user, which ends all of
+// their sessions.
+func (st Postgres) RevokeRefreshTokens(ctx context.Context, userID string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.postgres.RevokeRefreshTokens")
+	defer span.End()
+
+	if _, err := uuid.Parse(userID); err != nil {
+		return user.ErrInvalidID
+	}
+
+	const q = `UPDATE refresh_tokens SET revoked_at = $2 WHERE user_id = $1 AND revoked_at IS NULL`
+
+	if _, err := database.PqDB(ctx, st.DB).ExecContext(ctx, q, userID, now.UTC().Truncate(time.Microsecond)); err != nil {
+		return errors.Wrapf(err, "revoking refresh tokens of user %s", userID)
+	}
+
+	return nil
+}
+
+// sessionColumns maps the session query fields to their columns.
+var sessionColumns = map[string]string{
+	"id":           "token_id",
+	"user_id":      "user_id",
+	"device_name":  "device_name",
+	"ip":           "ip",
+	"date_created": "date_created",
+	"last_seen":    "last_seen",
+}
+
+// ListSessions retrieves a page of the active sessions of all users. Filter
+// on user_id for the sessions of a user.
+func (st Postgres) ListSessions(ctx context.Context, opts query.Options, now time.Time) ([]user.RefreshToken, query.Page, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.postgres.ListSessions")
+	defer span.End()
+
+	opts = opts.Normalize()
+
+	where, args, err := database.Where(opts, user.SessionQueryFields, sessionColumns, "revoked_at IS NULL")
+	if err != nil {
+		return nil, query.Page{}, err
+	}
+	args = append(args, now.UTC())
+	where += fmt.Sprintf(" AND expires_at > $%d", len(args))
+
+	sessions := []user.RefreshToken{}
+	q := `SELECT * FROM refresh_tokens` + where + database.OrderBy(opts, sessionColumns)
+
+	if err := sqlx.SelectContext(ctx, database.PqDB(ctx, st.DB), &sessions, q, args...); err != nil {
+		return nil, query.Page{}, errors.Wrap(err, "selecting sessions")
+	}
+
+	var page query.Page
+	if len(sessions) > opts.Limit {
+		sessions = sessions[:opts.Limit]
+		last := sessions[len(sessions)-1]
+		page.NextCursor = query.NewCursor(opts, last.Value(opts.Sort), last.ID)
+	}
+
+	return sessions, page, nil
+}
+
+// RetrieveSession gets the specified session from the database. It returns
+// ErrSessionNotFound if the session was revoked or expired.
+func (st Postgres) RetrieveSession(ctx context.Context, id string, now time.Time) (*user.RefreshToken, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.postgres.RetrieveSession")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, user.ErrInvalidID
+	}
+
+	const q = `SELECT * FROM refresh_tokens WHERE token_id = $1`
+
+	var t user.RefreshToken
+	if err := sqlx.GetContext(ctx, database.PqDB(ctx, st.DB), &t, q, id); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, user.ErrSessionNotFound
+		}
+		return nil, errors.Wrapf(err, "selecting session %q", id)
+	}
+	if !t.Active(now) {
+		return nil, user.ErrSessionNotFound
+	}
+
+	return &t, nil
+}
+
+// RevokeSession revokes the refresh token of a session. Its access tokens
+// stop working immediately. It returns ErrSessionNotFound if the session
+// already ended.
+func (st Postgres) RevokeSession(ctx context.Context, id string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.postgres.RevokeSession")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return user.ErrInvalidID
+	}
+
+	const q = `UPDATE refresh_tokens SET revoked_at = $2
+		WHERE token_id = $1 AND revoked_at IS NULL AND expires_at > $2`
+
+	res, err := database.PqDB(ctx, st.DB).ExecContext(ctx, q, id, now.UTC().Truncate(time.Microsecond))
+	if err != nil {
+		return errors.Wrapf(err, "revoking session %s", id)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrapf(err, "revoking session %s", id)
+	}
+	if n == 0 {
+		return user.ErrSessionNotFound
+	}
+
+	return nil
+}
+
+// SeeSession reports whether the session with the ID is still active and
+// records that it was seen at now. Sessions that don't exist anymore are not
+// active.
+func (st Postgres) SeeSession(ctx context.Context, id string, now time.Time) (bool, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.postgres.SeeSession")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return false, nil
+	}
+
+	const (
+		qt = `SELECT * FROM refresh_tokens WHERE token_id = $1`
+		ql = `UPDATE refresh_tokens SET last_seen = $2 WHERE token_id = $1 AND last_seen < $2`
+	)
+
+	db := database.PqDB(ctx, st.DB)
+
+	var t user.RefreshToken
+	if err := sqlx.GetContext(ctx, db, &t, qt, id); err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, errors.Wrapf(err, "selecting refresh token %s", id)
+	}
+	if !t.Active(now) {
+		return false, nil
+	}
+
+	// Most requests are read only, so the use is recorded only once in a
+	// while.
+	if t.Seen(now) {
+		if _, err := db.ExecContext(ctx, ql, id, t.LastSeen); err != nil {
+			return false, errors.Wrap(err, "recording use of session")
+		}
+	}
+
+	return true, nil
+}
+
+// RetrieveIdentity gets the link of an account at an identity provider. It
+// returns ErrIdentityNotFound if the account isn't linked to a user.
+func (st Postgres) RetrieveIdentity(ctx context.Context, issuer, subject string) (*user.Identity, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.postgres.RetrieveIdentity")
+	defer span.End()
+
+	var i user.Identity
+	const q = `SELECT * FROM identities WHERE issuer = $1 AND subject = $2`
+	if err := sqlx.GetContext(ctx, database.PqDB(ctx, st.DB), &i, q, issuer, subject); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, user.ErrIdentityNotFound
+		}
+		return nil, errors.Wrapf(err, "selecting identity %q of %q", subject, issuer)
+	}
+
+	return &i, nil
+}
+
+// LinkIdentity links an account at an identity provider to a user who isn't
+// deleted, replacing the user it was linked to before.
+func (st Postgres) LinkIdentity(ctx context.Context, issuer, subject, userID string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.postgres.LinkIdentity")
+	defer span.End()
+
+	if _, err := uuid.Parse(userID); err != nil {
+		return user.ErrInvalidID
+	}
+
+	const q = `INSERT INTO identities
+		(issuer, subject, user_id, date_created)
+		SELECT $1, $2, user_id, $4
+		FROM users WHERE user_id = $3 AND deleted_at IS NULL
+		ON CONFLICT (issuer, subject) DO UPDATE SET
+		"user_id" = EXCLUDED.user_id,
+		"date_created" = EXCLUDED.date_created`
+
+	res, err := database.PqDB(ctx, st.DB).ExecContext(ctx, q,
+		issuer, subject, userID, now.UTC().Truncate(time.Microsecond),
+	)
+	if err != nil {
+		return errors.Wrap(err, "inserting identity")
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "inserting identity")
+	}
+	if rows == 0 {
+		return user.ErrNotFound
+	}
+
+	return nil
+}
+
 // StatusCheck returns nil if it can successfully talk to the database. It
 // returns a non-nil error otherwise.
 func (st Postgres) StatusCheck(ctx context.Context) error {
@@ -212,3 +730,476 @@ func (st Postgres) StatusCheck(ctx context.Context) error {
 	var tmp bool
 	return st.DB.QueryRowContext(ctx, q).Scan(&tmp)
 }
+
+// CreateResetToken stores a new password reset token for the user with the
+// email address. It returns the user and the token to send them, or
+// ErrNotFound if there is no user with the address.
+func (st Postgres) CreateResetToken(ctx context.Context, email string, now time.Time) (*user.User, string, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.postgres.CreateResetToken")
+	defer span.End()
+
+	const (
+		qu = `SELECT * FROM users WHERE email = $1 AND deleted_at IS NULL`
+		qi = `INSERT INTO reset_tokens
+			(token_id, user_id, token_hash, date_created, expires_at)
+			VALUES ($1, $2, $3, $4, $5)`
+	)
+
+	var u user.User
+	if err := sqlx.GetContext(ctx, database.PqDB(ctx, st.DB), &u, qu, email); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, "", user.ErrNotFound
+		}
+		return nil, "", errors.Wrap(err, "selecting single user")
+	}
+
+	t, tkn, err := user.NewResetToken(u.ID, now)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if _, err := database.PqDB(ctx, st.DB).ExecContext(ctx, qi, t.ID, t.UserID, t.Hash, t.DateCreated, t.ExpiresAt); err != nil {
+		return nil, "", errors.Wrap(err, "inserting reset token")
+	}
+
+	return &u, tkn, nil
+}
+
+// UseResetToken marks a password reset token as used and returns the ID of
+// the user it was issued for. It returns ErrResetTokenInvalid if the token is
+// unknown, expired or was used before.
+func (st Postgres) UseResetToken(ctx context.Context, now time.Time, tkn string) (string, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.postgres.UseResetToken")
+	defer span.End()
+
+	id, hash, err := user.ParseResetToken(tkn)
+	if err != nil {
+		return "", err
+	}
+
+	const (
+		qt = `SELECT t.* FROM reset_tokens t JOIN users u ON u.user_id = t.user_id
+			WHERE t.token_id = $1 AND u.deleted_at IS NULL FOR UPDATE OF t`
+		qu = `UPDATE reset_tokens SET used_at = $2 WHERE token_id = $1`
+	)
+
+	var userID string
+	if err := database.PqUnitOfWork(st.DB)(ctx, func(ctx context.Context) error {
+		db := database.PqDB(ctx, st.DB)
+
+		var t user.ResetToken
+		if err := sqlx.GetContext(ctx, db, &t, qt, id); err != nil {
+			if err == sql.ErrNoRows {
+				return user.ErrResetTokenInvalid
+			}
+			return errors.Wrap(err, "selecting reset token")
+		}
+		if !t.Valid(hash, now) {
+			return user.ErrResetTokenInvalid
+		}
+
+		if _, err := db.ExecContext(ctx, qu, id, now.UTC().Truncate(time.Microsecond)); err != nil {
+			return errors.Wrap(err, "updating reset token")
+		}
+		userID = t.UserID
+		return nil
+	}); err != nil {
+		if err == user.ErrResetTokenInvalid {
+			return "", err
+		}
+		return "", errors.Wrap(err, "using reset token")
+	}
+
+	return userID, nil
+}
+
+// SetMFA replaces the second factor of a user. It doesn't change the version
+// of the user, since the MFA also changes whenever a code is used.
+func (st Postgres) SetMFA(ctx context.Context, id string, m user.MFA, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.postgres.SetMFA")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return user.ErrInvalidID
+	}
+
+	const q = `UPDATE users SET
+		"mfa_enabled" = $2,
+		"mfa_secret" = $3,
+		"mfa_last_step" = $4,
+		"mfa_recovery_codes" = $5
+		WHERE user_id = $1 AND deleted_at IS NULL`
+	res, err := database.PqDB(ctx, st.DB).ExecContext(ctx, q, id, m.Enabled, m.Secret, m.LastStep, m.RecoveryCodes)
+	if err != nil {
+		return errors.Wrapf(err, "updating mfa of user %q", id)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrapf(err, "updating mfa of user %q", id)
+	}
+	if n == 0 {
+		return user.ErrNotFound
+	}
+
+	return nil
+}
+
+// CreateMFAChallenge stores a new MFA challenge for the user and returns the
+// token to hand to the client.
+func (st Postgres) CreateMFAChallenge(ctx context.Context, userID string, now time.Time) (string, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.postgres.CreateMFAChallenge")
+	defer span.End()
+
+	c, tkn, err := user.NewMFAChallenge(userID, now)
+	if err != nil {
+		return "", err
+	}
+
+	const q = `INSERT INTO mfa_challenges
+		(challenge_id, user_id, challenge_hash, date_created, expires_at)
+		VALUES ($1, $2, $3, $4, $5)`
+	if _, err := database.PqDB(ctx, st.DB).ExecContext(ctx, q, c.ID, c.UserID, c.Hash, c.DateCreated, c.ExpiresAt); err != nil {
+		return "", errors.Wrap(err, "inserting mfa challenge")
+	}
+
+	return tkn, nil
+}
+
+// EnrollMFAChallenge stores the sealed secret of a second factor the user of
+// an MFA challenge enrolls, unless the challenge holds one already, and
+// returns the challenge. It returns ErrMFAChallengeInvalid if the challenge
+// is unknown, expired or was used before.
+func (st Postgres) EnrollMFAChallenge(ctx context.Context, now time.Time, tkn string, secret []byte) (*user.MFAChallenge, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.postgres.EnrollMFAChallenge")
+	defer span.End()
+
+	const q = `UPDATE mfa_challenges SET mfa_secret = $2 WHERE challenge_id = $1`
+
+	var c *user.MFAChallenge
+	if err := database.PqUnitOfWork(st.DB)(ctx, func(ctx context.Context) error {
+		db := database.PqDB(ctx, st.DB)
+
+		var err error
+		if c, err = validChallenge(ctx, db, now, tkn); err != nil {
+			return err
+		}
+		if len(c.Secret) > 0 {
+			return nil
+		}
+
+		if _, err := db.ExecContext(ctx, q, c.ID, secret); err != nil {
+			return errors.Wrap(err, "updating mfa challenge")
+		}
+		c.Secret = secret
+		return nil
+	}); err != nil {
+		if err == user.ErrMFAChallengeInvalid {
+			return nil, err
+		}
+		return nil, errors.Wrap(err, "enrolling with mfa challenge")
+	}
+
+	return c, nil
+}
+
+// UseMFAChallenge marks an MFA challenge as used and returns it. It returns
+// ErrMFAChallengeInvalid if the challenge is unknown, expired or was used
+// before.
+func (st Postgres) UseMFAChallenge(ctx context.Context, now time.Time, tkn string) (*user.MFAChallenge, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.postgres.UseMFAChallenge")
+	defer span.End()
+
+	const q = `UPDATE mfa_challenges SET used_at = $2 WHERE challenge_id = $1`
+
+	var c *user.MFAChallenge
+	if err := database.PqUnitOfWork(st.DB)(ctx, func(ctx context.Context) error {
+		db := database.PqDB(ctx, st.DB)
+
+		var err error
+		if c, err = validChallenge(ctx, db, now, tkn); err != nil {
+			return err
+		}
+
+		usedAt := now.UTC().Truncate(time.Microsecond)
+		if _, err := db.ExecContext(ctx, q, c.ID, usedAt); err != nil {
+			return errors.Wrap(err, "updating mfa challenge")
+		}
+		c.UsedAt = &usedAt
+		return nil
+	}); err != nil {
+		if err == user.ErrMFAChallengeInvalid {
+			return nil, err
+		}
+		return nil, errors.Wrap(err, "using mfa challenge")
+	}
+
+	return c, nil
+}
+
+// validChallenge locks the MFA challenge of the token and returns it if it
+// can be used at now. It returns ErrMFAChallengeInvalid otherwise.
+func validChallenge(ctx context.Context, db sqlx.ExtContext, now time.Time, tkn string) (*user.MFAChallenge, error) {
+	id, hash, err := user.ParseMFAChallenge(tkn)
+	if err != nil {
+		return nil, err
+	}
+
+	const q = `SELECT * FROM mfa_challenges WHERE challenge_id = $1 FOR UPDATE`
+
+	var c user.MFAChallenge
+	if err := sqlx.GetContext(ctx, db, &c, q, id); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, user.ErrMFAChallengeInvalid
+		}
+		return nil, errors.Wrap(err, "selecting mfa challenge")
+	}
+	if !c.Valid(hash, now) {
+		return nil, user.ErrMFAChallengeInvalid
+	}
+	return &c, nil
+}
+
+// LoginAttempts returns the failed login attempts with the key. Keys without
+// failures have none.
+func (st Postgres) LoginAttempts(ctx context.Context, key string) (*user.LoginAttempts, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.postgres.LoginAttempts")
+	defer span.End()
+
+	const q = `SELECT * FROM login_attempts WHERE attempt_key = $1`
+
+	a := user.LoginAttempts{Key: key}
+	if err := sqlx.GetContext(ctx, database.PqDB(ctx, st.DB), &a, q, key); err != nil && err != sql.ErrNoRows {
+		return nil, errors.Wrapf(err, "selecting login attempts %q", key)
+	}
+
+	return &a, nil
+}
+
+// FailLogin records a failed login attempt with the key and locks further
+// attempts according to the policy. It returns the updated attempts.
+func (st Postgres) FailLogin(ctx context.Context, key string, p user.LockoutPolicy, now time.Time) (*user.LoginAttempts, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.postgres.FailLogin")
+	defer span.End()
+
+	const (
+		qi = `INSERT INTO login_attempts (attempt_key, failures, last_failure, locked_until)
+			VALUES ($1, 0, 'epoch', 'epoch') ON CONFLICT DO NOTHING`
+		qs = `SELECT * FROM login_attempts WHERE attempt_key = $1 FOR UPDATE`
+		qu = `UPDATE login_attempts SET
+			"failures" = $2,
+			"last_failure" = $3,
+			"locked_until" = $4
+			WHERE attempt_key = $1`
+	)
+
+	var a user.LoginAttempts
+	if err := database.PqUnitOfWork(st.DB)(ctx, func(ctx context.Context) error {
+		db := database.PqDB(ctx, st.DB)
+
+		// The row is created first, so concurrent failures are counted one
+		// after the other.
+		if _, err := db.ExecContext(ctx, qi, key); err != nil {
+			return errors.Wrap(err, "inserting login attempts")
+		}
+		if err := sqlx.GetContext(ctx, db, &a, qs, key); err != nil {
+			return errors.Wrap(err, "selecting login attempts")
+		}
+
+		a.Fail(p, now)
+		if _, err := db.ExecContext(ctx, qu, key, a.Failures, a.LastFailure, a.LockedUntil); err != nil {
+			return errors.Wrap(err, "updating login attempts")
+		}
+		return nil
+	}); err != nil {
+		return nil, errors.Wrapf(err, "updating login attempts %q", key)
+	}
+
+	return &a, nil
+}
+
+// ResetLoginAttempts forgets the failed login attempts with the key, which
+// unlocks it.
+func (st Postgres) ResetLoginAttempts(ctx context.Context, key string) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.postgres.ResetLoginAttempts")
+	defer span.End()
+
+	const q = `DELETE FROM login_attempts WHERE attempt_key = $1`
+	if _, err := database.PqDB(ctx, st.DB).ExecContext(ctx, q, key); err != nil {
+		return errors.Wrapf(err, "deleting login attempts %q", key)
+	}
+
+	return nil
+}
+
+// CreateAPIKey creates an API key for a user who isn't deleted. It returns
+// the stored key and the key to hand to the client.
+func (st Postgres) CreateAPIKey(ctx context.Context, n user.NewAPIKey, now time.Time) (*user.APIKey, string, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.postgres.CreateAPIKey")
+	defer span.End()
+
+	if _, err := uuid.Parse(n.UserID); err != nil {
+		return nil, "", user.ErrInvalidID
+	}
+
+	k, key, err := n.NewKey(now)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// The key is only inserted for a user who isn't deleted.
+	const q = `INSERT INTO api_keys
+		(api_key_id, user_id, name, prefix, key_hash, scopes, date_created, expires_at, last_used)
+		SELECT $1, user_id, $3, $4, $5, $6, $7, $8, NULL
+		FROM users WHERE user_id = $2 AND deleted_at IS NULL`
+
+	res, err := database.PqDB(ctx, st.DB).ExecContext(ctx, q,
+		k.ID, k.UserID, k.Name, k.Prefix, k.Hash, k.Scopes, k.DateCreated, k.ExpiresAt,
+	)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "inserting api key")
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return nil, "", errors.Wrap(err, "inserting api key")
+	}
+	if rows == 0 {
+		return nil, "", user.ErrNotFound
+	}
+
+	return &k, key, nil
+}
+
+// apiKeyColumns maps the API key query fields to their columns.
+var apiKeyColumns = map[string]string{
+	"id":           "api_key_id",
+	"user_id":      "user_id",
+	"name":         "name",
+	"date_created": "date_created",
+}
+
+// ListAPIKeys retrieves a page of the API keys of all users. Filter on
+// user_id for the keys of a user.
+func (st Postgres) ListAPIKeys(ctx context.Context, opts query.Options) ([]user.APIKey, query.Page, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.postgres.ListAPIKeys")
+	defer span.End()
+
+	opts = opts.Normalize()
+
+	where, args, err := database.Where(opts, user.APIKeyQueryFields, apiKeyColumns)
+	if err != nil {
+		return nil, query.Page{}, err
+	}
+
+	keys := []user.APIKey{}
+	q := `SELECT * FROM api_keys` + where + database.OrderBy(opts, apiKeyColumns)
+
+	if err := sqlx.SelectContext(ctx, database.PqDB(ctx, st.DB), &keys, q, args...); err != nil {
+		return nil, query.Page{}, errors.Wrap(err, "selecting api keys")
+	}
+
+	var page query.Page
+	if len(keys) > opts.Limit {
+		keys = keys[:opts.Limit]
+		last := keys[len(keys)-1]
+		page.NextCursor = query.NewCursor(opts, last.Value(opts.Sort), last.ID)
+	}
+
+	return keys, page, nil
+}
+
+// RetrieveAPIKey gets the specified API key from the database.
+func (st Postgres) RetrieveAPIKey(ctx context.Context, id string) (*user.APIKey, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.postgres.RetrieveAPIKey")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, user.ErrInvalidID
+	}
+
+	var k user.APIKey
+	const q = `SELECT * FROM api_keys WHERE api_key_id = $1`
+	if err := sqlx.GetContext(ctx, database.PqDB(ctx, st.DB), &k, q, id); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, user.ErrAPIKeyNotFound
+		}
+		return nil, errors.Wrapf(err, "selecting api key %q", id)
+	}
+
+	return &k, nil
+}
+
+// DeleteAPIKey removes an API key, which can't be used from then on.
+func (st Postgres) DeleteAPIKey(ctx context.Context, id string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.postgres.DeleteAPIKey")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return user.ErrInvalidID
+	}
+
+	const q = `DELETE FROM api_keys WHERE api_key_id = $1`
+	res, err := database.PqDB(ctx, st.DB).ExecContext(ctx, q, id)
+	if err != nil {
+		return errors.Wrapf(err, "deleting api key %s", id)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrapf(err, "deleting api key %s", id)
+	}
+	if n == 0 {
+		return user.ErrAPIKeyNotFound
+	}
+
+	return nil
+}
+
+// AuthenticateAPIKey finds the API key and the user it acts as. It returns
+// claims for the user limited to the scopes of the key, and records when the
+// key was used. All failures return ErrAuthenticationFailure.
+func (st Postgres) AuthenticateAPIKey(ctx context.Context, now time.Time, key string) (auth.Claims, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.postgres.AuthenticateAPIKey")
+	defer span.End()
+
+	id, hash, err := user.ParseAPIKey(key)
+	if err != nil {
+		return auth.Claims{}, err
+	}
+
+	const (
+		qk = `SELECT * FROM api_keys WHERE api_key_id = $1`
+		qu = `SELECT * FROM users WHERE user_id = $1 AND deleted_at IS NULL`
+		ql = `UPDATE api_keys SET last_used = $2 WHERE api_key_id = $1`
+	)
+
+	db := database.PqDB(ctx, st.DB)
+
+	var k user.APIKey
+	if err := sqlx.GetContext(ctx, db, &k, qk, id); err != nil {
+		if err == sql.ErrNoRows {
+			return auth.Claims{}, user.ErrAuthenticationFailure
+		}
+		return auth.Claims{}, errors.Wrap(err, "selecting api key")
+	}
+	if !k.Valid(hash, now) {
+		return auth.Claims{}, user.ErrAuthenticationFailure
+	}
+
+	var u user.User
+	if err := sqlx.GetContext(ctx, db, &u, qu, k.UserID); err != nil {
+		if err == sql.ErrNoRows {
+			return auth.Claims{}, user.ErrAuthenticationFailure
+		}
+		return auth.Claims{}, errors.Wrap(err, "selecting single user")
+	}
+
+	// Most requests are read only, so the use is recorded only once in a
+	// while.
+	if k.Used(now) {
+		if _, err := db.ExecContext(ctx, ql, id, k.LastUsed); err != nil {
+			return auth.Claims{}, errors.Wrap(err, "recording use of api key")
+		}
+	}
+
+	return k.Claims(&u, now), nil
+}
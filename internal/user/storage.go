@@ -6,15 +6,45 @@ import (
 
 	"github.com/os-foundry/vetpms/internal/platform/auth"
 	"github.com/os-foundry/vetpms/internal/platform/database"
+	"github.com/os-foundry/vetpms/internal/platform/query"
 )
 
-// Storage is an entity providing access to the user database
+// Storage is an entity providing access to the user database. Deleted users
+// are kept, and hidden from everything but restore, until they are purged.
+// Deleting a user revokes their refresh tokens. The API keys of deleted users
+// can't be used until the user is restored.
 type Storage interface {
 	database.StatusChecker
-	List(ctx context.Context) ([]User, error)
+	List(ctx context.Context, opts query.Options) ([]User, query.Page, error)
 	Retrieve(ctx context.Context, claims auth.Claims, id string) (*User, error)
 	Create(ctx context.Context, n NewUser, now time.Time) (*User, error)
 	Update(ctx context.Context, claims auth.Claims, id string, upd UpdateUser, now time.Time) error
-	Delete(ctx context.Context, id string) error
+	Delete(ctx context.Context, claims auth.Claims, id string, now time.Time) error
+	Restore(ctx context.Context, id string, now time.Time) error
+	Purge(ctx context.Context, before time.Time) (int, error)
+	Put(ctx context.Context, u User) error
 	Authenticate(ctx context.Context, now time.Time, email, password string) (auth.Claims, error)
+	CreateRefreshToken(ctx context.Context, t RefreshToken) error
+	Refresh(ctx context.Context, now time.Time, tkn string) (auth.Claims, string, error)
+	RevokeRefreshTokens(ctx context.Context, userID string, now time.Time) error
+	ListSessions(ctx context.Context, opts query.Options, now time.Time) ([]RefreshToken, query.Page, error)
+	RetrieveSession(ctx context.Context, id string, now time.Time) (*RefreshToken, error)
+	RevokeSession(ctx context.Context, id string, now time.Time) error
+	SeeSession(ctx context.Context, id string, now time.Time) (bool, error)
+	CreateResetToken(ctx context.Context, email string, now time.Time) (*User, string, error)
+	UseResetToken(ctx context.Context, now time.Time, tkn string) (string, error)
+	SetMFA(ctx context.Context, id string, m MFA, now time.Time) error
+	CreateMFAChallenge(ctx context.Context, userID string, now time.Time) (string, error)
+	EnrollMFAChallenge(ctx context.Context, now time.Time, tkn string, secret []byte) (*MFAChallenge, error)
+	UseMFAChallenge(ctx context.Context, now time.Time, tkn string) (*MFAChallenge, error)
+	LoginAttempts(ctx context.Context, key string) (*LoginAttempts, error)
+	FailLogin(ctx context.Context, key string, p LockoutPolicy, now time.Time) (*LoginAttempts, error)
+	ResetLoginAttempts(ctx context.Context, key string) error
+	CreateAPIKey(ctx context.Context, n NewAPIKey, now time.Time) (*APIKey, string, error)
+	ListAPIKeys(ctx context.Context, opts query.Options) ([]APIKey, query.Page, error)
+	RetrieveAPIKey(ctx context.Context, id string) (*APIKey, error)
+	DeleteAPIKey(ctx context.Context, id string, now time.Time) error
+	AuthenticateAPIKey(ctx context.Context, now time.Time, key string) (auth.Claims, error)
+	RetrieveIdentity(ctx context.Context, issuer, subject string) (*Identity, error)
+	LinkIdentity(ctx context.Context, issuer, subject, userID string, now time.Time) error
 }
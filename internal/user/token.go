@@ -0,0 +1,335 @@
+package user
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/os-foundry/vetpms/internal/platform/envelope"
+	"github.com/os-foundry/vetpms/internal/platform/query"
+	"github.com/pkg/errors"
+)
+
+// AccessTokenTTL is how long the claims issued by Authenticate and Refresh
+// are valid.
+const AccessTokenTTL = time.Hour
+
+// RefreshTokenTTL is how long a refresh token can be used. Every use replaces
+// the token with a new one, so a session lasts as long as it is used at least
+// this often.
+const RefreshTokenTTL = 30 * 24 * time.Hour
+
+// SessionSeenInterval is how often the last use of a session is recorded.
+// Sessions are used on every request, so they aren't written every time.
+const SessionSeenInterval = time.Minute
+
+// RefreshToken lets a client obtain new access tokens without the password of
+// the user. Every token starts a session, access tokens issued with it carry
+// its ID and stop working when it is revoked. The session remembers the
+// device it was started on. Only a hash of the secret handed to the client is
+// stored.
+type RefreshToken struct {
+	ID          string     `db:"token_id" json:"id"`
+	UserID      string     `db:"user_id" json:"user_id"`
+	Hash        []byte     `db:"token_hash" json:"-"`
+	DeviceName  string     `db:"device_name" json:"device_name"`
+	IP          string     `db:"ip" json:"ip"`
+	UserAgent   string     `db:"user_agent" json:"user_agent"`
+	DateCreated time.Time  `db:"date_created" json:"date_created"`
+	DateUsed    time.Time  `db:"date_used" json:"date_used"`
+	LastSeen    time.Time  `db:"last_seen" json:"last_seen"`
+	ExpiresAt   time.Time  `db:"expires_at" json:"expires_at"`
+	RevokedAt   *time.Time `db:"revoked_at" json:"revoked_at,omitempty"`
+}
+
+// SessionQueryFields are the fields sessions can be sorted and filtered by
+// when they are listed.
+var SessionQueryFields = query.Fields{
+	"id":           query.String,
+	"user_id":      query.String,
+	"device_name":  query.String,
+	"ip":           query.String,
+	"date_created": query.Time,
+	"last_seen":    query.Time,
+}
+
+// Value returns the value of one of the SessionQueryFields of the session.
+func (t *RefreshToken) Value(field string) interface{} {
+	switch field {
+	case "id":
+		return t.ID
+	case "user_id":
+		return t.UserID
+	case "device_name":
+		return t.DeviceName
+	case "ip":
+		return t.IP
+	case "date_created":
+		return t.DateCreated
+	case "last_seen":
+		return t.LastSeen
+	}
+	return nil
+}
+
+// Device describes the client a session is started on. The name is chosen
+// by the client, such as "Reception PC", the rest is taken from the request.
+type Device struct {
+	Name      string
+	IP        string
+	UserAgent string
+}
+
+// These limit the length of what clients tell about their device.
+const (
+	maxDeviceName = 100
+	maxUserAgent  = 512
+)
+
+// NewDevice describes a device, cutting what the client sent to a sensible
+// length.
+func NewDevice(name, ip, userAgent string) Device {
+	return Device{
+		Name:      truncate(strings.TrimSpace(name), maxDeviceName),
+		IP:        ip,
+		UserAgent: truncate(userAgent, maxUserAgent),
+	}
+}
+
+// truncate cuts s to at most n bytes without splitting a character.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// NewRefreshToken starts a session for the user on the device. It returns the
+// stored token and the token to hand to the client, which is the only copy of
+// the secret.
+func NewRefreshToken(userID string, d Device, now time.Time) (RefreshToken, string, error) {
+	now = now.UTC().Truncate(time.Microsecond)
+	t := RefreshToken{
+		ID:          uuid.New().String(),
+		UserID:      userID,
+		DeviceName:  d.Name,
+		IP:          d.IP,
+		UserAgent:   d.UserAgent,
+		DateCreated: now,
+	}
+	tkn, err := t.Rotate(now)
+	if err != nil {
+		return RefreshToken{}, "", err
+	}
+	return t, tkn, nil
+}
+
+// Rotate replaces the secret of the token and extends its expiry. It returns
+// the token to hand to the client.
+func (t *RefreshToken) Rotate(now time.Time) (string, error) {
+	tkn, hash, err := newSecret(t.ID)
+	if err != nil {
+		return "", errors.Wrap(err, "generating refresh token")
+	}
+
+	now = now.UTC().Truncate(time.Microsecond)
+	t.Hash = hash
+	t.DateUsed = now
+	t.LastSeen = now
+	t.ExpiresAt = now.Add(RefreshTokenTTL)
+
+	return tkn, nil
+}
+
+// Active reports whether the session of the token is neither revoked nor
+// expired at now.
+func (t *RefreshToken) Active(now time.Time) bool {
+	return t.RevokedAt == nil && now.Before(t.ExpiresAt)
+}
+
+// Seen records a use of the session at now. It reports whether the use must
+// be stored, which it must at most every SessionSeenInterval.
+func (t *RefreshToken) Seen(now time.Time) bool {
+	if now.Sub(t.LastSeen) < SessionSeenInterval {
+		return false
+	}
+	t.LastSeen = now.UTC().Truncate(time.Microsecond)
+	return true
+}
+
+// Valid reports whether the token can be exchanged at now for the secret with
+// the given hash.
+func (t *RefreshToken) Valid(hash []byte, now time.Time) bool {
+	if subtle.ConstantTimeCompare(t.Hash, hash) != 1 {
+		return false
+	}
+	return t.Active(now)
+}
+
+// ParseRefreshToken splits a token handed to a client into the ID of the
+// stored token and the hash of its secret. It returns
+// ErrAuthenticationFailure if the token is malformed.
+func ParseRefreshToken(tkn string) (string, []byte, error) {
+	id, hash, ok := parseSecret(tkn)
+	if !ok {
+		return "", nil, ErrAuthenticationFailure
+	}
+	return id, hash, nil
+}
+
+// ResetTokenTTL is how long a password reset token can be used.
+const ResetTokenTTL = time.Hour
+
+// ResetToken lets a user who forgot their password choose a new one. It is
+// sent to their email address and can be used once. Only a hash of the secret
+// is stored.
+type ResetToken struct {
+	ID          string     `db:"token_id" json:"id"`
+	UserID      string     `db:"user_id" json:"user_id"`
+	Hash        []byte     `db:"token_hash" json:"-"`
+	DateCreated time.Time  `db:"date_created" json:"date_created"`
+	ExpiresAt   time.Time  `db:"expires_at" json:"expires_at"`
+	UsedAt      *time.Time `db:"used_at" json:"used_at,omitempty"`
+}
+
+// NewResetToken creates a password reset token for the user. It returns the
+// stored token and the token to send to the user.
+func NewResetToken(userID string, now time.Time) (ResetToken, string, error) {
+	now = now.UTC().Truncate(time.Microsecond)
+	t := ResetToken{
+		ID:          uuid.New().String(),
+		UserID:      userID,
+		DateCreated: now,
+		ExpiresAt:   now.Add(ResetTokenTTL),
+	}
+
+	tkn, hash, err := newSecret(t.ID)
+	if err != nil {
+		return ResetToken{}, "", errors.Wrap(err, "generating reset token")
+	}
+	t.Hash = hash
+
+	return t, tkn, nil
+}
+
+// Valid reports whether the token can be used at now for the secret with the
+// given hash.
+func (t *ResetToken) Valid(hash []byte, now time.Time) bool {
+	if subtle.ConstantTimeCompare(t.Hash, hash) != 1 {
+		return false
+	}
+	return t.UsedAt == nil && now.Before(t.ExpiresAt)
+}
+
+// ParseResetToken splits a token sent to a user into the ID of the stored
+// token and the hash of its secret. It returns ErrResetTokenInvalid if the
+// token is malformed.
+func ParseResetToken(tkn string) (string, []byte, error) {
+	id, hash, ok := parseSecret(tkn)
+	if !ok {
+		return "", nil, ErrResetTokenInvalid
+	}
+	return id, hash, nil
+}
+
+// newSecret generates a secret for the stored token with the ID. It returns
+// the token handed out, which joins the ID and the secret, and the hash of
+// the secret to store.
+func newSecret(id string) (string, []byte, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+	return id + "." + base64.RawURLEncoding.EncodeToString(secret), hashSecret(secret), nil
+}
+
+// parseSecret splits a token made by newSecret into the ID and the hash of the
+// secret.
+func parseSecret(tkn string) (string, []byte, bool) {
+	parts := strings.Split(tkn, ".")
+	if len(parts) != 2 {
+		return "", nil, false
+	}
+	if _, err := uuid.Parse(parts[0]); err != nil {
+		return "", nil, false
+	}
+	secret, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", nil, false
+	}
+	return parts[0], hashSecret(secret), true
+}
+
+// hashSecret hashes the secret of a token. Secrets are random, so unlike
+// passwords they don't need a slow hash.
+func hashSecret(secret []byte) []byte {
+	h := sha256.Sum256(secret)
+	return h[:]
+}
+
+// tokenRecord is the layout refresh tokens are stored in. Unlike the API it
+// includes the hash.
+type tokenRecord struct {
+	RefreshToken
+	Hash []byte `json:"hash"`
+}
+
+// tokenCodec encodes the refresh tokens stored in Bolt.
+var tokenCodec = envelope.Codec{Version: 1}
+
+// Encode encodes the refresh token into a slice of bytes stored in Bolt.
+func (t *RefreshToken) Encode() ([]byte, error) {
+	return tokenCodec.Encode(tokenRecord{RefreshToken: *t, Hash: t.Hash})
+}
+
+// DecodeRefreshToken creates a RefreshToken from a slice of bytes stored in
+// Bolt.
+func DecodeRefreshToken(b []byte) (*RefreshToken, error) {
+	var r tokenRecord
+	if err := tokenCodec.Decode(b, &r); err != nil {
+		return nil, err
+	}
+	t := r.RefreshToken
+	t.Hash = r.Hash
+
+	// Tokens stored before sessions were tracked were last seen when they
+	// were last used.
+	if t.LastSeen.IsZero() {
+		t.LastSeen = t.DateUsed
+	}
+	return &t, nil
+}
+
+// resetRecord is the layout reset tokens are stored in. Unlike the API it
+// includes the hash.
+type resetRecord struct {
+	ResetToken
+	Hash []byte `json:"hash"`
+}
+
+// resetCodec encodes the reset tokens stored in Bolt.
+var resetCodec = envelope.Codec{Version: 1}
+
+// Encode encodes the reset token into a slice of bytes stored in Bolt.
+func (t *ResetToken) Encode() ([]byte, error) {
+	return resetCodec.Encode(resetRecord{ResetToken: *t, Hash: t.Hash})
+}
+
+// DecodeResetToken creates a ResetToken from a slice of bytes stored in Bolt.
+func DecodeResetToken(b []byte) (*ResetToken, error) {
+	var r resetRecord
+	if err := resetCodec.Decode(b, &r); err != nil {
+		return nil, err
+	}
+	t := r.ResetToken
+	t.Hash = r.Hash
+	return &t, nil
+}
@@ -5,7 +5,12 @@ import (
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/uuid"
 	"github.com/os-foundry/vetpms/internal/platform/auth"
+	"github.com/os-foundry/vetpms/internal/platform/query"
+	"github.com/os-foundry/vetpms/internal/platform/seal"
+	"github.com/os-foundry/vetpms/internal/platform/totp"
+	"github.com/os-foundry/vetpms/internal/platform/web"
 	"github.com/os-foundry/vetpms/internal/tests"
 	"github.com/os-foundry/vetpms/internal/user"
 	"github.com/pkg/errors"
@@ -89,7 +94,7 @@ func TestUser(t *testing.T) {
 					t.Logf("\t%s\tShould be able to see updates to Email.", tests.Success)
 				}
 
-				if err := st.Delete(ctx, u.ID); err != nil {
+				if err := st.Delete(ctx, claims, u.ID, now); err != nil {
 					t.Fatalf("\t%s\tShould be able to delete user : %s.", tests.Failed, err)
 				}
 				t.Logf("\t%s\tShould be able to delete user.", tests.Success)
@@ -99,6 +104,32 @@ func TestUser(t *testing.T) {
 					t.Fatalf("\t%s\tShould NOT be able to retrieve user : %s.", tests.Failed, err)
 				}
 				t.Logf("\t%s\tShould NOT be able to retrieve user.", tests.Success)
+
+				if err := st.Restore(ctx, u.ID, now); err != nil {
+					t.Fatalf("\t%s\tShould be able to restore user : %s.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould be able to restore user.", tests.Success)
+
+				if _, err := st.Retrieve(ctx, claims, u.ID); err != nil {
+					t.Fatalf("\t%s\tShould be able to retrieve restored user : %s.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould be able to retrieve restored user.", tests.Success)
+
+				if err := st.Delete(ctx, claims, u.ID, now); err != nil {
+					t.Fatalf("\t%s\tShould be able to delete user : %s.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould be able to delete user.", tests.Success)
+
+				n, err := st.Purge(ctx, now.Add(time.Hour))
+				if err != nil || n != 1 {
+					t.Fatalf("\t%s\tShould be able to purge the deleted user : %d, %v.", tests.Failed, n, err)
+				}
+				t.Logf("\t%s\tShould be able to purge the deleted user.", tests.Success)
+
+				if err := st.Restore(ctx, u.ID, now); errors.Cause(err) != user.ErrNotFound {
+					t.Fatalf("\t%s\tShould NOT be able to restore purged user : %v.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould NOT be able to restore purged user.", tests.Success)
 			}
 		}
 	}
@@ -149,6 +180,900 @@ func TestAuthenticate(t *testing.T) {
 					t.Fatalf("\t%s\tShould get back the expected claims. Diff:\n%s", tests.Failed, diff)
 				}
 				t.Logf("\t%s\tShould get back the expected claims.", tests.Success)
+
+				upd := user.UpdateUser{Email: tests.StringPointer("jane@example.com")}
+				if err := st.Update(ctx, claims, u.ID, upd, now); err != nil {
+					t.Fatalf("\t%s\tShould be able to change the email address : %s.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould be able to change the email address.", tests.Success)
+
+				if _, err := st.Authenticate(ctx, now, "jane@example.com", "goroutines"); err != nil {
+					t.Fatalf("\t%s\tShould be able to authenticate with the new email address : %s.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould be able to authenticate with the new email address.", tests.Success)
+
+				if _, err := st.Authenticate(ctx, now, "anna@example.com", "goroutines"); errors.Cause(err) != user.ErrAuthenticationFailure {
+					t.Fatalf("\t%s\tShould NOT be able to authenticate with the old email address : %v.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould NOT be able to authenticate with the old email address.", tests.Success)
+
+				nu.Name = "John Doe"
+				nu.Email = "jane@example.com"
+				if _, err := st.Create(ctx, nu, now); errors.Cause(err) != user.ErrEmailInUse {
+					t.Fatalf("\t%s\tShould NOT be able to create a user with an email address in use : %v.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould NOT be able to create a user with an email address in use.", tests.Success)
+
+				upd = user.UpdateUser{Roles: []string{auth.RoleService, auth.RoleUser}}
+				if err := st.Update(ctx, claims, u.ID, upd, now); err != nil {
+					t.Fatalf("\t%s\tShould be able to make the user a service account : %s.", tests.Failed, err)
+				}
+				if _, err := st.Authenticate(ctx, now, "jane@example.com", "goroutines"); errors.Cause(err) != user.ErrAuthenticationFailure {
+					t.Fatalf("\t%s\tShould NOT be able to authenticate a service account with a password : %v.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould NOT be able to authenticate a service account with a password.", tests.Success)
+			}
+		}
+	}
+}
+
+// TestRefreshTokens validates refresh tokens are rotated on use and can be
+// revoked.
+func TestRefreshTokens(t *testing.T) {
+	tt := []string{"postgres", "bolt"}
+	for _, tc := range tt {
+		st, teardown := tests.NewUserStorageUnit(t, tc)
+		defer teardown()
+
+		t.Logf("Given the need to keep users signed in on %s.", tc)
+		{
+			ctx := tests.Context()
+			now := time.Date(2018, time.October, 1, 0, 0, 0, 0, time.UTC)
+
+			nu := user.NewUser{
+				Name:            "Anna Walker",
+				Email:           "anna@example.com",
+				Roles:           []string{auth.RoleAdmin},
+				Password:        "goroutines",
+				PasswordConfirm: "goroutines",
+			}
+
+			u, err := st.Create(ctx, nu, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create user : %s.", tests.Failed, err)
+			}
+
+			// session starts a new session of the user.
+			session := func() (user.RefreshToken, string) {
+				t.Helper()
+				rt, tkn, err := user.NewRefreshToken(u.ID, user.Device{}, now)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to generate a refresh token : %s.", tests.Failed, err)
+				}
+				if err := st.CreateRefreshToken(ctx, rt); err != nil {
+					t.Fatalf("\t%s\tShould be able to store a refresh token : %s.", tests.Failed, err)
+				}
+				return rt, tkn
+			}
+
+			// revoked reports whether the session was revoked.
+			revoked := func(id string) bool {
+				t.Helper()
+				ok, err := st.SeeSession(ctx, id, now)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to check the session : %s.", tests.Failed, err)
+				}
+				return !ok
+			}
+
+			t.Log("\tWhen refreshing a token.")
+			{
+				rt, tkn := session()
+
+				now = now.Add(time.Hour)
+				claims, next, err := st.Refresh(ctx, now, tkn)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to refresh the token : %s.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould be able to refresh the token.", tests.Success)
+
+				if claims.Subject != u.ID || claims.SessionID != rt.ID || claims.ExpiresAt != now.Add(user.AccessTokenTTL).Unix() {
+					t.Fatalf("\t%s\tShould get claims of the session : %+v.", tests.Failed, claims)
+				}
+				t.Logf("\t%s\tShould get claims of the session.", tests.Success)
+
+				if next == tkn || revoked(rt.ID) {
+					t.Fatalf("\t%s\tShould replace the token.", tests.Failed)
+				}
+				t.Logf("\t%s\tShould replace the token.", tests.Success)
+
+				if _, _, err := st.Refresh(ctx, now, tkn); err != user.ErrAuthenticationFailure {
+					t.Fatalf("\t%s\tShould not be able to reuse the token : %v.", tests.Failed, err)
+				}
+				if _, _, err := st.Refresh(ctx, now, next); err != user.ErrAuthenticationFailure || !revoked(rt.ID) {
+					t.Fatalf("\t%s\tShould revoke the session when a token is reused : %v.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould revoke the session when a token is reused.", tests.Success)
+			}
+
+			t.Log("\tWhen a token expired.")
+			{
+				_, tkn := session()
+				if _, _, err := st.Refresh(ctx, now.Add(user.RefreshTokenTTL), tkn); err != user.ErrAuthenticationFailure {
+					t.Fatalf("\t%s\tShould not be able to refresh the token : %v.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould not be able to refresh the token.", tests.Success)
+			}
+
+			t.Log("\tWhen revoking the sessions of a user.")
+			{
+				a, _ := session()
+				b, tkn := session()
+				if err := st.RevokeRefreshTokens(ctx, u.ID, now); err != nil {
+					t.Fatalf("\t%s\tShould be able to revoke the sessions : %s.", tests.Failed, err)
+				}
+				if !revoked(a.ID) || !revoked(b.ID) {
+					t.Fatalf("\t%s\tShould revoke all sessions.", tests.Failed)
+				}
+				if _, _, err := st.Refresh(ctx, now, tkn); err != user.ErrAuthenticationFailure {
+					t.Fatalf("\t%s\tShould not be able to refresh a revoked token : %v.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould revoke all sessions.", tests.Success)
+			}
+
+			t.Log("\tWhen the user becomes a service account.")
+			{
+				_, tkn := session()
+				claims := auth.NewClaims(u.ID, []string{auth.RoleAdmin}, now, time.Hour)
+				if err := st.Update(ctx, claims, u.ID, user.UpdateUser{Roles: []string{auth.RoleService, auth.RoleAdmin}}, now); err != nil {
+					t.Fatalf("\t%s\tShould be able to make the user a service account : %s.", tests.Failed, err)
+				}
+				if _, _, err := st.Refresh(ctx, now, tkn); err != user.ErrAuthenticationFailure {
+					t.Fatalf("\t%s\tShould not be able to refresh the token : %v.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould not be able to refresh the token.", tests.Success)
+			}
+
+			t.Log("\tWhen deleting a user.")
+			{
+				rt, _ := session()
+				claims := auth.NewClaims(u.ID, []string{auth.RoleAdmin}, now, time.Hour)
+				if err := st.Delete(ctx, claims, u.ID, now); err != nil {
+					t.Fatalf("\t%s\tShould be able to delete the user : %s.", tests.Failed, err)
+				}
+				if !revoked(rt.ID) {
+					t.Fatalf("\t%s\tShould revoke their sessions.", tests.Failed)
+				}
+				t.Logf("\t%s\tShould revoke their sessions.", tests.Success)
+
+				if _, err := st.Purge(ctx, now.Add(time.Second)); err != nil {
+					t.Fatalf("\t%s\tShould be able to purge the user with their sessions : %s.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould be able to purge the user with their sessions.", tests.Success)
+			}
+		}
+	}
+}
+
+// TestSessions validates the sessions of users can be listed with their
+// devices and ended one by one.
+func TestSessions(t *testing.T) {
+	tt := []string{"postgres", "bolt"}
+	for _, tc := range tt {
+		st, teardown := tests.NewUserStorageUnit(t, tc)
+		defer teardown()
+
+		t.Logf("Given the need to manage the devices users are signed in on with %s.", tc)
+		{
+			ctx := tests.Context()
+			now := time.Date(2018, time.October, 1, 0, 0, 0, 0, time.UTC)
+
+			var users []*user.User
+			for _, email := range []string{"anna@example.com", "ben@example.com"} {
+				u, err := st.Create(ctx, user.NewUser{
+					Name:            "Staff",
+					Email:           email,
+					Roles:           []string{auth.RoleUser},
+					Password:        "goroutines",
+					PasswordConfirm: "goroutines",
+				}, now)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to create user : %s.", tests.Failed, err)
+				}
+				users = append(users, u)
+			}
+
+			// start starts a session of the user on the device a second after
+			// the one before.
+			started := now
+			start := func(u *user.User, d user.Device) user.RefreshToken {
+				t.Helper()
+				started = started.Add(time.Second)
+				rt, _, err := user.NewRefreshToken(u.ID, d, started)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to generate a refresh token : %s.", tests.Failed, err)
+				}
+				if err := st.CreateRefreshToken(ctx, rt); err != nil {
+					t.Fatalf("\t%s\tShould be able to store a refresh token : %s.", tests.Failed, err)
+				}
+				return rt
+			}
+
+			// sessions returns the options listing the sessions of a user, or
+			// of all users, in the order they were started.
+			sessions := func(userID string) query.Options {
+				opts := query.Options{Sort: "date_created"}
+				if userID != "" {
+					opts.Filters = []query.Filter{{Field: "user_id", Value: userID}}
+				}
+				return opts
+			}
+
+			desk := start(users[0], user.NewDevice(" Reception PC ", "192.0.2.1", "Mozilla/5.0"))
+			phone := start(users[0], user.NewDevice("Phone", "192.0.2.2", "vetpms-ios/1.0"))
+			other := start(users[1], user.Device{})
+
+			t.Log("\tWhen listing sessions.")
+			{
+				own, _, err := st.ListSessions(ctx, sessions(users[0].ID), now)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to list the sessions of a user : %s.", tests.Failed, err)
+				}
+				if len(own) != 2 || own[0].ID != desk.ID || own[1].ID != phone.ID {
+					t.Fatalf("\t%s\tShould get the sessions of the user : %+v.", tests.Failed, own)
+				}
+				t.Logf("\t%s\tShould get the sessions of the user.", tests.Success)
+
+				got := own[0]
+				if got.DeviceName != "Reception PC" || got.IP != "192.0.2.1" || got.UserAgent != "Mozilla/5.0" || !got.LastSeen.Equal(desk.DateCreated) {
+					t.Fatalf("\t%s\tShould get the device of a session : %+v.", tests.Failed, got)
+				}
+				t.Logf("\t%s\tShould get the device of a session.", tests.Success)
+
+				all, _, err := st.ListSessions(ctx, sessions(""), now)
+				if err != nil || len(all) != 3 {
+					t.Fatalf("\t%s\tShould get the sessions of all users : %d, %v.", tests.Failed, len(all), err)
+				}
+				t.Logf("\t%s\tShould get the sessions of all users.", tests.Success)
+
+				opts := sessions("")
+				opts.Limit = 2
+				first, page, err := st.ListSessions(ctx, opts, now)
+				if err != nil || len(first) != 2 || page.NextCursor == "" {
+					t.Fatalf("\t%s\tShould get a page of the sessions : %d, %q, %v.", tests.Failed, len(first), page.NextCursor, err)
+				}
+				opts.Cursor = page.NextCursor
+				rest, page, err := st.ListSessions(ctx, opts, now)
+				if err != nil || len(rest) != 1 || rest[0].ID != other.ID || page.NextCursor != "" {
+					t.Fatalf("\t%s\tShould get the next page of the sessions : %+v, %q, %v.", tests.Failed, rest, page.NextCursor, err)
+				}
+				t.Logf("\t%s\tShould get the sessions page by page.", tests.Success)
+
+				if expired, _, err := st.ListSessions(ctx, sessions(users[0].ID), started.Add(user.RefreshTokenTTL)); err != nil || len(expired) != 0 {
+					t.Fatalf("\t%s\tShould not list expired sessions : %d, %v.", tests.Failed, len(expired), err)
+				}
+				t.Logf("\t%s\tShould not list expired sessions.", tests.Success)
+			}
+
+			t.Log("\tWhen a session is used.")
+			{
+				// seen returns when the session was last seen.
+				seen := func(id string) time.Time {
+					t.Helper()
+					rt, err := st.RetrieveSession(ctx, id, now)
+					if err != nil {
+						t.Fatalf("\t%s\tShould be able to retrieve the session : %s.", tests.Failed, err)
+					}
+					return rt.LastSeen
+				}
+
+				later := phone.LastSeen.Add(user.SessionSeenInterval / 2)
+				if ok, err := st.SeeSession(ctx, phone.ID, later); err != nil || !ok {
+					t.Fatalf("\t%s\tShould accept an active session : %v.", tests.Failed, err)
+				}
+				if !seen(phone.ID).Equal(phone.LastSeen) {
+					t.Fatalf("\t%s\tShould not record every use : %s.", tests.Failed, seen(phone.ID))
+				}
+				t.Logf("\t%s\tShould not record every use.", tests.Success)
+
+				later = phone.LastSeen.Add(user.SessionSeenInterval)
+				if ok, err := st.SeeSession(ctx, phone.ID, later); err != nil || !ok {
+					t.Fatalf("\t%s\tShould accept an active session : %v.", tests.Failed, err)
+				}
+				if !seen(phone.ID).Equal(later) {
+					t.Fatalf("\t%s\tShould record when it was last seen : %s.", tests.Failed, seen(phone.ID))
+				}
+				t.Logf("\t%s\tShould record when it was last seen.", tests.Success)
+
+				if ok, err := st.SeeSession(ctx, uuid.New().String(), now); err != nil || ok {
+					t.Fatalf("\t%s\tShould not accept unknown sessions : %v.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould not accept unknown sessions.", tests.Success)
+			}
+
+			t.Log("\tWhen revoking a session.")
+			{
+				if err := st.RevokeSession(ctx, phone.ID, now); err != nil {
+					t.Fatalf("\t%s\tShould be able to revoke the session : %s.", tests.Failed, err)
+				}
+				if ok, err := st.SeeSession(ctx, phone.ID, now); err != nil || ok {
+					t.Fatalf("\t%s\tShould end the session at once : %v.", tests.Failed, err)
+				}
+				if ok, err := st.SeeSession(ctx, desk.ID, now); err != nil || !ok {
+					t.Fatalf("\t%s\tShould keep the other sessions : %v.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould end only that session at once.", tests.Success)
+
+				if _, err := st.RetrieveSession(ctx, phone.ID, now); err != user.ErrSessionNotFound {
+					t.Fatalf("\t%s\tShould not find the ended session : %v.", tests.Failed, err)
+				}
+				if err := st.RevokeSession(ctx, phone.ID, now); err != user.ErrSessionNotFound {
+					t.Fatalf("\t%s\tShould not revoke the session twice : %v.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould not find the ended session.", tests.Success)
+
+				if err := st.RevokeSession(ctx, "nope", now); err != user.ErrInvalidID {
+					t.Fatalf("\t%s\tShould refuse invalid IDs : %v.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould refuse invalid IDs.", tests.Success)
+
+				if all, _, err := st.ListSessions(ctx, sessions(""), now); err != nil || len(all) != 2 || all[1].ID != other.ID {
+					t.Fatalf("\t%s\tShould not list the ended session : %+v, %v.", tests.Failed, all, err)
+				}
+				t.Logf("\t%s\tShould not list the ended session.", tests.Success)
+			}
+		}
+	}
+}
+
+// TestResetTokens validates password reset tokens can be used once before
+// they expire.
+func TestResetTokens(t *testing.T) {
+	tt := []string{"postgres", "bolt"}
+	for _, tc := range tt {
+		st, teardown := tests.NewUserStorageUnit(t, tc)
+		defer teardown()
+
+		t.Logf("Given the need to reset forgotten passwords on %s.", tc)
+		{
+			ctx := tests.Context()
+			now := time.Date(2018, time.October, 1, 0, 0, 0, 0, time.UTC)
+
+			nu := user.NewUser{
+				Name:            "Anna Walker",
+				Email:           "anna@example.com",
+				Roles:           []string{auth.RoleAdmin},
+				Password:        "goroutines",
+				PasswordConfirm: "goroutines",
+			}
+
+			u, err := st.Create(ctx, nu, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create user : %s.", tests.Failed, err)
+			}
+
+			t.Log("\tWhen requesting a token for an unknown email.")
+			{
+				if _, _, err := st.CreateResetToken(ctx, "unknown@example.com", now); err != user.ErrNotFound {
+					t.Fatalf("\t%s\tShould receive ErrNotFound : %v.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould receive ErrNotFound.", tests.Success)
+			}
+
+			t.Log("\tWhen using a token.")
+			{
+				usr, tkn, err := st.CreateResetToken(ctx, nu.Email, now)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to create a token : %s.", tests.Failed, err)
+				}
+				if usr.ID != u.ID {
+					t.Fatalf("\t%s\tShould get the user of the email : %s.", tests.Failed, usr.ID)
+				}
+				t.Logf("\t%s\tShould be able to create a token.", tests.Success)
+
+				id, err := st.UseResetToken(ctx, now.Add(time.Minute), tkn)
+				if err != nil || id != u.ID {
+					t.Fatalf("\t%s\tShould be able to use the token : %v.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould be able to use the token.", tests.Success)
+
+				if _, err := st.UseResetToken(ctx, now.Add(time.Minute), tkn); err != user.ErrResetTokenInvalid {
+					t.Fatalf("\t%s\tShould not be able to use the token again : %v.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould not be able to use the token again.", tests.Success)
+			}
+
+			t.Log("\tWhen a token expired.")
+			{
+				_, tkn, err := st.CreateResetToken(ctx, nu.Email, now)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to create a token : %s.", tests.Failed, err)
+				}
+				if _, err := st.UseResetToken(ctx, now.Add(user.ResetTokenTTL), tkn); err != user.ErrResetTokenInvalid {
+					t.Fatalf("\t%s\tShould not be able to use the token : %v.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould not be able to use the token.", tests.Success)
+			}
+
+			t.Log("\tWhen using a malformed token.")
+			{
+				if _, err := st.UseResetToken(ctx, now, "malformed"); err != user.ErrResetTokenInvalid {
+					t.Fatalf("\t%s\tShould receive ErrResetTokenInvalid : %v.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould receive ErrResetTokenInvalid.", tests.Success)
+			}
+		}
+	}
+}
+
+// TestPasswordPolicy validates new passwords are checked against the policy.
+func TestPasswordPolicy(t *testing.T) {
+	user.SetPasswordPolicy(user.PasswordPolicy{
+		MinLength: 8,
+		Denylist:  map[string]struct{}{"password": {}},
+	})
+	defer user.SetPasswordPolicy(user.PasswordPolicy{})
+
+	tt := []struct {
+		password string
+		valid    bool
+	}{
+		{"goroutines", true},
+		{"gophers", false},
+		{"Password", false},
+	}
+
+	t.Log("Given the need to reject weak passwords.")
+	{
+		for i, tc := range tt {
+			t.Logf("\tTest %d:\tWhen validating the password %q.", i, tc.password)
+			{
+				nu := user.NewUser{
+					Name:            "Anna Walker",
+					Email:           "anna@example.com",
+					Roles:           []string{auth.RoleAdmin},
+					Password:        tc.password,
+					PasswordConfirm: tc.password,
+				}
+				if err := web.Validate(nu); (err == nil) != tc.valid {
+					t.Fatalf("\t%s\tShould get the expected result : %v.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould get the expected result.", tests.Success)
+			}
+		}
+	}
+}
+
+// TestMFA validates second factors are stored and checked, and challenges can
+// be used once before they expire.
+func TestMFA(t *testing.T) {
+	box, err := seal.NewBox(make([]byte, seal.KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []string{"postgres", "bolt"}
+	for _, tc := range tt {
+		st, teardown := tests.NewUserStorageUnit(t, tc)
+		defer teardown()
+
+		t.Logf("Given the need to sign in with a second factor on %s.", tc)
+		{
+			ctx := tests.Context()
+			now := time.Date(2018, time.October, 1, 0, 0, 0, 0, time.UTC)
+
+			nu := user.NewUser{
+				Name:            "Anna Walker",
+				Email:           "anna@example.com",
+				Roles:           []string{auth.RoleAdmin},
+				Password:        "goroutines",
+				PasswordConfirm: "goroutines",
+			}
+
+			u, err := st.Create(ctx, nu, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create user : %s.", tests.Failed, err)
+			}
+			claims := auth.NewClaims(u.ID, u.Roles, now, time.Hour)
+
+			// stored retrieves the second factor of the user.
+			stored := func() user.MFA {
+				t.Helper()
+				saved, err := st.Retrieve(ctx, claims, u.ID)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to retrieve user : %s.", tests.Failed, err)
+				}
+				return saved.MFA
+			}
+
+			t.Log("\tWhen enabling a second factor.")
+			{
+				m, secret, err := user.NewMFA(box)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to enroll : %s.", tests.Failed, err)
+				}
+				if string(m.Secret) == string(secret) {
+					t.Fatalf("\t%s\tShould seal the secret.", tests.Failed)
+				}
+				t.Logf("\t%s\tShould seal the secret.", tests.Success)
+
+				if _, err := m.Enable(box, "000000", now); err != user.ErrMFACodeInvalid {
+					t.Fatalf("\t%s\tShould not enable it with a wrong code : %v.", tests.Failed, err)
+				}
+				codes, err := m.Enable(box, totp.Code(secret, totp.Step(now)), now)
+				if err != nil || len(codes) != user.RecoveryCodeCount {
+					t.Fatalf("\t%s\tShould enable it with a code : %v.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould enable it with a code.", tests.Success)
+
+				if err := st.SetMFA(ctx, u.ID, m, now); err != nil {
+					t.Fatalf("\t%s\tShould be able to store it : %s.", tests.Failed, err)
+				}
+				if diff := cmp.Diff(m, stored()); diff != "" {
+					t.Fatalf("\t%s\tShould get back the same second factor. Diff:\n%s", tests.Failed, diff)
+				}
+				t.Logf("\t%s\tShould get back the same second factor.", tests.Success)
+
+				m = stored()
+				if err := m.Verify(box, codes[0], now); err != nil {
+					t.Fatalf("\t%s\tShould accept a recovery code : %v.", tests.Failed, err)
+				}
+				if err := m.Verify(box, codes[0], now); err != user.ErrMFACodeInvalid {
+					t.Fatalf("\t%s\tShould not accept a recovery code twice : %v.", tests.Failed, err)
+				}
+				if err := m.Verify(box, totp.Code(secret, totp.Step(now)), now); err != user.ErrMFACodeInvalid {
+					t.Fatalf("\t%s\tShould not accept a code twice : %v.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould accept codes once.", tests.Success)
+			}
+
+			t.Log("\tWhen using a challenge.")
+			{
+				tkn, err := st.CreateMFAChallenge(ctx, u.ID, now)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to create a challenge : %s.", tests.Failed, err)
+				}
+				if c, err := st.UseMFAChallenge(ctx, now, tkn); err != nil || c.UserID != u.ID {
+					t.Fatalf("\t%s\tShould be able to use the challenge : %v.", tests.Failed, err)
+				}
+				if _, err := st.UseMFAChallenge(ctx, now, tkn); err != user.ErrMFAChallengeInvalid {
+					t.Fatalf("\t%s\tShould not be able to use the challenge again : %v.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould be able to use the challenge once.", tests.Success)
+
+				tkn, err = st.CreateMFAChallenge(ctx, u.ID, now)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to create a challenge : %s.", tests.Failed, err)
+				}
+				if _, err := st.UseMFAChallenge(ctx, now.Add(user.MFAChallengeTTL), tkn); err != user.ErrMFAChallengeInvalid {
+					t.Fatalf("\t%s\tShould not be able to use an expired challenge : %v.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould not be able to use an expired challenge.", tests.Success)
+			}
+
+			t.Log("\tWhen enrolling with a challenge.")
+			{
+				tkn, err := st.CreateMFAChallenge(ctx, u.ID, now)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to create a challenge : %s.", tests.Failed, err)
+				}
+				c, err := st.EnrollMFAChallenge(ctx, now, tkn, []byte("first"))
+				if err != nil || string(c.Secret) != "first" {
+					t.Fatalf("\t%s\tShould be able to enroll with the challenge : %v.", tests.Failed, err)
+				}
+				if c, err := st.EnrollMFAChallenge(ctx, now, tkn, []byte("second")); err != nil || string(c.Secret) != "first" {
+					t.Fatalf("\t%s\tShould keep the secret of the first enrollment : %v.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould keep the secret of the first enrollment.", tests.Success)
+
+				if c, err := st.UseMFAChallenge(ctx, now, tkn); err != nil || string(c.Secret) != "first" {
+					t.Fatalf("\t%s\tShould get the secret when using the challenge : %v.", tests.Failed, err)
+				}
+				if _, err := st.EnrollMFAChallenge(ctx, now, tkn, []byte("third")); err != user.ErrMFAChallengeInvalid {
+					t.Fatalf("\t%s\tShould not enroll with a used challenge : %v.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould not enroll with a used challenge.", tests.Success)
+			}
+		}
+	}
+}
+
+// TestLoginAttempts validates failed sign ins lock further attempts for
+// longer with every failure.
+func TestLoginAttempts(t *testing.T) {
+	p := user.LockoutPolicy{Threshold: 3, Delay: time.Minute, MaxDelay: 5 * time.Minute}
+
+	tt := []string{"postgres", "bolt"}
+	for _, tc := range tt {
+		st, teardown := tests.NewUserStorageUnit(t, tc)
+		defer teardown()
+
+		t.Logf("Given the need to slow down guessing passwords on %s.", tc)
+		{
+			ctx := tests.Context()
+			now := time.Date(2018, time.October, 1, 0, 0, 0, 0, time.UTC)
+			key := user.EmailAttempts("Anna@example.com")
+
+			// fail records a failed attempt.
+			fail := func() *user.LoginAttempts {
+				t.Helper()
+				a, err := st.FailLogin(ctx, key, p, now)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to record a failure : %s.", tests.Failed, err)
+				}
+				return a
+			}
+
+			t.Log("\tWhen sign ins keep failing.")
+			{
+				if a := fail(); a.Locked(now) {
+					t.Fatalf("\t%s\tShould not lock below the threshold.", tests.Failed)
+				}
+				fail()
+				t.Logf("\t%s\tShould not lock below the threshold.", tests.Success)
+
+				if a := fail(); a.LockedUntil != now.Add(time.Minute) {
+					t.Fatalf("\t%s\tShould lock for the delay : %v.", tests.Failed, a.LockedUntil)
+				}
+				t.Logf("\t%s\tShould lock for the delay.", tests.Success)
+
+				if a := fail(); a.LockedUntil != now.Add(2*time.Minute) {
+					t.Fatalf("\t%s\tShould double the delay : %v.", tests.Failed, a.LockedUntil)
+				}
+				fail()
+				if a := fail(); a.LockedUntil != now.Add(5*time.Minute) {
+					t.Fatalf("\t%s\tShould not lock for longer than the maximum : %v.", tests.Failed, a.LockedUntil)
+				}
+				t.Logf("\t%s\tShould double the delay up to the maximum.", tests.Success)
+
+				a, err := st.LoginAttempts(ctx, user.EmailAttempts("anna@example.com "))
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to retrieve the attempts : %s.", tests.Failed, err)
+				}
+				if !a.Locked(now) || a.Failures != 6 {
+					t.Fatalf("\t%s\tShould retrieve the locked attempts : %+v.", tests.Failed, a)
+				}
+				t.Logf("\t%s\tShould retrieve the locked attempts.", tests.Success)
+			}
+
+			t.Log("\tWhen unlocking sign ins.")
+			{
+				if err := st.ResetLoginAttempts(ctx, key); err != nil {
+					t.Fatalf("\t%s\tShould be able to reset the attempts : %s.", tests.Failed, err)
+				}
+				a, err := st.LoginAttempts(ctx, key)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to retrieve the attempts : %s.", tests.Failed, err)
+				}
+				if a.Locked(now) || a.Failures != 0 {
+					t.Fatalf("\t%s\tShould forget the failures : %+v.", tests.Failed, a)
+				}
+				t.Logf("\t%s\tShould forget the failures.", tests.Success)
+			}
+
+			t.Log("\tWhen failures are old.")
+			{
+				fail()
+				fail()
+				now = now.Add(p.MaxDelay + time.Second)
+				if a := fail(); a.Failures != 1 || a.Locked(now) {
+					t.Fatalf("\t%s\tShould forget them : %+v.", tests.Failed, a)
+				}
+				t.Logf("\t%s\tShould forget them.", tests.Success)
+			}
+		}
+	}
+}
+
+// TestAPIKeys validates API keys authenticate their user with their scopes
+// until they expire or are deleted.
+func TestAPIKeys(t *testing.T) {
+	tt := []string{"postgres", "bolt"}
+	for _, tc := range tt {
+		st, teardown := tests.NewUserStorageUnit(t, tc)
+		defer teardown()
+
+		t.Logf("Given the need to let integrations use API keys on %s.", tc)
+		{
+			ctx := tests.Context()
+			now := time.Date(2018, time.October, 1, 0, 0, 0, 0, time.UTC)
+
+			nu := user.NewUser{
+				Name:            "Lab Analyzer",
+				Email:           "lab@example.com",
+				Roles:           []string{auth.RoleUser},
+				Password:        "gophers",
+				PasswordConfirm: "gophers",
+			}
+			u, err := st.Create(ctx, nu, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create user : %s.", tests.Failed, err)
+			}
+
+			expires := now.Add(time.Hour)
+			n := user.NewAPIKey{
+				UserID:    u.ID,
+				Name:      "Analyzer",
+				Scopes:    []string{auth.ScopeProductsRead},
+				ExpiresAt: &expires,
+			}
+
+			var (
+				k   *user.APIKey
+				key string
+			)
+
+			t.Log("\tWhen creating a key.")
+			{
+				if k, key, err = st.CreateAPIKey(ctx, n, now); err != nil {
+					t.Fatalf("\t%s\tShould be able to create a key : %s.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould be able to create a key.", tests.Success)
+
+				if _, _, err := st.CreateAPIKey(ctx, user.NewAPIKey{UserID: tests.AdminID, Name: "x", Scopes: n.Scopes}, now); errors.Cause(err) != user.ErrNotFound {
+					t.Fatalf("\t%s\tShould not create keys of unknown users : %v.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould not create keys of unknown users.", tests.Success)
+
+				opts := query.Options{Sort: "date_created", Filters: []query.Filter{{Field: "user_id", Value: u.ID}}}
+				keys, _, err := st.ListAPIKeys(ctx, opts)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to list the keys : %s.", tests.Failed, err)
+				}
+				if len(keys) != 1 || keys[0].ID != k.ID || keys[0].Prefix != k.Prefix {
+					t.Fatalf("\t%s\tShould list the key : %+v.", tests.Failed, keys)
+				}
+				t.Logf("\t%s\tShould list the key.", tests.Success)
+
+				second := n
+				second.Name = "Second"
+				later, _, err := st.CreateAPIKey(ctx, second, now.Add(time.Second))
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to create a second key : %s.", tests.Failed, err)
+				}
+				opts.Limit = 1
+				first, page, err := st.ListAPIKeys(ctx, opts)
+				if err != nil || len(first) != 1 || first[0].ID != k.ID || page.NextCursor == "" {
+					t.Fatalf("\t%s\tShould get a page of the keys : %+v, %q, %v.", tests.Failed, first, page.NextCursor, err)
+				}
+				opts.Cursor = page.NextCursor
+				rest, page, err := st.ListAPIKeys(ctx, opts)
+				if err != nil || len(rest) != 1 || rest[0].ID != later.ID || page.NextCursor != "" {
+					t.Fatalf("\t%s\tShould get the next page of the keys : %+v, %q, %v.", tests.Failed, rest, page.NextCursor, err)
+				}
+				t.Logf("\t%s\tShould get the keys page by page.", tests.Success)
+			}
+
+			t.Log("\tWhen authenticating with the key.")
+			{
+				claims, err := st.AuthenticateAPIKey(ctx, now, key)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to authenticate : %s.", tests.Failed, err)
+				}
+				if claims.Subject != u.ID || claims.APIKeyID != k.ID || !claims.HasScope(auth.ScopeProductsRead) || claims.HasScope(auth.ScopeUsersRead) {
+					t.Fatalf("\t%s\tShould act as the user with the scopes of the key : %+v.", tests.Failed, claims)
+				}
+				t.Logf("\t%s\tShould act as the user with the scopes of the key.", tests.Success)
+
+				saved, err := st.RetrieveAPIKey(ctx, k.ID)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to retrieve the key : %s.", tests.Failed, err)
+				}
+				if saved.LastUsed == nil || !saved.LastUsed.Equal(now) {
+					t.Fatalf("\t%s\tShould record the use : %v.", tests.Failed, saved.LastUsed)
+				}
+				t.Logf("\t%s\tShould record the use.", tests.Success)
+
+				if _, err := st.AuthenticateAPIKey(ctx, now, key+"x"); errors.Cause(err) != user.ErrAuthenticationFailure {
+					t.Fatalf("\t%s\tShould refuse a wrong secret : %v.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould refuse a wrong secret.", tests.Success)
+
+				if _, err := st.AuthenticateAPIKey(ctx, expires, key); errors.Cause(err) != user.ErrAuthenticationFailure {
+					t.Fatalf("\t%s\tShould refuse an expired key : %v.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould refuse an expired key.", tests.Success)
+			}
+
+			t.Log("\tWhen the user is deleted.")
+			{
+				claims := auth.NewClaims(u.ID, u.Roles, now, time.Hour)
+				if err := st.Delete(ctx, claims, u.ID, now); err != nil {
+					t.Fatalf("\t%s\tShould be able to delete the user : %s.", tests.Failed, err)
+				}
+				if _, err := st.AuthenticateAPIKey(ctx, now, key); errors.Cause(err) != user.ErrAuthenticationFailure {
+					t.Fatalf("\t%s\tShould refuse the key : %v.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould refuse the key.", tests.Success)
+			}
+
+			t.Log("\tWhen deleting the key.")
+			{
+				if err := st.DeleteAPIKey(ctx, k.ID, now); err != nil {
+					t.Fatalf("\t%s\tShould be able to delete the key : %s.", tests.Failed, err)
+				}
+				if _, err := st.RetrieveAPIKey(ctx, k.ID); errors.Cause(err) != user.ErrAPIKeyNotFound {
+					t.Fatalf("\t%s\tShould not find the key : %v.", tests.Failed, err)
+				}
+				if err := st.DeleteAPIKey(ctx, k.ID, now); errors.Cause(err) != user.ErrAPIKeyNotFound {
+					t.Fatalf("\t%s\tShould not delete it twice : %v.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould remove the key.", tests.Success)
+			}
+		}
+	}
+}
+
+// TestIdentities validates accounts at identity providers are linked to
+// users.
+func TestIdentities(t *testing.T) {
+	tt := []string{"postgres", "bolt"}
+	for _, tc := range tt {
+		st, teardown := tests.NewUserStorageUnit(t, tc)
+		defer teardown()
+
+		t.Logf("Given the need to sign users in with an identity provider on %s.", tc)
+		{
+			ctx := tests.Context()
+			now := time.Date(2018, time.October, 1, 0, 0, 0, 0, time.UTC)
+			issuer := "https://login.example.com"
+
+			nu := user.NewUser{
+				Name:            "Jane Doe",
+				Email:           "jane@example.com",
+				Roles:           []string{auth.RoleUser},
+				Password:        "gophers",
+				PasswordConfirm: "gophers",
+			}
+			u, err := st.Create(ctx, nu, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create user : %s.", tests.Failed, err)
+			}
+
+			t.Log("\tWhen an account is linked to a user.")
+			{
+				if _, err := st.RetrieveIdentity(ctx, issuer, "jane"); errors.Cause(err) != user.ErrIdentityNotFound {
+					t.Fatalf("\t%s\tShould not find the account before it is linked : %v.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould not find the account before it is linked.", tests.Success)
+
+				if err := st.LinkIdentity(ctx, issuer, "jane", u.ID, now); err != nil {
+					t.Fatalf("\t%s\tShould be able to link the account : %s.", tests.Failed, err)
+				}
+				want := user.Identity{Issuer: issuer, Subject: "jane", UserID: u.ID, DateCreated: now}
+				i, err := st.RetrieveIdentity(ctx, issuer, "jane")
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to retrieve the link : %s.", tests.Failed, err)
+				}
+				if diff := cmp.Diff(&want, i); diff != "" {
+					t.Fatalf("\t%s\tShould get back the link. Diff:\n%s", tests.Failed, diff)
+				}
+				t.Logf("\t%s\tShould get back the link.", tests.Success)
+
+				if _, err := st.RetrieveIdentity(ctx, "https://other.example.com", "jane"); errors.Cause(err) != user.ErrIdentityNotFound {
+					t.Fatalf("\t%s\tShould keep accounts of other providers apart : %v.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould keep accounts of other providers apart.", tests.Success)
+			}
+
+			t.Log("\tWhen the user is deleted.")
+			{
+				claims := auth.NewClaims(u.ID, u.Roles, now, time.Hour)
+				if err := st.Delete(ctx, claims, u.ID, now); err != nil {
+					t.Fatalf("\t%s\tShould be able to delete the user : %s.", tests.Failed, err)
+				}
+				if err := st.LinkIdentity(ctx, issuer, "john", u.ID, now); errors.Cause(err) != user.ErrNotFound {
+					t.Fatalf("\t%s\tShould not link accounts to the user : %v.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould not link accounts to the user.", tests.Success)
+
+				if _, err := st.Purge(ctx, now.Add(time.Second)); err != nil {
+					t.Fatalf("\t%s\tShould be able to purge the user : %s.", tests.Failed, err)
+				}
+				if _, err := st.RetrieveIdentity(ctx, issuer, "jane"); errors.Cause(err) != user.ErrIdentityNotFound {
+					t.Fatalf("\t%s\tShould remove the links of purged users : %v.", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould remove the links of purged users.", tests.Success)
 			}
 		}
 	}